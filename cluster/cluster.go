@@ -0,0 +1,565 @@
+// cluster connects keeper nodes listed in config so they act as one server. Sessions
+// are shared, match listing is aggregated and new matches go to the least loaded node.
+package cluster
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/match"
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/util"
+	"github.com/jakubDoka/keeper/util/kcrypto"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+// ids of peer rpcs, register all of them with knet.RpcAssertPeer and Cluster.Accept
+const (
+	StatusRpc  = "cluster-status"
+	SessionRpc = "cluster-session"
+	ListRpc    = "cluster-list"
+	CreateRpc  = "cluster-create-match"
+	JoinRpc    = "cluster-join-match"
+)
+
+// Rpcs lists all peer rpcs Cluster.Accept handles.
+var Rpcs = []string{StatusRpc, SessionRpc, ListRpc, CreateRpc, JoinRpc}
+
+// MissExpiration is how long session unknown to all peers is not asked for again,
+// MaxMisses limits amount of remembered sessions.
+const (
+	MissExpiration = time.Minute
+	MaxMisses      = 1 << 16
+)
+
+var (
+	ErrUnknownRpc      = errors.New("unknown cluster rpc")
+	ErrInvalidRequest  = errors.New("cluster request is corrupted")
+	ErrInvalidResponse = errors.New("cluster response is corrupted")
+)
+
+// Node is load of a keeper node.
+type Node struct {
+	// Peer is http address of the node, empty for this node.
+	Peer string
+	// Address is tcp address players connect to.
+	Address string
+
+	Matches, Users uint32
+}
+
+// Load is the value nodes are compared by when creating a match.
+func (n Node) Load() uint32 {
+	return n.Matches + n.Users
+}
+
+// Entry is a listed match with address of its node.
+type Entry struct {
+	match.Entry
+	// Address is tcp address of the node running the match.
+	Address string
+	// Info is Match.Info of the match.
+	Info []byte
+}
+
+// Access is what client needs to connect to a match. Key is valid only on node
+// with the Address.
+type Access struct {
+	Match uuid.UUID
+	// Address is tcp address of the node running the match.
+	Address string
+	Key     kcrypto.Key
+}
+
+// Encode writes access as match id, address and key.
+func (a Access) Encode(writer *util.Writer) {
+	writer.
+		UUID(a.Match).
+		String(a.Address).
+		Key(a.Key)
+}
+
+// Page is a result of Cluster.List.
+type Page struct {
+	Entries []Entry
+	Cursor  []byte
+}
+
+// Cluster talks to peers from config trough knet.CallPeer. Without peers all
+// operations are local so it can be used unconditionally. All allowed operations
+// are thread safe.
+type Cluster struct {
+	*state.State
+
+	manager *match.Manager
+	peers   []string
+
+	misses      map[uuid.UUID]time.Time
+	missesMutex sync.Mutex
+}
+
+// New creates cluster of node with peers from config. Set it as state.Resolver to
+// share sessions.
+func New(state *state.State, manager *match.Manager) *Cluster {
+	return &Cluster{
+		State:   state,
+		manager: manager,
+		peers:   state.Cluster.Peers,
+		misses:  make(map[uuid.UUID]time.Time),
+	}
+}
+
+// Enabled reports whether there are any peers.
+func (c *Cluster) Enabled() bool {
+	return len(c.peers) != 0
+}
+
+// Local returns load of this node.
+func (c *Cluster) Local() Node {
+	matches, users := c.manager.Load()
+	return Node{
+		Address: c.Net.GetConnectionString(),
+		Matches: matches,
+		Users:   users,
+	}
+}
+
+// Nodes returns load of this node followed by loads of reachable peers.
+func (c *Cluster) Nodes() []Node {
+	nodes := []Node{c.Local()}
+	for _, r := range c.callPeers(StatusRpc, nil) {
+		reader := util.NewReader(r.data)
+		node := Node{Peer: r.peer}
+		var ok bool
+		if node.Matches, ok = reader.Uint32(); !ok {
+			continue
+		}
+		if node.Users, ok = reader.Uint32(); !ok {
+			continue
+		}
+		if node.Address, ok = reader.String(); !ok {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// ResolveSession asks peers for the session, unknown session costs one call to each
+// peer and then it is not asked for until MissExpiration passes.
+func (c *Cluster) ResolveSession(session uuid.UUID) *state.User {
+	if !c.Enabled() || c.missed(session) {
+		return nil
+	}
+
+	for _, r := range c.callPeers(SessionRpc, session[:]) {
+		reader := util.NewReader(r.data)
+		if found, ok := reader.Uint8(); !ok || found == 0 {
+			continue
+		}
+		user, ok := c.readUser(&reader)
+		if ok && user.Session() == session {
+			return user
+		}
+	}
+
+	c.miss(session)
+
+	return nil
+}
+
+func (c *Cluster) missed(session uuid.UUID) bool {
+	c.missesMutex.Lock()
+	defer c.missesMutex.Unlock()
+
+	expiration, ok := c.misses[session]
+	if ok && c.Clock.Now().After(expiration) {
+		delete(c.misses, session)
+		return false
+	}
+	return ok
+}
+
+func (c *Cluster) miss(session uuid.UUID) {
+	c.missesMutex.Lock()
+	defer c.missesMutex.Unlock()
+
+	now := c.Clock.Now()
+	if len(c.misses) >= MaxMisses {
+		for s, expiration := range c.misses {
+			if now.After(expiration) {
+				delete(c.misses, s)
+			}
+		}
+		if len(c.misses) >= MaxMisses {
+			c.misses = make(map[uuid.UUID]time.Time)
+		}
+	}
+	c.misses[session] = now.Add(MissExpiration)
+}
+
+// CreateMatch creates match on the least loaded node and returns access of the
+// creator. This node is preferred on tie. If peer fails match is created here.
+func (c *Cluster) CreateMatch(coreID string, creator *state.User, meta []byte) (Access, error) {
+	if c.Enabled() {
+		nodes := c.Nodes()
+		best := nodes[0]
+		for _, node := range nodes[1:] {
+			if node.Load() < best.Load() {
+				best = node
+			}
+		}
+
+		if best.Peer != "" {
+			writer := util.Writer{}
+			writeUser(&writer, creator)
+			writer.
+				String(coreID).
+				Bytes(meta)
+
+			access, err := c.callAccess(best.Peer, CreateRpc, writer.Buffer())
+			if err == nil {
+				return access, nil
+			}
+			c.Error("Failed to create match on %s: %s", best.Peer, err)
+		}
+	}
+
+	created, err := c.manager.CreateMatch(coreID, creator, meta)
+	if err != nil {
+		return Access{}, err
+	}
+
+	return c.access(created.ID(), creator), nil
+}
+
+// JoinMatch returns access of the user to match running on any node.
+func (c *Cluster) JoinMatch(id uuid.UUID, user *state.User) (Access, error) {
+	if c.manager.GetMatch(id) != nil {
+		return c.access(id, user), nil
+	}
+
+	if c.Enabled() {
+		writer := util.Writer{}
+		writeUser(&writer, user)
+		writer.UUID(id)
+
+		for _, r := range c.callPeers(JoinRpc, writer.Buffer()) {
+			reader := util.NewReader(r.data)
+			if access, ok := readAccess(&reader); ok {
+				return access, nil
+			}
+			c.Error("Peer %s responded with corrupted access.", r.peer)
+		}
+	}
+
+	return Access{}, match.ErrMatchNotFound
+}
+
+func (c *Cluster) callAccess(peer, id string, body []byte) (Access, error) {
+	response, err := knet.CallPeer(c.State, peer, id, body)
+	if err != nil {
+		return Access{}, err
+	}
+
+	reader := util.NewReader(response)
+	access, ok := readAccess(&reader)
+	if !ok {
+		return Access{}, ErrInvalidResponse
+	}
+
+	return access, nil
+}
+
+// access issues key of this node to the user, existing key is reused.
+func (c *Cluster) access(id uuid.UUID, user *state.User) Access {
+	if c.GetUser(user.Session(), uuid.Nil) == nil {
+		c.AddUser(user)
+	}
+
+	key, ok := c.GetKey(user.ID())
+	if !ok {
+		key = c.CreateKey(user.ID())
+	}
+
+	return Access{id, c.Net.GetConnectionString(), key}
+}
+
+// List lists matches of all reachable nodes. Pages are merged in the order of
+// match.ListOptions.Less and the cursor works on every node so it can be passed to
+// next call as is.
+func (c *Cluster) List(options match.ListOptions) (Page, error) {
+	local, err := c.manager.List(options)
+	if err != nil {
+		return Page{}, err
+	}
+
+	var page Page
+	more := local.Cursor != nil
+	address := c.Net.GetConnectionString()
+	for _, entry := range local.Entries {
+		page.Entries = append(page.Entries, c.entry(entry, address))
+	}
+
+	if c.Enabled() {
+		writer := util.Writer{}
+		options.Encode(&writer)
+
+		for _, r := range c.callPeers(ListRpc, writer.Buffer()) {
+			reader := util.NewReader(r.data)
+			entries, cursor, ok := readEntries(&reader)
+			if !ok {
+				c.Error("Peer %s responded with corrupted page.", r.peer)
+				continue
+			}
+			page.Entries = append(page.Entries, entries...)
+			more = more || cursor
+		}
+
+		sort.Slice(page.Entries, func(i, j int) bool {
+			return options.Less(page.Entries[i].Entry, page.Entries[j].Entry)
+		})
+	}
+
+	limit := options.PageLimit()
+	if len(page.Entries) > limit {
+		page.Entries = page.Entries[:limit]
+		more = true
+	}
+	if more && len(page.Entries) != 0 {
+		page.Cursor = options.CursorAfter(page.Entries[len(page.Entries)-1].Entry)
+	}
+
+	return page, nil
+}
+
+func (c *Cluster) entry(entry match.Entry, address string) Entry {
+	var info []byte
+	if m := c.manager.GetMatch(entry.ID); m != nil {
+		info = m.Info()
+	}
+	return Entry{entry, address, info}
+}
+
+// Accept handles peer rpc with given id and returns the response.
+func (c *Cluster) Accept(id string, data []byte) ([]byte, error) {
+	reader := util.NewReader(data)
+
+	switch id {
+	case StatusRpc:
+		local := c.Local()
+		writer := util.Writer{}
+		writer.
+			Uint32(local.Matches).
+			Uint32(local.Users).
+			String(local.Address)
+		return writer.Buffer(), nil
+	case SessionRpc:
+		session, ok := reader.UUID()
+		if !ok {
+			return nil, ErrInvalidRequest
+		}
+		writer := util.Writer{}
+		// only local users, asking resolver would bounce the call between peers
+		user := c.GetUser(session, uuid.Nil)
+		if user == nil {
+			writer.Uint8(0)
+		} else {
+			writer.Uint8(1)
+			writeUser(&writer, user)
+		}
+		return writer.Buffer(), nil
+	case ListRpc:
+		options, ok := match.DecodeListOptions(&reader)
+		if !ok {
+			return nil, ErrInvalidRequest
+		}
+		page, err := c.manager.List(options)
+		if err != nil {
+			return nil, err
+		}
+		address := c.Net.GetConnectionString()
+		writer := util.Writer{}
+		writer.Uint32(uint32(len(page.Entries)))
+		for _, entry := range page.Entries {
+			writeEntry(&writer, c.entry(entry, address))
+		}
+		var more uint8
+		if page.Cursor != nil {
+			more = 1
+		}
+		writer.Uint8(more)
+		return writer.Buffer(), nil
+	case CreateRpc:
+		creator, ok := c.readUser(&reader)
+		if !ok {
+			return nil, ErrInvalidRequest
+		}
+		coreID, ok := reader.String()
+		if !ok {
+			return nil, ErrInvalidRequest
+		}
+		meta, ok := reader.Bytes()
+		if !ok {
+			return nil, ErrInvalidRequest
+		}
+		created, err := c.manager.CreateMatch(coreID, creator, meta)
+		if err != nil {
+			return nil, err
+		}
+		writer := util.Writer{}
+		c.access(created.ID(), creator).Encode(&writer)
+		return writer.Buffer(), nil
+	case JoinRpc:
+		user, ok := c.readUser(&reader)
+		if !ok {
+			return nil, ErrInvalidRequest
+		}
+		id, ok := reader.UUID()
+		if !ok {
+			return nil, ErrInvalidRequest
+		}
+		if c.manager.GetMatch(id) == nil {
+			return nil, match.ErrMatchNotFound
+		}
+		writer := util.Writer{}
+		c.access(id, user).Encode(&writer)
+		return writer.Buffer(), nil
+	default:
+		return nil, ErrUnknownRpc
+	}
+}
+
+type response struct {
+	peer string
+	data []byte
+}
+
+// callPeers calls rpc on all peers at once and returns successful responses in order
+// of peers. Failures are logged.
+func (c *Cluster) callPeers(id string, body []byte) []response {
+	results := make([]response, len(c.peers))
+	done := make(chan struct{}, len(c.peers))
+	for i, peer := range c.peers {
+		go func(i int, peer string) {
+			data, err := knet.CallPeer(c.State, peer, id, body)
+			if err != nil {
+				c.Debug("Peer %s failed %s: %s", peer, id, err)
+			} else {
+				results[i] = response{peer, data}
+			}
+			done <- struct{}{}
+		}(i, peer)
+	}
+	for range c.peers {
+		<-done
+	}
+
+	responses := results[:0]
+	for _, r := range results {
+		if r.peer != "" {
+			responses = append(responses, r)
+		}
+	}
+	return responses
+}
+
+func writeUser(writer *util.Writer, user *state.User) {
+	writer.
+		UUID(user.ID()).
+		UUID(user.Session()).
+		Uint64(uint64(user.Expiration().UnixNano())).
+		String(user.IP())
+}
+
+func (c *Cluster) readUser(reader *util.Reader) (*state.User, bool) {
+	id, ok := reader.UUID()
+	if !ok {
+		return nil, false
+	}
+	session, ok := reader.UUID()
+	if !ok {
+		return nil, false
+	}
+	expiration, ok := reader.Uint64()
+	if !ok {
+		return nil, false
+	}
+	ip, ok := reader.String()
+	if !ok {
+		return nil, false
+	}
+
+	duration := time.Unix(0, int64(expiration)).Sub(c.Clock.Now())
+	return state.NewUserWithClock(c.Clock, id, session, duration, ip), true
+}
+
+func readAccess(reader *util.Reader) (a Access, ok bool) {
+	if a.Match, ok = reader.UUID(); !ok {
+		return
+	}
+	if a.Address, ok = reader.String(); !ok {
+		return
+	}
+	a.Key, ok = reader.Key()
+	return
+}
+
+func writeEntry(writer *util.Writer, entry Entry) {
+	var open uint8
+	if entry.Open {
+		open = 1
+	}
+	writer.
+		UUID(entry.ID).
+		Uint32(entry.Score).
+		Uint64(math.Float64bits(entry.Relevance)).
+		Uint32(entry.UserAmount).
+		Uint8(open).
+		String(entry.Address).
+		Bytes(entry.Info)
+}
+
+func readEntries(reader *util.Reader) (entries []Entry, more bool, ok bool) {
+	count, ok := reader.Uint32()
+	if !ok || count > match.MaxPageSize {
+		return nil, false, false
+	}
+
+	entries = make([]Entry, count)
+	for i := range entries {
+		e := &entries[i]
+		if e.ID, ok = reader.UUID(); !ok {
+			return
+		}
+		if e.Score, ok = reader.Uint32(); !ok {
+			return
+		}
+		var relevance uint64
+		if relevance, ok = reader.Uint64(); !ok {
+			return
+		}
+		e.Relevance = math.Float64frombits(relevance)
+		if e.UserAmount, ok = reader.Uint32(); !ok {
+			return
+		}
+		var open uint8
+		if open, ok = reader.Uint8(); !ok {
+			return
+		}
+		e.Open = open != 0
+		if e.Address, ok = reader.String(); !ok {
+			return
+		}
+		if e.Info, ok = reader.Bytes(); !ok {
+			return
+		}
+	}
+
+	flag, ok := reader.Uint8()
+	return entries, flag != 0, ok
+}
@@ -0,0 +1,344 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jakubDoka/keeper/kcfg"
+	"github.com/jakubDoka/keeper/klog"
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/match"
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/util"
+	"github.com/jakubDoka/keeper/util/kcrypto"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+// environment of node processes spawned by TestCluster
+const (
+	nodePortEnv  = "KEEPER_TEST_NODE_PORT"
+	nodePeersEnv = "KEEPER_TEST_NODE_PEERS"
+	testSecret   = "secret"
+)
+
+func TestMain(m *testing.M) {
+	if port := os.Getenv(nodePortEnv); port != "" {
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			panic(err)
+		}
+		_, err = startNode(uint16(p), strings.Split(os.Getenv(nodePeersEnv), ","))
+		if err != nil {
+			panic(err)
+		}
+		select {}
+	}
+
+	os.Exit(m.Run())
+}
+
+// startNode starts node with router serving peer rpcs, "match" acceptor and "whoami"
+// that responds with id of the caller.
+func startNode(port uint16, peers []string) (*Cluster, error) {
+	config := kcfg.DefaultConfig
+	config.Net.Port = port
+	config.Cluster.Secret = testSecret
+	config.Cluster.Peers = peers
+	s := state.New(nil, &config, &klog.Logger{})
+
+	manager := match.NewManager(s)
+	manager.RegisterCore("game", func() match.Core { return &match.CoreBase{} })
+
+	c := New(s, manager)
+	s.Resolver = c
+
+	router, err := knet.NewRouter(s)
+	if err != nil {
+		return nil, err
+	}
+
+	router.Listener.RegisterAcceptor("match", manager)
+
+	router.RegisterRpc("whoami", knet.RpcAssertUser, func(state *state.State, user *state.User, w http.ResponseWriter, re *http.Request) error {
+		id := user.ID()
+		w.Write(id[:])
+		return nil
+	})
+	for _, id := range Rpcs {
+		id := id
+		router.RegisterRpc(id, knet.RpcAssertPeer, func(state *state.State, user *state.User, w http.ResponseWriter, re *http.Request) error {
+			body, err := ioutil.ReadAll(re.Body)
+			if err != nil {
+				return err
+			}
+			response, err := c.Accept(id, body)
+			if err != nil {
+				return err
+			}
+			w.Write(response)
+			return nil
+		})
+	}
+
+	go router.Serve(config.Net.GetHttpConnectionString(), "", "")
+
+	return c, nil
+}
+
+// freePort finds port that is free for tcp and udp together with the next port for http.
+func freePort(t *testing.T) uint16 {
+	for i := 0; i < 100; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := listener.Addr().(*net.TCPAddr).Port
+		listener.Close()
+
+		udp, err := net.ListenPacket("udp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			continue
+		}
+		udp.Close()
+
+		next, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port+1))
+		if err != nil {
+			continue
+		}
+		next.Close()
+
+		return uint16(port)
+	}
+	t.Fatal("no free port")
+	return 0
+}
+
+func httpAddress(port uint16) string {
+	return fmt.Sprintf("127.0.0.1:%d", port+1)
+}
+
+// connect joins match trough tcp and udp the way client does and returns op code
+// node replied with.
+func connect(t *testing.T, user *state.User, access Access) knet.OpCode {
+	tcp, err := net.Dial("tcp", access.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	udp, err := net.Dial("udp", access.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+
+	request := func() []byte {
+		writer := util.Writer{}
+		writer.
+			UUID(user.Session()).
+			Uint32(uint32(knet.OCConnectionRequest)).
+			Uint32(0).
+			String("match").
+			UUID(access.Match)
+		return writer.Buffer()
+	}
+
+	cipher := kcrypto.NewCipherWithKey(access.Key)
+	id := user.ID()
+	data := append(id[:], cipher.EncryptTCP(request())...)
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+	if _, err := tcp.Write(append(size[:], data...)); err != nil {
+		t.Fatal(err)
+	}
+
+	udpCipher := kcrypto.NewCipherWithKey(access.Key)
+	encrypted, gen := udpCipher.EncryptUDP(request())
+	writer := util.Writer{}
+	writer.
+		UUID(id).
+		Uint32(gen).
+		Rest(encrypted)
+	if _, err := udp.Write(writer.Buffer()); err != nil {
+		t.Fatal(err)
+	}
+
+	tcp.SetReadDeadline(time.Now().Add(10 * time.Second))
+	reply, err := knet.ReadPacket(tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err = cipher.DecryptTCP(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return knet.OpCode(binary.BigEndian.Uint32(reply))
+}
+
+func TestResolveSessionMiss(t *testing.T) {
+	config := kcfg.DefaultConfig
+	config.Cluster.Peers = []string{"127.0.0.1:1"}
+	c := New(state.New(nil, &config, &klog.Logger{}), nil)
+
+	session := uuid.New()
+	if c.ResolveSession(session) != nil {
+		t.Fatal("session should not be found")
+	}
+	if !c.missed(session) {
+		t.Error("unknown session should not be asked for again")
+	}
+}
+
+func TestCluster(t *testing.T) {
+	ports := []uint16{freePort(t), freePort(t), freePort(t)}
+	peersOf := func(i int) []string {
+		var peers []string
+		for j, port := range ports {
+			if j != i {
+				peers = append(peers, httpAddress(port))
+			}
+		}
+		return peers
+	}
+
+	for i, port := range ports[1:] {
+		cmd := exec.Command(os.Args[0], "-test.run=^$")
+		cmd.Env = append(os.Environ(),
+			fmt.Sprintf("%s=%d", nodePortEnv, port),
+			fmt.Sprintf("%s=%s", nodePeersEnv, strings.Join(peersOf(i+1), ",")),
+		)
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer cmd.Process.Kill()
+	}
+
+	local, err := startNode(ports[0], peersOf(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(local.Nodes()) != len(ports) {
+		if time.Now().After(deadline) {
+			t.Fatal("nodes did not start")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	user := state.NewUser(uuid.New(), uuid.New(), time.Hour, "")
+	local.AddUser(user)
+
+	t.Run("session", func(t *testing.T) {
+		session := user.Session()
+		re, err := http.NewRequest(http.MethodPost, "http://"+httpAddress(ports[1])+"/rpc", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		re.Header.Set("id", "whoami")
+		re.Header.Set("session", hex.EncodeToString(session[:]))
+
+		resp, err := http.DefaultClient.Do(re)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+
+		id := user.ID()
+		if resp.StatusCode != http.StatusOK || string(body) != string(id[:]) {
+			t.Errorf("%d %q", resp.StatusCode, body)
+		}
+	})
+
+	created := map[uuid.UUID]string{}
+	t.Run("create", func(t *testing.T) {
+		addresses := map[string]bool{}
+		for range ports {
+			access, err := local.CreateMatch("game", user, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			created[access.Match] = access.Address
+			addresses[access.Address] = true
+
+			if code := connect(t, user, access); code != knet.OCMatchJoinSuccess {
+				t.Errorf("creator could not join match on %s: %v", access.Address, code)
+			}
+		}
+
+		for _, port := range ports {
+			if !addresses[fmt.Sprintf("127.0.0.1:%d", port)] {
+				t.Errorf("no match on node %d: %v", port, addresses)
+			}
+		}
+
+		if _, err := local.CreateMatch("unknown", user, nil); err != match.ErrUnknownCore {
+			t.Error(err)
+		}
+	})
+
+	t.Run("join", func(t *testing.T) {
+		other := state.NewUser(uuid.New(), uuid.New(), time.Hour, "")
+		local.AddUser(other)
+
+		for id, address := range created {
+			access, err := local.JoinMatch(id, other)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if access.Address != address {
+				t.Errorf("%s: %s != %s", id, access.Address, address)
+			}
+			if code := connect(t, other, access); code != knet.OCMatchJoinSuccess {
+				t.Errorf("user could not join match on %s: %v", address, code)
+			}
+		}
+
+		if _, err := local.JoinMatch(uuid.New(), other); err != match.ErrMatchNotFound {
+			t.Error(err)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		options := match.ListOptions{Limit: 2}
+		listed := map[uuid.UUID]string{}
+		pages := 0
+		for {
+			page, err := local.List(options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pages++
+			for _, entry := range page.Entries {
+				if _, ok := listed[entry.ID]; ok {
+					t.Errorf("%s listed twice", entry.ID)
+				}
+				listed[entry.ID] = entry.Address
+			}
+			if page.Cursor == nil {
+				break
+			}
+			options.Cursor = page.Cursor
+		}
+
+		if pages != 2 || len(listed) != len(created) {
+			t.Errorf("%d %v", pages, listed)
+		}
+		for id, address := range created {
+			if listed[id] != address {
+				t.Errorf("%s: %s != %s", id, listed[id], address)
+			}
+		}
+	})
+}
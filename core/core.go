@@ -1,17 +1,28 @@
 package core
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
 	"reflect"
+	"syscall"
+	"time"
 
+	"github.com/jakubDoka/keeper/cluster"
+	"github.com/jakubDoka/keeper/index"
 	"github.com/jakubDoka/keeper/kcfg"
 	"github.com/jakubDoka/keeper/klog"
 	"github.com/jakubDoka/keeper/knet"
 	"github.com/jakubDoka/keeper/match"
+	"github.com/jakubDoka/keeper/matchmaker"
+	"github.com/jakubDoka/keeper/notify"
+	"github.com/jakubDoka/keeper/party"
+	"github.com/jakubDoka/keeper/presence"
 	"github.com/jakubDoka/keeper/state"
 	"github.com/jakubDoka/keeper/util"
 	"github.com/jakubDoka/keeper/util/uuid"
@@ -57,17 +68,60 @@ func LaunchWithConfig(config *kcfg.Config, mods ...Module) App {
 
 	matchManager := match.NewManager(s)
 
+	if config.Match.Snapshots {
+		store, err := match.NewSQLSnapshotStore(s)
+		if err != nil {
+			logger.Fatal("cannot prepare match snapshots: %s", err)
+		}
+		matchManager.EnableSnapshots(store)
+	}
+
 	logger.Info("Initializing router...")
 	router, err := knet.NewRouter(s)
 	if err != nil {
 		logger.Fatal("cannot create router: %s", err)
 	}
 
+	hub := notify.NewHub(s)
+
 	router.Listener.RegisterAcceptor("match", matchManager)
+	router.Listener.RegisterAcceptor("spectate", match.SpectatorAcceptor{Manager: matchManager})
+	router.Listener.RegisterAcceptor("notify", hub)
+
+	nodes := cluster.New(s, matchManager)
+	if nodes.Enabled() {
+		s.Resolver = nodes
+	}
 
-	app := App{s, router, matchManager}
+	mm := matchmaker.New(s, matchManager, hub)
+	parties := party.New(s, nodes, mm, hub)
+	matchManager.SetPartyResolver(parties)
+	hub.AddListener(parties)
+
+	tracker := presence.New(s, hub)
+	hub.AddListener(tracker)
+	matchManager.SetListener(tracker)
+
+	app := App{
+		State:      s,
+		Router:     router,
+		Manager:    matchManager,
+		Notify:     hub,
+		Matchmaker: mm,
+		Parties:    parties,
+		Presence:   tracker,
+		Cluster:    nodes,
+		Indexes:    make(map[string]*index.Index),
+	}
 	app.createMatchHandler()
 	app.createKeyHandler()
+	app.createListHandler()
+	app.createMigrationHandler()
+	app.createClusterHandlers()
+	app.createMatchmakerHandlers()
+	app.createPartyHandlers()
+	app.createPresenceHandlers()
+	app.createDebugHandlers()
 
 	if len(mods) > 0 {
 		for _, mod := range mods {
@@ -78,6 +132,22 @@ func LaunchWithConfig(config *kcfg.Config, mods ...Module) App {
 
 	logger.Finish()
 	s.Prepared.Finish()
+	matchManager.Finish()
+	app.Matchmaker.Finish()
+
+	if config.Match.Snapshots {
+		logger.Info("Restoring matches...")
+		err := matchManager.RestoreSnapshots()
+		if err != nil {
+			logger.Error("cannot restore matches: %s", err)
+		}
+		go matchManager.SnapshotPeriodically(time.Duration(config.Match.SnapshotInterval) * time.Second)
+	}
+
+	go hub.Run(time.Second)
+	go tracker.Run(time.Second)
+	go parties.Run(time.Second)
+	go app.Matchmaker.Run(time.Duration(config.Match.MatchmakingInterval) * time.Second)
 
 	logger.Info("Starting HTTP server (%s)...", config.Net.GetHttpConnectionString())
 	go func() {
@@ -94,6 +164,57 @@ type App struct {
 	*state.State
 	*knet.Router
 	*match.Manager
+
+	Notify     *notify.Hub
+	Matchmaker *matchmaker.Matchmaker
+	Parties    *party.Parties
+	Presence   *presence.Tracker
+	Cluster    *cluster.Cluster
+	// Indexes are inspected by index-stats rpc, see RegisterIndex.
+	Indexes map[string]*index.Index
+}
+
+// Shutdown stops http server and all matches. Matches are persisted if snapshots are enabled.
+func (a App) Shutdown() {
+	a.Info("Shutting down...")
+	err := a.Router.Server.Shutdown(context.Background())
+	if err != nil {
+		a.Error("Http server failed to shut down: %s", err)
+	}
+	a.Manager.Shutdown()
+}
+
+// Block blocks until process receives interrupt, then shuts the app down.
+func (a App) Block() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	<-ch
+	a.Shutdown()
+}
+
+// RegisterTargetRpc registers rpc that reads single uuid from body and passes it to
+// handler along with caller id, missing is returned if body does not contain it.
+func (a App) RegisterTargetRpc(id string, missing error, handler func(actor, target uuid.UUID) error) {
+	a.RegisterRpc(id, knet.RpcAssertUser, func(state *state.State, user *state.User, w http.ResponseWriter, re *http.Request) error {
+		reader, err := util.BodyToReader(re)
+		if err != nil {
+			return err
+		}
+
+		target, ok := reader.UUID()
+		if !ok {
+			return missing
+		}
+
+		err = handler(user.ID(), target)
+		if err != nil {
+			return err
+		}
+
+		w.Write([]byte("OK"))
+
+		return nil
+	})
 }
 
 type Module interface {
@@ -175,6 +296,7 @@ func (a App) RegisterEmailLoginHandler(handler func(state *state.State, email, p
 		w.Write(writer.Buffer())
 
 		state.AddUser(user)
+		a.Presence.Login(user.ID())
 
 		return nil
 	})
@@ -192,26 +314,104 @@ func (a App) createMatchHandler() {
 			return errors.New("missing match type")
 		}
 
-		factory := a.GetCore(factoryID)
-		if factory == nil {
-			return errors.New("unknown match type")
+		access, err := a.Cluster.CreateMatch(factoryID, user, reader.Rest())
+		if err != nil {
+			return err
 		}
 
-		core := factory()
-		matchID := uuid.New()
-		match, err := match.New(state, a.Manager, core, user, matchID, reader.Rest())
+		writer := util.Writer{}
+		access.Encode(&writer)
+
+		w.Write(writer.Buffer())
+
+		return nil
+	})
+
+	a.RegisterRpc("join-match", knet.RpcAssertUser, func(state *state.State, user *state.User, w http.ResponseWriter, re *http.Request) error {
+		reader, err := util.BodyToReader(re)
+		if err != nil {
+			return err
+		}
+
+		matchID, ok := reader.UUID()
+		if !ok {
+			return match.ErrMissingMatchID
+		}
+
+		access, err := a.Cluster.JoinMatch(matchID, user)
+		if err != nil {
+			return err
+		}
+
+		writer := util.Writer{}
+		access.Encode(&writer)
+
+		w.Write(writer.Buffer())
+
+		return nil
+	})
+}
+
+func (a App) createMigrationHandler() {
+	a.RegisterRpc(match.MigrateRpc, knet.RpcAssertPeer, func(state *state.State, user *state.User, w http.ResponseWriter, re *http.Request) error {
+		reader, err := util.BodyToReader(re)
+		if err != nil {
+			return err
+		}
+
+		response, err := a.AcceptMigration(reader.Rest())
 		if err != nil {
 			return err
 		}
 
-		a.AddMatch(match)
+		w.Write(response)
+
+		return nil
+	})
+
+	a.RegisterRpc(match.AbortMigrationRpc, knet.RpcAssertPeer, func(state *state.State, user *state.User, w http.ResponseWriter, re *http.Request) error {
+		reader, err := util.BodyToReader(re)
+		if err != nil {
+			return err
+		}
 
-		w.Write(matchID[:])
+		id, ok := reader.UUID()
+		if !ok {
+			return match.ErrMissingMatchID
+		}
+
+		err = a.AbortMigration(id)
+		if err != nil {
+			return err
+		}
+
+		w.Write([]byte("OK"))
 
 		return nil
 	})
 }
 
+func (a App) createClusterHandlers() {
+	for _, id := range cluster.Rpcs {
+		id := id
+		a.RegisterRpc(id, knet.RpcAssertPeer, func(state *state.State, user *state.User, w http.ResponseWriter, re *http.Request) error {
+			reader, err := util.BodyToReader(re)
+			if err != nil {
+				return err
+			}
+
+			response, err := a.Cluster.Accept(id, reader.Rest())
+			if err != nil {
+				return err
+			}
+
+			w.Write(response)
+
+			return nil
+		})
+	}
+}
+
 func (a App) createKeyHandler() {
 	a.RegisterRpc("create-key", knet.RpcAssertUser, func(state *state.State, user *state.User, w http.ResponseWriter, re *http.Request) error {
 		if _, ok := state.GetKey(user.ID()); ok {
@@ -0,0 +1,84 @@
+package core
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+
+	"github.com/jakubDoka/keeper/index"
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/util"
+)
+
+// MatchIndex is name of match tag index in index-stats rpc.
+const MatchIndex = "matches"
+
+var ErrUnknownIndex = errors.New("unknown index")
+
+// RegisterIndex makes index visible to index-stats rpc under the name. Call this from
+// Module.Init.
+func (a App) RegisterIndex(name string, idx *index.Index) {
+	a.Indexes[name] = idx
+}
+
+// createDebugHandlers registers rpcs for inspecting the node, they are authorized
+// as peer calls so only holders of cluster secret can use them.
+func (a App) createDebugHandlers() {
+	a.RegisterIndex(MatchIndex, a.Manager.Index())
+
+	a.RegisterRpc("index-stats", knet.RpcAssertPeer, func(state *state.State, user *state.User, w http.ResponseWriter, re *http.Request) error {
+		reader, err := util.BodyToReader(re)
+		if err != nil {
+			return err
+		}
+
+		// empty name means all indexes
+		name, _ := reader.String()
+
+		var names []string
+		if name != "" {
+			if _, ok := a.Indexes[name]; !ok {
+				return ErrUnknownIndex
+			}
+			names = append(names, name)
+		} else {
+			for name := range a.Indexes {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		}
+
+		writer := util.NewWriter(0)
+		writer.Uint32(uint32(len(names)))
+		for _, name := range names {
+			stats := a.Indexes[name].Stats()
+			writer.String(name)
+			writer.Uint32(uint32(stats.Documents))
+			writer.Uint32(uint32(len(stats.Categories)))
+			for _, c := range stats.Categories {
+				writer.String(c.Name)
+				writer.String(c.Type)
+				if c.Declared {
+					writer.Uint8(uint8(c.Kind) + 1)
+				} else {
+					writer.Uint8(0)
+				}
+				writer.Uint32(statCount(c.Fields))
+				writer.Uint32(statCount(c.Values))
+			}
+		}
+
+		_, err = w.Write(writer.Buffer())
+		return err
+	})
+}
+
+// statCount encodes unknown count as max uint32.
+func statCount(count int) uint32 {
+	if count < 0 {
+		return math.MaxUint32
+	}
+	return uint32(count)
+}
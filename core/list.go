@@ -0,0 +1,60 @@
+package core
+
+import (
+	"errors"
+	"math"
+	"net/http"
+
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/match"
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/util"
+)
+
+var ErrInvalidListOptions = errors.New("invalid list options")
+
+// createListHandler registers list-matches, request body is match.ListOptions as
+// written by match.ListOptions.Encode.
+func (a App) createListHandler() {
+	a.RegisterRpc("list-matches", knet.RpcAssertUser, func(state *state.State, user *state.User, w http.ResponseWriter, re *http.Request) error {
+		reader, err := util.BodyToReader(re)
+		if err != nil {
+			return err
+		}
+
+		options, ok := match.DecodeListOptions(&reader)
+		if !ok {
+			return ErrInvalidListOptions
+		}
+
+		page, err := a.Cluster.List(options)
+		if err != nil {
+			return err
+		}
+
+		writer := util.NewWriter(len(page.Entries) * 0xFF)
+		writer.Uint32(uint32(len(page.Entries)))
+
+		for _, entry := range page.Entries {
+			var open uint8
+			if entry.Open {
+				open = 1
+			}
+
+			writer.
+				UUID(entry.ID).
+				Uint32(entry.Score).
+				Uint64(math.Float64bits(entry.Relevance)).
+				Uint32(entry.UserAmount).
+				Uint8(open).
+				Bytes(entry.Info).
+				String(entry.Address)
+		}
+
+		writer.Bytes(page.Cursor)
+
+		w.Write(writer.Buffer())
+
+		return nil
+	})
+}
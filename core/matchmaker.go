@@ -0,0 +1,169 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/jakubDoka/keeper/index"
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/matchmaker"
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/util"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+var (
+	ErrMissingQueue    = errors.New("missing queue")
+	ErrMissingQuery    = errors.New("missing query")
+	ErrMissingProperty = errors.New("missing property")
+	ErrMissingTicketID = errors.New("missing ticket id")
+	ErrForeignTicket   = errors.New("ticket does not belong to you")
+)
+
+func (a App) createMatchmakerHandlers() {
+	a.RegisterRpc("matchmaker-add", knet.RpcAssertUser, func(state *state.State, user *state.User, w http.ResponseWriter, re *http.Request) error {
+		reader, err := util.BodyToReader(re)
+		if err != nil {
+			return err
+		}
+
+		ticket, err := readTicket(&reader)
+		if err != nil {
+			return err
+		}
+		ticket.Users = []uuid.UUID{user.ID()}
+
+		id, err := a.Matchmaker.Add(ticket)
+		if err != nil {
+			return err
+		}
+
+		w.Write(id[:])
+
+		return nil
+	})
+
+	a.RegisterRpc("matchmaker-remove", knet.RpcAssertUser, func(state *state.State, user *state.User, w http.ResponseWriter, re *http.Request) error {
+		id, err := a.ownTicket(user, re)
+		if err != nil {
+			return err
+		}
+
+		err = a.Matchmaker.Remove(id)
+		if err != nil {
+			return err
+		}
+
+		w.Write([]byte("OK"))
+
+		return nil
+	})
+
+	a.RegisterRpc("matchmaker-status", knet.RpcAssertUser, func(state *state.State, user *state.User, w http.ResponseWriter, re *http.Request) error {
+		reader, err := util.BodyToReader(re)
+		if err != nil {
+			return err
+		}
+
+		id, ok := reader.UUID()
+		if !ok {
+			return ErrMissingTicketID
+		}
+
+		status, result := a.Matchmaker.Status(id)
+
+		if status == matchmaker.Matched && !contains(result.Users, user.ID()) {
+			return ErrForeignTicket
+		}
+
+		var calc util.Calculator
+		writer := calc.Uint32().UUID().String(result.Address).ToWriter()
+		writer.Uint32(uint32(status))
+		if status == matchmaker.Matched {
+			writer.
+				UUID(result.Match).
+				String(result.Address)
+		}
+
+		w.Write(writer.Buffer())
+
+		return nil
+	})
+}
+
+// readTicket reads queue, query and numeric properties encoded as name and float64 bits.
+func readTicket(reader *util.Reader) (matchmaker.Ticket, error) {
+	queue, ok := reader.String()
+	if !ok {
+		return matchmaker.Ticket{}, ErrMissingQueue
+	}
+
+	query, ok := reader.Bytes()
+	if !ok {
+		return matchmaker.Ticket{}, ErrMissingQuery
+	}
+
+	var parser index.Parser
+	fields, i, err := parser.Parse(query)
+	if err != nil {
+		return matchmaker.Ticket{}, fmt.Errorf("failed to parse query:%d: %s", i, err)
+	}
+
+	count, ok := reader.Uint32()
+	if !ok {
+		return matchmaker.Ticket{}, ErrMissingProperty
+	}
+
+	properties := make(map[string]float64)
+	for i := uint32(0); i < count; i++ {
+		name, ok := reader.String()
+		if !ok {
+			return matchmaker.Ticket{}, ErrMissingProperty
+		}
+		value, ok := reader.Uint64()
+		if !ok {
+			return matchmaker.Ticket{}, ErrMissingProperty
+		}
+		properties[name] = math.Float64frombits(value)
+	}
+
+	return matchmaker.Ticket{
+		Queue:      queue,
+		Query:      append([]index.Field(nil), fields...),
+		Properties: properties,
+	}, nil
+}
+
+func (a App) ownTicket(user *state.User, re *http.Request) (uuid.UUID, error) {
+	reader, err := util.BodyToReader(re)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	id, ok := reader.UUID()
+	if !ok {
+		return uuid.Nil, ErrMissingTicketID
+	}
+
+	ticket, ok := a.Matchmaker.Ticket(id)
+	if !ok {
+		return uuid.Nil, matchmaker.ErrTicketNotFound
+	}
+
+	if !contains(ticket.Users, user.ID()) {
+		return uuid.Nil, ErrForeignTicket
+	}
+
+	return id, nil
+}
+
+func contains(ids []uuid.UUID, id uuid.UUID) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package core
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/match"
+	"github.com/jakubDoka/keeper/party"
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/util"
+)
+
+var (
+	ErrMissingPartyID = errors.New("missing party id")
+	ErrMissingUserID  = errors.New("missing user id")
+)
+
+func (a App) createPartyHandlers() {
+	a.RegisterRpc("party-create", knet.RpcAssertUser, func(state *state.State, user *state.User, w http.ResponseWriter, re *http.Request) error {
+		id, err := a.Parties.Create(user.ID())
+		if err != nil {
+			return err
+		}
+
+		w.Write(id[:])
+
+		return nil
+	})
+
+	a.RegisterRpc("party-get", knet.RpcAssertUser, func(state *state.State, user *state.User, w http.ResponseWriter, re *http.Request) error {
+		p, ok := a.Parties.Get(user.ID())
+		if !ok {
+			return party.ErrNotInParty
+		}
+
+		var writer util.Writer
+		p.Encode(&writer)
+		w.Write(writer.Buffer())
+
+		return nil
+	})
+
+	a.RegisterTargetRpc("party-invite", ErrMissingUserID, a.Parties.Invite)
+	a.RegisterTargetRpc("party-join", ErrMissingPartyID, a.Parties.Join)
+	a.RegisterTargetRpc("party-promote", ErrMissingUserID, a.Parties.Promote)
+	a.RegisterTargetRpc("party-kick", ErrMissingUserID, a.Parties.Kick)
+	a.RegisterTargetRpc("party-join-match", match.ErrMissingMatchID, a.Parties.JoinMatch)
+
+	a.RegisterRpc("party-leave", knet.RpcAssertUser, func(state *state.State, user *state.User, w http.ResponseWriter, re *http.Request) error {
+		err := a.Parties.Leave(user.ID())
+		if err != nil {
+			return err
+		}
+
+		w.Write([]byte("OK"))
+
+		return nil
+	})
+
+	a.RegisterRpc("party-matchmake", knet.RpcAssertUser, func(state *state.State, user *state.User, w http.ResponseWriter, re *http.Request) error {
+		reader, err := util.BodyToReader(re)
+		if err != nil {
+			return err
+		}
+
+		ticket, err := readTicket(&reader)
+		if err != nil {
+			return err
+		}
+
+		id, err := a.Parties.Matchmake(user.ID(), ticket)
+		if err != nil {
+			return err
+		}
+
+		w.Write(id[:])
+
+		return nil
+	})
+}
@@ -0,0 +1,110 @@
+package core
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/presence"
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/util"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+// MaxPresenceBatch limits amount of users in one presence rpc.
+const MaxPresenceBatch = 256
+
+var (
+	ErrMissingUsers  = errors.New("missing user list")
+	ErrTooManyUsers  = errors.New("too many users in one request")
+	ErrMissingStatus = errors.New("missing status")
+)
+
+func (a App) createPresenceHandlers() {
+	a.registerPresenceBatchRpc("presence-get", a.Presence.Get)
+	a.registerPresenceBatchRpc("presence-subscribe", a.Presence.Subscribe)
+
+	a.RegisterRpc("presence-unsubscribe", knet.RpcAssertUser, func(state *state.State, user *state.User, w http.ResponseWriter, re *http.Request) error {
+		targets, err := readUserList(re)
+		if err != nil {
+			return err
+		}
+
+		a.Presence.Unsubscribe(user.ID(), targets...)
+
+		w.Write([]byte("OK"))
+
+		return nil
+	})
+
+	a.RegisterRpc("presence-set-status", knet.RpcAssertUser, func(state *state.State, user *state.User, w http.ResponseWriter, re *http.Request) error {
+		reader, err := util.BodyToReader(re)
+		if err != nil {
+			return err
+		}
+
+		custom, ok := reader.String()
+		if !ok {
+			return ErrMissingStatus
+		}
+
+		err = a.Presence.SetCustom(user.ID(), custom)
+		if err != nil {
+			return err
+		}
+
+		w.Write([]byte("OK"))
+
+		return nil
+	})
+}
+
+// registerPresenceBatchRpc registers rpc that reads list of users from body and
+// responds with their presence returned by handler.
+func (a App) registerPresenceBatchRpc(id string, handler func(viewer uuid.UUID, targets ...uuid.UUID) ([]presence.Presence, error)) {
+	a.RegisterRpc(id, knet.RpcAssertUser, func(state *state.State, user *state.User, w http.ResponseWriter, re *http.Request) error {
+		targets, err := readUserList(re)
+		if err != nil {
+			return err
+		}
+
+		presences, err := handler(user.ID(), targets...)
+		if err != nil {
+			return err
+		}
+
+		writer := util.NewWriter(0)
+		writer.Uint32(uint32(len(presences)))
+		for _, p := range presences {
+			p.Encode(&writer)
+		}
+		w.Write(writer.Buffer())
+
+		return nil
+	})
+}
+
+// readUserList reads uint32 count followed by user ids.
+func readUserList(re *http.Request) ([]uuid.UUID, error) {
+	reader, err := util.BodyToReader(re)
+	if err != nil {
+		return nil, err
+	}
+
+	count, ok := reader.Uint32()
+	if !ok {
+		return nil, ErrMissingUsers
+	}
+	if count > MaxPresenceBatch {
+		return nil, ErrTooManyUsers
+	}
+
+	targets := make([]uuid.UUID, count)
+	for i := range targets {
+		if targets[i], ok = reader.UUID(); !ok {
+			return nil, ErrMissingUserID
+		}
+	}
+
+	return targets, nil
+}
@@ -0,0 +1,269 @@
+package index
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+const (
+	// EarthRadius is mean radius of earth in kilometers.
+	EarthRadius = 6371.0
+	// DefaultCellSize is default size of GeoIndexCategory grid cell in degrees.
+	DefaultCellSize = 1.0
+)
+
+type GeoCapsule struct {
+	lat, lon float64
+	data     interface{}
+}
+
+type geoCell struct {
+	x, y int
+}
+
+// GeoIndexCategory indexes FTPoint fields in grid of cells so search only visits
+// cells near the point. FTPoint search finds points at the same location,
+// FTGeoRadius points within the radius and FTGeoNearest given amount of points
+// closest to the point. Found points are scored by distance, point Scale away from
+// the center scores half of the point in the center.
+type GeoIndexCategory struct {
+	cells        map[geoCell][]GeoCapsule
+	cellsMutex   sync.RWMutex
+	Synchronized bool
+	// CellSize is in degrees, DefaultCellSize if 0. It must not change after first
+	// insert.
+	CellSize float64
+	// Scale is in kilometers. If 0 it is half of the radius or half of the distance
+	// to the farthest of nearest points.
+	Scale float64
+}
+
+func (g *GeoIndexCategory) Insert(field Field) {
+	if field.Type != FTPoint {
+		return
+	}
+
+	if g.Synchronized {
+		g.cellsMutex.Lock()
+		defer g.cellsMutex.Unlock()
+	}
+
+	if g.cells == nil {
+		g.cells = make(map[geoCell][]GeoCapsule)
+	}
+
+	cell := g.cell(field.Float1, field.Float2)
+	g.cells[cell] = append(g.cells[cell], GeoCapsule{lat: field.Float1, lon: field.Float2, data: field.Value})
+}
+
+func (g *GeoIndexCategory) Remove(field Field) {
+	if field.Type != FTPoint {
+		return
+	}
+
+	if g.Synchronized {
+		g.cellsMutex.Lock()
+		defer g.cellsMutex.Unlock()
+	}
+
+	cell := g.cell(field.Float1, field.Float2)
+	capsules := g.cells[cell]
+	for i, c := range capsules {
+		if c.data == field.Value && c.lat == field.Float1 && c.lon == field.Float2 {
+			capsules = append(capsules[:i], capsules[i+1:]...)
+			break
+		}
+	}
+
+	if len(capsules) == 0 {
+		delete(g.cells, cell)
+	} else {
+		g.cells[cell] = capsules
+	}
+}
+
+func (g *GeoIndexCategory) Search(field Field, buffer ResultBuffer) {
+	if field.Type != FTPoint && field.Type != FTGeoRadius && field.Type != FTGeoNearest {
+		return
+	}
+
+	if g.Synchronized {
+		g.cellsMutex.RLock()
+		defer g.cellsMutex.RUnlock()
+	}
+
+	lat, lon := field.Float1, field.Float2
+	switch field.Type {
+	case FTPoint:
+		g.within(lat, lon, 0, func(c GeoCapsule, distance float64) {
+			buffer.Add(c.data)
+		})
+	case FTGeoRadius:
+		scale := g.Scale
+		if scale == 0 {
+			scale = field.Radius / 2
+		}
+		g.within(lat, lon, field.Radius, func(c GeoCapsule, distance float64) {
+			addScore(buffer, c.data, proximity(distance, 0, math.Inf(1), scale))
+		})
+	case FTGeoNearest:
+		found := g.nearest(lat, lon, int(field.Int1))
+		if len(found) == 0 {
+			return
+		}
+		scale := g.Scale
+		if scale == 0 {
+			scale = found[len(found)-1].distance / 2
+		}
+		for _, f := range found {
+			addScore(buffer, f.data, proximity(f.distance, 0, math.Inf(1), scale))
+		}
+	}
+}
+
+func (g *GeoIndexCategory) Dump(visit func(Field)) {
+	if g.Synchronized {
+		g.cellsMutex.RLock()
+		defer g.cellsMutex.RUnlock()
+	}
+
+	for _, capsules := range g.cells {
+		for _, c := range capsules {
+			visit(Field{Type: FTPoint, Float1: c.lat, Float2: c.lon, Value: c.data})
+		}
+	}
+}
+
+func (g *GeoIndexCategory) size() float64 {
+	if g.CellSize <= 0 {
+		return DefaultCellSize
+	}
+	return g.CellSize
+}
+
+// grid returns amount of cell columns and rows.
+func (g *GeoIndexCategory) grid() (cols, rows int) {
+	size := g.size()
+	return int(math.Ceil(360 / size)), int(math.Ceil(180 / size))
+}
+
+func (g *GeoIndexCategory) cell(lat, lon float64) geoCell {
+	cols, _ := g.grid()
+	return geoCell{
+		x: mod(int(math.Floor((lon+180)/g.size())), cols),
+		y: g.row(lat),
+	}
+}
+
+func (g *GeoIndexCategory) row(lat float64) int {
+	_, rows := g.grid()
+	y := int(math.Floor((lat + 90) / g.size()))
+	if y < 0 {
+		return 0
+	}
+	if y >= rows {
+		return rows - 1
+	}
+	return y
+}
+
+// within visits all points at most radius kilometers from the point. Only cells
+// in bounding box of the circle are visited.
+func (g *GeoIndexCategory) within(lat, lon, radius float64, visit func(c GeoCapsule, distance float64)) {
+	cols, rows := g.grid()
+	size := g.size()
+
+	minX, maxX, minY, maxY := 0, cols-1, 0, rows-1
+	angle := radius / EarthRadius
+	if angle < math.Pi {
+		delta := angle * 180 / math.Pi
+		minLat, maxLat := lat-delta, lat+delta
+		minY, maxY = g.row(minLat), g.row(maxLat)
+
+		// longitude can be bounded only if the circle does not contain a pole
+		if minLat > -90 && maxLat < 90 {
+			sin := math.Sin(angle) / math.Cos(lat*math.Pi/180)
+			if sin < 1 {
+				delta = math.Asin(sin) * 180 / math.Pi
+				minX = int(math.Floor((lon - delta + 180) / size))
+				maxX = int(math.Floor((lon + delta + 180) / size))
+				if maxX-minX+1 >= cols {
+					minX, maxX = 0, cols-1
+				}
+			}
+		}
+	}
+
+	check := func(capsules []GeoCapsule) {
+		for _, c := range capsules {
+			if distance := Distance(lat, lon, c.lat, c.lon); distance <= radius {
+				visit(c, distance)
+			}
+		}
+	}
+
+	// sparse grid is cheaper to scan whole
+	if (maxX-minX+1)*(maxY-minY+1) > len(g.cells) {
+		for cell, capsules := range g.cells {
+			x := mod(cell.x-minX, cols) + minX
+			if x <= maxX && cell.y >= minY && cell.y <= maxY {
+				check(capsules)
+			}
+		}
+		return
+	}
+
+	for y := minY; y <= maxY; y++ {
+		for x := minX; x <= maxX; x++ {
+			check(g.cells[geoCell{mod(x, cols), y}])
+		}
+	}
+}
+
+type geoHit struct {
+	data     interface{}
+	distance float64
+}
+
+// nearest returns at most count closest points sorted by distance. Radius is
+// doubled until it contains enough points, points outside it are farther then all
+// points inside so they cannot be among the nearest.
+func (g *GeoIndexCategory) nearest(lat, lon float64, count int) []geoHit {
+	var found []geoHit
+	collect := func(c GeoCapsule, distance float64) {
+		found = append(found, geoHit{c.data, distance})
+	}
+
+	for radius := g.size() * EarthRadius * math.Pi / 180; ; radius *= 2 {
+		found = found[:0]
+		g.within(lat, lon, radius, collect)
+		if len(found) >= count || radius >= EarthRadius*math.Pi {
+			break
+		}
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].distance < found[j].distance
+	})
+
+	if len(found) > count {
+		found = found[:count]
+	}
+
+	return found
+}
+
+// Distance returns great circle distance between two points in kilometers.
+func Distance(lat1, lon1, lat2, lon2 float64) float64 {
+	const rad = math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EarthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+func mod(a, b int) int {
+	return (a%b + b) % b
+}
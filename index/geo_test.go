@@ -0,0 +1,73 @@
+package index
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGeoIndexCategory(t *testing.T) {
+	points := [][2]float64{
+		{48.15, 17.11},  // Bratislava
+		{48.21, 16.37},  // Vienna
+		{50.08, 14.44},  // Prague
+		{40.71, -74.01}, // New York
+		{35.68, 139.69}, // Tokyo
+		{-17.7, 178},    // Fiji
+		{-16.5, -179.9}, // across antimeridian
+		{89.5, 0},       // near pole
+		{89.5, 180},     // other side of pole
+	}
+
+	category := &GeoIndexCategory{}
+	for i, p := range points {
+		category.Insert(Field{Type: FTPoint, Float1: p[0], Float2: p[1], Value: i})
+	}
+
+	tests := []struct {
+		name   string
+		field  Field
+		result testBuffer
+	}{
+		{"point", Field{Type: FTPoint, Float1: 48.15, Float2: 17.11}, testBuffer{0: 1}},
+		{"radius", Field{Type: FTGeoRadius, Float1: 48.15, Float2: 17.11, Radius: 100}, testBuffer{0: 1, 1: 1}},
+		{"wider", Field{Type: FTGeoRadius, Float1: 48.15, Float2: 17.11, Radius: 400}, testBuffer{0: 1, 1: 1, 2: 1}},
+		{"antimeridian", Field{Type: FTGeoRadius, Float1: -17.7, Float2: 178, Radius: 300}, testBuffer{5: 1, 6: 1}},
+		{"pole", Field{Type: FTGeoRadius, Float1: 89.5, Float2: 0, Radius: 150}, testBuffer{7: 1, 8: 1}},
+		{"everything", Field{Type: FTGeoRadius, Radius: 30000}, testBuffer{0: 1, 1: 1, 2: 1, 3: 1, 4: 1, 5: 1, 6: 1, 7: 1, 8: 1}},
+		{"nearest", Field{Type: FTGeoNearest, Float1: 48.15, Float2: 17.11, Int1: 2}, testBuffer{0: 1, 1: 1}},
+		{"nearest far", Field{Type: FTGeoNearest, Float1: 0, Float2: -70, Int1: 1}, testBuffer{3: 1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := testBuffer{}
+			category.Search(test.field, result)
+			if !reflect.DeepEqual(result, test.result) {
+				t.Errorf("\n%v\n%v", test.result, result)
+			}
+		})
+	}
+
+	scores := Scores{}
+	category.Search(Field{Type: FTGeoNearest, Float1: 48.15, Float2: 17.11, Int1: 2}, scores)
+	if scores[0] != 1 || scores[1] != 1/3.0 {
+		t.Error(scores)
+	}
+
+	category.Remove(Field{Type: FTPoint, Float1: 48.21, Float2: 16.37, Value: 1})
+	result := testBuffer{}
+	category.Search(Field{Type: FTGeoNearest, Float1: 48.15, Float2: 17.11, Int1: 2}, result)
+	if !reflect.DeepEqual(result, testBuffer{0: 1, 2: 1}) {
+		t.Error(result)
+	}
+}
+
+func TestDistance(t *testing.T) {
+	// Bratislava - Vienna
+	if d := Distance(48.15, 17.11, 48.21, 16.37); d < 54 || d > 56 {
+		t.Error(d)
+	}
+	if d := Distance(0, 0, 0, 180); d < 20015 || d > 20016 {
+		t.Error(d)
+	}
+}
@@ -3,6 +3,8 @@ package index
 import (
 	"strings"
 	"sync"
+	"unicode"
+	"unicode/utf8"
 )
 
 type IndexCategory interface {
@@ -13,18 +15,37 @@ type IndexCategory interface {
 
 type Index struct {
 	categories      map[string]IndexCategory
+	kinds           map[string]Kind
 	categoriesMutex sync.RWMutex
+
+	// documents counts indexed fields of each document so negated queries know
+	// what to negate against
+	documents      map[interface{}]int
+	documentsMutex sync.Mutex
 }
 
 func New() *Index {
 	return &Index{
 		categories: make(map[string]IndexCategory),
+		documents:  make(map[interface{}]int),
+	}
+}
+
+// Documents returns set of values with at least one indexed field.
+func (i *Index) Documents() map[interface{}]struct{} {
+	i.documentsMutex.Lock()
+	result := make(map[interface{}]struct{}, len(i.documents))
+	for document := range i.documents {
+		result[document] = struct{}{}
 	}
+	i.documentsMutex.Unlock()
+	return result
 }
 
 func (i *Index) AddCategory(name string, value IndexCategory) {
 	i.categoriesMutex.Lock()
 	i.categories[name] = value
+	delete(i.kinds, name)
 	i.categoriesMutex.Unlock()
 }
 
@@ -36,6 +57,10 @@ func (i *Index) Insert(fields ...Field) {
 			continue
 		}
 		category.Insert(field)
+
+		i.documentsMutex.Lock()
+		i.documents[field.Value]++
+		i.documentsMutex.Unlock()
 	}
 	i.categoriesMutex.RUnlock()
 }
@@ -48,6 +73,16 @@ func (i *Index) Remove(fields ...Field) {
 			continue
 		}
 		category.Remove(field)
+
+		i.documentsMutex.Lock()
+		if count, ok := i.documents[field.Value]; ok {
+			if count <= 1 {
+				delete(i.documents, field.Value)
+			} else {
+				i.documents[field.Value] = count - 1
+			}
+		}
+		i.documentsMutex.Unlock()
 	}
 	i.categoriesMutex.RUnlock()
 }
@@ -59,7 +94,7 @@ func (i *Index) Search(buffer ResultBuffer, fields ...Field) {
 		if !ok {
 			continue
 		}
-		category.Search(field, buffer)
+		category.Search(field, weigh(buffer, field))
 	}
 	i.categoriesMutex.RUnlock()
 }
@@ -69,10 +104,15 @@ type IntCapsule struct {
 	data  interface{}
 }
 
+// IntIndexCategory indexes FTInt fields. Documents found by FTRange are scored by
+// proximity to middle of the range, or to the finite bound if range is unbounded
+// from one side, value Scale away scores half of the value in the middle.
 type IntIndexCategory struct {
 	capsules      []IntCapsule
 	capsulesMutex sync.RWMutex
 	Synchronized  bool
+	// Scale is half of the range if 0, or 1 for unbounded ranges.
+	Scale float64
 }
 
 func (i *IntIndexCategory) Insert(field Field) {
@@ -91,10 +131,10 @@ func (i *IntIndexCategory) Insert(field Field) {
 	}
 
 	idx, _ := i.BinSearch(field.Int1)
-	i.capsules = append(i.capsules, IntCapsule{value: field.Int1})
+	i.capsules = append(i.capsules, IntCapsule{})
 	copy(i.capsules[idx+1:], i.capsules[idx:])
 
-	i.capsules[idx].data = field.Value
+	i.capsules[idx] = IntCapsule{value: field.Int1, data: field.Value}
 }
 
 func (i *IntIndexCategory) Search(field Field, buffer ResultBuffer) {
@@ -109,15 +149,17 @@ func (i *IntIndexCategory) Search(field Field, buffer ResultBuffer) {
 
 	switch field.Type {
 	case FTInt:
-		idx, ok := i.BinSearch(field.Int1)
-		if ok {
+		idx, _ := i.BinSearch(field.Int1)
+		for idx < len(i.capsules) && i.capsules[idx].value == field.Int1 {
 			buffer.Add(i.capsules[idx].data)
+			idx++
 		}
 	case FTRange:
 		start, _ := i.BinSearch(field.Int1)
 		end, _ := i.BinSearch(field.Int2)
+		min, max := rangeBounds(field)
 		for j := start; j < end; j++ {
-			buffer.Add(i.capsules[j].data)
+			addScore(buffer, i.capsules[j].data, proximity(float64(i.capsules[j].value), min, max, i.Scale))
 		}
 	}
 }
@@ -143,6 +185,17 @@ func (i *IntIndexCategory) Remove(field Field) {
 	}
 }
 
+func (i *IntIndexCategory) Dump(visit func(Field)) {
+	if i.Synchronized {
+		i.capsulesMutex.RLock()
+		defer i.capsulesMutex.RUnlock()
+	}
+
+	for _, c := range i.capsules {
+		visit(Field{Type: FTInt, Int1: c.value, Value: c.data})
+	}
+}
+
 func (i *IntIndexCategory) BinSearch(value int32) (int, bool) {
 	if len(i.capsules) == 0 {
 		return 0, false
@@ -167,10 +220,17 @@ type StringCapsule struct {
 	data  interface{}
 }
 
+// StringIndexCategory indexes FTString fields. FTString search finds values with
+// the prefix, FTExactString only equal values. Both ignore case if Field.Fold is set,
+// which makes search linear. Equal values score ExactWeight, values only sharing
+// prefix score PrefixWeight.
 type StringIndexCategory struct {
 	capsules      []StringCapsule
 	capsulesMutex sync.RWMutex
 	Synchronized  bool
+	// ExactWeight and PrefixWeight default to DefaultExactWeight and
+	// DefaultPrefixWeight if 0.
+	ExactWeight, PrefixWeight float64
 }
 
 func (i *StringIndexCategory) Insert(field Field) {
@@ -189,10 +249,10 @@ func (i *StringIndexCategory) Insert(field Field) {
 	}
 
 	idx, _ := i.BinSearch(field.String)
-	i.capsules = append(i.capsules, StringCapsule{value: field.String})
+	i.capsules = append(i.capsules, StringCapsule{})
 	copy(i.capsules[idx+1:], i.capsules[idx:])
 
-	i.capsules[idx].data = field.Value
+	i.capsules[idx] = StringCapsule{value: field.String, data: field.Value}
 }
 
 func (i *StringIndexCategory) Search(field Field, buffer ResultBuffer) {
@@ -205,21 +265,60 @@ func (i *StringIndexCategory) Search(field Field, buffer ResultBuffer) {
 		defer i.capsulesMutex.RUnlock()
 	}
 
-	idx, ok := i.BinSearch(field.String)
+	exact, prefix := i.ExactWeight, i.PrefixWeight
+	if exact == 0 {
+		exact = DefaultExactWeight
+	}
+	if prefix == 0 {
+		prefix = DefaultPrefixWeight
+	}
 
-	if field.Type == FTExactString {
-		if ok {
-			buffer.Add(i.capsules[idx].data)
+	if field.Fold {
+		// sorting does not help when ignoring case
+		for _, c := range i.capsules {
+			switch {
+			case strings.EqualFold(c.value, field.String):
+				addScore(buffer, c.data, exact)
+			case field.Type == FTString && hasFoldPrefix(c.value, field.String):
+				addScore(buffer, c.data, prefix)
+			}
 		}
 		return
 	}
 
+	idx, _ := i.BinSearch(field.String)
+
+	for idx < len(i.capsules) && i.capsules[idx].value == field.String {
+		addScore(buffer, i.capsules[idx].data, exact)
+		idx++
+	}
+
+	if field.Type == FTExactString {
+		return
+	}
+
 	for idx < len(i.capsules) && strings.HasPrefix(i.capsules[idx].value, field.String) {
-		buffer.Add(i.capsules[idx].data)
+		addScore(buffer, i.capsules[idx].data, prefix)
 		idx++
 	}
 }
 
+// hasFoldPrefix is strings.HasPrefix ignoring case.
+func hasFoldPrefix(s, prefix string) bool {
+	for prefix != "" {
+		if s == "" {
+			return false
+		}
+		a, size := utf8.DecodeRuneInString(s)
+		b, prefixSize := utf8.DecodeRuneInString(prefix)
+		if unicode.ToLower(a) != unicode.ToLower(b) {
+			return false
+		}
+		s, prefix = s[size:], prefix[prefixSize:]
+	}
+	return true
+}
+
 func (i *StringIndexCategory) Remove(field Field) {
 	if field.Type != FTString {
 		return
@@ -241,6 +340,17 @@ func (i *StringIndexCategory) Remove(field Field) {
 	}
 }
 
+func (i *StringIndexCategory) Dump(visit func(Field)) {
+	if i.Synchronized {
+		i.capsulesMutex.RLock()
+		defer i.capsulesMutex.RUnlock()
+	}
+
+	for _, c := range i.capsules {
+		visit(Field{Type: FTString, String: c.value, Value: c.data})
+	}
+}
+
 func (i *StringIndexCategory) BinSearch(value string) (int, bool) {
 	if len(i.capsules) == 0 {
 		return 0, false
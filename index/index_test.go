@@ -107,3 +107,162 @@ type testBuffer map[int]int
 func (m testBuffer) Add(value interface{}) {
 	m[value.(int)]++
 }
+
+func TestIndexDuplicates(t *testing.T) {
+	index := New()
+	index.AddCategory("string", &StringIndexCategory{})
+	index.AddCategory("int", &IntIndexCategory{})
+
+	var parser Parser
+	for i, data := range []string{"string: b int: 2", "string: a int: 1", "string: b int: 2", "string: a int: 1"} {
+		fields, _, err := parser.Parse([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := range fields {
+			fields[j].Value = i
+		}
+		index.Insert(fields...)
+	}
+
+	fields, _, _ := parser.Parse([]byte("string: !a int: 2"))
+	result := testBuffer{}
+	index.Search(result, fields...)
+
+	expected := testBuffer{0: 1, 1: 1, 2: 1, 3: 1}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("\n%v\n%v", expected, result)
+	}
+}
+
+func TestIndexTypes(t *testing.T) {
+	index := New()
+	index.AddCategory("mmr", &FloatIndexCategory{})
+	index.AddCategory("private", &BoolIndexCategory{})
+	index.AddCategory("mods", &SetIndexCategory{})
+
+	var parser Parser
+	for i, data := range []string{
+		"mmr: 1000.5 private: true mods: [fast, fog]",
+		"mmr: 1500 private: false mods: [fast]",
+		"mmr: 2000.25 private: false mods: []",
+	} {
+		fields, _, err := parser.Parse([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := range fields {
+			fields[j].Value = i
+		}
+		index.Insert(fields...)
+	}
+
+	tests := []struct {
+		query  string
+		result testBuffer
+	}{
+		{"mmr: 1000.5", testBuffer{0: 1}},
+		{"mmr: 1500", testBuffer{1: 1}},
+		{"mmr: 1000.6-2000.25", testBuffer{1: 1}},
+		{"mmr: >1500", testBuffer{1: 1, 2: 1}},
+		{"mmr: <1500.5", testBuffer{0: 1, 1: 1}},
+		{"private: false", testBuffer{1: 1, 2: 1}},
+		{"mods: [fast]", testBuffer{0: 1, 1: 1}},
+		{"mods: [fog, fast]", testBuffer{0: 1}},
+		{"mods: []", testBuffer{0: 1, 1: 1, 2: 1}},
+		{"mods: f", testBuffer{0: 1, 1: 1}},
+		{"mods: !fo", testBuffer{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			fields, i, err := parser.Parse([]byte(test.query))
+			if err != nil {
+				t.Fatal(err, i)
+			}
+			result := testBuffer{}
+			index.Search(result, fields...)
+			if !reflect.DeepEqual(result, test.result) {
+				t.Errorf("\n%v\n%v", test.result, result)
+			}
+		})
+	}
+
+	fields, _, _ := parser.Parse([]byte("mmr: 1000.5 private: true mods: [fast, fog]"))
+	for j := range fields {
+		fields[j].Value = 0
+	}
+	index.Remove(fields...)
+
+	fields, _, _ = parser.Parse([]byte("mmr: <3000 private: true mods: [fog]"))
+	result := testBuffer{}
+	index.Search(result, fields...)
+	if !reflect.DeepEqual(result, testBuffer{1: 1, 2: 1}) {
+		t.Error(result)
+	}
+}
+
+func TestIndexScores(t *testing.T) {
+	index := New()
+	index.AddCategory("name", &StringIndexCategory{})
+	index.AddCategory("level", &IntIndexCategory{})
+	index.AddCategory("mmr", &FloatIndexCategory{Scale: 100})
+
+	var parser Parser
+	for i, data := range []string{
+		"name: lobby level: 10 mmr: 1000",
+		"name: lobbyist level: 20 mmr: 1500",
+		"name: lob level: 30 mmr: 1600",
+	} {
+		fields, _, err := parser.Parse([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := range fields {
+			fields[j].Value = i
+		}
+		index.Insert(fields...)
+	}
+
+	less := func(a, b interface{}) bool { return a.(int) < b.(int) }
+	top := func(query string, k int) []Scored {
+		fields, i, err := parser.Parse([]byte(query))
+		if err != nil {
+			t.Fatal(err, i)
+		}
+		scores := Scores{}
+		index.Search(scores, fields...)
+		return scores.Top(k, less)
+	}
+
+	tests := []struct {
+		query    string
+		k        int
+		expected []Scored
+	}{
+		{"name: lobby", 3, []Scored{{0, 1}, {1, 0.5}}},
+		{"name^3: lobby", 1, []Scored{{0, 3}}},
+		{"name: ?LOBBY", 3, []Scored{{0, 1}, {1, 0.5}}},
+		{"name: !?LOBBY", 3, []Scored{{0, 1}}},
+		{"level: 10-30", 3, []Scored{{1, 1}, {0, 0.5}}},
+		{"mmr: >1500.0", 3, []Scored{{1, 1}, {2, 0.5}}},
+		{"name: lob level: 0-60", 2, []Scored{{2, 2}, {1, 1.25}}},
+		{"level: >0", 3, []Scored{{0, 1 / 11.0}, {1, 1 / 21.0}, {2, 1 / 31.0}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			result := top(test.query, test.k)
+			if !reflect.DeepEqual(result, test.expected) {
+				t.Errorf("\n%v\n%v", test.expected, result)
+			}
+		})
+	}
+
+	scores := Scores{3: 1, 1: 1, 2: 1, 0: 2}
+	for i := 0; i < 10; i++ {
+		if result := scores.Top(3, less); !reflect.DeepEqual(result, []Scored{{0, 2}, {1, 1}, {2, 1}}) {
+			t.Fatal(result)
+		}
+	}
+}
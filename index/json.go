@@ -0,0 +1,473 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+var (
+	ErrExpectedNode       = errors.New("expected object or array")
+	ErrUnknownKey         = errors.New("unknown key")
+	ErrAmbiguousNode      = errors.New("node needs exactly one of name, and, or and not")
+	ErrExpectedValue      = errors.New("field needs exactly one of string, int, float, range, bool, set and point")
+	ErrExpectedJSONString = errors.New("expected string")
+	ErrExpectedJSONNumber = errors.New("expected number")
+	ErrExpectedJSONBool   = errors.New("expected true or false")
+	ErrExpectedJSONArray  = errors.New("expected array")
+	ErrExpectedInteger    = errors.New("expected 32 bit integer")
+	ErrExpectedRange      = errors.New("expected [min, max], null bound is unbounded")
+	ErrExpectedOccur      = errors.New("expected should, must or must_not")
+	ErrFuzzyModifiers     = errors.New("fuzzy cannot be combined with exact or fold")
+	ErrStringModifiers    = errors.New("exact, fold and fuzzy need string")
+	ErrPointModifiers     = errors.New("radius and nearest need point and cannot be combined")
+	ErrExpectedPoint      = errors.New("expected [latitude, longitude]")
+	ErrExpectedPositive   = errors.New("expected positive integer")
+	ErrNegativeNumber     = errors.New("expected non negative number")
+)
+
+// JSONError is error of ParseJSONQuery, Path points to the offending value, for
+// example $[1].and[0].range.
+type JSONError struct {
+	Path string
+	Err  error
+}
+
+func (j *JSONError) Error() string {
+	return fmt.Sprintf("%s: %s", j.Path, j.Err)
+}
+
+func (j *JSONError) Unwrap() error {
+	return j.Err
+}
+
+// IsJSONQuery reports whether query is JSON document rather then text query, text
+// query cannot start with '{' or '['.
+func IsJSONQuery(data []byte) bool {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	return len(data) != 0 && (data[0] == '{' || data[0] == '[')
+}
+
+// ParseJSONQuery parses JSON representation of Query. Array is OpGroup, its elements
+// can have "occur" set to "should" (default), "must" or "must_not". Object with "and"
+// or "or" array is OpAnd or OpOr, object with "not" is OpNot and object with "name"
+// is a field:
+//
+//	{"name": "mode", "string": "ranked", "exact": true, "fold": true}
+//	{"name": "name", "string": "lobby", "fuzzy": true}
+//	{"name": "level", "int": 10}
+//	{"name": "mmr", "float": 1500.5, "weight": 2}
+//	{"name": "mmr", "range": [1000, null]}
+//	{"name": "private", "bool": false}
+//	{"name": "mods", "set": ["fast", "no fog"]}
+//	{"name": "server", "point": [48.15, 17.11], "radius": 500}
+//	{"name": "server", "point": [48.15, 17.11], "nearest": 5}
+//
+// Range with integer bounds is FTRange, otherwise FTFloatRange. Array of fields is
+// the same query as flat list of fields parsed by Parser.Parse. Check is called for
+// every field if not nil. All errors are *JSONError except for malformed JSON.
+func ParseJSONQuery(data []byte, check func(field Field) error) (Query, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return Query{}, fmt.Errorf("invalid json: %s", err)
+	}
+	if decoder.More() {
+		return Query{}, errors.New("invalid json: data after the query")
+	}
+
+	j := jsonParser{check: check}
+	return j.node(document, "$", false)
+}
+
+type jsonParser struct {
+	check func(field Field) error
+}
+
+func (j *jsonParser) node(value interface{}, path string, grouped bool) (Query, error) {
+	switch value := value.(type) {
+	case []interface{}:
+		group := Query{Op: OpGroup}
+		for i, element := range value {
+			child, err := j.node(element, fmt.Sprintf("%s[%d]", path, i), true)
+			if err != nil {
+				return Query{}, err
+			}
+			group.Children = append(group.Children, child)
+		}
+		if len(group.Children) == 1 && group.Children[0].Occur == Should {
+			return group.Children[0], nil
+		}
+		return group, nil
+	case map[string]interface{}:
+		return j.object(value, path, grouped)
+	default:
+		return Query{}, &JSONError{path, ErrExpectedNode}
+	}
+}
+
+func (j *jsonParser) object(object map[string]interface{}, path string, grouped bool) (Query, error) {
+	var occur Occur
+	if value, ok := object["occur"]; ok && grouped {
+		str, ok := value.(string)
+		switch {
+		case !ok:
+			return Query{}, &JSONError{path + ".occur", ErrExpectedJSONString}
+		case str == "should":
+		case str == "must":
+			occur = Must
+		case str == "must_not":
+			occur = MustNot
+		default:
+			return Query{}, &JSONError{path + ".occur", ErrExpectedOccur}
+		}
+	}
+
+	var kinds []string
+	for _, key := range [...]string{"name", "and", "or", "not"} {
+		if _, ok := object[key]; ok {
+			kinds = append(kinds, key)
+		}
+	}
+	if len(kinds) != 1 {
+		return Query{}, &JSONError{path, ErrAmbiguousNode}
+	}
+
+	var query Query
+	var err error
+	var keys []string
+	switch kinds[0] {
+	case "name":
+		query, err = j.field(object, path)
+		keys = fieldKeys[:]
+	case "and", "or":
+		query.Op = OpAnd
+		if kinds[0] == "or" {
+			query.Op = OpOr
+		}
+		query.Children, err = j.operands(object[kinds[0]], path+"."+kinds[0])
+		keys = kinds
+	case "not":
+		var child Query
+		child, err = j.node(object["not"], path+".not", false)
+		query = Query{Op: OpNot, Children: []Query{child}}
+		keys = kinds
+	}
+	if err != nil {
+		return Query{}, err
+	}
+
+	if grouped {
+		keys = append(keys, "occur")
+	}
+	if err := unknownKey(object, path, keys); err != nil {
+		return Query{}, err
+	}
+
+	query.Occur = occur
+	return query, nil
+}
+
+func (j *jsonParser) operands(value interface{}, path string) ([]Query, error) {
+	array, ok := value.([]interface{})
+	if !ok {
+		return nil, &JSONError{path, ErrExpectedJSONArray}
+	}
+	if len(array) == 0 {
+		return nil, &JSONError{path, ErrExpectedOperand}
+	}
+
+	result := make([]Query, len(array))
+	for i, element := range array {
+		child, err := j.node(element, fmt.Sprintf("%s[%d]", path, i), false)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = child
+	}
+
+	return result, nil
+}
+
+var fieldKeys = [...]string{
+	"name", "weight",
+	"string", "exact", "fold", "fuzzy",
+	"int", "float", "range", "bool", "set",
+	"point", "radius", "nearest",
+}
+
+func (j *jsonParser) field(object map[string]interface{}, path string) (Query, error) {
+	var field Field
+	var ok bool
+	if field.Name, ok = object["name"].(string); !ok {
+		return Query{}, &JSONError{path + ".name", ErrExpectedJSONString}
+	}
+
+	if value, ok := object["weight"]; ok {
+		weight, err := jsonFloat(value)
+		if err == nil && weight < 0 {
+			err = ErrNegativeNumber
+		}
+		if err != nil {
+			return Query{}, &JSONError{path + ".weight", err}
+		}
+		field.Weight = weight
+	}
+
+	var kinds []string
+	for _, key := range [...]string{"string", "int", "float", "range", "bool", "set", "point"} {
+		if _, ok := object[key]; ok {
+			kinds = append(kinds, key)
+		}
+	}
+	if len(kinds) != 1 {
+		return Query{}, &JSONError{path, ErrExpectedValue}
+	}
+
+	kind := kinds[0]
+	valuePath := path + "." + kind
+	value := object[kind]
+
+	_, hasRadius := object["radius"]
+	_, hasNearest := object["nearest"]
+	if kind != "point" && (hasRadius || hasNearest) || hasRadius && hasNearest {
+		return Query{}, &JSONError{path, ErrPointModifiers}
+	}
+
+	switch kind {
+	case "string":
+		if err := j.string(object, path, &field); err != nil {
+			return Query{}, err
+		}
+	case "int":
+		integer, err := jsonInt(value)
+		if err != nil {
+			return Query{}, &JSONError{valuePath, err}
+		}
+		field.Type = FTInt
+		field.Int1 = integer
+	case "float":
+		float, err := jsonFloat(value)
+		if err != nil {
+			return Query{}, &JSONError{valuePath, err}
+		}
+		field.Type = FTFloat
+		field.Float1 = float
+	case "range":
+		if err := jsonRange(value, &field); err != nil {
+			return Query{}, &JSONError{valuePath, err}
+		}
+	case "bool":
+		if field.Bool, ok = value.(bool); !ok {
+			return Query{}, &JSONError{valuePath, ErrExpectedJSONBool}
+		}
+		field.Type = FTBool
+	case "set":
+		array, ok := value.([]interface{})
+		if !ok {
+			return Query{}, &JSONError{valuePath, ErrExpectedJSONArray}
+		}
+		field.Type = FTSet
+		for i, element := range array {
+			str, ok := element.(string)
+			if !ok {
+				return Query{}, &JSONError{fmt.Sprintf("%s[%d]", valuePath, i), ErrExpectedJSONString}
+			}
+			field.Strings = append(field.Strings, str)
+		}
+	case "point":
+		if err := jsonPoint(object, path, &field); err != nil {
+			return Query{}, err
+		}
+	}
+
+	if kind != "string" {
+		for _, key := range [...]string{"exact", "fold", "fuzzy"} {
+			if _, ok := object[key]; ok {
+				return Query{}, &JSONError{path + "." + key, ErrStringModifiers}
+			}
+		}
+	}
+
+	if j.check != nil {
+		if err := j.check(field); err != nil {
+			return Query{}, &JSONError{path, err}
+		}
+	}
+
+	return Query{Op: OpField, Field: field}, nil
+}
+
+func (j *jsonParser) string(object map[string]interface{}, path string, field *Field) error {
+	var ok bool
+	if field.String, ok = object["string"].(string); !ok {
+		return &JSONError{path + ".string", ErrExpectedJSONString}
+	}
+
+	var modifiers [3]bool
+	for i, key := range [...]string{"exact", "fold", "fuzzy"} {
+		if value, present := object[key]; present {
+			if modifiers[i], ok = value.(bool); !ok {
+				return &JSONError{path + "." + key, ErrExpectedJSONBool}
+			}
+		}
+	}
+	exact, fold, fuzzy := modifiers[0], modifiers[1], modifiers[2]
+
+	field.Type = FTString
+	field.Fold = fold
+	switch {
+	case fuzzy && (exact || fold):
+		return &JSONError{path + ".fuzzy", ErrFuzzyModifiers}
+	case fuzzy:
+		field.Type = FTFuzzyString
+	case exact:
+		field.Type = FTExactString
+	}
+
+	return nil
+}
+
+func jsonPoint(object map[string]interface{}, path string, field *Field) error {
+	array, ok := object["point"].([]interface{})
+	if !ok || len(array) != 2 {
+		return &JSONError{path + ".point", ErrExpectedPoint}
+	}
+
+	var coordinates [2]float64
+	for i, element := range array {
+		value, err := jsonFloat(element)
+		if err != nil {
+			return &JSONError{fmt.Sprintf("%s.point[%d]", path, i), err}
+		}
+		coordinates[i] = value
+	}
+
+	lat, lon := coordinates[0], coordinates[1]
+	if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return &JSONError{path + ".point", ErrInvalidCoordinates}
+	}
+
+	field.Type = FTPoint
+	field.Float1, field.Float2 = lat, lon
+
+	if value, ok := object["radius"]; ok {
+		radius, err := jsonFloat(value)
+		if err == nil && radius < 0 {
+			err = ErrNegativeNumber
+		}
+		if err != nil {
+			return &JSONError{path + ".radius", err}
+		}
+		field.Type = FTGeoRadius
+		field.Radius = radius
+	}
+
+	if value, ok := object["nearest"]; ok {
+		count, err := jsonInt(value)
+		if err == nil && count <= 0 {
+			err = ErrExpectedPositive
+		}
+		if err != nil {
+			return &JSONError{path + ".nearest", err}
+		}
+		field.Type = FTGeoNearest
+		field.Int1 = count
+	}
+
+	return nil
+}
+
+func jsonRange(value interface{}, field *Field) error {
+	array, ok := value.([]interface{})
+	if !ok || len(array) != 2 || array[0] == nil && array[1] == nil {
+		return ErrExpectedRange
+	}
+
+	isFloat := false
+	var bounds [2]float64
+	var ints [2]int32
+	for i, element := range array {
+		if element == nil {
+			bounds[i] = math.Inf(i*2 - 1)
+			continue
+		}
+
+		var err error
+		if bounds[i], err = jsonFloat(element); err != nil {
+			return ErrExpectedRange
+		}
+		if ints[i], err = jsonInt(element); err != nil {
+			isFloat = true
+		}
+	}
+
+	if isFloat {
+		field.Type = FTFloatRange
+		field.Float1, field.Float2 = bounds[0], bounds[1]
+		return nil
+	}
+
+	field.Type = FTRange
+	field.Int1, field.Int2 = ints[0], ints[1]
+	if array[0] == nil {
+		field.Int1 = math.MinInt32
+	}
+	if array[1] == nil {
+		field.Int2 = math.MaxInt32
+	}
+
+	return nil
+}
+
+func jsonFloat(value interface{}) (float64, error) {
+	number, ok := value.(json.Number)
+	if !ok {
+		return 0, ErrExpectedJSONNumber
+	}
+	float, err := number.Float64()
+	if err != nil {
+		return 0, ErrExpectedJSONNumber
+	}
+	return float, nil
+}
+
+func jsonInt(value interface{}) (int32, error) {
+	number, ok := value.(json.Number)
+	if !ok {
+		return 0, ErrExpectedJSONNumber
+	}
+	integer, err := strconv.ParseInt(number.String(), 10, 32)
+	if err != nil {
+		return 0, ErrExpectedInteger
+	}
+	return int32(integer), nil
+}
+
+// unknownKey returns error for the first key of object, in sorted order, that is not
+// in keys.
+func unknownKey(object map[string]interface{}, path string, keys []string) error {
+	var unknown []string
+outer:
+	for key := range object {
+		for _, k := range keys {
+			if k == key {
+				continue outer
+			}
+		}
+		unknown = append(unknown, key)
+	}
+
+	if len(unknown) == 0 {
+		return nil
+	}
+
+	sort.Strings(unknown)
+	return &JSONError{path + "." + unknown[0], ErrUnknownKey}
+}
@@ -0,0 +1,91 @@
+package index
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseJSONQuery(t *testing.T) {
+	tc := []struct {
+		name, json, text string
+	}{
+		{"field", `{"name": "mode", "string": "ranked"}`, `mode: ranked`},
+		{"fields", `[{"name": "mode", "string": "ranked", "exact": true}, {"name": "level", "int": 10}]`, `mode: !ranked level: 10`},
+		{"modifiers", `[{"name": "a", "string": "x", "fold": true}, {"name": "b", "string": "y", "fuzzy": true}]`, `a: ?x b: ~y`},
+		{"ranges", `[{"name": "a", "range": [1, 5]}, {"name": "b", "range": [null, 5]}, {"name": "c", "range": [1.5, null]}]`, `a: 1-5 b: <5 c: >1.5`},
+		{"types", `[{"name": "a", "float": 1.5, "weight": 2}, {"name": "b", "bool": true}, {"name": "c", "set": ["x", "y z"]}]`, `a^2: 1.5 b: true c: [x, "y z"]`},
+		{"geo", `[{"name": "a", "point": [48.15, 17.11]}, {"name": "b", "point": [0, 0], "radius": 500}, {"name": "c", "point": [1, -1], "nearest": 3}]`, `a: @48.15,17.11 b: @0,0<500 c: @1,-1#3`},
+		{
+			"boolean",
+			`[{"occur": "must", "name": "mode", "string": "ranked"}, {"occur": "must_not", "name": "region", "string": "eu"}, {"or": [{"name": "map", "string": "dust", "exact": true}, {"not": {"name": "private", "int": 1}}]}]`,
+			`+mode: ranked -region: eu (map: !dust OR NOT private: 1)`,
+		},
+		{"and", `{"and": [{"name": "a", "int": 1}, {"name": "b", "int": 2}]}`, `a: 1 AND b: 2`},
+		{"empty", `[]`, ``},
+	}
+
+	var parser Parser
+	for _, test := range tc {
+		t.Run(test.name, func(t *testing.T) {
+			if !IsJSONQuery([]byte(test.json)) {
+				t.Fatal("not recognized as json")
+			}
+			expected, i, err := parser.ParseQuery([]byte(test.text))
+			if err != nil {
+				t.Fatal(err, i)
+			}
+			result, err := ParseJSONQuery([]byte(test.json), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(result, expected) {
+				t.Errorf("\n%+v\n%+v", expected, result)
+			}
+		})
+	}
+
+	errorCases := []struct {
+		name, json, path string
+		err              error
+	}{
+		{"node", `[1]`, "$[0]", ErrExpectedNode},
+		{"ambiguous", `{"name": "a", "not": {}}`, "$", ErrAmbiguousNode},
+		{"value", `{"name": "a"}`, "$", ErrExpectedValue},
+		{"unknown", `{"name": "a", "int": 1, "intt": 2}`, "$.intt", ErrUnknownKey},
+		{"occur", `{"occur": "must", "name": "a", "int": 1}`, "$.occur", ErrUnknownKey},
+		{"bad occur", `[{"occur": "maybe", "name": "a", "int": 1}]`, "$[0].occur", ErrExpectedOccur},
+		{"integer", `{"and": [{"name": "a", "int": 1}, {"name": "b", "int": 1.5}]}`, "$.and[1].int", ErrExpectedInteger},
+		{"range", `[{"name": "a", "range": [null, null]}]`, "$[0].range", ErrExpectedRange},
+		{"set", `{"not": {"name": "a", "set": ["x", 1]}}`, "$.not.set[1]", ErrExpectedJSONString},
+		{"point", `{"name": "a", "point": [91, 0]}`, "$.point", ErrInvalidCoordinates},
+		{"nearest", `{"name": "a", "point": [0, 0], "nearest": 0}`, "$.nearest", ErrExpectedPositive},
+		{"fuzzy", `{"name": "a", "string": "x", "fuzzy": true, "exact": true}`, "$.fuzzy", ErrFuzzyModifiers},
+		{"modifier", `{"name": "a", "int": 1, "fold": true}`, "$.fold", ErrStringModifiers},
+		{"operands", `{"or": []}`, "$.or", ErrExpectedOperand},
+	}
+
+	for _, test := range errorCases {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseJSONQuery([]byte(test.json), nil)
+			var jsonErr *JSONError
+			if !errors.As(err, &jsonErr) || jsonErr.Path != test.path || jsonErr.Err != test.err {
+				t.Errorf("expected %s: %v, got %v", test.path, test.err, err)
+			}
+		})
+	}
+
+	if _, err := ParseJSONQuery([]byte(`{"name": "a", "int": 1} {}`), nil); err == nil {
+		t.Error("expected error")
+	}
+
+	index := New()
+	index.Declare("a", KindInt, false)
+	_, err := ParseJSONQuery([]byte(`[{"name": "a", "int": 1}, {"name": "a", "string": "x"}]`), func(field Field) error {
+		return index.Check(true, field)
+	})
+	var fieldErr *FieldError
+	if !errors.As(err, &fieldErr) || fieldErr.Err != ErrFieldType || err.(*JSONError).Path != "$[1]" {
+		t.Error(err)
+	}
+}
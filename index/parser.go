@@ -3,6 +3,7 @@ package index
 import (
 	"errors"
 	"math"
+	"strconv"
 	"unicode/utf8"
 )
 
@@ -14,6 +15,14 @@ var (
 	ErrExpectedMinusOrSpace = errors.New("expected '-' or ' '")
 	ErrExpectedDirection    = errors.New("expected '<' or '>'")
 	ErrExpectedString       = errors.New("expected string")
+	ErrExpectedFraction     = errors.New("expected digits after '.'")
+	ErrExpectedComma        = errors.New("expected ',' or ']'")
+	ErrExpectedWeight       = errors.New("expected weight after '^'")
+	ErrExpectedCoordinate   = errors.New("expected ',' between latitude and longitude")
+	ErrInvalidCoordinates   = errors.New("latitude has to be in [-90, 90] and longitude in [-180, 180]")
+	ErrExpectedRadius       = errors.New("expected non negative radius after '<'")
+	ErrExpectedCount        = errors.New("expected positive count after '#'")
+	ErrExpectedPointEnd     = errors.New("expected '<', '#' or ' ' after point")
 )
 
 type FieldType int
@@ -23,133 +32,310 @@ const (
 	FTExactString
 	FTInt
 	FTRange
+	// FTFloat is number with fraction, mmr: 1500.5
+	FTFloat
+	// FTFloatRange is range with at least one float bound, mmr: 1000.5-2000, bounds
+	// are in Float1 and Float2.
+	FTFloatRange
+	// FTBool is written as true or false without quotes, see Parser.Kind.
+	FTBool
+	// FTSet is list of strings in brackets, mods: [fast, "no fog"]. As query it
+	// matches sets containing all listed strings.
+	FTSet
+	// FTFuzzyString matches strings at most one edit away ignoring case, name: ~lobby
+	FTFuzzyString
+	// FTPoint is latitude and longitude in degrees stored in Float1 and Float2,
+	// server: @48.15,17.11
+	FTPoint
+	// FTGeoRadius matches points at most Radius kilometers away from the point,
+	// server: @48.15,17.11<500
+	FTGeoRadius
+	// FTGeoNearest matches Int1 points nearest to the point, server: @48.15,17.11#5
+	FTGeoNearest
 )
 
 type Field struct {
-	Name       string
-	Type       FieldType
-	String     string
-	Int1, Int2 int32
-	Value      interface{}
+	Name           string
+	Type           FieldType
+	String         string
+	Int1, Int2     int32
+	Float1, Float2 float64
+	Bool           bool
+	Strings        []string
+	// Radius is in kilometers, see FTGeoRadius.
+	Radius float64
+	// Fold makes string search case insensitive, it is written as '?' before the
+	// value, name: ?Lobby or name: !?Lobby
+	Fold bool
+	// Weight multiplies relevance of documents found by field, 0 means 1. It is
+	// written after name, "mode^2: ranked".
+	Weight float64
+	Value  interface{}
 }
 
 type Parser struct {
+	// Kind reports declared kind of field, usually Index.Kind. If set, bare true and
+	// false are FTBool only for fields of KindBool and FTString for others, so
+	// "name: true" stays a string. Without it they are always FTBool.
+	Kind func(name string) (Kind, bool)
+
 	data               []byte
 	current            rune
 	progress, previous int
 	result             []Field
+	// depth is amount of open parenthesis in ParseQuery
+	depth int
 }
 
 func (p *Parser) Parse(data []byte) ([]Field, int, error) {
 	p.data = data
 	p.progress = 0
 	p.previous = 0
+	p.depth = 0
 	p.result = p.result[:0]
 
 	for p.Advance() {
-		if !IsIdentStart(p.current) {
-			return nil, p.progress, ErrExpectedIdentifier
+		field, err := p.Field()
+		if err != nil {
+			return nil, p.progress, err
 		}
+		p.result = append(p.result, field)
+	}
+
+	return p.result, p.progress, nil
+}
+
+// Field parses one "name: value" field starting at current rune.
+func (p *Parser) Field() (Field, error) {
+	if !IsIdentStart(p.current) {
+		return Field{}, ErrExpectedIdentifier
+	}
 
-		name := p.Ident()
+	name := p.Ident()
 
-		if p.current != ':' {
-			return nil, p.progress, ErrExpectedColon
+	var weight float64
+	if p.current == '^' {
+		p.Advance()
+		start := p.previous
+		integer, ok := p.Number()
+		if !ok || integer < 0 {
+			return Field{}, ErrExpectedWeight
 		}
+		weight = float64(integer)
+		if p.current == '.' {
+			if weight, ok = p.Fraction(start); !ok {
+				return Field{}, ErrExpectedFraction
+			}
+		}
+	}
+
+	field, err := p.value(name)
+	field.Weight = weight
+	return field, err
+}
+
+// bool reports whether bare true and false are FTBool for the field.
+func (p *Parser) bool(name string) bool {
+	if p.Kind == nil {
+		return true
+	}
+	kind, ok := p.Kind(name)
+	return ok && kind == KindBool
+}
+
+func (p *Parser) value(name string) (Field, error) {
+	if p.current != ':' {
+		return Field{}, ErrExpectedColon
+	}
+	p.Advance()
+
+	if p.current != ' ' {
+		return Field{}, ErrExpectedSpace
+	}
+	p.Advance()
+
+	stringType := FTString
+	if p.current == '!' {
+		stringType = FTExactString
 		p.Advance()
+	}
 
-		if p.current != ' ' {
-			return nil, p.progress, ErrExpectedSpace
-		}
+	var fold bool
+	if p.current == '?' {
+		fold = true
 		p.Advance()
+	}
 
-		stringType := FTString
-		if p.current == '!' {
-			stringType = FTExactString
-			p.Advance()
-		}
+	if p.current == '~' && stringType == FTString && !fold {
+		stringType = FTFuzzyString
+		p.Advance()
+	}
 
-		switch p.current {
-		case '"': // string
-			p.result = append(p.result, Field{
+	// value can only be a string
+	marked := stringType != FTString || fold
+
+	switch p.current {
+	case '"': // string
+		return Field{
+			Name:   name,
+			Type:   stringType,
+			String: p.String(),
+			Fold:   fold,
+		}, nil
+	case '[': // set
+		if marked {
+			return Field{}, ErrExpectedString
+		}
+		strings, err := p.Set()
+		if err != nil {
+			return Field{}, err
+		}
+		return Field{
+			Name:    name,
+			Type:    FTSet,
+			Strings: strings,
+		}, nil
+	case '@': // point
+		if marked {
+			return Field{}, ErrExpectedString
+		}
+		field, err := p.Point()
+		field.Name = name
+		return field, err
+	default: // int / float / range / bool / identifier (string)
+
+		if IsIdentStart(p.current) {
+			ident := p.Ident()
+			if !marked && (ident == "true" || ident == "false") && p.bool(name) {
+				return Field{
+					Name: name,
+					Type: FTBool,
+					Bool: ident == "true",
+				}, nil
+			}
+			return Field{
 				Name:   name,
 				Type:   stringType,
-				String: p.String(),
-			})
-		default: // int / range / identifier (string)
-
-			if IsIdentStart(p.current) {
-				p.result = append(p.result, Field{
-					Name:   name,
-					Type:   stringType,
-					String: p.Ident(),
-				})
-				continue
-			}
+				String: ident,
+				Fold:   fold,
+			}, nil
+		}
 
-			if stringType == FTExactString {
-				return nil, p.progress, ErrExpectedString
-			}
+		if marked {
+			return Field{}, ErrExpectedString
+		}
 
-			if min, ok := p.Number(); ok {
-				switch p.current {
-				case '-':
-					p.Advance()
-					if max, ok := p.Number(); ok {
-						p.result = append(p.result, Field{
-							Name: name,
-							Type: FTRange,
-							Int1: min,
-							Int2: max,
-						})
-					} else {
-						return nil, p.progress, ErrExpectedNumber
-					}
-				case ' ', utf8.RuneError:
-					p.result = append(p.result, Field{
-						Name: name,
-						Type: FTInt,
-						Int1: min,
-					})
-				default:
-					return nil, p.progress, ErrExpectedMinusOrSpace
+		start := p.previous
+		if min, ok := p.Number(); ok {
+			minFloat, isFloat := float64(min), false
+			if p.current == '.' {
+				if minFloat, ok = p.Fraction(start); !ok {
+					return Field{}, ErrExpectedFraction
 				}
-				continue
+				isFloat = true
 			}
 
-			var left bool
 			switch p.current {
-			case '>':
-			case '<':
-				left = true
-			default:
-				return nil, p.progress, ErrExpectedDirection
-			}
-			p.Advance()
-
-			if num, ok := p.Number(); ok {
-				field := Field{
+			case '-':
+				p.Advance()
+				start = p.previous
+				max, ok := p.Number()
+				if !ok {
+					return Field{}, ErrExpectedNumber
+				}
+				maxFloat := float64(max)
+				if p.current == '.' {
+					if maxFloat, ok = p.Fraction(start); !ok {
+						return Field{}, ErrExpectedFraction
+					}
+					isFloat = true
+				}
+				if isFloat {
+					return Field{
+						Name:   name,
+						Type:   FTFloatRange,
+						Float1: minFloat,
+						Float2: maxFloat,
+					}, nil
+				}
+				return Field{
 					Name: name,
 					Type: FTRange,
+					Int1: min,
+					Int2: max,
+				}, nil
+			case ')':
+				if p.depth == 0 {
+					break
 				}
-
-				if left {
-					field.Int1 = math.MinInt32
-					field.Int2 = num
-				} else {
-					field.Int1 = num
-					field.Int2 = math.MaxInt32
+				fallthrough
+			case ' ', utf8.RuneError:
+				if isFloat {
+					return Field{
+						Name:   name,
+						Type:   FTFloat,
+						Float1: minFloat,
+					}, nil
 				}
+				return Field{
+					Name: name,
+					Type: FTInt,
+					Int1: min,
+				}, nil
+			}
+			return Field{}, ErrExpectedMinusOrSpace
+		}
+
+		var left bool
+		switch p.current {
+		case '>':
+		case '<':
+			left = true
+		default:
+			return Field{}, ErrExpectedDirection
+		}
+		p.Advance()
+
+		start = p.previous
+		num, ok := p.Number()
+		if !ok {
+			return Field{}, ErrExpectedNumber
+		}
 
-				p.result = append(p.result, field)
+		if p.current == '.' {
+			value, ok := p.Fraction(start)
+			if !ok {
+				return Field{}, ErrExpectedFraction
+			}
+			field := Field{
+				Name: name,
+				Type: FTFloatRange,
+			}
+			if left {
+				field.Float1 = math.Inf(-1)
+				field.Float2 = value
 			} else {
-				return nil, p.progress, ErrExpectedNumber
+				field.Float1 = value
+				field.Float2 = math.Inf(1)
 			}
+			return field, nil
 		}
 
-	}
+		field := Field{
+			Name: name,
+			Type: FTRange,
+		}
 
-	return p.result, p.progress, nil
+		if left {
+			field.Int1 = math.MinInt32
+			field.Int2 = num
+		} else {
+			field.Int1 = num
+			field.Int2 = math.MaxInt32
+		}
+
+		return field, nil
+	}
 }
 
 func (p *Parser) Number() (int32, bool) {
@@ -175,6 +361,127 @@ func (p *Parser) Number() (int32, bool) {
 	return result, hasNumber
 }
 
+// Fraction parses digits after '.' of number that started at start and returns the
+// whole number.
+func (p *Parser) Fraction(start int) (float64, bool) {
+	p.Advance()
+
+	var hasDigits bool
+	for IsNumber(p.current) {
+		hasDigits = true
+		p.Advance()
+	}
+	if !hasDigits {
+		return 0, false
+	}
+
+	value, err := strconv.ParseFloat(string(p.data[start:p.previous]), 64)
+	return value, err == nil
+}
+
+// Point parses "@lat,lon" optionally followed by "<radius" or "#count".
+func (p *Parser) Point() (Field, error) {
+	p.Advance()
+
+	lat, err := p.coordinate()
+	if err != nil {
+		return Field{}, err
+	}
+
+	if p.current != ',' {
+		return Field{}, ErrExpectedCoordinate
+	}
+	p.Advance()
+
+	lon, err := p.coordinate()
+	if err != nil {
+		return Field{}, err
+	}
+
+	if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return Field{}, ErrInvalidCoordinates
+	}
+
+	field := Field{Type: FTPoint, Float1: lat, Float2: lon}
+
+	switch p.current {
+	case '<':
+		p.Advance()
+		radius, err := p.coordinate()
+		if err != nil || radius < 0 {
+			return Field{}, ErrExpectedRadius
+		}
+		field.Type = FTGeoRadius
+		field.Radius = radius
+	case '#':
+		p.Advance()
+		count, ok := p.Number()
+		if !ok || count <= 0 {
+			return Field{}, ErrExpectedCount
+		}
+		field.Type = FTGeoNearest
+		field.Int1 = count
+	case ')':
+		if p.depth == 0 {
+			return Field{}, ErrExpectedPointEnd
+		}
+	case ' ', utf8.RuneError:
+	default:
+		return Field{}, ErrExpectedPointEnd
+	}
+
+	return field, nil
+}
+
+// coordinate parses integer or number with fraction.
+func (p *Parser) coordinate() (float64, error) {
+	start := p.previous
+	value, ok := p.Number()
+	if !ok {
+		return 0, ErrExpectedNumber
+	}
+
+	if p.current != '.' {
+		return float64(value), nil
+	}
+
+	result, ok := p.Fraction(start)
+	if !ok {
+		return 0, ErrExpectedFraction
+	}
+
+	return result, nil
+}
+
+// Set parses comma separated identifiers or strings enclosed in brackets.
+func (p *Parser) Set() ([]string, error) {
+	var result []string
+	p.Advance()
+	for {
+		p.skipSpaces()
+		switch {
+		case p.current == ']' && len(result) == 0:
+		case p.current == '"':
+			result = append(result, p.String())
+		case IsIdentStart(p.current):
+			result = append(result, p.Ident())
+		default:
+			return nil, ErrExpectedString
+		}
+
+		p.skipSpaces()
+		switch p.current {
+		case ',':
+			p.Advance()
+		case ']':
+			p.Advance()
+			return result, nil
+		default:
+			return nil, ErrExpectedComma
+		}
+	}
+}
+
 func (p *Parser) String() string {
 	start := p.progress
 	var escaped bool
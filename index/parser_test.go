@@ -64,6 +64,158 @@ func TestParser(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "types",
+			code: `mmr: 1500.5 mmr: -0.5-2 mmr: <2.25 private: true open: false exact: !true mods: [fast, "no fog"] empty: []`,
+			result: []Field{
+				{
+					Name:   "mmr",
+					Type:   FTFloat,
+					Float1: 1500.5,
+				},
+				{
+					Name:   "mmr",
+					Type:   FTFloatRange,
+					Float1: -0.5,
+					Float2: 2,
+				},
+				{
+					Name:   "mmr",
+					Type:   FTFloatRange,
+					Float1: math.Inf(-1),
+					Float2: 2.25,
+				},
+				{
+					Name: "private",
+					Type: FTBool,
+					Bool: true,
+				},
+				{
+					Name: "open",
+					Type: FTBool,
+				},
+				{
+					Name:   "exact",
+					Type:   FTExactString,
+					String: "true",
+				},
+				{
+					Name:    "mods",
+					Type:    FTSet,
+					Strings: []string{"fast", "no fog"},
+				},
+				{
+					Name: "empty",
+					Type: FTSet,
+				},
+			},
+		},
+		{
+			name: "weights",
+			code: `mode^2: ranked mmr^0.5: 10`,
+			result: []Field{
+				{
+					Name:   "mode",
+					Type:   FTString,
+					String: "ranked",
+					Weight: 2,
+				},
+				{
+					Name:   "mmr",
+					Type:   FTInt,
+					Int1:   10,
+					Weight: 0.5,
+				},
+			},
+		},
+		{
+			name: "weight",
+			code: `mode^: ranked`,
+			err:  ErrExpectedWeight,
+		},
+		{
+			name: "fraction",
+			code: `mmr: 1.`,
+			err:  ErrExpectedFraction,
+		},
+		{
+			name: "set",
+			code: `mods: [a b]`,
+			err:  ErrExpectedComma,
+		},
+		{
+			name: "fold",
+			code: `name: ~lobby name: ?Lobby name: !?"Big Lobby" name: ?true`,
+			result: []Field{
+				{
+					Name:   "name",
+					Type:   FTFuzzyString,
+					String: "lobby",
+				},
+				{
+					Name:   "name",
+					Type:   FTString,
+					String: "Lobby",
+					Fold:   true,
+				},
+				{
+					Name:   "name",
+					Type:   FTExactString,
+					String: "Big Lobby",
+					Fold:   true,
+				},
+				{
+					Name:   "name",
+					Type:   FTString,
+					String: "true",
+					Fold:   true,
+				},
+			},
+		},
+		{
+			name: "geo",
+			code: `server: @48.15,17.11 near: @-16.5,-180<500.5 top: @0,0#3`,
+			result: []Field{
+				{
+					Name:   "server",
+					Type:   FTPoint,
+					Float1: 48.15,
+					Float2: 17.11,
+				},
+				{
+					Name:   "near",
+					Type:   FTGeoRadius,
+					Float1: -16.5,
+					Float2: -180,
+					Radius: 500.5,
+				},
+				{
+					Name: "top",
+					Type: FTGeoNearest,
+					Int1: 3,
+				},
+			},
+		},
+		{
+			name: "latitude",
+			code: `server: @91,0`,
+			err:  ErrInvalidCoordinates,
+		},
+		{
+			name: "coordinate",
+			code: `server: @48 17`,
+			err:  ErrExpectedCoordinate,
+		},
+		{
+			name: "count",
+			code: `server: @48,17#0`,
+			err:  ErrExpectedCount,
+		},
+		{
+			name: "fuzzy",
+			code: `level: ~10`,
+			err:  ErrExpectedString,
+		},
 	}
 
 	var parser Parser
@@ -84,3 +236,25 @@ func TestParser(t *testing.T) {
 	}
 
 }
+
+func TestParserKind(t *testing.T) {
+	index := New()
+	index.Declare("private", KindBool, false)
+	index.Declare("name", KindString, false)
+
+	parser := Parser{Kind: index.Kind}
+	result, _, err := parser.Parse([]byte("private: true name: true"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result[0].Type != FTBool || !result[0].Bool {
+		t.Errorf("declared bool should be FTBool, got %v", result[0])
+	}
+	if result[1].Type != FTString || result[1].String != "true" {
+		t.Errorf("string field should stay string, got %v", result[1])
+	}
+	if err := index.Check(false, result...); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,358 @@
+package index
+
+import (
+	"errors"
+	"unicode/utf8"
+)
+
+var (
+	ErrExpectedClosingParen = errors.New("expected ')'")
+	ErrUnexpectedParen      = errors.New("unexpected ')'")
+	ErrExpectedOperand      = errors.New("expected field, '(' or NOT")
+)
+
+// Operator is kind of Query node.
+type Operator uint8
+
+const (
+	// OpField matches documents matching the field.
+	OpField Operator = iota
+	// OpAnd matches documents matching all children.
+	OpAnd
+	// OpOr matches documents matching any child.
+	OpOr
+	// OpNot matches documents not matching the only child.
+	OpNot
+	// OpGroup combines children by their Occur. Documents have to match all Must
+	// children and no MustNot children. Should children are required only if there
+	// are no Must children, then at least one of them has to match. Group without
+	// children matches everything.
+	OpGroup
+)
+
+// Occur is how query takes part in parent OpGroup.
+type Occur uint8
+
+const (
+	Should Occur = iota
+	// Must is written as '+' before the clause.
+	Must
+	// MustNot is written as '-' before the clause.
+	MustNot
+)
+
+// Query is boolean expression over fields, see Parser.ParseQuery.
+type Query struct {
+	Op       Operator
+	Occur    Occur
+	Field    Field
+	Children []Query
+}
+
+// Fields appends all fields query does not negate to dst, they are the fields
+// relevance can be counted from.
+func (q Query) Fields(dst []Field) []Field {
+	switch {
+	case q.Occur == MustNot || q.Op == OpNot:
+	case q.Op == OpField:
+		dst = append(dst, q.Field)
+	default:
+		for _, child := range q.Children {
+			dst = child.Fields(dst)
+		}
+	}
+	return dst
+}
+
+// ParseQuery parses boolean query. Clauses separated by spaces form a group, clause
+// can be prefixed with '+' (required) or '-' (prohibited), other clauses are
+// optional. Clause is made of fields combined with NOT, AND and OR, in order of
+// precedence, and parenthesized groups. Marker applies to whole clause so
+// "+a: 1 OR b: 2" requires one of the fields. Flat list of fields parsed by Parse
+// is a valid query matching documents that match any field. Optional clauses filter
+// only groups without required clauses, otherwise they just add to relevance.
+//
+//	+mode: ranked -region: eu +(map: !dust OR map: !mirage) +NOT private: 1
+func (p *Parser) ParseQuery(data []byte) (Query, int, error) {
+	p.data = data
+	p.progress = 0
+	p.previous = 0
+	p.depth = 0
+	p.Advance()
+
+	query, err := p.group()
+	if err != nil {
+		return Query{}, p.progress, err
+	}
+
+	return query, p.progress, nil
+}
+
+func (p *Parser) group() (Query, error) {
+	group := Query{Op: OpGroup}
+	for {
+		p.skipSpaces()
+
+		if p.current == utf8.RuneError {
+			if p.depth > 0 {
+				return Query{}, ErrExpectedClosingParen
+			}
+			break
+		}
+
+		if p.current == ')' {
+			if p.depth == 0 {
+				return Query{}, ErrUnexpectedParen
+			}
+			p.Advance()
+			break
+		}
+
+		occur := Should
+		switch p.current {
+		case '+':
+			occur = Must
+			p.Advance()
+		case '-':
+			occur = MustNot
+			p.Advance()
+		}
+
+		clause, err := p.or()
+		if err != nil {
+			return Query{}, err
+		}
+		clause.Occur = occur
+		group.Children = append(group.Children, clause)
+	}
+
+	if len(group.Children) == 1 && group.Children[0].Occur == Should {
+		return group.Children[0], nil
+	}
+
+	return group, nil
+}
+
+func (p *Parser) or() (Query, error) {
+	return p.binary(OpOr, "OR", p.and)
+}
+
+func (p *Parser) and() (Query, error) {
+	return p.binary(OpAnd, "AND", p.unary)
+}
+
+func (p *Parser) binary(op Operator, keyword string, operand func() (Query, error)) (Query, error) {
+	first, err := operand()
+	if err != nil {
+		return Query{}, err
+	}
+
+	if !p.keyword(keyword) {
+		return first, nil
+	}
+
+	query := Query{Op: op, Children: []Query{first}}
+	for {
+		next, err := operand()
+		if err != nil {
+			return Query{}, err
+		}
+		query.Children = append(query.Children, next)
+
+		if !p.keyword(keyword) {
+			return query, nil
+		}
+	}
+}
+
+func (p *Parser) unary() (Query, error) {
+	if p.keyword("NOT") {
+		child, err := p.unary()
+		if err != nil {
+			return Query{}, err
+		}
+		return Query{Op: OpNot, Children: []Query{child}}, nil
+	}
+
+	p.skipSpaces()
+
+	if p.current == '(' {
+		p.Advance()
+		p.depth++
+		group, err := p.group()
+		p.depth--
+		return group, err
+	}
+
+	if !IsIdentStart(p.current) {
+		return Query{}, ErrExpectedOperand
+	}
+
+	field, err := p.Field()
+	if err != nil {
+		return Query{}, err
+	}
+
+	return Query{Op: OpField, Field: field}, nil
+}
+
+// keyword consumes keyword if it is next, keyword followed by ':' is a field name.
+func (p *Parser) keyword(word string) bool {
+	p.skipSpaces()
+
+	end := p.previous + len(word)
+	if end > len(p.data) || string(p.data[p.previous:end]) != word {
+		return false
+	}
+
+	if end < len(p.data) {
+		next, _ := utf8.DecodeRune(p.data[end:])
+		if IsIdent(next) || next == ':' {
+			return false
+		}
+	}
+
+	p.progress = end
+	p.Advance()
+
+	return true
+}
+
+func (p *Parser) skipSpaces() {
+	for p.current == ' ' {
+		p.Advance()
+	}
+}
+
+// Query adds every document satisfying query to buffer exactly once. Negations are
+// evaluated against Documents, use QueryIn if documents without fields exist.
+func (i *Index) Query(buffer ResultBuffer, query Query) {
+	i.QueryIn(buffer, query, i.Documents)
+}
+
+// QueryIn is like Query but negations are evaluated against documents returned by
+// universe. Universe is called at most once and only if query needs it.
+func (i *Index) QueryIn(buffer ResultBuffer, query Query, universe func() map[interface{}]struct{}) {
+	i.categoriesMutex.RLock()
+	e := evaluation{index: i, documents: universe}
+	result := e.evaluate(query)
+	i.categoriesMutex.RUnlock()
+
+	for document := range result {
+		buffer.Add(document)
+	}
+}
+
+type set map[interface{}]struct{}
+
+func (s set) Add(value interface{}) {
+	s[value] = struct{}{}
+}
+
+type evaluation struct {
+	index     *Index
+	documents func() map[interface{}]struct{}
+	universe  set
+}
+
+func (e *evaluation) all() set {
+	if e.universe == nil {
+		e.universe = e.documents()
+		if e.universe == nil {
+			e.universe = set{}
+		}
+	}
+	return e.universe
+}
+
+func (e *evaluation) evaluate(query Query) set {
+	switch query.Op {
+	case OpField:
+		result := set{}
+		if category, ok := e.index.categories[query.Field.Name]; ok {
+			category.Search(query.Field, result)
+		}
+		return result
+	case OpAnd:
+		result := e.evaluate(query.Children[0])
+		for _, child := range query.Children[1:] {
+			result = intersect(result, e.evaluate(child))
+		}
+		return result
+	case OpOr:
+		result := set{}
+		for _, child := range query.Children {
+			union(result, e.evaluate(child))
+		}
+		return result
+	case OpNot:
+		return subtract(e.all(), e.evaluate(query.Children[0]))
+	case OpGroup:
+		var result set
+		var should []Query
+		for _, child := range query.Children {
+			switch child.Occur {
+			case Must:
+				if result == nil {
+					result = e.evaluate(child)
+				} else {
+					result = intersect(result, e.evaluate(child))
+				}
+			case Should:
+				should = append(should, child)
+			}
+		}
+
+		if result == nil {
+			if len(should) == 0 {
+				result = subtract(e.all(), nil)
+			} else {
+				result = set{}
+				for _, child := range should {
+					union(result, e.evaluate(child))
+				}
+			}
+		}
+
+		for _, child := range query.Children {
+			if child.Occur == MustNot {
+				for document := range e.evaluate(child) {
+					delete(result, document)
+				}
+			}
+		}
+
+		return result
+	default:
+		panic("unknown operator")
+	}
+}
+
+func intersect(a, b set) set {
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	for document := range a {
+		if _, ok := b[document]; !ok {
+			delete(a, document)
+		}
+	}
+	return a
+}
+
+func union(dst, src set) {
+	for document := range src {
+		dst[document] = struct{}{}
+	}
+}
+
+// subtract returns new set, a is not modified.
+func subtract(a, b set) set {
+	result := make(set, len(a))
+	for document := range a {
+		if _, ok := b[document]; !ok {
+			result[document] = struct{}{}
+		}
+	}
+	return result
+}
@@ -0,0 +1,149 @@
+package index
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	field := func(name string, value int32) Query {
+		return Query{Op: OpField, Field: Field{Name: name, Type: FTInt, Int1: value}}
+	}
+	occur := func(q Query, o Occur) Query {
+		q.Occur = o
+		return q
+	}
+
+	tests := []struct {
+		name, code string
+		result     Query
+		err        error
+	}{
+		{
+			"single",
+			"a: 1",
+			field("a", 1),
+			nil,
+		},
+		{
+			"flat",
+			"a: 1 b: 2",
+			Query{Op: OpGroup, Children: []Query{field("a", 1), field("b", 2)}},
+			nil,
+		},
+		{
+			"markers",
+			"+a: 1 -b: 2 c: 3",
+			Query{Op: OpGroup, Children: []Query{occur(field("a", 1), Must), occur(field("b", 2), MustNot), field("c", 3)}},
+			nil,
+		},
+		{
+			"precedence",
+			"a: 1 OR b: 2 AND NOT c: 3",
+			Query{Op: OpOr, Children: []Query{
+				field("a", 1),
+				{Op: OpAnd, Children: []Query{
+					field("b", 2),
+					{Op: OpNot, Children: []Query{field("c", 3)}},
+				}},
+			}},
+			nil,
+		},
+		{
+			"parenthesis",
+			"(a: 1 OR b: 2) AND c: 3",
+			Query{Op: OpAnd, Children: []Query{
+				{Op: OpOr, Children: []Query{field("a", 1), field("b", 2)}},
+				field("c", 3),
+			}},
+			nil,
+		},
+		{
+			"keyword field",
+			"OR: 1 OR AND: 2",
+			Query{Op: OpOr, Children: []Query{field("OR", 1), field("AND", 2)}},
+			nil,
+		},
+		{"unclosed", "(a: 1", Query{}, ErrExpectedClosingParen},
+		{"unopened", "a: b)", Query{}, ErrUnexpectedParen},
+		{"missing operand", "a: 1 AND", Query{}, ErrExpectedOperand},
+	}
+
+	var parser Parser
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, i, err := parser.ParseQuery([]byte(test.code))
+			if err != test.err {
+				t.Fatalf("expected error %v, got %v at %d", test.err, err, i)
+			}
+			if !reflect.DeepEqual(result, test.result) {
+				t.Errorf("\n%v\n%v", test.result, result)
+			}
+		})
+	}
+}
+
+func TestIndexQuery(t *testing.T) {
+	index := New()
+	index.AddCategory("mode", &StringIndexCategory{})
+	index.AddCategory("region", &StringIndexCategory{})
+	index.AddCategory("level", &IntIndexCategory{})
+
+	var parser Parser
+	for i, data := range []string{
+		"mode: ranked region: eu level: 10",
+		"mode: ranked region: us level: 20",
+		"mode: casual region: eu level: 30",
+		"mode: casual region: us level: 40",
+	} {
+		fields, _, err := parser.Parse([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := range fields {
+			fields[j].Value = i
+		}
+		index.Insert(fields...)
+	}
+
+	tests := []struct {
+		query  string
+		result testBuffer
+	}{
+		{"mode: ranked region: eu", testBuffer{0: 1, 1: 1, 2: 1}},
+		{"+mode: ranked -region: eu", testBuffer{1: 1}},
+		{"+mode: ranked region: eu", testBuffer{0: 1, 1: 1}},
+		{"-region: eu", testBuffer{1: 1, 3: 1}},
+		{"NOT mode: ranked", testBuffer{2: 1, 3: 1}},
+		{"mode: casual AND (region: eu OR level: >35)", testBuffer{2: 1, 3: 1}},
+		{"mode: casual AND NOT (region: eu OR level: >35)", testBuffer{}},
+		{"+(mode: ranked OR level: <35) -(region: us AND level: 20)", testBuffer{0: 1, 2: 1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			query, i, err := parser.ParseQuery([]byte(test.query))
+			if err != nil {
+				t.Fatal(err, i)
+			}
+			result := testBuffer{}
+			index.Query(result, query)
+			if !reflect.DeepEqual(result, test.result) {
+				t.Errorf("\n%v\n%v", test.result, result)
+			}
+		})
+	}
+
+	fields, _, _ := parser.Parse([]byte("mode: casual region: eu level: 30"))
+	for j := range fields {
+		fields[j].Value = 2
+	}
+	index.Remove(fields...)
+
+	query, _, _ := parser.ParseQuery([]byte("NOT mode: ranked"))
+	result := testBuffer{}
+	index.Query(result, query)
+	if !reflect.DeepEqual(result, testBuffer{3: 1}) {
+		t.Error(result)
+	}
+}
@@ -0,0 +1,340 @@
+package index
+
+import (
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DefaultFuzzyWeight is default weight of values one edit away from the query.
+const DefaultFuzzyWeight = 0.25
+
+// RadixIndexCategory indexes FTString fields in radix tree so insert and remove cost
+// is proportional to length of the value, not to amount of values. Besides exact and
+// prefix search it supports case insensitive search (Field.Fold) and FTFuzzyString
+// that finds values at most one edit (insertion, deletion or substitution of a
+// character) away from the query, ignoring case. Equal values score ExactWeight,
+// values only sharing prefix PrefixWeight and values one edit away FuzzyWeight.
+type RadixIndexCategory struct {
+	root         radixNode
+	rootMutex    sync.RWMutex
+	Synchronized bool
+	// ExactWeight, PrefixWeight and FuzzyWeight default to DefaultExactWeight,
+	// DefaultPrefixWeight and DefaultFuzzyWeight if 0.
+	ExactWeight, PrefixWeight, FuzzyWeight float64
+}
+
+// radixNode holds values whose key ends at the node. Edge labels never split runes
+// and children differ in first rune.
+type radixNode struct {
+	label    string
+	children []*radixNode
+	values   []interface{}
+}
+
+func (n *radixNode) child(key string) (int, *radixNode) {
+	r, _ := utf8.DecodeRuneInString(key)
+	for i, child := range n.children {
+		if c, _ := utf8.DecodeRuneInString(child.label); c == r {
+			return i, child
+		}
+	}
+	return -1, nil
+}
+
+func (n *radixNode) walk(visit func(values []interface{})) {
+	visit(n.values)
+	for _, child := range n.children {
+		child.walk(visit)
+	}
+}
+
+// commonPrefix returns byte length of common prefix of whole runes.
+func commonPrefix(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) {
+		ra, size := utf8.DecodeRuneInString(a[i:])
+		rb, _ := utf8.DecodeRuneInString(b[i:])
+		if ra != rb {
+			break
+		}
+		i += size
+	}
+	return i
+}
+
+func (r *RadixIndexCategory) Insert(field Field) {
+	if field.Type != FTString {
+		return
+	}
+
+	if r.Synchronized {
+		r.rootMutex.Lock()
+		defer r.rootMutex.Unlock()
+	}
+
+	node, key := &r.root, field.String
+	for key != "" {
+		i, child := node.child(key)
+		if child == nil {
+			node.children = append(node.children, &radixNode{label: key, values: []interface{}{field.Value}})
+			return
+		}
+
+		n := commonPrefix(child.label, key)
+		if n < len(child.label) {
+			middle := &radixNode{label: child.label[:n], children: []*radixNode{child}}
+			child.label = child.label[n:]
+			node.children[i] = middle
+			child = middle
+		}
+
+		node, key = child, key[n:]
+	}
+
+	node.values = append(node.values, field.Value)
+}
+
+func (r *RadixIndexCategory) Remove(field Field) {
+	if field.Type != FTString {
+		return
+	}
+
+	if r.Synchronized {
+		r.rootMutex.Lock()
+		defer r.rootMutex.Unlock()
+	}
+
+	r.remove(&r.root, field.String, field.Value)
+}
+
+// remove returns whether node should be removed from parent.
+func (r *RadixIndexCategory) remove(node *radixNode, key string, value interface{}) bool {
+	if key == "" {
+		for i, v := range node.values {
+			if v == value {
+				node.values = append(node.values[:i], node.values[i+1:]...)
+				break
+			}
+		}
+	} else {
+		i, child := node.child(key)
+		if child == nil || !strings.HasPrefix(key, child.label) {
+			return false
+		}
+		if r.remove(child, key[len(child.label):], value) {
+			node.children = append(node.children[:i], node.children[i+1:]...)
+		}
+	}
+
+	if node == &r.root || len(node.values) != 0 {
+		return false
+	}
+
+	switch len(node.children) {
+	case 0:
+		return true
+	case 1:
+		child := node.children[0]
+		node.label += child.label
+		node.children = child.children
+		node.values = child.values
+	}
+
+	return false
+}
+
+func (r *RadixIndexCategory) Dump(visit func(Field)) {
+	if r.Synchronized {
+		r.rootMutex.RLock()
+		defer r.rootMutex.RUnlock()
+	}
+
+	r.root.dump("", visit)
+}
+
+func (n *radixNode) dump(key string, visit func(Field)) {
+	key += n.label
+	for _, value := range n.values {
+		visit(Field{Type: FTString, String: key, Value: value})
+	}
+	for _, child := range n.children {
+		child.dump(key, visit)
+	}
+}
+
+func (r *RadixIndexCategory) Search(field Field, buffer ResultBuffer) {
+	if field.Type != FTString && field.Type != FTExactString && field.Type != FTFuzzyString {
+		return
+	}
+
+	if r.Synchronized {
+		r.rootMutex.RLock()
+		defer r.rootMutex.RUnlock()
+	}
+
+	exact, prefix, fuzzy := r.ExactWeight, r.PrefixWeight, r.FuzzyWeight
+	if exact == 0 {
+		exact = DefaultExactWeight
+	}
+	if prefix == 0 {
+		prefix = DefaultPrefixWeight
+	}
+	if fuzzy == 0 {
+		fuzzy = DefaultFuzzyWeight
+	}
+
+	s := radixSearch{
+		buffer: buffer,
+		exact:  exact,
+		prefix: prefix,
+		fuzzy:  fuzzy,
+		whole:  field.Type == FTExactString,
+	}
+
+	switch {
+	case field.Type == FTFuzzyString:
+		query := []rune(strings.ToLower(field.String))
+		row := make([]int, len(query)+1)
+		for i := range row {
+			row[i] = i
+		}
+		for _, child := range r.root.children {
+			s.fuzzySearch(child, query, row)
+		}
+		s.fuzzyValues(&r.root, row)
+	case field.Fold:
+		s.foldSearch(&r.root, field.String)
+	default:
+		s.search(&r.root, field.String)
+	}
+}
+
+type radixSearch struct {
+	buffer               ResultBuffer
+	exact, prefix, fuzzy float64
+	whole                bool
+}
+
+func (s *radixSearch) add(values []interface{}, score float64) {
+	for _, value := range values {
+		addScore(s.buffer, value, score)
+	}
+}
+
+// found adds values of node whose path equals the query and, unless search is
+// exact, values of all descendants.
+func (s *radixSearch) found(node *radixNode) {
+	s.add(node.values, s.exact)
+	if !s.whole {
+		for _, child := range node.children {
+			child.walk(func(values []interface{}) { s.add(values, s.prefix) })
+		}
+	}
+}
+
+func (s *radixSearch) search(node *radixNode, key string) {
+	for key != "" {
+		_, child := node.child(key)
+		if child == nil {
+			return
+		}
+
+		if len(key) < len(child.label) {
+			if !s.whole && strings.HasPrefix(child.label, key) {
+				child.walk(func(values []interface{}) { s.add(values, s.prefix) })
+			}
+			return
+		}
+
+		if !strings.HasPrefix(key, child.label) {
+			return
+		}
+
+		node, key = child, key[len(child.label):]
+	}
+
+	s.found(node)
+}
+
+// foldSearch is search ignoring case, it can follow more then one child.
+func (s *radixSearch) foldSearch(node *radixNode, key string) {
+	label := node.label
+	for label != "" {
+		if key == "" {
+			if !s.whole {
+				node.walk(func(values []interface{}) { s.add(values, s.prefix) })
+			}
+			return
+		}
+
+		a, size := utf8.DecodeRuneInString(label)
+		b, keySize := utf8.DecodeRuneInString(key)
+		if unicode.ToLower(a) != unicode.ToLower(b) {
+			return
+		}
+		label, key = label[size:], key[keySize:]
+	}
+
+	if key == "" {
+		s.found(node)
+		return
+	}
+
+	for _, child := range node.children {
+		s.foldSearch(child, key)
+	}
+}
+
+// fuzzySearch computes rows of Levenshtein matrix along the path and prunes branches
+// that are already more then one edit away.
+func (s *radixSearch) fuzzySearch(node *radixNode, query []rune, row []int) {
+	for _, r := range node.label {
+		r = unicode.ToLower(r)
+
+		next := make([]int, len(row))
+		next[0] = row[0] + 1
+		best := next[0]
+		for i := 1; i < len(row); i++ {
+			cost := 1
+			if query[i-1] == r {
+				cost = 0
+			}
+			next[i] = min3(row[i]+1, next[i-1]+1, row[i-1]+cost)
+			if next[i] < best {
+				best = next[i]
+			}
+		}
+
+		if best > 1 {
+			return
+		}
+		row = next
+	}
+
+	s.fuzzyValues(node, row)
+
+	for _, child := range node.children {
+		s.fuzzySearch(child, query, row)
+	}
+}
+
+func (s *radixSearch) fuzzyValues(node *radixNode, row []int) {
+	switch row[len(row)-1] {
+	case 0:
+		s.add(node.values, s.exact)
+	case 1:
+		s.add(node.values, s.fuzzy)
+	}
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,110 @@
+package index
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestRadixIndexCategory(t *testing.T) {
+	words := []string{"lobby", "lobbyist", "lob", "Lobby", "hobby", "lbby", "lobbby", "žlutý", "žluťoučký", "team"}
+
+	category := &RadixIndexCategory{}
+	for i, word := range words {
+		category.Insert(Field{Type: FTString, String: word, Value: i})
+	}
+
+	tests := []struct {
+		name   string
+		field  Field
+		result testBuffer
+	}{
+		{"prefix", Field{Type: FTString, String: "lob"}, testBuffer{0: 1, 1: 1, 2: 1, 6: 1}},
+		{"split", Field{Type: FTString, String: "lobb"}, testBuffer{0: 1, 1: 1, 6: 1}},
+		{"exact", Field{Type: FTExactString, String: "lobby"}, testBuffer{0: 1}},
+		{"missing", Field{Type: FTString, String: "lobx"}, testBuffer{}},
+		{"fold", Field{Type: FTString, String: "LOBBY", Fold: true}, testBuffer{0: 1, 1: 1, 3: 1}},
+		{"fold exact", Field{Type: FTExactString, String: "LOBBY", Fold: true}, testBuffer{0: 1, 3: 1}},
+		{"fuzzy", Field{Type: FTFuzzyString, String: "lobby"}, testBuffer{0: 1, 3: 1, 4: 1, 5: 1, 6: 1}},
+		{"fuzzy short", Field{Type: FTFuzzyString, String: "lo"}, testBuffer{2: 1}},
+		{"runes", Field{Type: FTString, String: "žlu"}, testBuffer{7: 1, 8: 1}},
+		{"fuzzy runes", Field{Type: FTFuzzyString, String: "ŽLUTY"}, testBuffer{7: 1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := testBuffer{}
+			category.Search(test.field, result)
+			if !reflect.DeepEqual(result, test.result) {
+				t.Errorf("\n%v\n%v", test.result, result)
+			}
+		})
+	}
+
+	scores := Scores{}
+	category.Search(Field{Type: FTFuzzyString, String: "lobby"}, scores)
+	expected := Scores{0: 1, 3: 1, 4: DefaultFuzzyWeight, 5: DefaultFuzzyWeight, 6: DefaultFuzzyWeight}
+	if !reflect.DeepEqual(scores, expected) {
+		t.Errorf("\n%v\n%v", expected, scores)
+	}
+
+	for i, word := range words {
+		if i != 1 {
+			category.Remove(Field{Type: FTString, String: word, Value: i})
+		}
+	}
+
+	result := testBuffer{}
+	category.Search(Field{Type: FTString, String: "lob"}, result)
+	if !reflect.DeepEqual(result, testBuffer{1: 1}) {
+		t.Error(result)
+	}
+
+	if len(category.root.children) != 1 || category.root.children[0].label != "lobbyist" {
+		t.Error("nodes were not merged")
+	}
+}
+
+func benchmarkWords(n int) []string {
+	words := make([]string, n)
+	for i := range words {
+		words[i] = fmt.Sprintf("lobby-%x-%d", i*2654435761%4096, i)
+	}
+	return words
+}
+
+func benchmarkCategories() map[string]func() IndexCategory {
+	return map[string]func() IndexCategory{
+		"string": func() IndexCategory { return &StringIndexCategory{} },
+		"radix":  func() IndexCategory { return &RadixIndexCategory{} },
+	}
+}
+
+func BenchmarkStringInsert(b *testing.B) {
+	words := benchmarkWords(10000)
+	for name, create := range benchmarkCategories() {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				category := create()
+				for j, word := range words {
+					category.Insert(Field{Type: FTString, String: word, Value: j})
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkStringSearch(b *testing.B) {
+	words := benchmarkWords(10000)
+	for name, create := range benchmarkCategories() {
+		category := create()
+		for j, word := range words {
+			category.Insert(Field{Type: FTString, String: word, Value: j})
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				category.Search(Field{Type: FTString, String: "lobby-ff"}, testBuffer{})
+			}
+		})
+	}
+}
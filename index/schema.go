@@ -0,0 +1,185 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrUndeclaredField = errors.New("field is not declared")
+	ErrFieldType       = errors.New("field has wrong type")
+)
+
+// Kind is declared type of indexed field, it determines the category and field
+// types that can be inserted and searched.
+type Kind uint8
+
+const (
+	// KindString stores FTString and searches by FTString and FTExactString.
+	KindString Kind = iota
+	// KindInt stores FTInt and searches by FTInt and FTRange.
+	KindInt
+	// KindFloat stores FTFloat and FTInt and searches by any numeric field.
+	KindFloat
+	// KindBool stores and searches by FTBool.
+	KindBool
+	// KindSet stores FTSet and searches by FTSet, FTString and FTExactString.
+	KindSet
+	// KindText stores FTString in radix tree and searches by FTString,
+	// FTExactString and FTFuzzyString.
+	KindText
+	// KindGeo stores FTPoint and searches by FTPoint, FTGeoRadius and FTGeoNearest.
+	KindGeo
+)
+
+var kindStrings = [...]string{"string", "int", "float", "bool", "set", "text", "geo"}
+
+func (k Kind) String() string {
+	if int(k) < len(kindStrings) {
+		return kindStrings[k]
+	}
+	return fmt.Sprintf("Kind(%d)", k)
+}
+
+var fieldTypeStrings = [...]string{"string", "exact string", "int", "int range", "float", "float range", "bool", "set", "fuzzy string", "point", "radius", "nearest"}
+
+func (t FieldType) String() string {
+	if t >= 0 && int(t) < len(fieldTypeStrings) {
+		return fieldTypeStrings[t]
+	}
+	return fmt.Sprintf("FieldType(%d)", t)
+}
+
+// Category creates empty category for the kind.
+func (k Kind) Category(synchronized bool) IndexCategory {
+	switch k {
+	case KindString:
+		return &StringIndexCategory{Synchronized: synchronized}
+	case KindInt:
+		return &IntIndexCategory{Synchronized: synchronized}
+	case KindFloat:
+		return &FloatIndexCategory{Synchronized: synchronized}
+	case KindBool:
+		return &BoolIndexCategory{Synchronized: synchronized}
+	case KindSet:
+		return &SetIndexCategory{Synchronized: synchronized}
+	case KindText:
+		return &RadixIndexCategory{Synchronized: synchronized}
+	case KindGeo:
+		return &GeoIndexCategory{Synchronized: synchronized}
+	default:
+		panic("unknown kind")
+	}
+}
+
+// Accepts reports whether field of type t can be inserted, or searched if query is
+// true, in category of the kind.
+func (k Kind) Accepts(t FieldType, query bool) bool {
+	switch k {
+	case KindString:
+		return t == FTString || query && t == FTExactString
+	case KindInt:
+		return t == FTInt || query && t == FTRange
+	case KindFloat:
+		return t == FTFloat || t == FTInt || query && (t == FTFloatRange || t == FTRange)
+	case KindBool:
+		return t == FTBool
+	case KindSet:
+		return t == FTSet || query && (t == FTString || t == FTExactString)
+	case KindText:
+		return t == FTString || query && (t == FTExactString || t == FTFuzzyString)
+	case KindGeo:
+		return t == FTPoint || query && (t == FTGeoRadius || t == FTGeoNearest)
+	default:
+		return false
+	}
+}
+
+// FieldError describes field that does not fit declared fields of index.
+type FieldError struct {
+	Name string
+	// Err is ErrUndeclaredField or ErrFieldType.
+	Err error
+	// Expected and Got are set if Err is ErrFieldType.
+	Expected Kind
+	Got      FieldType
+}
+
+func (f *FieldError) Error() string {
+	if f.Err == ErrFieldType {
+		return fmt.Sprintf("field %s is %s, %s does not fit it", f.Name, f.Expected, f.Got)
+	}
+	return fmt.Sprintf("field %s: %s", f.Name, f.Err)
+}
+
+func (f *FieldError) Unwrap() error {
+	return f.Err
+}
+
+// Declare adds category of the kind under name. Unlike with AddCategory, types of
+// fields under the name are checked by Check and CheckQuery.
+func (i *Index) Declare(name string, kind Kind, synchronized bool) {
+	i.categoriesMutex.Lock()
+	i.categories[name] = kind.Category(synchronized)
+	if i.kinds == nil {
+		i.kinds = make(map[string]Kind)
+	}
+	i.kinds[name] = kind
+	i.categoriesMutex.Unlock()
+}
+
+// Kind returns declared kind of field.
+func (i *Index) Kind(name string) (Kind, bool) {
+	i.categoriesMutex.RLock()
+	kind, ok := i.kinds[name]
+	i.categoriesMutex.RUnlock()
+	return kind, ok
+}
+
+// Check returns *FieldError for the first field that has no category or does not
+// fit the declared kind. Query tells whether fields are meant for search.
+func (i *Index) Check(query bool, fields ...Field) error {
+	i.categoriesMutex.RLock()
+	defer i.categoriesMutex.RUnlock()
+
+	for _, field := range fields {
+		if err := i.check(field, query); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CheckQuery is Check for all fields of query.
+func (i *Index) CheckQuery(query Query) error {
+	i.categoriesMutex.RLock()
+	defer i.categoriesMutex.RUnlock()
+
+	return i.checkQuery(query)
+}
+
+func (i *Index) checkQuery(query Query) error {
+	if query.Op == OpField {
+		return i.check(query.Field, true)
+	}
+	for _, child := range query.Children {
+		if err := i.checkQuery(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i *Index) check(field Field, query bool) error {
+	if _, ok := i.categories[field.Name]; !ok {
+		return &FieldError{Name: field.Name, Err: ErrUndeclaredField}
+	}
+
+	kind, ok := i.kinds[field.Name]
+	if ok && !kind.Accepts(field.Type, query) {
+		return &FieldError{Name: field.Name, Err: ErrFieldType, Expected: kind, Got: field.Type}
+	}
+
+	return nil
+}
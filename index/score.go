@@ -0,0 +1,145 @@
+package index
+
+import (
+	"container/heap"
+	"math"
+)
+
+// default weights of string matches, see StringIndexCategory
+const (
+	DefaultExactWeight  = 1
+	DefaultPrefixWeight = 0.5
+)
+
+// ScoreBuffer is ResultBuffer that accepts relevance. Categories pass relevance of
+// each found document trough AddScore if buffer implements it, Add then means
+// score 1.
+type ScoreBuffer interface {
+	ResultBuffer
+	AddScore(value interface{}, score float64)
+}
+
+func addScore(buffer ResultBuffer, value interface{}, score float64) {
+	if scores, ok := buffer.(ScoreBuffer); ok {
+		scores.AddScore(value, score)
+	} else {
+		buffer.Add(value)
+	}
+}
+
+// proximity scores value found by range query, value in the middle of range scores 1,
+// value scale away from it scores 0.5. If scale is 0, it is half of the range or 1
+// if range is unbounded. Unbounded range is centered at its finite bound.
+func proximity(value, min, max, scale float64) float64 {
+	var center float64
+	switch {
+	case math.IsInf(min, 0) && math.IsInf(max, 0):
+		return 1
+	case math.IsInf(min, 0):
+		center = max
+	case math.IsInf(max, 0):
+		center = min
+	default:
+		center = (min + max) / 2
+		if scale == 0 {
+			scale = (max - min) / 2
+		}
+	}
+	if scale <= 0 {
+		scale = 1
+	}
+
+	return 1 / (1 + math.Abs(value-center)/scale)
+}
+
+// weighted multiplies scores of one field by its weight.
+type weighted struct {
+	ScoreBuffer
+	weight float64
+}
+
+func (w weighted) Add(value interface{}) {
+	w.ScoreBuffer.AddScore(value, w.weight)
+}
+
+func (w weighted) AddScore(value interface{}, score float64) {
+	w.ScoreBuffer.AddScore(value, score*w.weight)
+}
+
+func weigh(buffer ResultBuffer, field Field) ResultBuffer {
+	scores, ok := buffer.(ScoreBuffer)
+	if !ok || field.Weight == 0 || field.Weight == 1 {
+		return buffer
+	}
+	return weighted{scores, field.Weight}
+}
+
+// Scores sums relevance of documents, it is a ScoreBuffer.
+type Scores map[interface{}]float64
+
+func (s Scores) Add(value interface{}) {
+	s[value]++
+}
+
+func (s Scores) AddScore(value interface{}, score float64) {
+	s[value] += score
+}
+
+// Scored is a document with its relevance.
+type Scored struct {
+	Value interface{}
+	Score float64
+}
+
+// Top returns at most k documents with the highest score, the best first. Ties are
+// broken by less so result does not depend on map order.
+func (s Scores) Top(k int, less func(a, b interface{}) bool) []Scored {
+	if k <= 0 {
+		return nil
+	}
+
+	h := &topHeap{less: less}
+	for value, score := range s {
+		entry := Scored{value, score}
+		if len(h.entries) < k {
+			heap.Push(h, entry)
+		} else if h.worse(h.entries[0], entry) {
+			h.entries[0] = entry
+			heap.Fix(h, 0)
+		}
+	}
+
+	result := make([]Scored, len(h.entries))
+	for i := len(result) - 1; i >= 0; i-- {
+		result[i] = heap.Pop(h).(Scored)
+	}
+
+	return result
+}
+
+// topHeap keeps the worst entry on top.
+type topHeap struct {
+	entries []Scored
+	less    func(a, b interface{}) bool
+}
+
+func (h *topHeap) worse(a, b Scored) bool {
+	if a.Score != b.Score {
+		return a.Score < b.Score
+	}
+	return h.less(b.Value, a.Value)
+}
+
+func (h *topHeap) Len() int           { return len(h.entries) }
+func (h *topHeap) Less(i, j int) bool { return h.worse(h.entries[i], h.entries[j]) }
+func (h *topHeap) Swap(i, j int)      { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+
+func (h *topHeap) Push(x interface{}) {
+	h.entries = append(h.entries, x.(Scored))
+}
+
+func (h *topHeap) Pop() interface{} {
+	last := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return last
+}
@@ -0,0 +1,414 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/jakubDoka/keeper/util"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+var (
+	ErrCannotDump       = errors.New("category cannot be dumped")
+	ErrInvalidSnapshot  = errors.New("snapshot is corrupted")
+	ErrSnapshotVersion  = errors.New("snapshot has unknown version")
+	ErrMissingCategory  = errors.New("snapshot contains undeclared category missing in index")
+	ErrValueType        = errors.New("value has unsupported type")
+	ErrUnsupportedField = errors.New("field type cannot be stored")
+)
+
+// snapshotVersion is written at the start of each snapshot.
+const snapshotVersion = 1
+
+// DumpCategory is IndexCategory that can list stored fields. Index can be
+// serialized only if all its categories are DumpCategory, all builtin categories are.
+type DumpCategory interface {
+	IndexCategory
+	// Dump visits all stored fields, Name of the fields is not set.
+	Dump(visit func(Field))
+}
+
+// ValueEncoder converts values of documents to bytes and back. Decoded values have to
+// be comparable as they are used as map keys. Each value is encoded once per snapshot
+// so fields of one document share the decoded value after restore. Data passed to
+// DecodeValue must not be retained.
+type ValueEncoder interface {
+	EncodeValue(value interface{}) ([]byte, error)
+	DecodeValue(data []byte) (interface{}, error)
+}
+
+// UUIDEncoder encodes uuid.UUID values, useful for indexes of users.
+type UUIDEncoder struct{}
+
+func (UUIDEncoder) EncodeValue(value interface{}) ([]byte, error) {
+	id, ok := value.(uuid.UUID)
+	if !ok {
+		return nil, ErrValueType
+	}
+	return id[:], nil
+}
+
+func (UUIDEncoder) DecodeValue(data []byte) (interface{}, error) {
+	var id uuid.UUID
+	if len(data) != len(id) {
+		return nil, ErrInvalidSnapshot
+	}
+	copy(id[:], data)
+	return id, nil
+}
+
+// StringEncoder encodes string values.
+type StringEncoder struct{}
+
+func (StringEncoder) EncodeValue(value interface{}) ([]byte, error) {
+	str, ok := value.(string)
+	if !ok {
+		return nil, ErrValueType
+	}
+	return []byte(str), nil
+}
+
+func (StringEncoder) DecodeValue(data []byte) (interface{}, error) {
+	return string(data), nil
+}
+
+// Snapshot serializes all fields of all categories together with declared kinds.
+// Values are encoded by encoder. Configuration of categories such as weights is
+// not stored.
+func (i *Index) Snapshot(encoder ValueEncoder) ([]byte, error) {
+	i.categoriesMutex.RLock()
+	defer i.categoriesMutex.RUnlock()
+
+	names := make([]string, 0, len(i.categories))
+	for name := range i.categories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var values []interface{}
+	indexes := map[interface{}]uint32{}
+
+	categories := util.NewWriter(0)
+	categories.Uint32(uint32(len(names)))
+	for _, name := range names {
+		category, ok := i.categories[name].(DumpCategory)
+		if !ok {
+			return nil, fmt.Errorf("category %s: %w", name, ErrCannotDump)
+		}
+
+		categories.String(name)
+		if kind, ok := i.kinds[name]; ok {
+			categories.Uint8(uint8(kind) + 1)
+		} else {
+			categories.Uint8(0)
+		}
+
+		var fields []Field
+		category.Dump(func(field Field) {
+			fields = append(fields, field)
+		})
+
+		categories.Uint32(uint32(len(fields)))
+		for _, field := range fields {
+			if err := writeField(&categories, field); err != nil {
+				return nil, fmt.Errorf("category %s: %w", name, err)
+			}
+
+			idx, ok := indexes[field.Value]
+			if !ok {
+				idx = uint32(len(values))
+				indexes[field.Value] = idx
+				values = append(values, field.Value)
+			}
+			categories.Uint32(idx)
+		}
+	}
+
+	w := util.NewWriter(0)
+	w.Uint8(snapshotVersion)
+	w.Uint32(uint32(len(values)))
+	for _, value := range values {
+		data, err := encoder.EncodeValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode value: %w", err)
+		}
+		w.Bytes(data)
+	}
+	w.Rest(categories.Buffer())
+
+	return w.Buffer(), nil
+}
+
+// Restore inserts fields from snapshot made by Snapshot. Declared categories missing
+// in index are declared as synchronized, undeclared categories have to be added
+// before the call. Index is not modified if snapshot cannot be restored.
+func (i *Index) Restore(data []byte, encoder ValueEncoder) error {
+	snapshot, err := i.decodeSnapshot(data, encoder)
+	if err != nil {
+		return err
+	}
+
+	snapshot.apply(i)
+	return nil
+}
+
+// Reload replaces content of index with snapshot. Unlike Restore it removes all
+// fields first so all categories have to be DumpCategory. Index is not modified if
+// snapshot cannot be restored.
+func (i *Index) Reload(data []byte, encoder ValueEncoder) error {
+	snapshot, err := i.decodeSnapshot(data, encoder)
+	if err != nil {
+		return err
+	}
+
+	if err := i.Clear(); err != nil {
+		return err
+	}
+
+	snapshot.apply(i)
+	return nil
+}
+
+// Clear removes all fields from index, categories stay.
+func (i *Index) Clear() error {
+	i.categoriesMutex.RLock()
+	var fields []Field
+	for name, category := range i.categories {
+		dump, ok := category.(DumpCategory)
+		if !ok {
+			i.categoriesMutex.RUnlock()
+			return fmt.Errorf("category %s: %w", name, ErrCannotDump)
+		}
+		dump.Dump(func(field Field) {
+			field.Name = name
+			fields = append(fields, field)
+		})
+	}
+	i.categoriesMutex.RUnlock()
+
+	i.Remove(fields...)
+	return nil
+}
+
+// SaveFile writes snapshot to file. File is replaced only after whole snapshot is
+// written so crash does not leave it corrupted.
+func (i *Index) SaveFile(path string, encoder ValueEncoder) error {
+	data, err := i.Snapshot(encoder)
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return util.WrapErr("failed to create snapshot file", err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return util.WrapErr("failed to write snapshot file", err)
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// LoadFile reloads index from file written by SaveFile, see Reload. Error satisfies
+// os.IsNotExist if there is no snapshot yet.
+func (i *Index) LoadFile(path string, encoder ValueEncoder) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return i.Reload(data, encoder)
+}
+
+type snapshotCategory struct {
+	name     string
+	kind     Kind
+	declared bool
+	fields   []Field
+}
+
+type snapshot []snapshotCategory
+
+func (i *Index) decodeSnapshot(data []byte, encoder ValueEncoder) (snapshot, error) {
+	r := util.NewReader(data)
+
+	version, ok := r.Uint8()
+	if !ok {
+		return nil, ErrInvalidSnapshot
+	}
+	if version != snapshotVersion {
+		return nil, ErrSnapshotVersion
+	}
+
+	count, ok := r.Uint32()
+	if !ok {
+		return nil, ErrInvalidSnapshot
+	}
+
+	var values []interface{}
+	for j := uint32(0); j < count; j++ {
+		data, ok := r.Bytes()
+		if !ok {
+			return nil, ErrInvalidSnapshot
+		}
+		value, err := encoder.DecodeValue(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode value: %w", err)
+		}
+		values = append(values, value)
+	}
+
+	count, ok = r.Uint32()
+	if !ok {
+		return nil, ErrInvalidSnapshot
+	}
+
+	var result snapshot
+	for j := uint32(0); j < count; j++ {
+		var category snapshotCategory
+		var kind uint8
+		var fields uint32
+		if category.name, ok = r.String(); !ok {
+			return nil, ErrInvalidSnapshot
+		}
+		if kind, ok = r.Uint8(); !ok {
+			return nil, ErrInvalidSnapshot
+		}
+		if kind != 0 {
+			category.kind, category.declared = Kind(kind-1), true
+			if int(category.kind) >= len(kindStrings) {
+				return nil, ErrInvalidSnapshot
+			}
+		}
+
+		if fields, ok = r.Uint32(); !ok {
+			return nil, ErrInvalidSnapshot
+		}
+		for k := uint32(0); k < fields; k++ {
+			field, ok := readField(&r)
+			if !ok {
+				return nil, ErrInvalidSnapshot
+			}
+			idx, ok := r.Uint32()
+			if !ok || idx >= uint32(len(values)) {
+				return nil, ErrInvalidSnapshot
+			}
+			field.Name = category.name
+			field.Value = values[idx]
+			category.fields = append(category.fields, field)
+		}
+
+		result = append(result, category)
+	}
+
+	i.categoriesMutex.RLock()
+	defer i.categoriesMutex.RUnlock()
+	for _, category := range result {
+		if _, ok := i.categories[category.name]; !ok && !category.declared {
+			return nil, fmt.Errorf("category %s: %w", category.name, ErrMissingCategory)
+		}
+	}
+
+	return result, nil
+}
+
+func (s snapshot) apply(i *Index) {
+	for _, category := range s {
+		i.categoriesMutex.RLock()
+		_, ok := i.categories[category.name]
+		i.categoriesMutex.RUnlock()
+		if !ok {
+			i.Declare(category.name, category.kind, true)
+		}
+
+		i.Insert(category.fields...)
+	}
+}
+
+func writeField(w *util.Writer, field Field) error {
+	w.Uint8(uint8(field.Type))
+	switch field.Type {
+	case FTString:
+		w.String(field.String)
+	case FTInt:
+		w.Uint32(uint32(field.Int1))
+	case FTFloat:
+		w.Uint64(math.Float64bits(field.Float1))
+	case FTPoint:
+		w.Uint64(math.Float64bits(field.Float1))
+		w.Uint64(math.Float64bits(field.Float2))
+	case FTBool:
+		if field.Bool {
+			w.Uint8(1)
+		} else {
+			w.Uint8(0)
+		}
+	case FTSet:
+		w.Uint32(uint32(len(field.Strings)))
+		for _, s := range field.Strings {
+			w.String(s)
+		}
+	default:
+		return ErrUnsupportedField
+	}
+	return nil
+}
+
+func readField(r *util.Reader) (field Field, ok bool) {
+	var t uint8
+	if t, ok = r.Uint8(); !ok {
+		return
+	}
+
+	field.Type = FieldType(t)
+	switch field.Type {
+	case FTString:
+		field.String, ok = r.String()
+	case FTInt:
+		var value uint32
+		value, ok = r.Uint32()
+		field.Int1 = int32(value)
+	case FTFloat:
+		var bits uint64
+		bits, ok = r.Uint64()
+		field.Float1 = math.Float64frombits(bits)
+	case FTPoint:
+		var lat, lon uint64
+		if lat, ok = r.Uint64(); !ok {
+			return
+		}
+		lon, ok = r.Uint64()
+		field.Float1, field.Float2 = math.Float64frombits(lat), math.Float64frombits(lon)
+	case FTBool:
+		var value uint8
+		value, ok = r.Uint8()
+		field.Bool = value != 0
+	case FTSet:
+		var count uint32
+		if count, ok = r.Uint32(); !ok {
+			return
+		}
+		for j := uint32(0); j < count && ok; j++ {
+			var s string
+			s, ok = r.String()
+			field.Strings = append(field.Strings, s)
+		}
+	default:
+		ok = false
+	}
+
+	return
+}
@@ -0,0 +1,158 @@
+package index
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testPlayers(t *testing.T) *Index {
+	index := New()
+	index.Declare("name", KindText, true)
+	index.Declare("level", KindInt, true)
+	index.Declare("mmr", KindFloat, true)
+	index.Declare("online", KindBool, true)
+	index.Declare("tags", KindSet, true)
+	index.Declare("server", KindGeo, true)
+	index.AddCategory("region", &StringIndexCategory{})
+
+	var parser Parser
+	for id, data := range map[string]string{
+		"a": `name: Lobster level: 10 mmr: 1000.5 online: true tags: [pro, "night owl"] region: eu server: @48.15,17.11`,
+		"b": `name: lobby level: 20 mmr: 1500 online: false tags: [] region: us server: @40.71,-74.01`,
+		"c": `name: hobo level: 30 online: true tags: [pro]`,
+	} {
+		fields, _, err := parser.Parse([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := range fields {
+			fields[j].Value = id
+		}
+		index.Insert(fields...)
+	}
+
+	return index
+}
+
+type stringBuffer map[string]int
+
+func (s stringBuffer) Add(value interface{}) {
+	s[value.(string)]++
+}
+
+func TestIndexSnapshot(t *testing.T) {
+	original := testPlayers(t)
+	data, err := original.Snapshot(StringEncoder{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := New()
+	err = restored.Restore(data, StringEncoder{})
+	if !errors.Is(err, ErrMissingCategory) {
+		t.Fatal(err)
+	}
+	if len(restored.Documents()) != 0 {
+		t.Fatal("index was modified")
+	}
+
+	restored.AddCategory("region", &StringIndexCategory{})
+	if err := restored.Restore(data, StringEncoder{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if kind, ok := restored.Kind("name"); !ok || kind != KindText {
+		t.Error(kind, ok)
+	}
+
+	var parser Parser
+	for _, query := range []string{
+		"name: ~lobbx",
+		"name: ?LOB",
+		"level: 10-25",
+		"mmr: >1000.0",
+		"online: true",
+		"tags: [pro]",
+		"tags: []",
+		"region: eu",
+		"server: @48,17<100",
+		"server: @0,0#1",
+		"+tags: night -online: false",
+	} {
+		t.Run(query, func(t *testing.T) {
+			q, i, err := parser.ParseQuery([]byte(query))
+			if err != nil {
+				t.Fatal(err, i)
+			}
+			expected, result := stringBuffer{}, stringBuffer{}
+			original.Query(expected, q)
+			restored.Query(result, q)
+			if !reflect.DeepEqual(expected, result) {
+				t.Errorf("\n%v\n%v", expected, result)
+			}
+		})
+	}
+
+	if !reflect.DeepEqual(original.Stats(), restored.Stats()) {
+		t.Errorf("\n%v\n%v", original.Stats(), restored.Stats())
+	}
+
+	if _, err := original.Snapshot(UUIDEncoder{}); !errors.Is(err, ErrValueType) {
+		t.Error(err)
+	}
+
+	if err := restored.Reload(data[:len(data)-1], StringEncoder{}); err != ErrInvalidSnapshot {
+		t.Error(err)
+	}
+}
+
+func TestIndexReload(t *testing.T) {
+	index := testPlayers(t)
+	path := filepath.Join(t.TempDir(), "players")
+
+	if err := index.LoadFile(path, StringEncoder{}); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	if err := index.SaveFile(path, StringEncoder{}); err != nil {
+		t.Fatal(err)
+	}
+
+	index.Insert(Field{Name: "level", Type: FTInt, Int1: 40, Value: "d"})
+	if err := index.LoadFile(path, StringEncoder{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.LoadFile(path, StringEncoder{}); err != nil {
+		t.Fatal(err)
+	}
+
+	result := stringBuffer{}
+	index.Search(result, Field{Name: "level", Type: FTRange, Int1: 0, Int2: 50})
+	if !reflect.DeepEqual(result, stringBuffer{"a": 1, "b": 1, "c": 1}) {
+		t.Error(result)
+	}
+
+	stats := index.Stats()
+	expected := []CategoryStats{
+		{"level", "*index.IntIndexCategory", KindInt, true, 3, 3},
+		{"mmr", "*index.FloatIndexCategory", KindFloat, true, 2, 2},
+		{"name", "*index.RadixIndexCategory", KindText, true, 3, 3},
+		{"online", "*index.BoolIndexCategory", KindBool, true, 3, 3},
+		{"region", "*index.StringIndexCategory", KindString, false, 2, 2},
+		{"server", "*index.GeoIndexCategory", KindGeo, true, 2, 2},
+		{"tags", "*index.SetIndexCategory", KindSet, true, 3, 3},
+	}
+	if stats.Documents != 3 || !reflect.DeepEqual(stats.Categories, expected) {
+		t.Errorf("\n%v\n%v", expected, stats)
+	}
+
+	if err := index.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Documents()) != 0 {
+		t.Error(index.Documents())
+	}
+}
@@ -0,0 +1,67 @@
+package index
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Stats describes content of index, see Index.Stats.
+type Stats struct {
+	// Documents is amount of values with at least one indexed field.
+	Documents  int
+	Categories []CategoryStats
+}
+
+// CategoryStats describes one category.
+type CategoryStats struct {
+	Name string
+	// Type is Go type of the category.
+	Type string
+	// Kind is valid only if Declared is true.
+	Kind     Kind
+	Declared bool
+	// Fields is amount of stored fields and Values amount of distinct values
+	// among them, both are -1 if category is not DumpCategory.
+	Fields, Values int
+}
+
+// Stats collects stats of all categories sorted by name. Categories are dumped so
+// this is as expensive as Snapshot without encoding.
+func (i *Index) Stats() Stats {
+	i.categoriesMutex.RLock()
+	defer i.categoriesMutex.RUnlock()
+
+	i.documentsMutex.Lock()
+	stats := Stats{Documents: len(i.documents)}
+	i.documentsMutex.Unlock()
+
+	for name, category := range i.categories {
+		kind, declared := i.kinds[name]
+		c := CategoryStats{
+			Name:     name,
+			Type:     fmt.Sprintf("%T", category),
+			Kind:     kind,
+			Declared: declared,
+			Fields:   -1,
+			Values:   -1,
+		}
+
+		if dump, ok := category.(DumpCategory); ok {
+			values := set{}
+			c.Fields = 0
+			dump.Dump(func(field Field) {
+				c.Fields++
+				values.Add(field.Value)
+			})
+			c.Values = len(values)
+		}
+
+		stats.Categories = append(stats.Categories, c)
+	}
+
+	sort.Slice(stats.Categories, func(a, b int) bool {
+		return stats.Categories[a].Name < stats.Categories[b].Name
+	})
+
+	return stats
+}
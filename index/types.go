@@ -0,0 +1,345 @@
+package index
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+type FloatCapsule struct {
+	value float64
+	data  interface{}
+}
+
+// FloatIndexCategory indexes FTFloat fields, FTInt fields are stored as floats. Search
+// accepts FTFloat, FTFloatRange and their int counterparts. Ranges include lower
+// bound and exclude upper bound and are scored same as in IntIndexCategory.
+type FloatIndexCategory struct {
+	capsules      []FloatCapsule
+	capsulesMutex sync.RWMutex
+	Synchronized  bool
+	// Scale is half of the range if 0, or 1 for unbounded ranges.
+	Scale float64
+}
+
+func (i *FloatIndexCategory) Insert(field Field) {
+	value, ok := floatValue(field)
+	if !ok {
+		return
+	}
+
+	if i.Synchronized {
+		i.capsulesMutex.Lock()
+		defer i.capsulesMutex.Unlock()
+	}
+
+	idx := i.BinSearch(value)
+	i.capsules = append(i.capsules, FloatCapsule{})
+	copy(i.capsules[idx+1:], i.capsules[idx:])
+
+	i.capsules[idx] = FloatCapsule{value: value, data: field.Value}
+}
+
+func (i *FloatIndexCategory) Search(field Field, buffer ResultBuffer) {
+	var min, max float64
+	switch field.Type {
+	case FTFloat, FTInt:
+		min, _ = floatValue(field)
+		max = min
+	case FTFloatRange:
+		min, max = field.Float1, field.Float2
+	case FTRange:
+		min, max = rangeBounds(field)
+	default:
+		return
+	}
+
+	if i.Synchronized {
+		i.capsulesMutex.RLock()
+		defer i.capsulesMutex.RUnlock()
+	}
+
+	idx := i.BinSearch(min)
+	if min == max {
+		for idx < len(i.capsules) && i.capsules[idx].value == min {
+			buffer.Add(i.capsules[idx].data)
+			idx++
+		}
+		return
+	}
+
+	for idx < len(i.capsules) && i.capsules[idx].value < max {
+		addScore(buffer, i.capsules[idx].data, proximity(i.capsules[idx].value, min, max, i.Scale))
+		idx++
+	}
+}
+
+func (i *FloatIndexCategory) Remove(field Field) {
+	value, ok := floatValue(field)
+	if !ok {
+		return
+	}
+
+	if i.Synchronized {
+		i.capsulesMutex.Lock()
+		defer i.capsulesMutex.Unlock()
+	}
+
+	idx := i.BinSearch(value)
+	for idx < len(i.capsules) && i.capsules[idx].value == value {
+		if i.capsules[idx].data == field.Value {
+			i.capsules = append(i.capsules[:idx], i.capsules[idx+1:]...)
+			return
+		}
+		idx++
+	}
+}
+
+func (i *FloatIndexCategory) Dump(visit func(Field)) {
+	if i.Synchronized {
+		i.capsulesMutex.RLock()
+		defer i.capsulesMutex.RUnlock()
+	}
+
+	for _, c := range i.capsules {
+		visit(Field{Type: FTFloat, Float1: c.value, Value: c.data})
+	}
+}
+
+// BinSearch returns index of first capsule with value not less then value.
+func (i *FloatIndexCategory) BinSearch(value float64) int {
+	return sort.Search(len(i.capsules), func(j int) bool {
+		return i.capsules[j].value >= value
+	})
+}
+
+// rangeBounds converts FTRange to float bounds, bounds of unbounded range are infinite.
+func rangeBounds(field Field) (min, max float64) {
+	min, max = float64(field.Int1), float64(field.Int2)
+	if field.Int1 == math.MinInt32 {
+		min = math.Inf(-1)
+	}
+	if field.Int2 == math.MaxInt32 {
+		max = math.Inf(1)
+	}
+	return
+}
+
+func floatValue(field Field) (float64, bool) {
+	switch field.Type {
+	case FTFloat:
+		return field.Float1, true
+	case FTInt:
+		return float64(field.Int1), true
+	}
+	return 0, false
+}
+
+// BoolIndexCategory indexes FTBool fields.
+type BoolIndexCategory struct {
+	values       [2]map[interface{}]int
+	valuesMutex  sync.RWMutex
+	Synchronized bool
+}
+
+func (i *BoolIndexCategory) Insert(field Field) {
+	if field.Type != FTBool {
+		return
+	}
+
+	if i.Synchronized {
+		i.valuesMutex.Lock()
+		defer i.valuesMutex.Unlock()
+	}
+
+	values := &i.values[boolIndex(field.Bool)]
+	if *values == nil {
+		*values = make(map[interface{}]int)
+	}
+	(*values)[field.Value]++
+}
+
+func (i *BoolIndexCategory) Search(field Field, buffer ResultBuffer) {
+	if field.Type != FTBool {
+		return
+	}
+
+	if i.Synchronized {
+		i.valuesMutex.RLock()
+		defer i.valuesMutex.RUnlock()
+	}
+
+	for data, count := range i.values[boolIndex(field.Bool)] {
+		for j := 0; j < count; j++ {
+			buffer.Add(data)
+		}
+	}
+}
+
+func (i *BoolIndexCategory) Remove(field Field) {
+	if field.Type != FTBool {
+		return
+	}
+
+	if i.Synchronized {
+		i.valuesMutex.Lock()
+		defer i.valuesMutex.Unlock()
+	}
+
+	values := i.values[boolIndex(field.Bool)]
+	if count, ok := values[field.Value]; ok {
+		if count <= 1 {
+			delete(values, field.Value)
+		} else {
+			values[field.Value] = count - 1
+		}
+	}
+}
+
+func (i *BoolIndexCategory) Dump(visit func(Field)) {
+	if i.Synchronized {
+		i.valuesMutex.RLock()
+		defer i.valuesMutex.RUnlock()
+	}
+
+	for j, values := range i.values {
+		for data, count := range values {
+			for k := 0; k < count; k++ {
+				visit(Field{Type: FTBool, Bool: j == 1, Value: data})
+			}
+		}
+	}
+}
+
+func boolIndex(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// SetIndexCategory indexes FTSet fields. Search with FTSet finds documents containing
+// all strings of the field, FTString and FTExactString find documents containing
+// string with the prefix or equal string. Each document is added to buffer once.
+type SetIndexCategory struct {
+	strings      StringIndexCategory
+	documents    map[interface{}]int
+	stringsMutex sync.RWMutex
+	Synchronized bool
+}
+
+func (i *SetIndexCategory) Insert(field Field) {
+	if field.Type != FTSet {
+		return
+	}
+
+	if i.Synchronized {
+		i.stringsMutex.Lock()
+		defer i.stringsMutex.Unlock()
+	}
+
+	if i.documents == nil {
+		i.documents = make(map[interface{}]int)
+	}
+	i.documents[field.Value]++
+
+	for _, s := range unique(field.Strings) {
+		i.strings.Insert(Field{Type: FTString, String: s, Value: field.Value})
+	}
+}
+
+func (i *SetIndexCategory) Search(field Field, buffer ResultBuffer) {
+	if field.Type != FTSet && field.Type != FTString && field.Type != FTExactString {
+		return
+	}
+
+	if i.Synchronized {
+		i.stringsMutex.RLock()
+		defer i.stringsMutex.RUnlock()
+	}
+
+	var result set
+	if field.Type == FTSet {
+		for j, s := range unique(field.Strings) {
+			found := set{}
+			i.strings.Search(Field{Type: FTExactString, String: s}, found)
+			if j == 0 {
+				result = found
+			} else {
+				result = intersect(result, found)
+			}
+		}
+
+		if len(field.Strings) == 0 {
+			result = set{}
+			for data := range i.documents {
+				result.Add(data)
+			}
+		}
+	} else {
+		result = set{}
+		i.strings.Search(field, result)
+	}
+
+	for data := range result {
+		buffer.Add(data)
+	}
+}
+
+func (i *SetIndexCategory) Remove(field Field) {
+	if field.Type != FTSet {
+		return
+	}
+
+	if i.Synchronized {
+		i.stringsMutex.Lock()
+		defer i.stringsMutex.Unlock()
+	}
+
+	if count, ok := i.documents[field.Value]; ok {
+		if count <= 1 {
+			delete(i.documents, field.Value)
+		} else {
+			i.documents[field.Value] = count - 1
+		}
+	}
+
+	for _, s := range unique(field.Strings) {
+		i.strings.Remove(Field{Type: FTString, String: s, Value: field.Value})
+	}
+}
+
+// Dump visits one set per document with all its strings, document inserted with
+// more sets is dumped as union of them followed by empty sets.
+func (i *SetIndexCategory) Dump(visit func(Field)) {
+	if i.Synchronized {
+		i.stringsMutex.RLock()
+		defer i.stringsMutex.RUnlock()
+	}
+
+	strings := make(map[interface{}][]string, len(i.documents))
+	i.strings.Dump(func(field Field) {
+		strings[field.Value] = append(strings[field.Value], field.String)
+	})
+
+	for data, count := range i.documents {
+		visit(Field{Type: FTSet, Strings: unique(strings[data]), Value: data})
+		for k := 1; k < count; k++ {
+			visit(Field{Type: FTSet, Value: data})
+		}
+	}
+}
+
+func unique(strings []string) []string {
+	var result []string
+outer:
+	for j, s := range strings {
+		for _, o := range strings[:j] {
+			if o == s {
+				continue outer
+			}
+		}
+		result = append(result, s)
+	}
+	return result
+}
@@ -52,6 +52,10 @@ var DefaultConfig = Config{
 		Port:    5432,
 		SSLMode: "disable",
 	},
+	Match: Match{
+		SnapshotInterval:    60,
+		MatchmakingInterval: 1,
+	},
 	Log: Log{
 		Level:        "info",
 		LogToConsole: true,
@@ -65,9 +69,29 @@ var DefaultConfig = Config{
 }
 
 type Config struct {
-	Db  DB  `yaml:"db"`
-	Net Net `yaml:"net"`
-	Log Log `yaml:"log"`
+	Db    DB    `yaml:"db"`
+	Net   Net   `yaml:"net"`
+	Log   Log   `yaml:"log"`
+	Match Match `yaml:"match"`
+
+	Cluster Cluster `yaml:"cluster"`
+}
+
+type Cluster struct {
+	// Secret authenticates requests between keeper nodes, they are all rejected
+	// while it is empty.
+	Secret string `yaml:"secret"`
+	// Peers are http addresses of other nodes, cluster mode is enabled if there are any.
+	Peers []string `yaml:"peers"`
+}
+
+type Match struct {
+	// Snapshots enables persisting matches with match.SnapshotCore in database.
+	Snapshots bool `yaml:"snapshots"`
+	// SnapshotInterval is amount of seconds between snapshots.
+	SnapshotInterval int `yaml:"snapshot_interval"`
+	// MatchmakingInterval is amount of seconds between matchmaker passes.
+	MatchmakingInterval int `yaml:"matchmaking_interval"`
 }
 
 type Net struct {
@@ -19,6 +19,22 @@ const (
 	OCConnectionRequest
 	OCMatchJoinFail
 	OCMatchJoinSuccess
+	OCMatchFound
+	OCPartyInvite
+	OCPartyUpdate
+	OCPartyLeave
+	OCPartyJoinMatch
+	OCLockstepInput
+	OCLockstepFrame
+	OCStateFull
+	OCStateDelta
+	OCStateAck
+	OCMatchRedirect
+	OCPresenceUpdate
+	OCFriendRequest
+	OCFriendAccept
+	OCFriendRemove
+	OCTicketExpired
 
 	OCLast
 )
@@ -28,6 +44,22 @@ var opCodeStrings = [...]string{
 	"ConnectionRequest",
 	"MatchJoinFail",
 	"MatchJoinSuccess",
+	"MatchFound",
+	"PartyInvite",
+	"PartyUpdate",
+	"PartyLeave",
+	"PartyJoinMatch",
+	"LockstepInput",
+	"LockstepFrame",
+	"StateFull",
+	"StateDelta",
+	"StateAck",
+	"MatchRedirect",
+	"PresenceUpdate",
+	"FriendRequest",
+	"FriendAccept",
+	"FriendRemove",
+	"TicketExpired",
 }
 
 func (o OpCode) String() string {
@@ -9,6 +9,17 @@ import (
 	"github.com/jakubDoka/keeper/util/kcrypto"
 )
 
+// Conn is the part of Connection that match and other acceptors depend on. It allows
+// substituting the network with in-memory transport.
+type Conn interface {
+	HarvestPackets(state *state.State, buffer *[]ClientPacket, helper *[][]byte)
+	WritePacket(packetCode OpCode, packetData []byte, udp bool) error
+	WritePacketTCP(packetCode OpCode, packetData []byte) error
+	WritePacketUDP(packetCode OpCode, packetData []byte) error
+	Disconnected() bool
+	Close()
+}
+
 type Connection struct {
 	Tcp *net.TCPConn
 	Udp *UDPListener
@@ -57,6 +68,7 @@ func (c *Connection) CollectPackets(state *state.State) {
 }
 
 func (c *Connection) HarvestPackets(state *state.State, buffer *[]ClientPacket, helper *[][]byte) {
+	*helper = (*helper)[:0]
 	c.UdpBuff.HarvestPackets(helper)
 
 	for _, data := range *helper {
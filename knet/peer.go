@@ -0,0 +1,129 @@
+package knet
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/util"
+)
+
+// headers of peer requests
+const (
+	PeerTimeHeader      = "peer-time"
+	PeerSignatureHeader = "peer-signature"
+)
+
+// PeerMaxSkew is how old peer request can be, it limits replaying of captured requests.
+const PeerMaxSkew = 30 * time.Second
+
+// PeerTimeout limits duration of CallPeer.
+var PeerTimeout = 10 * time.Second
+
+var (
+	ErrPeerDisabled     = errors.New("cluster secret is not configured")
+	ErrPeerUnauthorized = errors.New("peer request is not authorized")
+	ErrPeerExpired      = errors.New("peer request expired")
+)
+
+// SignPeer computes signature of rpc call between nodes.
+func SignPeer(secret, id string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(id))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// PeerError is returned by CallPeer if peer responded with error status.
+type PeerError struct {
+	Status  int
+	Message string
+}
+
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("peer responded with %d: %s", e.Status, e.Message)
+}
+
+// Rejected returns whether the rpc handler of the peer returned error, so the call
+// had no effect unless the handler says otherwise.
+func (e *PeerError) Rejected() bool {
+	return e.Status == http.StatusBadRequest
+}
+
+// CallPeer calls rpc on other keeper node. Address is http address of the node, call
+// is signed with secret from config.
+func CallPeer(state *state.State, address, id string, body []byte) ([]byte, error) {
+	secret := state.Cluster.Secret
+	if secret == "" {
+		return nil, ErrPeerDisabled
+	}
+
+	re, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s://%s/rpc", state.Net.Scheme, address), bytes.NewReader(body))
+	if err != nil {
+		return nil, util.WrapErr("failed to create request", err)
+	}
+
+	timestamp := state.Clock.Now().Unix()
+	re.Header.Set("id", id)
+	re.Header.Set(PeerTimeHeader, strconv.FormatInt(timestamp, 10))
+	re.Header.Set(PeerSignatureHeader, SignPeer(secret, id, timestamp, body))
+
+	client := http.Client{Timeout: PeerTimeout}
+	resp, err := client.Do(re)
+	if err != nil {
+		return nil, util.WrapErr("failed to call peer", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, util.WrapErr("failed to read peer response", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &PeerError{resp.StatusCode, string(bytes.TrimSpace(data))}
+	}
+
+	return data, nil
+}
+
+// RpcAssertPeer allows only calls made by CallPeer from node sharing the secret. Body
+// is still readable by following handlers.
+func RpcAssertPeer(state *state.State, user *state.User, w http.ResponseWriter, re *http.Request) error {
+	secret := state.Cluster.Secret
+	if secret == "" {
+		return ErrPeerDisabled
+	}
+
+	timestamp, err := strconv.ParseInt(re.Header.Get(PeerTimeHeader), 10, 64)
+	if err != nil {
+		return ErrPeerUnauthorized
+	}
+
+	skew := state.Clock.Now().Sub(time.Unix(timestamp, 0))
+	if skew > PeerMaxSkew || skew < -PeerMaxSkew {
+		return ErrPeerExpired
+	}
+
+	body, err := ioutil.ReadAll(re.Body)
+	if err != nil {
+		return util.WrapErr("failed to read request body", err)
+	}
+	re.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	expected := SignPeer(secret, re.Header.Get("id"), timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(re.Header.Get(PeerSignatureHeader))) {
+		return ErrPeerUnauthorized
+	}
+
+	return nil
+}
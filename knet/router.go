@@ -76,7 +76,7 @@ func (r *Router) RpcHandler(w http.ResponseWriter, re *http.Request) {
 	var session uuid.UUID
 	hex.Decode(session[:], rawSession[:])
 
-	user := r.GetUser(session, uuid.Nil)
+	user := r.ResolveSession(session)
 
 	r.Debug("Rpc call: id: %s session: %s", id, session)
 
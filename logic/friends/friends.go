@@ -0,0 +1,524 @@
+// friends manages friend requests, friendships and blocks between users. Relations
+// are persisted in Store and cached for users that have session. They are loaded
+// when user is added to state so checks done by matches never wait for Store.
+package friends
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/notify"
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+// DefaultMaxFriends is default limit of friends and sent requests of one user.
+const DefaultMaxFriends = 256
+
+var (
+	ErrSelf             = errors.New("you cannot do this to yourself")
+	ErrBlocked          = errors.New("user is blocked")
+	ErrAlreadyFriends   = errors.New("you are already friends")
+	ErrAlreadyRequested = errors.New("friend request was already sent")
+	ErrNoRequest        = errors.New("there is no friend request from this user")
+	ErrNotFriend        = errors.New("user is not your friend")
+	ErrNotBlocked       = errors.New("user is not blocked")
+	ErrTooManyFriends   = errors.New("too many friends")
+	ErrOperationFailed  = errors.New("operation failed")
+)
+
+// Entry is relation as seen by its owner.
+type Entry struct {
+	User uuid.UUID
+	Kind Kind
+	// Incoming is true for requests sent to the owner.
+	Incoming bool
+}
+
+type user struct {
+	// outgoing relations are owned by the user, incoming target them
+	outgoing, incoming map[uuid.UUID]Kind
+}
+
+// apply sets relation r on u which holds relations of id.
+func (u *user) apply(id uuid.UUID, r Relation) {
+	if r.Owner == id {
+		set(u.outgoing, r.Target, r.Kind)
+	}
+	if r.Target == id {
+		set(u.incoming, r.Owner, r.Kind)
+	}
+}
+
+// loading is relations of user being loaded from Store.
+type loading struct {
+	done chan struct{}
+	err  error
+	// updates stored while loading, they are applied once load finishes since
+	// load could have read relations before they were stored
+	updates []Relation
+}
+
+// Friends holds relations of users. Friends is match.BlockResolver and its
+// IsFriend can be used as presence.Tracker.Authorize, add it to state with
+// AddUserListener so relations are cached before they are checked. Users are
+// notified about requests with knet.OCFriendRequest, about accepted requests with
+// knet.OCFriendAccept and about removed friendships with knet.OCFriendRemove, data
+// is always id of the other user. Notifications are sent after Friends is unlocked.
+// Store is never accessed while Friends is locked so checks do not wait for it. All
+// allowed operations are thread safe.
+type Friends struct {
+	*state.State
+
+	// MaxFriends limits friends and sent requests, DefaultMaxFriends is used if 0.
+	MaxFriends int
+
+	store    Store
+	notifier notify.Notifier
+
+	users   map[uuid.UUID]*user
+	loading map[uuid.UUID]*loading
+	// failed holds users whose relations could not be loaded, Sweep retries them
+	failed  map[uuid.UUID]bool
+	pending notify.Batch
+	mutex   sync.Mutex
+	// writeMutex serializes updates so checks done before storing them stay valid
+	// while mutex is released
+	writeMutex sync.Mutex
+}
+
+// New creates friends, notifier can be nil. Call Run on goroutine so relations of
+// users without session are released from memory.
+func New(state *state.State, store Store, notifier notify.Notifier) *Friends {
+	return &Friends{
+		State:    state,
+		store:    store,
+		notifier: notifier,
+		users:    make(map[uuid.UUID]*user),
+		loading:  make(map[uuid.UUID]*loading),
+		failed:   make(map[uuid.UUID]bool),
+	}
+}
+
+// Request sends friend request to target. If target already sent request to the
+// user they become friends.
+func (f *Friends) Request(id, target uuid.UUID) error {
+	if id == target {
+		return ErrSelf
+	}
+
+	u, err := f.lockWrite(id)
+	if err != nil {
+		return err
+	}
+	defer f.unlockWrite()
+
+	switch {
+	case u.outgoing[target] == Blocked || u.incoming[target] == Blocked:
+		return ErrBlocked
+	case u.outgoing[target] == Friend:
+		return ErrAlreadyFriends
+	case u.outgoing[target] == Requested:
+		return ErrAlreadyRequested
+	case u.incoming[target] == Requested:
+		return f.accept(id, target, u)
+	case f.count(u) >= f.maxFriends():
+		return ErrTooManyFriends
+	}
+
+	if err := f.update(Relation{id, target, Requested}); err != nil {
+		return err
+	}
+
+	f.notify(target, knet.OCFriendRequest, id)
+
+	return nil
+}
+
+// Accept accepts friend request from requester.
+func (f *Friends) Accept(id, requester uuid.UUID) error {
+	u, err := f.lockWrite(id)
+	if err != nil {
+		return err
+	}
+	defer f.unlockWrite()
+
+	if u.incoming[requester] != Requested {
+		return ErrNoRequest
+	}
+
+	return f.accept(id, requester, u)
+}
+
+func (f *Friends) accept(id, requester uuid.UUID, u *user) error {
+	if f.count(u) >= f.maxFriends() {
+		return ErrTooManyFriends
+	}
+
+	err := f.update(Relation{requester, id, Friend}, Relation{id, requester, Friend})
+	if err != nil {
+		return err
+	}
+
+	f.notify(requester, knet.OCFriendAccept, id)
+
+	return nil
+}
+
+// Decline rejects friend request from requester.
+func (f *Friends) Decline(id, requester uuid.UUID) error {
+	u, err := f.lockWrite(id)
+	if err != nil {
+		return err
+	}
+	defer f.unlockWrite()
+
+	if u.incoming[requester] != Requested {
+		return ErrNoRequest
+	}
+
+	return f.update(Relation{requester, id, None})
+}
+
+// Remove ends friendship with target or cancels request sent to them.
+func (f *Friends) Remove(id, target uuid.UUID) error {
+	u, err := f.lockWrite(id)
+	if err != nil {
+		return err
+	}
+	defer f.unlockWrite()
+
+	switch u.outgoing[target] {
+	case Requested:
+		return f.update(Relation{id, target, None})
+	case Friend:
+		err := f.update(Relation{id, target, None}, Relation{target, id, None})
+		if err != nil {
+			return err
+		}
+		f.notify(target, knet.OCFriendRemove, id)
+		return nil
+	default:
+		return ErrNotFriend
+	}
+}
+
+// Block blocks target. Friendship and requests between users are removed and
+// target cannot send requests to the user or play with them.
+func (f *Friends) Block(id, target uuid.UUID) error {
+	if id == target {
+		return ErrSelf
+	}
+
+	u, err := f.lockWrite(id)
+	if err != nil {
+		return err
+	}
+	defer f.unlockWrite()
+
+	previous := u.outgoing[target]
+	if previous == Blocked {
+		return nil
+	}
+
+	relations := []Relation{{id, target, Blocked}}
+	if kind := u.incoming[target]; kind == Requested || kind == Friend {
+		relations = append(relations, Relation{target, id, None})
+	}
+	if err := f.update(relations...); err != nil {
+		return err
+	}
+
+	if previous == Friend {
+		f.notify(target, knet.OCFriendRemove, id)
+	}
+
+	return nil
+}
+
+// Unblock removes block of target.
+func (f *Friends) Unblock(id, target uuid.UUID) error {
+	u, err := f.lockWrite(id)
+	if err != nil {
+		return err
+	}
+	defer f.unlockWrite()
+
+	if u.outgoing[target] != Blocked {
+		return ErrNotBlocked
+	}
+
+	return f.update(Relation{id, target, None})
+}
+
+// List returns friends, sent and received requests and blocked users sorted by
+// kind. Users that blocked the user are not listed.
+func (f *Friends) List(id uuid.UUID) ([]Entry, error) {
+	u, err := f.lock(id)
+	if err != nil {
+		return nil, err
+	}
+	defer f.unlock()
+
+	entries := make([]Entry, 0, len(u.outgoing)+len(u.incoming))
+	for target, kind := range u.outgoing {
+		entries = append(entries, Entry{User: target, Kind: kind})
+	}
+	for owner, kind := range u.incoming {
+		if kind == Requested {
+			entries = append(entries, Entry{User: owner, Kind: kind, Incoming: true})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Kind != b.Kind {
+			return a.Kind > b.Kind
+		}
+		if a.Incoming != b.Incoming {
+			return a.Incoming
+		}
+		return bytes.Compare(a.User[:], b.User[:]) < 0
+	})
+
+	return entries, nil
+}
+
+// IsFriend returns whether users are friends. Only cached relations are checked,
+// users whose relations are not cached are not friends.
+func (f *Friends) IsFriend(a, b uuid.UUID) bool {
+	return f.relation(a, b, func(u *user, other uuid.UUID) bool {
+		return u.outgoing[other] == Friend
+	})
+}
+
+// Blocked returns whether one of the users blocked the other. Only cached relations
+// are checked so it is cheap enough for match loops and matchmaker.
+func (f *Friends) Blocked(a, b uuid.UUID) bool {
+	return f.relation(a, b, func(u *user, other uuid.UUID) bool {
+		return u.outgoing[other] == Blocked || u.incoming[other] == Blocked
+	})
+}
+
+// relation checks cached relations of a, or of b if a is not cached, with test.
+// Relations are symmetric so either side is enough.
+func (f *Friends) relation(a, b uuid.UUID, test func(u *user, other uuid.UUID) bool) bool {
+	if a == b {
+		return false
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if u, ok := f.users[a]; ok {
+		return test(u, b)
+	}
+	if u, ok := f.users[b]; ok {
+		return test(u, a)
+	}
+
+	return false
+}
+
+// UserAdded implements state.UserListener, it preloads relations of the user. If
+// loading fails, Sweep retries it and the user is not considered blocked meanwhile.
+func (f *Friends) UserAdded(user *state.User) {
+	f.Preload(user.ID())
+}
+
+// Preload caches relations of user if they are not cached. Store is accessed
+// without holding the lock, concurrent calls for the same user wait for one load.
+func (f *Friends) Preload(id uuid.UUID) error {
+	f.mutex.Lock()
+	if _, ok := f.users[id]; ok {
+		f.mutex.Unlock()
+		return nil
+	}
+	if l, ok := f.loading[id]; ok {
+		f.mutex.Unlock()
+		<-l.done
+		return l.err
+	}
+	l := &loading{done: make(chan struct{})}
+	f.loading[id] = l
+	f.mutex.Unlock()
+
+	u, err := f.load(id)
+
+	f.mutex.Lock()
+	delete(f.loading, id)
+	if err == nil {
+		for _, r := range l.updates {
+			u.apply(id, r)
+		}
+		f.users[id] = u
+		delete(f.failed, id)
+	} else {
+		f.failed[id] = true
+	}
+	f.mutex.Unlock()
+
+	l.err = err
+	close(l.done)
+
+	return err
+}
+
+// Run periodically calls Sweep.
+func (f *Friends) Run(interval time.Duration) {
+	ticker := f.Clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C() {
+		f.Sweep()
+	}
+}
+
+// Sweep releases cached relations of users without session and retries loading
+// relations of users with session that failed to load.
+func (f *Friends) Sweep() {
+	f.mutex.Lock()
+	for id := range f.users {
+		if f.GetUser(uuid.Nil, id) == nil {
+			delete(f.users, id)
+		}
+	}
+	var retry []uuid.UUID
+	for id := range f.failed {
+		if f.GetUser(uuid.Nil, id) != nil {
+			retry = append(retry, id)
+		}
+		delete(f.failed, id)
+	}
+	f.mutex.Unlock()
+
+	for _, id := range retry {
+		f.Preload(id)
+	}
+}
+
+// lock preloads relations of id and locks f, relations are then cached until
+// unlock.
+func (f *Friends) lock(id uuid.UUID) (*user, error) {
+	for {
+		if err := f.Preload(id); err != nil {
+			return nil, err
+		}
+
+		f.mutex.Lock()
+		if u, ok := f.users[id]; ok {
+			return u, nil
+		}
+		// swept in the meantime
+		f.mutex.Unlock()
+	}
+}
+
+// unlock unlocks f and sends notifications queued while it was locked.
+func (f *Friends) unlock() {
+	pending := f.pending.Take()
+	f.mutex.Unlock()
+	pending.Send(f.notifier)
+}
+
+// lockWrite is lock that also excludes other updates until unlockWrite.
+func (f *Friends) lockWrite(id uuid.UUID) (*user, error) {
+	f.writeMutex.Lock()
+	u, err := f.lock(id)
+	if err != nil {
+		f.writeMutex.Unlock()
+	}
+	return u, err
+}
+
+// unlockWrite unlocks f and sends notifications queued while it was locked.
+func (f *Friends) unlockWrite() {
+	pending := f.pending.Take()
+	f.mutex.Unlock()
+	f.writeMutex.Unlock()
+	pending.Send(f.notifier)
+}
+
+// load reads relations of id from store.
+func (f *Friends) load(id uuid.UUID) (*user, error) {
+	relations, err := f.store.Load(id)
+	if err != nil {
+		f.Error("Failed to load friends of %s: %s", id, err)
+		return nil, ErrOperationFailed
+	}
+
+	u := &user{
+		outgoing: make(map[uuid.UUID]Kind),
+		incoming: make(map[uuid.UUID]Kind),
+	}
+	for _, r := range relations {
+		if r.Owner == id {
+			u.outgoing[r.Target] = r.Kind
+		} else {
+			u.incoming[r.Owner] = r.Kind
+		}
+	}
+
+	return u, nil
+}
+
+// update stores relations and applies them to cached and loading users. It has to
+// be called between lockWrite and unlockWrite, lock is released while storing so
+// cached users can be swept in the meantime.
+func (f *Friends) update(relations ...Relation) error {
+	f.mutex.Unlock()
+	err := f.store.Update(relations...)
+	f.mutex.Lock()
+	if err != nil {
+		f.Error("Failed to update friends: %s", err)
+		return ErrOperationFailed
+	}
+
+	for _, r := range relations {
+		for _, id := range [...]uuid.UUID{r.Owner, r.Target} {
+			if u, ok := f.users[id]; ok {
+				u.apply(id, r)
+			}
+			if l, ok := f.loading[id]; ok {
+				l.updates = append(l.updates, r)
+			}
+		}
+	}
+
+	return nil
+}
+
+func set(relations map[uuid.UUID]Kind, id uuid.UUID, kind Kind) {
+	if kind == None {
+		delete(relations, id)
+	} else {
+		relations[id] = kind
+	}
+}
+
+// count returns amount of friends and sent requests.
+func (f *Friends) count(u *user) int {
+	count := 0
+	for _, kind := range u.outgoing {
+		if kind == Friend || kind == Requested {
+			count++
+		}
+	}
+	return count
+}
+
+// notify queues notification, it is sent on unlock.
+func (f *Friends) notify(target uuid.UUID, opCode knet.OpCode, other uuid.UUID) {
+	f.pending.Add(target, opCode, other[:])
+}
+
+func (f *Friends) maxFriends() int {
+	if f.MaxFriends == 0 {
+		return DefaultMaxFriends
+	}
+	return f.MaxFriends
+}
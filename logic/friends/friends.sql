@@ -0,0 +1,14 @@
+--+init+--
+CREATE TABLE IF NOT EXISTS friend_relations (
+    owner UUID NOT NULL,
+    target UUID NOT NULL,
+    kind SMALLINT NOT NULL,
+    PRIMARY KEY (owner, target)
+)
+--+set+--
+INSERT INTO friend_relations (owner, target, kind) VALUES ($1, $2, $3)
+ON CONFLICT (owner, target) DO UPDATE SET kind = $3
+--+delete+--
+DELETE FROM friend_relations WHERE owner = $1 AND target = $2
+--+load+--
+SELECT owner, target, kind FROM friend_relations WHERE owner = $1 OR target = $1
@@ -0,0 +1,387 @@
+package friends
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/notify/notifytest"
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/state/statetest"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+type memoryStore struct {
+	relations map[[2]uuid.UUID]Kind
+	fail      bool
+	loads     int
+	// hooks are called once from store methods, after relations are read
+	onLoad, onUpdate func()
+}
+
+func hook(h *func()) {
+	if f := *h; f != nil {
+		*h = nil
+		f()
+	}
+}
+
+func (m *memoryStore) Update(relations ...Relation) error {
+	if m.fail {
+		return errors.New("store failed")
+	}
+	for _, r := range relations {
+		if r.Kind == None {
+			delete(m.relations, [2]uuid.UUID{r.Owner, r.Target})
+		} else {
+			m.relations[[2]uuid.UUID{r.Owner, r.Target}] = r.Kind
+		}
+	}
+	hook(&m.onUpdate)
+	return nil
+}
+
+func (m *memoryStore) Load(user uuid.UUID) ([]Relation, error) {
+	m.loads++
+	if m.fail {
+		return nil, errors.New("store failed")
+	}
+	var result []Relation
+	for key, kind := range m.relations {
+		if key[0] == user || key[1] == user {
+			result = append(result, Relation{key[0], key[1], kind})
+		}
+	}
+	hook(&m.onLoad)
+	return result, nil
+}
+
+// last returns opcode of the last notification user received.
+func last(n *notifytest.Recorder, user uuid.UUID) knet.OpCode {
+	notification, ok := n.Last(user)
+	if !ok {
+		return knet.OCError
+	}
+	return notification.OpCode
+}
+
+func setup() (*Friends, *memoryStore, *notifytest.Recorder) {
+	s := statetest.New()
+	store := &memoryStore{relations: map[[2]uuid.UUID]Kind{}}
+	n := &notifytest.Recorder{}
+	return New(s, store, n), store, n
+}
+
+func TestRequests(t *testing.T) {
+	f, store, n := setup()
+	a, b, c := uuid.New(), uuid.New(), uuid.New()
+
+	if err := f.Request(a, a); err != ErrSelf {
+		t.Error(err)
+	}
+
+	if err := f.Request(a, b); err != nil {
+		t.Fatal(err)
+	}
+	if last(n, b) != knet.OCFriendRequest {
+		t.Error("b should be notified about request")
+	}
+	if err := f.Request(a, b); err != ErrAlreadyRequested {
+		t.Error(err)
+	}
+	if err := f.Accept(a, b); err != ErrNoRequest {
+		t.Error(err)
+	}
+
+	if err := f.Accept(b, a); err != nil {
+		t.Fatal(err)
+	}
+	if last(n, a) != knet.OCFriendAccept {
+		t.Error("a should be notified about accept")
+	}
+	if !f.IsFriend(a, b) || !f.IsFriend(b, a) {
+		t.Error("a and b should be friends")
+	}
+	if err := f.Request(b, a); err != ErrAlreadyFriends {
+		t.Error(err)
+	}
+
+	// mutual requests are accepted
+	if err := f.Request(c, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Request(a, c); err != nil {
+		t.Fatal(err)
+	}
+	if !f.IsFriend(c, a) {
+		t.Error("c and a should be friends")
+	}
+
+	if err := f.Remove(a, c); err != nil {
+		t.Fatal(err)
+	}
+	if last(n, c) != knet.OCFriendRemove || f.IsFriend(c, a) {
+		t.Error("friendship should be removed")
+	}
+	if err := f.Remove(a, c); err != ErrNotFriend {
+		t.Error(err)
+	}
+
+	if err := f.Request(c, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Decline(a, c); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Decline(a, c); err != ErrNoRequest {
+		t.Error(err)
+	}
+
+	if len(store.relations) != 2 {
+		t.Error(store.relations)
+	}
+
+	// cache is rebuilt from store
+	f.Sweep()
+	if len(f.users) != 0 || f.IsFriend(b, a) {
+		t.Error("relations should be released")
+	}
+	if err := f.Preload(b); err != nil || !f.IsFriend(b, a) {
+		t.Error("relations should be reloaded")
+	}
+
+	f.MaxFriends = 1
+	if err := f.Request(a, c); err != ErrTooManyFriends {
+		t.Error(err)
+	}
+}
+
+func TestBlock(t *testing.T) {
+	f, _, n := setup()
+	a, b, c := uuid.New(), uuid.New(), uuid.New()
+
+	if err := f.Request(a, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Accept(b, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Request(c, a); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Block(b, a); err != nil {
+		t.Fatal(err)
+	}
+	if last(n, a) != knet.OCFriendRemove || f.IsFriend(a, b) {
+		t.Error("block should remove friendship")
+	}
+	if !f.Blocked(a, b) || !f.Blocked(b, a) || f.Blocked(a, c) {
+		t.Error("a and b should be blocked")
+	}
+	if err := f.Request(a, b); err != ErrBlocked {
+		t.Error(err)
+	}
+
+	if err := f.Block(a, c); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := f.List(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries, []Entry{{User: c, Kind: Blocked}}) {
+		t.Error(entries)
+	}
+
+	if err := f.Unblock(b, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Unblock(b, a); err != ErrNotBlocked {
+		t.Error(err)
+	}
+	if f.Blocked(a, b) {
+		t.Error("a and b should not be blocked")
+	}
+}
+
+func TestList(t *testing.T) {
+	f, _, _ := setup()
+	a, friend, incoming, outgoing, blocked := uuid.New(), uuid.New(), uuid.New(), uuid.New(), uuid.New()
+
+	for _, err := range []error{
+		f.Request(friend, a),
+		f.Accept(a, friend),
+		f.Request(incoming, a),
+		f.Request(a, outgoing),
+		f.Block(a, blocked),
+		f.Block(uuid.New(), a),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := f.List(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Entry{
+		{User: blocked, Kind: Blocked},
+		{User: friend, Kind: Friend},
+		{User: incoming, Kind: Requested, Incoming: true},
+		{User: outgoing, Kind: Requested},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("\n%v\n%v", expected, entries)
+	}
+}
+
+func TestStoreFailure(t *testing.T) {
+	f, store, _ := setup()
+	a, b := uuid.New(), uuid.New()
+	store.fail = true
+
+	if err := f.Request(a, b); err != ErrOperationFailed {
+		t.Error(err)
+	}
+	if f.Blocked(a, b) {
+		t.Error("failed load should not block")
+	}
+
+	store.fail = false
+	if err := f.Request(a, b); err != nil {
+		t.Fatal(err)
+	}
+
+	store.fail = true
+	if err := f.Accept(b, a); err != ErrOperationFailed {
+		t.Error(err)
+	}
+	if f.IsFriend(a, b) {
+		t.Error("failed update should not change cache")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	f, _, _ := setup()
+	f.AddUserListener(f)
+	online := state.NewUser(uuid.New(), uuid.New(), time.Hour, "")
+	f.AddUser(online)
+
+	f.Preload(uuid.New())
+	f.Sweep()
+
+	if _, ok := f.users[online.ID()]; !ok || len(f.users) != 1 {
+		t.Error(f.users)
+	}
+}
+
+func TestCachedChecks(t *testing.T) {
+	f, store, _ := setup()
+	a, b := uuid.New(), uuid.New()
+
+	if err := f.Block(a, b); err != nil {
+		t.Fatal(err)
+	}
+	f.Sweep()
+
+	loads := store.loads
+	if f.Blocked(a, b) || f.IsFriend(a, b) || store.loads != loads {
+		t.Error("checks should not load relations")
+	}
+
+	// relations of either user are enough
+	f.AddUserListener(f)
+	f.AddUser(state.NewUser(b, uuid.New(), time.Hour, ""))
+	if store.loads != loads+1 || !f.Blocked(a, b) || !f.Blocked(b, a) {
+		t.Error("relations should be preloaded when user is added")
+	}
+}
+
+type reentrant struct {
+	notifytest.Recorder
+	friends *Friends
+}
+
+func (r *reentrant) Notify(user uuid.UUID, opCode knet.OpCode, data []byte) bool {
+	r.friends.IsFriend(user, user)
+	return r.Recorder.Notify(user, opCode, data)
+}
+
+func TestNotifyOutsideLock(t *testing.T) {
+	f, _, _ := setup()
+	n := &reentrant{friends: f}
+	f.notifier = n
+	a, b := uuid.New(), uuid.New()
+
+	if err := f.Request(a, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if last(&n.Recorder, b) != knet.OCFriendRequest {
+		t.Error("b should be notified")
+	}
+}
+
+func TestUpdateWhileLoading(t *testing.T) {
+	f, store, _ := setup()
+	a, b := uuid.New(), uuid.New()
+
+	// block is stored after a's relations were read
+	store.onLoad = func() {
+		if err := f.Block(b, a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Preload(a); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.users[a].incoming[b] != Blocked {
+		t.Error("update should be applied to loaded relations")
+	}
+}
+
+func TestStoreOutsideLock(t *testing.T) {
+	f, store, _ := setup()
+	a, b := uuid.New(), uuid.New()
+
+	store.onUpdate = func() {
+		if f.Blocked(a, b) {
+			t.Error("block should not be visible before it is stored")
+		}
+	}
+	if err := f.Block(a, b); err != nil {
+		t.Fatal(err)
+	}
+	if !f.Blocked(a, b) {
+		t.Error("a should block b")
+	}
+}
+
+func TestPreloadRetry(t *testing.T) {
+	f, store, _ := setup()
+	f.AddUserListener(f)
+	a, b := uuid.New(), uuid.New()
+	if err := f.Block(a, b); err != nil {
+		t.Fatal(err)
+	}
+	f.Sweep()
+
+	store.fail = true
+	f.AddUser(state.NewUser(a, uuid.New(), time.Hour, ""))
+	if f.Blocked(a, b) {
+		t.Error("failed load should not block")
+	}
+
+	store.fail = false
+	f.Sweep()
+	if !f.Blocked(a, b) {
+		t.Error("sweep should retry failed load")
+	}
+}
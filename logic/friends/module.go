@@ -0,0 +1,111 @@
+package friends
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jakubDoka/keeper/core"
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/presence"
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/util"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+// Module stores relations in database and registers friend rpcs. Only friends can
+// see presence of each other and blocked users are kept apart in matches.
+// friends-list responds with count of entries followed by kind, incoming flag and
+// presence of each entry, presence of users that are not friends is always empty.
+type Module struct {
+	*Friends
+
+	presence *presence.Tracker
+}
+
+func (m *Module) Init(a core.App) {
+	store, err := NewSQLStore(a.State)
+	if err != nil {
+		a.Fatal("cannot prepare friends: %s", err)
+	}
+
+	m.Friends = New(a.State, store, a.Notify)
+	m.presence = a.Presence
+
+	a.AddUserListener(m.Friends)
+	a.Manager.SetBlockResolver(m.Friends)
+	a.Presence.Authorize = m.IsFriend
+
+	a.RegisterTargetRpc("friends-request", core.ErrMissingUserID, m.Request)
+	a.RegisterTargetRpc("friends-accept", core.ErrMissingUserID, m.Accept)
+	a.RegisterTargetRpc("friends-decline", core.ErrMissingUserID, m.Decline)
+	a.RegisterTargetRpc("friends-remove", core.ErrMissingUserID, m.remove)
+	a.RegisterTargetRpc("friends-block", core.ErrMissingUserID, m.block)
+	a.RegisterTargetRpc("friends-unblock", core.ErrMissingUserID, m.Unblock)
+
+	a.RegisterRpc("friends-list", knet.RpcAssertUser, func(state *state.State, user *state.User, w http.ResponseWriter, re *http.Request) error {
+		entries, err := m.List(user.ID())
+		if err != nil {
+			return err
+		}
+
+		var friends []uuid.UUID
+		for _, e := range entries {
+			if e.Kind == Friend {
+				friends = append(friends, e.User)
+			}
+		}
+		presences, err := m.presence.Get(user.ID(), friends...)
+		if err != nil {
+			return err
+		}
+
+		byUser := make(map[uuid.UUID]presence.Presence, len(presences))
+		for _, p := range presences {
+			byUser[p.User] = p
+		}
+
+		writer := util.NewWriter(0)
+		writer.Uint32(uint32(len(entries)))
+		for _, e := range entries {
+			p, ok := byUser[e.User]
+			if !ok {
+				p = presence.Presence{User: e.User}
+			}
+			writer.Uint8(uint8(e.Kind))
+			if e.Incoming {
+				writer.Uint8(1)
+			} else {
+				writer.Uint8(0)
+			}
+			p.Encode(&writer)
+		}
+		w.Write(writer.Buffer())
+
+		return nil
+	})
+
+	go m.Run(time.Minute)
+}
+
+// remove also stops presence updates between the users.
+func (m *Module) remove(id, target uuid.UUID) error {
+	err := m.Remove(id, target)
+	if err == nil {
+		m.unsubscribe(id, target)
+	}
+	return err
+}
+
+// block also stops presence updates between the users.
+func (m *Module) block(id, target uuid.UUID) error {
+	err := m.Block(id, target)
+	if err == nil {
+		m.unsubscribe(id, target)
+	}
+	return err
+}
+
+func (m *Module) unsubscribe(a, b uuid.UUID) {
+	m.presence.Unsubscribe(a, b)
+	m.presence.Unsubscribe(b, a)
+}
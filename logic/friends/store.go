@@ -0,0 +1,106 @@
+package friends
+
+import (
+	_ "embed"
+
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+// Kind is kind of relation owner has to target.
+type Kind uint8
+
+const (
+	// None means there is no relation, storing it deletes the relation.
+	None Kind = iota
+	// Requested means owner sent friend request to target.
+	Requested
+	// Friend relation is always stored in both directions.
+	Friend
+	// Blocked means owner blocked target.
+	Blocked
+)
+
+// Relation is one directed relation between two users.
+type Relation struct {
+	Owner, Target uuid.UUID
+	Kind          Kind
+}
+
+// Store persists relations. Methods are called from multiple goroutines.
+type Store interface {
+	// Update stores all relations at once.
+	Update(relations ...Relation) error
+	// Load returns all relations user owns or is target of.
+	Load(user uuid.UUID) ([]Relation, error)
+}
+
+//go:embed friends.sql
+var sqlString string
+
+// SQLStore stores relations in database trough state.Prepared.
+type SQLStore struct {
+	*state.State
+}
+
+// NewSQLStore prepares the statements, this has to be called before state.Prepared
+// is finished.
+func NewSQLStore(s *state.State) (*SQLStore, error) {
+	err := s.Prepare("friends", sqlString)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLStore{s}, nil
+}
+
+// Update performs all changes in one transaction.
+func (s *SQLStore) Update(relations ...Relation) error {
+	tx, err := s.Begin()
+	if err != nil {
+		return err
+	}
+
+	set, del := tx.Stmt(s.Get("friends:set")), tx.Stmt(s.Get("friends:delete"))
+	for _, r := range relations {
+		if r.Kind == None {
+			_, err = del.Exec(r.Owner.StringWithHyphens(), r.Target.StringWithHyphens())
+		} else {
+			_, err = set.Exec(r.Owner.StringWithHyphens(), r.Target.StringWithHyphens(), r.Kind)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLStore) Load(user uuid.UUID) ([]Relation, error) {
+	rows, err := s.Get("friends:load").Query(user.StringWithHyphens())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Relation
+	for rows.Next() {
+		var owner, target string
+		var r Relation
+		err := rows.Scan(&owner, &target, &r.Kind)
+		if err != nil {
+			return nil, err
+		}
+		r.Owner, err = uuid.ParseWithHyphens(owner)
+		if err != nil {
+			return nil, err
+		}
+		r.Target, err = uuid.ParseWithHyphens(target)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+
+	return result, rows.Err()
+}
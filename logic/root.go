@@ -10,6 +10,7 @@ import (
 	"github.com/jakubDoka/keeper/core"
 	"github.com/jakubDoka/keeper/logic/auth"
 	"github.com/jakubDoka/keeper/logic/cfg"
+	"github.com/jakubDoka/keeper/logic/friends"
 	"github.com/jakubDoka/keeper/logic/pages"
 	"github.com/jakubDoka/keeper/logic/users"
 	"github.com/jakubDoka/keeper/state"
@@ -26,9 +27,9 @@ var (
 )
 
 func Run() {
-	core.Launch(&Mod{})
+	app := core.Launch(&Mod{}, &friends.Module{})
 
-	core.Block()
+	app.Block()
 }
 
 type Mod struct {
@@ -67,13 +68,13 @@ func (m *Mod) HandleLogin(s *state.State, email string, password string, addr st
 		return nil, ErrInvalidLogin
 	}
 
-	user := state.NewUser(id, uuid.New(), time.Duration(m.SessionDuration)*time.Minute, addr)
+	user := state.NewUserWithClock(s.Clock, id, uuid.New(), time.Duration(m.SessionDuration)*time.Minute, addr)
 
 	return user, nil
 }
 
 func (m *Mod) HandleRegistration(state *state.State, email, password string, meta []byte) error {
-	user, err := users.NewUnverified(email, password)
+	user, err := users.NewUnverified(state.Clock, email, password)
 	if err != nil {
 		return err
 	}
@@ -124,7 +125,7 @@ func (m *Mod) VerifyUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if time.Now().After(user.Expiration) {
+	if user.Expired(m.State.Clock) {
 		http.Error(w, "Code expired.", http.StatusBadRequest)
 		return
 	}
@@ -163,9 +164,14 @@ func (m *Mod) SearchMatch(state *state.State, user *state.User, w http.ResponseW
 	writer := util.NewWriter(len(matches) * 0xFF)
 	writer.Uint32(uint32(len(matches)))
 
-	for _, match := range matches {
-		writer.UUID(match)
-		match := m.Manager.GetMatch(match)
+	for _, hit := range matches {
+		writer.UUID(hit.ID)
+		match := m.Manager.GetMatch(hit.ID)
+		if match == nil {
+			writer.Uint32(0)
+			writer.Bytes(nil)
+			continue
+		}
 		writer.Uint32(match.UserAmount())
 		writer.Bytes(match.Info())
 	}
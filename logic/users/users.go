@@ -9,6 +9,7 @@ import (
 
 	"github.com/jakubDoka/keeper/core"
 	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/util/clock"
 	"github.com/jakubDoka/keeper/util/uuid"
 	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
@@ -91,7 +92,14 @@ type Unverified struct {
 	Expiration time.Time
 }
 
-func NewUnverified(email, password string) (Unverified, error) {
+// Expired returns whether verification code is no longer valid.
+func (u Unverified) Expired(c clock.Clock) bool {
+	return c.Now().After(u.Expiration)
+}
+
+// NewUnverified hashes the password and generates verification code that expires
+// after 5 minutes measured by c.
+func NewUnverified(c clock.Clock, email, password string) (Unverified, error) {
 	if len(password) < MinPasswordLength {
 		return Unverified{}, ErrPasswordTooShort
 	}
@@ -112,6 +120,6 @@ func NewUnverified(email, password string) (Unverified, error) {
 		Email:      email,
 		Password:   string(hash),
 		Code:       uuid.New(),
-		Expiration: time.Now().Add(time.Minute * 5),
+		Expiration: c.Now().Add(time.Minute * 5),
 	}, nil
 }
@@ -0,0 +1,189 @@
+package match
+
+import (
+	"math"
+
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+// DefaultCellSize is cell size of Interest created by Match.Interest.
+const DefaultCellSize = 64
+
+// DefaultMaxRadius is MaxRadius of Interest created by NewInterest in cells.
+const DefaultMaxRadius = 8
+
+// Vec is position in the world.
+type Vec struct {
+	X, Y float64
+}
+
+// Interest is area of interest grid. Each subscriber has a position and radius and
+// it is interested in everything that happens inside the circle. Subscriber is
+// stored in all cells its circle touches so lookup only visits one cell. Cell size
+// should be close to typical radius.
+type Interest struct {
+	// MaxRadius limits radius passed to Subscribe so one subscriber cannot occupy
+	// unbounded amount of cells.
+	MaxRadius float64
+
+	cellSize    float64
+	cells       map[cell][]uuid.UUID
+	subscribers map[uuid.UUID]subscriber
+	buffer      []uuid.UUID
+}
+
+type cell struct {
+	x, y int32
+}
+
+type subscriber struct {
+	position Vec
+	radius   float64
+	min, max cell
+}
+
+// NewInterest creates empty grid with given cell size and MaxRadius of
+// DefaultMaxRadius cells.
+func NewInterest(cellSize float64) *Interest {
+	if cellSize <= 0 {
+		panic("cell size has to be positive")
+	}
+	return &Interest{
+		MaxRadius:   cellSize * DefaultMaxRadius,
+		cellSize:    cellSize,
+		cells:       make(map[cell][]uuid.UUID),
+		subscribers: make(map[uuid.UUID]subscriber),
+	}
+}
+
+// Subscribe adds user or updates their position and radius. Radius is clamped
+// between 0 and MaxRadius.
+func (i *Interest) Subscribe(user uuid.UUID, position Vec, radius float64) {
+	if !(radius > 0) {
+		radius = 0
+	} else if radius > i.MaxRadius {
+		radius = i.MaxRadius
+	}
+
+	s := subscriber{
+		position: position,
+		radius:   radius,
+		min:      i.cell(Vec{position.X - radius, position.Y - radius}),
+		max:      i.cell(Vec{position.X + radius, position.Y + radius}),
+	}
+
+	old, ok := i.subscribers[user]
+	if ok && old.min == s.min && old.max == s.max {
+		i.subscribers[user] = s
+		return
+	}
+
+	if ok {
+		i.remove(user, old)
+	}
+	i.subscribers[user] = s
+
+	for x := s.min.x; x <= s.max.x; x++ {
+		for y := s.min.y; y <= s.max.y; y++ {
+			c := cell{x, y}
+			i.cells[c] = append(i.cells[c], user)
+		}
+	}
+}
+
+// Unsubscribe removes user from the grid.
+func (i *Interest) Unsubscribe(user uuid.UUID) {
+	s, ok := i.subscribers[user]
+	if !ok {
+		return
+	}
+	i.remove(user, s)
+	delete(i.subscribers, user)
+}
+
+// Subscribed returns position and radius of user.
+func (i *Interest) Subscribed(user uuid.UUID) (position Vec, radius float64, ok bool) {
+	s, ok := i.subscribers[user]
+	return s.position, s.radius, ok
+}
+
+// Interested returns users whose circle contains position. Returned slice is reused
+// by next call.
+func (i *Interest) Interested(position Vec) []uuid.UUID {
+	i.buffer = i.buffer[:0]
+	for _, user := range i.cells[i.cell(position)] {
+		s := i.subscribers[user]
+		dx, dy := s.position.X-position.X, s.position.Y-position.Y
+		if dx*dx+dy*dy <= s.radius*s.radius {
+			i.buffer = append(i.buffer, user)
+		}
+	}
+	return i.buffer
+}
+
+func (i *Interest) remove(user uuid.UUID, s subscriber) {
+	for x := s.min.x; x <= s.max.x; x++ {
+		for y := s.min.y; y <= s.max.y; y++ {
+			c := cell{x, y}
+			users := i.cells[c]
+			for j, u := range users {
+				if u == user {
+					users[j] = users[len(users)-1]
+					users = users[:len(users)-1]
+					break
+				}
+			}
+			if len(users) == 0 {
+				delete(i.cells, c)
+			} else {
+				i.cells[c] = users
+			}
+		}
+	}
+}
+
+// cellLimit bounds cell coordinates so loops over cells of a subscriber cannot
+// overflow.
+const cellLimit = math.MaxInt32 - 1
+
+func (i *Interest) cell(position Vec) cell {
+	return cell{
+		x: coordinate(position.X / i.cellSize),
+		y: coordinate(position.Y / i.cellSize),
+	}
+}
+
+// coordinate converts v to cell coordinate clamped to cellLimit, NaN maps to 0.
+func coordinate(v float64) int32 {
+	v = math.Floor(v)
+	switch {
+	case v >= cellLimit:
+		return cellLimit
+	case v <= -cellLimit:
+		return -cellLimit
+	case v != v:
+		return 0
+	}
+	return int32(v)
+}
+
+// Interest returns area of interest grid of the match, it is created on first call
+// with DefaultCellSize. Disconnected users are unsubscribed automatically.
+func (m *Match) Interest() *Interest {
+	if m.interest == nil {
+		m.interest = NewInterest(DefaultCellSize)
+	}
+	return m.interest
+}
+
+// SetInterest replaces area of interest grid of the match.
+func (m *Match) SetInterest(interest *Interest) {
+	m.interest = interest
+}
+
+// SendToInterested sends packet to all players interested in position.
+func (m *Match) SendToInterested(position Vec, opCode knet.OpCode, data []byte, udp bool) {
+	targets := m.Interest().Interested(position)
+	m.SendPacket(&targets, opCode, data, udp)
+}
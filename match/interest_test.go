@@ -0,0 +1,145 @@
+package match_test
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/match"
+	"github.com/jakubDoka/keeper/match/matchtest"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+func TestInterestMatchesBruteForce(t *testing.T) {
+	interest := match.NewInterest(10)
+	r := rand.New(rand.NewSource(0))
+
+	type sub struct {
+		position match.Vec
+		radius   float64
+	}
+	subs := map[uuid.UUID]sub{}
+	random := func() match.Vec {
+		return match.Vec{X: r.Float64()*200 - 100, Y: r.Float64()*200 - 100}
+	}
+
+	for i := 0; i < 100; i++ {
+		id := uuid.New()
+		s := sub{random(), r.Float64() * 30}
+		subs[id] = s
+		interest.Subscribe(id, s.position, s.radius)
+	}
+
+	// move and remove some to exercise updates
+	i := 0
+	for id := range subs {
+		switch i % 3 {
+		case 0:
+			s := sub{random(), r.Float64() * 30}
+			subs[id] = s
+			interest.Subscribe(id, s.position, s.radius)
+		case 1:
+			delete(subs, id)
+			interest.Unsubscribe(id)
+		}
+		i++
+	}
+
+	for i := 0; i < 1000; i++ {
+		p := random()
+		expected := map[uuid.UUID]bool{}
+		for id, s := range subs {
+			dx, dy := s.position.X-p.X, s.position.Y-p.Y
+			if dx*dx+dy*dy <= s.radius*s.radius {
+				expected[id] = true
+			}
+		}
+
+		got := interest.Interested(p)
+		if len(got) != len(expected) {
+			t.Fatalf("at %v expected %d users, got %d", p, len(expected), len(got))
+		}
+		for _, id := range got {
+			if !expected[id] {
+				t.Fatalf("at %v user %s should not be interested", p, id)
+			}
+		}
+	}
+}
+
+func TestSendToInterested(t *testing.T) {
+	h, err := matchtest.New(&match.CoreBase{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	near, far := h.Join(nil), h.Join(nil)
+	h.Tick(1)
+
+	h.Interest().Subscribe(near.ID(), match.Vec{X: 0, Y: 0}, 50)
+	h.Interest().Subscribe(far.ID(), match.Vec{X: 1000, Y: 0}, 50)
+
+	h.SendToInterested(match.Vec{X: 20, Y: 20}, knet.OCLast, nil, true)
+
+	if len(near.Received(knet.OCLast)) != 1 || len(far.Received(knet.OCLast)) != 0 {
+		t.Error("only near player should receive the packet")
+	}
+
+	far.Disconnect()
+	h.Tick(1)
+	if _, _, ok := h.Interest().Subscribed(far.ID()); ok {
+		t.Error("disconnected player should be unsubscribed")
+	}
+}
+
+func TestInterestMaxRadius(t *testing.T) {
+	interest := match.NewInterest(10)
+	interest.MaxRadius = 20
+
+	user := uuid.New()
+	interest.Subscribe(user, match.Vec{}, 1e18)
+	if _, radius, _ := interest.Subscribed(user); radius != 20 {
+		t.Errorf("radius should be clamped to 20, got %f", radius)
+	}
+	if len(interest.Interested(match.Vec{X: 30})) != 0 {
+		t.Error("position outside of max radius should not be interesting")
+	}
+
+	interest.Subscribe(user, match.Vec{}, -5)
+	if _, radius, _ := interest.Subscribed(user); radius != 0 {
+		t.Errorf("negative radius should be clamped to 0, got %f", radius)
+	}
+}
+
+func TestInterestFarPositions(t *testing.T) {
+	interest := match.NewInterest(match.DefaultCellSize)
+	far, nan := uuid.New(), uuid.New()
+
+	position := match.Vec{X: 1.4e11, Y: -1.4e11}
+	interest.Subscribe(far, position, interest.MaxRadius)
+	if users := interest.Interested(position); len(users) != 1 || users[0] != far {
+		t.Errorf("subscriber should be interested, got %v", users)
+	}
+
+	// these only have to terminate
+	interest.Subscribe(far, match.Vec{X: math.MaxFloat64, Y: math.Inf(-1)}, interest.MaxRadius)
+	interest.Subscribe(nan, match.Vec{X: math.NaN()}, 10)
+	interest.Unsubscribe(far)
+	interest.Unsubscribe(nan)
+	if len(interest.Interested(match.Vec{})) != 0 {
+		t.Error("unsubscribed users should not be interested")
+	}
+}
+
+func BenchmarkInterested(b *testing.B) {
+	interest := match.NewInterest(64)
+	r := rand.New(rand.NewSource(0))
+	for i := 0; i < 10000; i++ {
+		interest.Subscribe(uuid.New(), match.Vec{X: r.Float64() * 10000, Y: r.Float64() * 10000}, 100)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		interest.Interested(match.Vec{X: r.Float64() * 10000, Y: r.Float64() * 10000})
+	}
+}
@@ -0,0 +1,307 @@
+package match
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"sort"
+	"sync/atomic"
+
+	"github.com/jakubDoka/keeper/index"
+	"github.com/jakubDoka/keeper/util"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+// MaxPageSize is the maximal amount of matches List returns at once.
+const MaxPageSize = 100
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrUnknownSort   = errors.New("unknown sort order")
+)
+
+// SortBy determines order of listed matches. Both orders are descending by default and
+// ties are broken by match id so the order is stable.
+type SortBy uint8
+
+const (
+	// SortScore sorts by weighted relevance of query fields match satisfies, the same
+	// relevance Manager.Search orders by.
+	SortScore SortBy = iota
+	// SortUserAmount sorts by amount of connected players.
+	SortUserAmount
+	sortLast
+)
+
+// ListOptions configures Manager.List, zero value lists all matches by id.
+type ListOptions struct {
+	// Query is boolean index query (see index.Parser.ParseQuery) or its JSON
+	// representation (see index.ParseJSONQuery) matches have to satisfy, empty query
+	// matches everything with score 0.
+	Query []byte
+	// MinScore filters out matches satisfying less query fields that are not negated.
+	MinScore uint32
+
+	Sort      SortBy
+	Ascending bool
+
+	// MinUsers and MaxUsers filter by player count, MaxUsers 0 means no limit.
+	MinUsers, MaxUsers uint32
+	// OpenOnly filters out matches that are not open for join, see Match.SetOpen.
+	OpenOnly bool
+
+	// Limit is clamped to MaxPageSize, 0 means MaxPageSize.
+	Limit uint32
+	// Cursor is Page.Cursor of previous page, nil starts from the beginning.
+	Cursor []byte
+}
+
+// Entry is a listed match.
+type Entry struct {
+	ID uuid.UUID
+	// Score is amount of query fields match satisfies, see ListOptions.MinScore.
+	Score uint32
+	// Relevance is sum of relevance of fields match satisfies, see index.Scores.
+	Relevance  float64
+	UserAmount uint32
+	Open       bool
+}
+
+// Page is a result of Manager.List.
+type Page struct {
+	Entries []Entry
+	// Cursor points after the last entry, it is nil if there are no more matches.
+	Cursor []byte
+}
+
+// List lists matches page by page. Cursor remembers the sort key of last entry so
+// pages do not overlap even if matches are added or removed in between, though match
+// whose player count changes may appear twice or not at all when sorting by it.
+func (m *Manager) List(options ListOptions) (Page, error) {
+	if options.Sort >= sortLast {
+		return Page{}, ErrUnknownSort
+	}
+
+	limit := options.PageLimit()
+
+	var after Entry
+	hasCursor := options.Cursor != nil
+	if hasCursor {
+		var ok bool
+		after, ok = decodeCursor(options.Cursor, options.Sort)
+		if !ok {
+			return Page{}, ErrInvalidCursor
+		}
+	}
+
+	var scores, matched Buffer
+	var relevance index.Scores
+	if len(options.Query) != 0 {
+		query, err := m.parseQuery(options.Query)
+		if err != nil {
+			return Page{}, err
+		}
+
+		matched = Buffer{}
+		m.index.QueryIn(&matched, query, m.documents)
+
+		fields := query.Fields(nil)
+		scores = Buffer{}
+		m.index.Search(&scores, fields...)
+		relevance = index.Scores{}
+		m.index.Search(relevance, fields...)
+	}
+
+	var entries []Entry
+
+	m.matchesMutex.RLock()
+	for id, match := range m.matches {
+		var score uint32
+		if matched != nil {
+			score = scores[id]
+			if matched[id] == 0 || score < options.MinScore {
+				continue
+			}
+		}
+
+		entry := Entry{
+			ID:         id,
+			Score:      score,
+			Relevance:  relevance[&match.id],
+			UserAmount: match.UserAmount(),
+			Open:       match.Open(),
+		}
+
+		if entry.UserAmount < options.MinUsers ||
+			options.MaxUsers != 0 && entry.UserAmount > options.MaxUsers ||
+			options.OpenOnly && !entry.Open {
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+	m.matchesMutex.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return options.Less(entries[i], entries[j])
+	})
+
+	start := 0
+	if hasCursor {
+		start = sort.Search(len(entries), func(i int) bool {
+			return options.Less(after, entries[i])
+		})
+	}
+
+	entries = entries[start:]
+
+	var page Page
+	if len(entries) > limit {
+		entries = entries[:limit]
+		page.Cursor = options.CursorAfter(entries[limit-1])
+	}
+	page.Entries = entries
+
+	return page, nil
+}
+
+// Less reports whether a is listed before b. Order does not depend on node so pages
+// from multiple managers can be merged.
+func (o ListOptions) Less(a, b Entry) bool {
+	ka, kb := a.key(o.Sort), b.key(o.Sort)
+	if ka != kb {
+		return ka > kb != o.Ascending
+	}
+	return bytes.Compare(a.ID[:], b.ID[:]) < 0
+}
+
+// CursorAfter returns cursor of page that starts after e.
+func (o ListOptions) CursorAfter(e Entry) []byte {
+	return encodeCursor(e, o.Sort)
+}
+
+// PageLimit returns Limit clamped to MaxPageSize.
+func (o ListOptions) PageLimit() int {
+	if o.Limit != 0 && o.Limit < MaxPageSize {
+		return int(o.Limit)
+	}
+	return MaxPageSize
+}
+
+// ListOptions flags.
+const (
+	listAscending uint8 = 1 << iota
+	listOpenOnly
+)
+
+// Encode writes options as sort, flags, user limits, page limit, min score, cursor and
+// query. Clients use the same format in list-matches rpc.
+func (o ListOptions) Encode(writer *util.Writer) {
+	var flags uint8
+	if o.Ascending {
+		flags |= listAscending
+	}
+	if o.OpenOnly {
+		flags |= listOpenOnly
+	}
+
+	writer.
+		Uint8(uint8(o.Sort)).
+		Uint8(flags).
+		Uint32(o.MinUsers).
+		Uint32(o.MaxUsers).
+		Uint32(o.Limit).
+		Uint32(o.MinScore).
+		Bytes(o.Cursor).
+		Bytes(o.Query)
+}
+
+// DecodeListOptions reads options written by ListOptions.Encode.
+func DecodeListOptions(reader *util.Reader) (o ListOptions, ok bool) {
+	sort, ok := reader.Uint8()
+	if !ok {
+		return
+	}
+	o.Sort = SortBy(sort)
+	flags, ok := reader.Uint8()
+	if !ok {
+		return
+	}
+	o.Ascending = flags&listAscending != 0
+	o.OpenOnly = flags&listOpenOnly != 0
+	if o.MinUsers, ok = reader.Uint32(); !ok {
+		return
+	}
+	if o.MaxUsers, ok = reader.Uint32(); !ok {
+		return
+	}
+	if o.Limit, ok = reader.Uint32(); !ok {
+		return
+	}
+	if o.MinScore, ok = reader.Uint32(); !ok {
+		return
+	}
+	if o.Cursor, ok = reader.Bytes(); !ok {
+		return
+	}
+	if len(o.Cursor) == 0 {
+		o.Cursor = nil
+	}
+	o.Query, ok = reader.Bytes()
+	return
+}
+
+// Open returns whether core accepts new players. This is thread safe.
+func (m *Match) Open() bool {
+	return atomic.LoadInt32(&m.open) == 1
+}
+
+// SetOpen marks match as open or closed for new players, matches are open by default.
+// Flag is only informative for List, core still has to reject players itself.
+func (m *Match) SetOpen(open bool) {
+	var value int32
+	if open {
+		value = 1
+	}
+	atomic.StoreInt32(&m.open, value)
+}
+
+func (e Entry) key(sort SortBy) float64 {
+	if sort == SortUserAmount {
+		return float64(e.UserAmount)
+	}
+	return e.Relevance
+}
+
+func encodeCursor(e Entry, sort SortBy) []byte {
+	var calc util.Calculator
+	writer := calc.Uint8().Uint64().UUID().ToWriter()
+	writer.
+		Uint8(uint8(sort)).
+		Uint64(math.Float64bits(e.key(sort))).
+		UUID(e.ID)
+	return writer.Buffer()
+}
+
+func decodeCursor(data []byte, sort SortBy) (e Entry, ok bool) {
+	reader := util.NewReader(data)
+
+	s, ok := reader.Uint8()
+	if !ok || SortBy(s) != sort {
+		return e, false
+	}
+
+	bits, ok := reader.Uint64()
+	if !ok {
+		return e, false
+	}
+	key := math.Float64frombits(bits)
+	if sort == SortUserAmount {
+		e.UserAmount = uint32(key)
+	} else {
+		e.Relevance = key
+	}
+
+	e.ID, ok = reader.UUID()
+	return e, ok
+}
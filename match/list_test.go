@@ -0,0 +1,281 @@
+package match
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/jakubDoka/keeper/index"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+func TestList(t *testing.T) {
+	manager := testManager()
+	manager.DeclareField("mode", index.KindString)
+	manager.DeclareField("region", index.KindInt)
+
+	add := func(tag string, users uint32, open bool) uuid.UUID {
+		m := newMatch(manager.State, manager, &CoreBase{}, uuid.Nil, uuid.Nil)
+		if _, err := m.SetTag([]byte(tag)); err != nil {
+			t.Fatal(err)
+		}
+		m.userAmount = users
+		m.SetOpen(open)
+		manager.matches[m.ID()] = m
+		return m.ID()
+	}
+
+	full := add("mode: ranked region: 1", 8, false)
+	a := add("mode: ranked region: 1", 3, true)
+	b := add("mode: ranked region: 2", 5, true)
+	add("mode: casual region: 1", 1, true)
+
+	page, err := manager.List(ListOptions{Query: []byte("mode: ranked region: 1"), MinScore: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != 2 || page.Cursor != nil {
+		t.Errorf("expected 2 entries on single page, got %+v", page)
+	}
+
+	page, err = manager.List(ListOptions{
+		Query:    []byte("mode: ranked"),
+		Sort:     SortUserAmount,
+		OpenOnly: true,
+		MaxUsers: 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != 2 || page.Entries[0].ID != b || page.Entries[1].ID != a {
+		t.Errorf("unexpected entries %+v", page.Entries)
+	}
+
+	page, err = manager.List(ListOptions{Query: []byte("+mode: ranked -region: 1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != 1 || page.Entries[0].ID != b || page.Entries[0].Score != 1 {
+		t.Errorf("unexpected boolean query result %+v", page.Entries)
+	}
+
+	var ids []uuid.UUID
+	options := ListOptions{Sort: SortUserAmount, Ascending: true, Limit: 1}
+	for {
+		page, err := manager.List(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range page.Entries {
+			ids = append(ids, entry.ID)
+		}
+		if page.Cursor == nil {
+			break
+		}
+		options.Cursor = page.Cursor
+	}
+	if len(ids) != 4 || ids[2] != b || ids[3] != full {
+		t.Errorf("unexpected pagination %v", ids)
+	}
+
+	if _, err := manager.List(ListOptions{Cursor: []byte{1}}); err != ErrInvalidCursor {
+		t.Errorf("expected %v, got %v", ErrInvalidCursor, err)
+	}
+	if _, err := manager.List(ListOptions{Sort: sortLast}); err != ErrUnknownSort {
+		t.Errorf("expected %v, got %v", ErrUnknownSort, err)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	manager := testManager()
+	manager.DeclareField("mmr", index.KindFloat)
+	manager.DeclareField("mods", index.KindSet)
+
+	m := newMatch(manager.State, manager, &CoreBase{}, uuid.Nil, uuid.Nil)
+	manager.matches[m.ID()] = m
+
+	if _, err := m.SetTag([]byte("mmr: 1200.5 mods: [fast]")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := m.SetTag([]byte("mmr: 1200.5 mode: ranked"))
+	if fieldErr, ok := err.(*index.FieldError); !ok || fieldErr.Err != index.ErrUndeclaredField || fieldErr.Name != "mode" {
+		t.Errorf("expected undeclared field, got %v", err)
+	}
+
+	_, err = m.SetTag([]byte("mmr: fast"))
+	if fieldErr, ok := err.(*index.FieldError); !ok || fieldErr.Err != index.ErrFieldType || fieldErr.Got != index.FTString {
+		t.Errorf("expected type mismatch, got %v", err)
+	}
+
+	if page, err := manager.List(ListOptions{Query: []byte("mmr: >1000 mods: !fast")}); err != nil || len(page.Entries) != 1 {
+		t.Errorf("unexpected result %+v %v", page, err)
+	}
+
+	_, err = manager.List(ListOptions{Query: []byte("+mmr: >1000 -(mods: [fast] OR mmr: [slow])")})
+	if fieldErr, ok := err.(*index.FieldError); !ok || fieldErr.Name != "mmr" || fieldErr.Got != index.FTSet {
+		t.Errorf("expected type mismatch, got %v", err)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	manager := testManager()
+	manager.DeclareField("mode", index.KindString)
+	manager.DeclareField("mmr", index.KindFloat)
+	manager.DeclareField("server", index.KindGeo)
+
+	add := func(tag string) uuid.UUID {
+		m := newMatch(manager.State, manager, &CoreBase{}, uuid.Nil, uuid.Nil)
+		if _, err := m.SetTag([]byte(tag)); err != nil {
+			t.Fatal(err)
+		}
+		manager.matches[m.ID()] = m
+		return m.ID()
+	}
+
+	near := add("mode: ranked mmr: 1490 server: @48.21,16.37")
+	far := add("mode: ranked mmr: 1900 server: @40.71,-74.01")
+	add("mode: rank mmr: 1500 server: @50.08,14.44")
+	casual := add("mode: casual mmr: 1500")
+
+	hits, err := manager.Search(2, 2, []byte("mode^2: !ranked mmr: 1000-2000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 2 || hits[0].ID != near || hits[1].ID != far || hits[0].Score <= hits[1].Score {
+		t.Errorf("unexpected hits %+v", hits)
+	}
+
+	hits, err = manager.Search(10, 0, []byte("-mode: rank"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].ID != casual {
+		t.Errorf("unexpected hits %+v", hits)
+	}
+
+	hits, err = manager.Search(10, 0, []byte("server: @48.15,17.11#2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 2 || hits[0].ID != near || hits[0].Score <= hits[1].Score {
+		t.Errorf("unexpected hits %+v", hits)
+	}
+
+	hits, err = manager.Search(10, 0, []byte("+mode: ranked +server: @48.15,17.11<1000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].ID != near {
+		t.Errorf("unexpected hits %+v", hits)
+	}
+
+	hits, err = manager.Search(10, 0, []byte(`[{"occur": "must", "name": "mode", "string": "ranked"}, {"occur": "must", "name": "server", "point": [48.15, 17.11], "radius": 1000}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].ID != near {
+		t.Errorf("unexpected hits %+v", hits)
+	}
+
+	_, err = manager.Search(10, 0, []byte(`{"or": [{"name": "mode", "string": "ranked"}, {"name": "mmr", "string": "high"}]}`))
+	var jsonErr *index.JSONError
+	if !errors.As(err, &jsonErr) || jsonErr.Path != "$.or[1]" || !errors.Is(err, index.ErrFieldType) {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	hits, err = manager.Search(10, 0, nil)
+	if err != nil || len(hits) != 4 {
+		t.Fatalf("unexpected hits %+v %v", hits, err)
+	}
+	for i := 1; i < len(hits); i++ {
+		if bytes.Compare(hits[i-1].ID[:], hits[i].ID[:]) >= 0 {
+			t.Errorf("hits with equal score are not ordered by id %+v", hits)
+		}
+	}
+}
+
+func TestNegatedQueryUntagged(t *testing.T) {
+	manager := testManager()
+	manager.DeclareField("private", index.KindBool)
+
+	add := func(tag string) uuid.UUID {
+		m := newMatch(manager.State, manager, &CoreBase{}, uuid.Nil, uuid.Nil)
+		if _, err := m.SetTag([]byte(tag)); err != nil {
+			t.Fatal(err)
+		}
+		manager.matches[m.ID()] = m
+		return m.ID()
+	}
+
+	add("private: true")
+	untagged := add("")
+
+	page, err := manager.List(ListOptions{Query: []byte("-private: true")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != 1 || page.Entries[0].ID != untagged {
+		t.Errorf("untagged match should be listed, got %+v", page.Entries)
+	}
+
+	hits, err := manager.Search(10, 0, []byte("NOT private: true"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].ID != untagged {
+		t.Errorf("untagged match should be found, got %+v", hits)
+	}
+}
+
+func TestListRelevance(t *testing.T) {
+	manager := testManager()
+	manager.DeclareField("mode", index.KindString)
+	manager.DeclareField("mmr", index.KindFloat)
+
+	add := func(tag string) uuid.UUID {
+		m := newMatch(manager.State, manager, &CoreBase{}, uuid.Nil, uuid.Nil)
+		if _, err := m.SetTag([]byte(tag)); err != nil {
+			t.Fatal(err)
+		}
+		manager.matches[m.ID()] = m
+		return m.ID()
+	}
+
+	// both satisfy one field so only weights tell them apart
+	for i := 0; i < 8; i++ {
+		add("mode: casual mmr: 1500")
+		add("mode: ranked mmr: 3000")
+	}
+
+	query := []byte("mode^4: ranked mmr: 1000-2000")
+	hits, err := manager.Search(MaxPageSize, 0, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []uuid.UUID
+	options := ListOptions{Query: query, Limit: 3}
+	for {
+		page, err := manager.List(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range page.Entries {
+			ids = append(ids, entry.ID)
+		}
+		if page.Cursor == nil {
+			break
+		}
+		options.Cursor = page.Cursor
+	}
+
+	if len(ids) != len(hits) {
+		t.Fatalf("expected %d entries, got %d", len(hits), len(ids))
+	}
+	for i, hit := range hits {
+		if ids[i] != hit.ID {
+			t.Fatalf("list and search order differ at %d", i)
+		}
+	}
+}
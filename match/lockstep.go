@@ -0,0 +1,300 @@
+package match
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/util"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+// DefaultHistorySize is used when Lockstep.HistorySize is 0.
+const DefaultHistorySize = 512
+
+// MissingPolicy decides what goes to the frame for player who did not send input
+// before deadline.
+type MissingPolicy uint8
+
+const (
+	// MissingEmpty includes empty input.
+	MissingEmpty MissingPolicy = iota
+	// MissingRepeat repeats the last input player sent.
+	MissingRepeat
+	// MissingSkip leaves player out of the frame.
+	MissingSkip
+)
+
+// LatePolicy decides what happens with input for already closed frame.
+type LatePolicy uint8
+
+const (
+	// LateDrop discards the input.
+	LateDrop LatePolicy = iota
+	// LateNext uses the input for current frame unless player already sent one.
+	LateNext
+)
+
+// Frame is combined input of all players for one lockstep step.
+type Frame struct {
+	Number uint32
+	Inputs []Input
+}
+
+// Input is data player sent for a frame.
+type Input struct {
+	User uuid.UUID
+	Data []byte
+}
+
+// Encode writes frame as number, input count and user, length prefixed data pairs.
+func (f Frame) Encode(writer *util.Writer) {
+	writer.
+		Uint32(f.Number).
+		Uint32(uint32(len(f.Inputs)))
+	for _, input := range f.Inputs {
+		writer.
+			UUID(input.User).
+			Bytes(input.Data)
+	}
+}
+
+func (f Frame) size() int {
+	var calc util.Calculator
+	calc.Uint32().Uint32()
+	for _, input := range f.Inputs {
+		calc.UUID().Bytes(input.Data)
+	}
+	return calc.Value()
+}
+
+// Lockstep turns the match into lockstep simulation relay. Players send
+// knet.OCLockstepInput packets holding frame number followed by input. Once every
+// player sent input for current frame or Deadline passes, frame is closed and
+// broadcasted as knet.OCLockstepFrame (see Frame.Encode). Frames do not advance
+// while match is empty. Players that joined receive kept frames on the next tick,
+// after their join was accepted.
+//
+// Embed it in a core instead of CoreBase. Hooks that are overridden have to call
+// the Lockstep ones, custom requests that are not inputs are passed to Requests.
+type Lockstep struct {
+	CoreBase
+
+	// Deadline is how long frame waits for inputs, 0 means it waits for all players.
+	Deadline time.Duration
+	// MaxAhead is how many frames in the future player can send input for.
+	MaxAhead uint32
+	// HistorySize limits amount of kept frames, DefaultHistorySize is used if 0.
+	HistorySize int
+
+	Missing MissingPolicy
+	Late    LatePolicy
+
+	// OnFrame is called after frame is broadcasted.
+	OnFrame func(state State, frame Frame) error
+	// Requests receives custom requests that are not lockstep inputs.
+	Requests func(state State, req []Request) error
+
+	frame      uint32
+	frameStart time.Time
+	players    map[uuid.UUID]bool
+	joining    []uuid.UUID
+	pending    map[uint32]map[uuid.UUID][]byte
+	last       map[uuid.UUID][]byte
+	history    []Frame
+	rest       []Request
+}
+
+// FrameNumber returns number of the frame that is being collected.
+func (l *Lockstep) FrameNumber() uint32 {
+	return l.frame
+}
+
+// History returns closed frames starting with frame from. Frames that exceeded
+// HistorySize are not included so check the first frame number.
+func (l *Lockstep) History(from uint32) []Frame {
+	if len(l.history) == 0 {
+		return nil
+	}
+	first := l.history[0].Number
+	if from < first {
+		from = first
+	}
+	if from-first >= uint32(len(l.history)) {
+		return nil
+	}
+	return l.history[from-first:]
+}
+
+func (l *Lockstep) init(state State) {
+	if l.players != nil {
+		return
+	}
+	l.players = make(map[uuid.UUID]bool)
+	l.pending = make(map[uint32]map[uuid.UUID][]byte)
+	l.last = make(map[uuid.UUID][]byte)
+	l.frameStart = state.Clock.Now()
+}
+
+// OnConnection remembers the player, it becomes part of frames and receives frame
+// history on next tick if the join is accepted.
+func (l *Lockstep) OnConnection(state State, user User, meta []byte) ([]byte, error, error) {
+	l.init(state)
+
+	l.joining = append(l.joining, user.User.ID())
+
+	return nil, nil, nil
+}
+
+// join adds players whose join was accepted and sends them history so they can
+// catch up.
+func (l *Lockstep) join(state State) {
+	for _, id := range l.joining {
+		user, ok := state.Match.GetUser(id)
+		if !ok {
+			continue
+		}
+
+		if len(l.players) == 0 {
+			l.frameStart = state.Clock.Now()
+		}
+		l.players[id] = true
+
+		for _, frame := range l.history {
+			writer := util.NewWriter(frame.size())
+			frame.Encode(&writer)
+			user.WritePacketTCP(knet.OCLockstepFrame, writer.Buffer())
+		}
+	}
+	l.joining = l.joining[:0]
+}
+
+func (l *Lockstep) OnDisconnection(state State, user User) error {
+	l.init(state)
+
+	id := user.User.ID()
+	delete(l.players, id)
+	delete(l.last, id)
+	for _, inputs := range l.pending {
+		delete(inputs, id)
+	}
+
+	return nil
+}
+
+func (l *Lockstep) OnCustomRequest(state State, req []Request) error {
+	l.init(state)
+
+	l.rest = l.rest[:0]
+	for _, r := range req {
+		if r.OpCode != knet.OCLockstepInput {
+			l.rest = append(l.rest, r)
+			continue
+		}
+		l.input(r.ClientPacket)
+	}
+
+	if l.Requests != nil && len(l.rest) != 0 {
+		return l.Requests(state, l.rest)
+	}
+
+	return nil
+}
+
+func (l *Lockstep) input(packet knet.ClientPacket) {
+	if packet.User == nil {
+		return
+	}
+	id := packet.User.ID()
+	if !l.players[id] {
+		return
+	}
+
+	reader := util.NewReader(packet.Data)
+	frame, ok := reader.Uint32()
+	if !ok {
+		return
+	}
+
+	if frame < l.frame {
+		if l.Late == LateDrop {
+			return
+		}
+		frame = l.frame
+		if _, ok := l.pending[frame][id]; ok {
+			return
+		}
+	}
+
+	if frame-l.frame > l.MaxAhead {
+		return
+	}
+
+	inputs, ok := l.pending[frame]
+	if !ok {
+		inputs = make(map[uuid.UUID][]byte)
+		l.pending[frame] = inputs
+	}
+	inputs[id] = append([]byte(nil), reader.Rest()...)
+}
+
+// OnTick closes the frame if it is complete or the deadline passed.
+func (l *Lockstep) OnTick(state State) error {
+	l.init(state)
+	l.join(state)
+
+	if len(l.players) == 0 {
+		return nil
+	}
+
+	now := state.Clock.Now()
+	inputs := l.pending[l.frame]
+	if len(inputs) < len(l.players) && (l.Deadline == 0 || now.Sub(l.frameStart) < l.Deadline) {
+		return nil
+	}
+
+	frame := Frame{Number: l.frame}
+	for id := range l.players {
+		data, ok := inputs[id]
+		if !ok {
+			switch l.Missing {
+			case MissingSkip:
+				continue
+			case MissingRepeat:
+				data = l.last[id]
+			}
+		}
+		l.last[id] = data
+		frame.Inputs = append(frame.Inputs, Input{id, data})
+	}
+	sort.Slice(frame.Inputs, func(i, j int) bool {
+		return bytes.Compare(frame.Inputs[i].User[:], frame.Inputs[j].User[:]) < 0
+	})
+
+	delete(l.pending, l.frame)
+	l.frame++
+	l.frameStart = now
+
+	l.history = append(l.history, frame)
+	if size := l.historySize(); len(l.history) > size {
+		l.history = append(l.history[:0], l.history[len(l.history)-size:]...)
+	}
+
+	writer := util.NewWriter(frame.size())
+	frame.Encode(&writer)
+	state.SendPacket(state.All(), knet.OCLockstepFrame, writer.Buffer(), false)
+
+	if l.OnFrame != nil {
+		return l.OnFrame(state, frame)
+	}
+
+	return nil
+}
+
+func (l *Lockstep) historySize() int {
+	if l.HistorySize == 0 {
+		return DefaultHistorySize
+	}
+	return l.HistorySize
+}
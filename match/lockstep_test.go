@@ -0,0 +1,166 @@
+package match_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/match"
+	"github.com/jakubDoka/keeper/match/matchtest"
+	"github.com/jakubDoka/keeper/util"
+)
+
+func input(frame uint32, data string) []byte {
+	buf := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(buf, frame)
+	return append(buf, data...)
+}
+
+func decodeFrame(t *testing.T, data []byte) match.Frame {
+	reader := util.NewReader(data)
+	number, _ := reader.Uint32()
+	count, _ := reader.Uint32()
+	frame := match.Frame{Number: number}
+	for i := uint32(0); i < count; i++ {
+		user, ok := reader.UUID()
+		if !ok {
+			t.Fatal("truncated frame")
+		}
+		data, _ := reader.Bytes()
+		frame.Inputs = append(frame.Inputs, match.Input{User: user, Data: data})
+	}
+	return frame
+}
+
+func inputOf(frame match.Frame, p *matchtest.Player) (string, bool) {
+	for _, input := range frame.Inputs {
+		if input.User == p.ID() {
+			return string(input.Data), true
+		}
+	}
+	return "", false
+}
+
+func TestLockstep(t *testing.T) {
+	var frames []match.Frame
+	core := &match.Lockstep{
+		Deadline: 300 * time.Millisecond,
+		MaxAhead: 1,
+		Missing:  match.MissingRepeat,
+		Late:     match.LateNext,
+		OnFrame: func(state match.State, frame match.Frame) error {
+			frames = append(frames, frame)
+			return nil
+		},
+	}
+	h, err := matchtest.New(core, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetTickRate(10)
+
+	a, b := h.Join(nil), h.Join(nil)
+	h.Tick(1)
+
+	a.Send(knet.OCLockstepInput, input(0, "a0"), true)
+	b.Send(knet.OCLockstepInput, input(0, "b0"), true)
+	a.Send(knet.OCLockstepInput, input(1, "a1"), true)
+	a.Send(knet.OCLockstepInput, input(5, "too far"), true)
+	h.Tick(1)
+
+	if len(frames) != 1 || len(frames[0].Inputs) != 2 {
+		t.Fatalf("frame 0 should be complete %+v", frames)
+	}
+	if received := a.Received(knet.OCLockstepFrame); len(received) != 1 || decodeFrame(t, received[0].Data).Number != 0 {
+		t.Errorf("frame should be broadcasted %v", received)
+	}
+
+	h.Tick(2)
+	if len(frames) != 1 {
+		t.Fatal("frame 1 should wait for deadline")
+	}
+	h.Tick(1)
+	if len(frames) != 2 {
+		t.Fatal("frame 1 should close after deadline")
+	}
+	if data, _ := inputOf(frames[1], b); data != "b0" {
+		t.Errorf("missing input should be repeated, got %q", data)
+	}
+
+	b.Send(knet.OCLockstepInput, input(1, "b1 late"), true)
+	a.Send(knet.OCLockstepInput, input(2, "a2"), true)
+	h.Tick(1)
+	if len(frames) != 3 {
+		t.Fatal("frame 2 should be complete")
+	}
+	if data, _ := inputOf(frames[2], b); data != "b1 late" {
+		t.Errorf("late input should go to next frame, got %q", data)
+	}
+
+	c := h.Join(nil)
+	h.Tick(1)
+	if received := c.Received(knet.OCLockstepFrame); len(received) != 3 {
+		t.Errorf("late joiner should receive history, got %d frames", len(received))
+	}
+	if history := core.History(1); len(history) != 2 || history[0].Number != 1 {
+		t.Errorf("unexpected history %+v", history)
+	}
+
+	c.Disconnect()
+	a.Send(knet.OCLockstepInput, input(3, "a3"), true)
+	b.Send(knet.OCLockstepInput, input(3, "b3"), true)
+	h.Tick(1)
+	if len(frames) != 4 {
+		t.Fatal("disconnected player should not block the frame")
+	}
+	if _, ok := inputOf(frames[3], c); ok {
+		t.Error("disconnected player should not be in frame")
+	}
+}
+
+type picky struct {
+	match.Lockstep
+}
+
+func (p *picky) OnConnection(state match.State, user match.User, meta []byte) ([]byte, error, error) {
+	p.Lockstep.OnConnection(state, user, meta)
+	if string(meta) == "reject" {
+		return nil, errors.New("rejected"), nil
+	}
+	return nil, nil, nil
+}
+
+func TestLockstepCatchUp(t *testing.T) {
+	core := &picky{}
+	h, err := matchtest.New(core, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := h.Join(nil)
+	h.Tick(1)
+	for i := 0; i < match.DefaultHistorySize+1; i++ {
+		a.Send(knet.OCLockstepInput, input(uint32(i), "a"), true)
+		h.Tick(1)
+	}
+	if history := core.History(0); len(history) != match.DefaultHistorySize || history[0].Number != 1 {
+		t.Errorf("history should be bounded by default, got %d frames", len(history))
+	}
+
+	rejected, b := h.Join([]byte("reject")), h.Join(nil)
+	h.Tick(1)
+
+	if received := rejected.Received(knet.OCLockstepFrame); len(received) != 0 {
+		t.Errorf("rejected player should not receive frames, got %d", len(received))
+	}
+
+	sent := b.Sent()
+	if len(sent) == 0 || sent[0].OpCode != knet.OCMatchJoinSuccess {
+		t.Fatal("join should be confirmed before frames")
+	}
+	if received := b.Received(knet.OCLockstepFrame); len(received) != match.DefaultHistorySize {
+		t.Errorf("player should catch up, got %d frames", len(received))
+	}
+}
@@ -1,9 +1,12 @@
 package match
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jakubDoka/keeper/index"
 	"github.com/jakubDoka/keeper/knet"
@@ -15,6 +18,8 @@ import (
 var (
 	ErrMissingMatchID = errors.New("missing match id")
 	ErrMatchNotFound  = errors.New("match not found")
+	ErrUnknownCore    = errors.New("unknown match type")
+	ErrBlocked        = errors.New("match contains blocked user")
 )
 
 type Manager struct {
@@ -23,8 +28,39 @@ type Manager struct {
 	index        *index.Index
 	matches      map[uuid.UUID]*Match
 	factories    map[string]func() Core
+	policies     map[string]Policy
 	matchesMutex sync.RWMutex
 	finished     bool
+
+	store    SnapshotStore
+	running  sync.WaitGroup
+	parties  PartyResolver
+	blocks   BlockResolver
+	listener Listener
+
+	// aborted holds times of aborted migrations by match id
+	aborted        map[uuid.UUID]time.Time
+	migrationMutex sync.Mutex
+}
+
+// PartyResolver tells which party user belongs to.
+type PartyResolver interface {
+	// PartyOf returns uuid.Nil if user is not in party.
+	PartyOf(user uuid.UUID) uuid.UUID
+}
+
+// BlockResolver tells whether two users must not play together. Blocked is called
+// from match loops and matchmaker so it should not block.
+type BlockResolver interface {
+	Blocked(a, b uuid.UUID) bool
+}
+
+// Listener is told when users join and leave matches. Methods are called from match
+// loops so they should not block.
+type Listener interface {
+	JoinedMatch(user, match uuid.UUID)
+	// LeftMatch is also called for users remaining in match when it ends.
+	LeftMatch(user, match uuid.UUID)
 }
 
 func NewManager(state *state.State) *Manager {
@@ -33,51 +69,118 @@ func NewManager(state *state.State) *Manager {
 		index:     index.New(),
 		matches:   make(map[uuid.UUID]*Match),
 		factories: make(map[string]func() Core),
+		policies:  make(map[string]Policy),
+		aborted:   make(map[uuid.UUID]time.Time),
 	}
 }
 
-func (m *Manager) Search(max, ratio uint32, query []byte) ([]uuid.UUID, error) {
-	max = util.Clamp(max, 1, 100)
-	result := make([]uuid.UUID, 0, max)
+// Hit is a match found by Manager.Search.
+type Hit struct {
+	ID uuid.UUID
+	// Score is sum of relevance of fields match satisfies, see index.Scores.
+	Score float64
+}
 
+// Search returns at most max matches satisfying the query and at least ratio of its
+// fields, the most relevant first. Query is text or JSON, see ListOptions.Query.
+// Matches with equal score are ordered by id. Use List for pagination and filtering.
+func (m *Manager) Search(max, ratio uint32, query []byte) ([]Hit, error) {
+	var candidates index.Scores
 	if len(query) == 0 {
-		m.matchesMutex.Lock()
-		for id := range m.matches {
-			result = append(result, id)
+		candidates = index.Scores{}
+		m.matchesMutex.RLock()
+		for _, match := range m.matches {
+			candidates[&match.id] = 0
+		}
+		m.matchesMutex.RUnlock()
+	} else {
+		q, err := m.parseQuery(query)
+		if err != nil {
+			return nil, err
 		}
-		m.matchesMutex.Unlock()
-		return result, nil
-	}
 
-	buffer := Buffer{}
+		matched := index.Scores{}
+		m.index.QueryIn(matched, q, m.documents)
 
-	var parser index.Parser
+		fields := q.Fields(nil)
+		counts := Buffer{}
+		m.index.Search(&counts, fields...)
+		scores := index.Scores{}
+		m.index.Search(scores, fields...)
 
-	fields, i, err := parser.Parse(query)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse query:%d: %s", i, err)
+		candidates = index.Scores{}
+		for value := range matched {
+			if counts[*value.(*uuid.UUID)] >= ratio {
+				candidates[value] = scores[value]
+			}
+		}
 	}
 
-	m.index.Search(&buffer, fields...)
+	top := candidates.Top(int(util.Clamp(max, 1, MaxPageSize)), func(a, b interface{}) bool {
+		return bytes.Compare(a.(*uuid.UUID)[:], b.(*uuid.UUID)[:]) < 0
+	})
 
-	for id, count := range buffer {
-		if count >= ratio {
-			result = append(result, id)
-		}
-		if uint32(len(result)) >= max {
-			break
-		}
+	result := make([]Hit, len(top))
+	for i, scored := range top {
+		result[i] = Hit{*scored.Value.(*uuid.UUID), scored.Score}
 	}
 
 	return result, nil
 }
 
+// documents returns tag values of all matches, including matches without tag, so
+// negated queries match them too.
+func (m *Manager) documents() map[interface{}]struct{} {
+	m.matchesMutex.RLock()
+	defer m.matchesMutex.RUnlock()
+
+	result := make(map[interface{}]struct{}, len(m.matches))
+	for _, match := range m.matches {
+		result[&match.id] = struct{}{}
+	}
+	return result
+}
+
+// parseQuery parses text or JSON query and checks its fields against declared fields.
+func (m *Manager) parseQuery(data []byte) (index.Query, error) {
+	if index.IsJSONQuery(data) {
+		return index.ParseJSONQuery(data, func(field index.Field) error {
+			return m.index.Check(true, field)
+		})
+	}
+
+	parser := index.Parser{Kind: m.index.Kind}
+	query, i, err := parser.ParseQuery(data)
+	if err != nil {
+		return index.Query{}, fmt.Errorf("failed to parse query:%d: %s", i, err)
+	}
+
+	return query, m.index.CheckQuery(query)
+}
+
+// Accept handles "match" connections. Packet has to contain match id and meta passed
+// to the core. See SpectatorAcceptor for spectators.
 func (m *Manager) Accept(conn *knet.Connection, packet knet.ClientPacket) {
+	m.accept(conn, packet, false)
+}
+
+// SpectatorAcceptor handles "spectate" connections, packet has same format as for
+// Manager.Accept but user joins as spectator.
+type SpectatorAcceptor struct {
+	*Manager
+}
+
+func (s SpectatorAcceptor) Accept(conn *knet.Connection, packet knet.ClientPacket) {
+	s.accept(conn, packet, true)
+}
+
+func (m *Manager) accept(conn *knet.Connection, packet knet.ClientPacket, spectator bool) {
 	reader := util.NewReader(packet.Data)
 
 	matchID, ok := reader.UUID()
 	if !ok {
 		m.Debug("Packet from %s is missing match id.", conn.Tcp.RemoteAddr())
+		conn.WritePacketTCP(knet.OCMatchJoinFail, []byte(ErrMissingMatchID.Error()))
 		return
 	}
 
@@ -89,7 +192,53 @@ func (m *Manager) Accept(conn *knet.Connection, packet knet.ClientPacket) {
 
 	go conn.CollectPackets(m.State)
 
-	match.ConnectUser(packet.User, conn, reader.Rest())
+	if spectator {
+		match.ConnectSpectator(packet.User, conn, reader.Rest())
+	} else {
+		match.ConnectUser(packet.User, conn, reader.Rest())
+	}
+}
+
+// SignalMatch sends signal to match and waits for the reply. It is safe to call from
+// rpc handlers as long as the match does not signal back.
+func (m *Manager) SignalMatch(id uuid.UUID, data []byte) ([]byte, error) {
+	match := m.GetMatch(id)
+	if match == nil {
+		return nil, ErrMatchNotFound
+	}
+
+	reply := <-match.Signal(data)
+	return reply.Data, reply.Err
+}
+
+// DeclareField declares field that can be used in match tags and queries, SetTag and
+// queries with undeclared fields or fields not fitting the kind fail with
+// *index.FieldError. Category of the field is synchronized since tags change while
+// matches are listed. Call this from Module.Init.
+func (m *Manager) DeclareField(name string, kind index.Kind) {
+	m.check()
+	m.index.Declare(name, kind, true)
+}
+
+// Index returns index of match tags, it should be only inspected, see index.Index.Stats.
+func (m *Manager) Index() *index.Index {
+	return m.index
+}
+
+// FieldKind returns declared kind of the field.
+func (m *Manager) FieldKind(name string) (index.Kind, bool) {
+	return m.index.Kind(name)
+}
+
+// Load returns amount of running matches and players connected to them.
+func (m *Manager) Load() (matches, users uint32) {
+	m.matchesMutex.RLock()
+	for _, match := range m.matches {
+		users += match.UserAmount()
+	}
+	matches = uint32(len(m.matches))
+	m.matchesMutex.RUnlock()
+	return
 }
 
 func (m *Manager) GetMatch(id uuid.UUID) *Match {
@@ -99,18 +248,194 @@ func (m *Manager) GetMatch(id uuid.UUID) *Match {
 	return match
 }
 
+// SetPartyResolver sets the source of User.Party.
+func (m *Manager) SetPartyResolver(resolver PartyResolver) {
+	m.check()
+	m.parties = resolver
+}
+
+// PartyOf returns party of user or uuid.Nil if there is no party resolver.
+func (m *Manager) PartyOf(user uuid.UUID) uuid.UUID {
+	if m.parties == nil {
+		return uuid.Nil
+	}
+	return m.parties.PartyOf(user)
+}
+
+// SetBlockResolver sets the source of Blocked. Users blocked by someone in match cannot
+// join it, see ErrBlocked.
+func (m *Manager) SetBlockResolver(resolver BlockResolver) {
+	m.check()
+	m.blocks = resolver
+}
+
+// Blocked returns whether users must not play together, false if there is no block
+// resolver.
+func (m *Manager) Blocked(a, b uuid.UUID) bool {
+	if m.blocks == nil {
+		return false
+	}
+	return m.blocks.Blocked(a, b)
+}
+
+// SetListener sets listener of users joining and leaving matches.
+func (m *Manager) SetListener(listener Listener) {
+	m.check()
+	m.listener = listener
+}
+
+func (m *Manager) joinedMatch(user, match uuid.UUID) {
+	if m.listener != nil {
+		m.listener.JoinedMatch(user, match)
+	}
+}
+
+func (m *Manager) leftMatch(user, match uuid.UUID) {
+	if m.listener != nil {
+		m.listener.LeftMatch(user, match)
+	}
+}
+
+// CreateMatch creates match with core registered under coreID and adds it to manager.
+func (m *Manager) CreateMatch(coreID string, creator *state.User, meta []byte) (*Match, error) {
+	factory := m.GetCore(coreID)
+	if factory == nil {
+		return nil, ErrUnknownCore
+	}
+
+	match, err := New(m.State, m, factory(), creator, uuid.Nil, meta)
+	if err != nil {
+		return nil, err
+	}
+	match.coreID = coreID
+	match.policy = m.policies[coreID]
+
+	m.AddMatch(match)
+
+	return match, nil
+}
+
 func (m *Manager) AddMatch(match *Match) {
 	m.matchesMutex.Lock()
 	m.matches[match.id] = match
 	m.matchesMutex.Unlock()
 
-	go match.Run()
+	m.running.Add(1)
+	go func() {
+		match.Run()
+		match.saver.close()
+		m.RemoveMatch(match)
+		for id := range match.users {
+			m.leftMatch(id, match.id)
+		}
+		if m.store != nil && atomic.LoadInt32(&match.stopRequested) == 0 && !match.migrated {
+			if _, ok := match.Core.(SnapshotCore); ok {
+				err := m.store.Delete(match.id)
+				if err != nil {
+					m.Error("Failed to delete snapshot of match %s: %s", match.id, err)
+				}
+			}
+		}
+		m.running.Done()
+	}()
+}
+
+// RemoveMatch removes match and its tag from manager. This is called when match
+// loop exits.
+func (m *Manager) RemoveMatch(match *Match) {
+	m.matchesMutex.Lock()
+	if m.matches[match.id] == match {
+		delete(m.matches, match.id)
+	}
+	m.matchesMutex.Unlock()
+
+	m.index.Remove(match.tag...)
+}
+
+// EnableSnapshots makes manager persist matches with SnapshotCore into store.
+func (m *Manager) EnableSnapshots(store SnapshotStore) {
+	m.check()
+	m.store = store
+}
+
+// RestoreSnapshots recreates all matches from store. Call this after all cores are registered.
+// Snapshots that cannot be restored are logged and skipped.
+func (m *Manager) RestoreSnapshots() error {
+	if m.store == nil {
+		return nil
+	}
+
+	snapshots, err := m.store.Load()
+	if err != nil {
+		return util.WrapErr("failed to load snapshots", err)
+	}
+
+	for _, snapshot := range snapshots {
+		factory := m.GetCore(snapshot.Core)
+		if factory == nil {
+			m.Error("Cannot restore match %s, core %s is not registered.", snapshot.ID, snapshot.Core)
+			continue
+		}
+
+		match, err := Restore(m.State, m, factory(), snapshot)
+		if err != nil {
+			m.Error("Cannot restore match %s: %s", snapshot.ID, err)
+			continue
+		}
+		match.policy = m.policies[snapshot.Core]
+
+		m.AddMatch(match)
+	}
+
+	m.Info("Restored %d matches.", len(snapshots))
+
+	return nil
+}
+
+// SnapshotPeriodically requests snapshot from all matches each interval. Run this on goroutine.
+func (m *Manager) SnapshotPeriodically(interval time.Duration) {
+	ticker := m.Clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C() {
+		m.matchesMutex.RLock()
+		for _, match := range m.matches {
+			match.RequestSnapshot()
+		}
+		m.matchesMutex.RUnlock()
+	}
+}
+
+// Shutdown stops all matches and waits until they exit. Matches with SnapshotCore
+// save snapshots if snapshots are enabled.
+func (m *Manager) Shutdown() {
+	m.matchesMutex.RLock()
+	for _, match := range m.matches {
+		match.RequestStop()
+	}
+	m.matchesMutex.RUnlock()
+
+	m.running.Wait()
+}
+
+func (m *Manager) saveSnapshot(snapshot Snapshot) {
+	err := m.store.Save(snapshot)
+	if err != nil {
+		m.Error("Failed to save snapshot of match %s: %s", snapshot.ID, err)
+	}
 }
 
 func (m *Manager) RegisterCore(id string, factory func() Core) {
+	m.RegisterCoreWithPolicy(id, factory, Policy{})
+}
+
+// RegisterCoreWithPolicy is like RegisterCore but matches created with the core are
+// terminated according to policy.
+func (m *Manager) RegisterCoreWithPolicy(id string, factory func() Core, policy Policy) {
 	m.check()
 	m.Info("Registered match core under %s.", id)
 	m.factories[id] = factory
+	m.policies[id] = policy
 }
 
 func (m *Manager) GetCore(id string) func() Core {
@@ -8,6 +8,7 @@ import (
 	"github.com/jakubDoka/keeper/index"
 	"github.com/jakubDoka/keeper/knet"
 	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/util/clock"
 	"github.com/jakubDoka/keeper/util/uuid"
 )
 
@@ -21,6 +22,18 @@ type Match struct {
 	state       *state.State
 	tag         []index.Field
 	manager     *Manager
+	meta        []byte
+	recorder    Recorder
+	interest    *Interest
+	tick        uint64
+	coreID      string
+	tagSource   []byte
+
+	policy                          Policy
+	created, lastPacket, emptySince time.Time
+
+	snapshotRequested, stopRequested, open int32
+	saver                                  snapshotSaver
 
 	users      map[uuid.UUID]User
 	idBuffer   []uuid.UUID
@@ -29,119 +42,268 @@ type Match struct {
 	queuedUsers, tempQueuedUsers []User
 	queuedUsersMutex             sync.Mutex
 
-	tickRate   int
-	ticker     *time.Ticker
-	terminated bool
+	signals, tempSignals []signal
+	signalsMutex         sync.Mutex
+	ended                bool
+
+	spectators      map[uuid.UUID]User
+	spectatorAmount uint32
+	delayed         []delayedPacket
+
+	buffer   []knet.ClientPacket
+	requests []Request
+	helper   [][]byte
+
+	info      []byte
+	infoMutex sync.Mutex
+
+	tickRate                              int
+	ticker                                clock.Ticker
+	terminated, done, migrated, migrating bool
+	// migratedIn is true for matches restored by Manager.AcceptMigration
+	migratedIn bool
 }
 
 // New constructs a new match. meta is passed to core.OnInit method.
 func New(state *state.State, manager *Manager, core Core, creator *state.User, id uuid.UUID, meta []byte) (*Match, error) {
+	m := newMatch(state, manager, core, creator.ID(), id)
+	m.meta = meta
+
+	err := core.OnInit(m.State(), meta)
+	if err == nil {
+		m.refreshInfo()
+	}
+
+	return m, err
+}
+
+func newMatch(state *state.State, manager *Manager, core Core, creator, id uuid.UUID) *Match {
 	if id == uuid.Nil {
 		id = uuid.New()
 	}
 
-	m := &Match{
-		id:       id,
-		Core:     core,
-		creator:  creator.ID(),
-		state:    state,
-		manager:  manager,
-		users:    make(map[uuid.UUID]User),
-		tickRate: 30,
-		ticker:   time.NewTicker(time.Second / 30),
+	now := state.Clock.Now()
+
+	return &Match{
+		id:         id,
+		Core:       core,
+		creator:    creator,
+		state:      state,
+		manager:    manager,
+		users:      make(map[uuid.UUID]User),
+		spectators: make(map[uuid.UUID]User),
+		tickRate:   30,
+		ticker:     state.Clock.NewTicker(time.Second / 30),
+		created:    now,
+		lastPacket: now,
+		emptySince: now,
+		open:       1,
 	}
-
-	err := core.OnInit(m.State(), meta)
-
-	return m, err
 }
 
+// Info returns result of Core.OnInfoRequest, it is refreshed every tick on match loop
+// so this is thread safe.
 func (m *Match) Info() []byte {
+	m.infoMutex.Lock()
+	defer m.infoMutex.Unlock()
+	return m.info
+}
+
+func (m *Match) refreshInfo() {
 	inf, err := m.OnInfoRequest(m.State())
 	if err != nil {
 		m.state.Error("Error while getting match info: %s", err)
-		return nil
+		inf = nil
 	}
-	return inf
+	m.infoMutex.Lock()
+	m.info = inf
+	m.infoMutex.Unlock()
 }
 
 // ConnectUser is thread safe and you can call it from anywhere. Match will not handle
 // the connection immediately though.
-func (m *Match) ConnectUser(user *state.User, conn *knet.Connection, meta []byte) {
+func (m *Match) ConnectUser(user *state.User, conn knet.Conn, meta []byte) {
 	m.queuedUsersMutex.Lock()
-	m.queuedUsers = append(m.queuedUsers, User{user, conn, meta})
+	m.queuedUsers = append(m.queuedUsers, User{
+		User:  user,
+		Conn:  conn,
+		Party: m.manager.PartyOf(user.ID()),
+		meta:  meta,
+	})
 	m.queuedUsersMutex.Unlock()
 }
 
 // Run launches a match main loop. This should be run on goroutine.
 func (m *Match) Run() {
-	var buffer []knet.ClientPacket
-	var requests []Request
-	var helper [][]byte
+	for m.Update() {
+		<-m.ticker.C()
+	}
+	m.ticker.Stop()
+}
 
+// Update performs one iteration of match loop without waiting for the ticker. It returns
+// false once the match ended, after that calls have no effect. Run uses this internally,
+// call it directly only if you are driving the match manually (tests, simulations).
+func (m *Match) Update() bool {
+	if m.done {
+		return false
+	}
+
+	if !m.update() {
+		m.done = true
+		m.endSignals()
+		return false
+	}
+
+	return true
+}
+
+func (m *Match) update() bool {
 	state := m.State()
 
-	for !m.terminated {
-		userAmount := uint32(len(m.users))
-		// handle disconnected and custom requests
-		for id, user := range m.users {
-			if user.Disconnected() {
-				if m.handleErr(m.OnDisconnection(state, user)) {
-					return
-				}
-				user.Close()
-				delete(m.users, id)
-			} else {
-				requests = requests[:0]
-				buffer = buffer[:0]
+	if m.recorder != nil {
+		m.recorder.RecordTick(m.tick, m.state.Clock.Now())
+	}
+	m.tick++
+
+	if atomic.LoadInt32(&m.stopRequested) == 1 {
+		if m.manager.store != nil {
+			if snapshot, ok := m.Snapshot(); ok {
+				m.saver.close()
+				m.manager.saveSnapshot(snapshot)
+				m.done = true
+				state.Debug("Match %s stopped with snapshot", m.id)
+				return false
+			}
+		}
+		m.terminated = true
+	}
 
-				user.HarvestPackets(m.state, &buffer, &helper)
-				for _, packet := range buffer {
-					requests = append(requests, Request{user.Connection, packet})
-				}
+	if m.terminated {
+		m.OnEnd(state)
+		m.done = true
+		state.Debug("Match %s terminated", m.id)
+		return false
+	}
+
+	// core is paused until Manager.Migrate finishes
+	if m.migrating {
+		return m.handleSignals(state)
+	}
+
+	userAmount := uint32(len(m.users))
+	// handle disconnected and custom requests
+	for id, user := range m.users {
+		if user.Disconnected() {
+			if m.recorder != nil {
+				m.recorder.RecordLeave(id)
+			}
+			if m.handleErr(m.OnDisconnection(state, user)) {
+				return false
+			}
+			user.Close()
+			delete(m.users, id)
+			m.manager.leftMatch(id, m.id)
+			if m.interest != nil {
+				m.interest.Unsubscribe(id)
+			}
+		} else {
+			m.requests = m.requests[:0]
+			m.buffer = m.buffer[:0]
 
-				if m.handleErr(m.OnCustomRequest(state, requests)) {
-					return
+			user.HarvestPackets(m.state, &m.buffer, &m.helper)
+			if len(m.buffer) != 0 {
+				m.lastPacket = m.state.Clock.Now()
+			}
+			for _, packet := range m.buffer {
+				if m.recorder != nil {
+					m.recorder.RecordRequest(id, packet)
 				}
+				m.requests = append(m.requests, Request{user.Conn, packet})
+			}
+
+			if m.handleErr(m.OnCustomRequest(state, m.requests)) {
+				return false
 			}
 		}
+	}
 
-		// handle incoming
-		m.queuedUsersMutex.Lock()
-		m.queuedUsers, m.tempQueuedUsers = m.tempQueuedUsers[:0], m.queuedUsers
-		m.queuedUsersMutex.Unlock()
-		for _, user := range m.tempQueuedUsers {
-			meta, err, fatalErr := m.OnConnection(state, user, user.meta)
+	if m.handleErr(m.updateSpectators(state)) {
+		return false
+	}
 
-			if m.handleErr(fatalErr) {
-				return
+	// handle incoming
+	m.queuedUsersMutex.Lock()
+	m.queuedUsers, m.tempQueuedUsers = m.tempQueuedUsers[:0], m.queuedUsers
+	m.queuedUsersMutex.Unlock()
+	for _, user := range m.tempQueuedUsers {
+		if user.Spectator {
+			if m.handleErr(m.connectSpectator(state, user)) {
+				return false
 			}
+			continue
+		}
 
+		if m.blocked(user.User.ID()) {
 			user.meta = nil
+			user.WritePacketTCP(knet.OCMatchJoinFail, []byte(ErrBlocked.Error()))
+			continue
+		}
 
-			if err != nil {
-				user.WritePacketTCP(knet.OCMatchJoinFail, []byte(err.Error()))
-			} else {
-				user.WritePacketTCP(knet.OCMatchJoinSuccess, meta)
-				m.users[user.User.ID()] = user
-			}
+		if m.recorder != nil {
+			m.recorder.RecordJoin(user.User.ID(), user.meta)
 		}
+		meta, err, fatalErr := m.OnConnection(state, user, user.meta)
 
-		// handle tick
-		if m.handleErr(m.OnTick(state)) {
-			return
+		if m.handleErr(fatalErr) {
+			return false
 		}
 
-		newUserAmount := uint32(len(m.users))
-		if newUserAmount != userAmount {
-			atomic.StoreUint32(&m.userAmount, newUserAmount)
+		user.meta = nil
+
+		if err != nil {
+			user.WritePacketTCP(knet.OCMatchJoinFail, []byte(err.Error()))
+		} else {
+			user.WritePacketTCP(knet.OCMatchJoinSuccess, meta)
+			// rejoining user replaces the old connection and stays in match
+			if old, ok := m.users[user.User.ID()]; ok {
+				if old.Conn != user.Conn {
+					old.Close()
+				}
+			} else {
+				m.manager.joinedMatch(user.User.ID(), m.id)
+			}
+			m.users[user.User.ID()] = user
 		}
+	}
 
-		<-m.ticker.C
+	if !m.handleSignals(state) {
+		return false
 	}
 
-	m.OnEnd(state)
-	state.Debug("Match %s terminated", m.id)
+	// handle tick
+	if m.handleErr(m.OnTick(state)) {
+		return false
+	}
+
+	m.refreshInfo()
+
+	newUserAmount := uint32(len(m.users))
+	if newUserAmount != userAmount {
+		atomic.StoreUint32(&m.userAmount, newUserAmount)
+	}
+
+	m.flushDelayed()
+
+	m.applyPolicy()
+
+	if atomic.CompareAndSwapInt32(&m.snapshotRequested, 1, 0) && m.manager.store != nil {
+		if snapshot, ok := m.Snapshot(); ok {
+			m.saver.save(m.manager, snapshot)
+		}
+	}
+
+	return true
 }
 
 func (m *Match) UserAmount() uint32 {
@@ -155,6 +317,14 @@ func (m *Match) ResendPacket(request knet.ClientPacket) {
 
 // Send packet sends a packet to all targets. Nil means all players.
 func (m *Match) SendPacket(targets *[]uuid.UUID, opCode knet.OpCode, data []byte, udp bool) {
+	if m.recorder != nil {
+		if targets != nil {
+			m.recorder.RecordSend(*targets, opCode, data, udp)
+		} else {
+			m.recorder.RecordSend(nil, opCode, data, udp)
+		}
+	}
+
 	if targets != nil {
 		if len(*targets) == 0 {
 			return
@@ -169,9 +339,15 @@ func (m *Match) SendPacket(targets *[]uuid.UUID, opCode knet.OpCode, data []byte
 		for _, user := range m.users {
 			user.WritePacket(opCode, data, udp)
 		}
+		m.broadcastSpectators(opCode, data, udp)
 	}
 }
 
+// TickRate returns amount of ticks per second.
+func (m *Match) TickRate() int {
+	return m.tickRate
+}
+
 // SetTickRate changes a tickrate of match
 func (m *Match) SetTickRate(rate int) {
 	if rate == 0 {
@@ -186,25 +362,95 @@ func (m *Match) SetTickRate(rate int) {
 }
 
 func (m *Match) SetTag(value []byte) (int, error) {
-	var parser index.Parser
+	parser := index.Parser{Kind: m.manager.index.Kind}
 	tag, i, err := parser.Parse(value)
 	if err != nil {
 		return i, err
 	}
+	if err := m.manager.index.Check(false, tag...); err != nil {
+		return 0, err
+	}
 	for i := range tag {
 		tag[i].Value = &m.id
 	}
 	m.manager.index.Remove(m.tag...)
 	m.tag = tag
+	m.tagSource = append(m.tagSource[:0], value...)
 	m.manager.index.Insert(m.tag...)
 	return 0, nil
 }
 
+// SetRecorder attaches recorder to match, nil detaches it. Recorder has to be set before
+// match is running.
+func (m *Match) SetRecorder(r Recorder) {
+	m.recorder = r
+	if r != nil {
+		r.RecordInit(m.id, m.creator, m.meta)
+	}
+}
+
+// Ticks returns number of updates match performed so far.
+func (m *Match) Ticks() uint64 {
+	return m.tick
+}
+
+// Policy returns current termination policy.
+func (m *Match) Policy() Policy {
+	return m.policy
+}
+
+// SetPolicy replaces termination policy, it is initially the one core was registered with.
+func (m *Match) SetPolicy(policy Policy) {
+	m.policy = policy
+}
+
+func (m *Match) applyPolicy() {
+	if m.terminated {
+		return
+	}
+
+	now := m.state.Clock.Now()
+
+	if len(m.users) != 0 {
+		m.emptySince = time.Time{}
+	} else if m.emptySince.IsZero() {
+		m.emptySince = now
+	}
+
+	var reason string
+	switch {
+	case m.policy.MaxLifetime != 0 && now.Sub(m.created) >= m.policy.MaxLifetime:
+		reason = "reached max lifetime"
+	case m.policy.EmptyTimeout != 0 && !m.emptySince.IsZero() && now.Sub(m.emptySince) >= m.policy.EmptyTimeout:
+		reason = "was empty for too long"
+	case m.policy.IdleTimeout != 0 && now.Sub(m.lastPacket) >= m.policy.IdleTimeout:
+		reason = "was idle for too long"
+	default:
+		return
+	}
+
+	m.state.Debug("Match %s %s.", m.id, reason)
+	m.Terminate()
+}
+
 func (m *Match) GetUser(id uuid.UUID) (User, bool) {
 	user, ok := m.users[id]
 	return user, ok
 }
 
+// blocked returns whether user is blocked by someone in the match or blocks someone.
+func (m *Match) blocked(id uuid.UUID) bool {
+	if m.manager.blocks == nil {
+		return false
+	}
+	for other := range m.users {
+		if m.manager.blocks.Blocked(id, other) {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *Match) handleErr(err error) bool {
 	if err == nil {
 		return false
@@ -213,6 +459,7 @@ func (m *Match) handleErr(err error) bool {
 	res := m.OnError(m.State(), err)
 	if res {
 		m.OnEnd(m.State())
+		m.done = true
 	}
 	return res
 }
@@ -221,6 +468,19 @@ func (m *Match) Terminate() {
 	m.terminated = true
 }
 
+// RequestSnapshot makes match save its snapshot at the end of next update. This is
+// thread safe and has effect only if snapshots are enabled on Manager.
+func (m *Match) RequestSnapshot() {
+	atomic.StoreInt32(&m.snapshotRequested, 1)
+}
+
+// RequestStop makes match stop on next update. Match with SnapshotCore saves its
+// snapshot instead of ending if Manager has snapshots enabled, others are terminated.
+// This is thread safe.
+func (m *Match) RequestStop() {
+	atomic.StoreInt32(&m.stopRequested, 1)
+}
+
 // State return match state.
 func (m *Match) State() State {
 	return State{m.state, m}
@@ -256,11 +516,31 @@ func (m *Match) AllExcept(except uuid.UUID) *[]uuid.UUID {
 	return &m.idBuffer
 }
 
+// Policy describes when match should be terminated automatically and how it treats
+// spectators. Zero value disables the rule.
+type Policy struct {
+	// EmptyTimeout terminates match that has no users for this long.
+	EmptyTimeout time.Duration
+	// MaxLifetime terminates match this long after it was created.
+	MaxLifetime time.Duration
+	// IdleTimeout terminates match that received no packets for this long.
+	IdleTimeout time.Duration
+
+	// MaxSpectators is the amount of spectators match accepts.
+	MaxSpectators int
+	// SpectatorDelay delays packets broadcasted to spectators.
+	SpectatorDelay time.Duration
+}
+
 // User is match side extension of state.User.
 type User struct {
 	*state.User
-	*knet.Connection
-	meta []byte
+	knet.Conn
+	// Party is id of party user was in when connecting or uuid.Nil.
+	Party uuid.UUID
+	// Spectator is true if user only watches the match.
+	Spectator bool
+	meta      []byte
 }
 
 // State is match extension of state.State.
@@ -273,9 +553,23 @@ func (s State) UserAmount() int {
 	return len(s.users)
 }
 
+// Recorder observes everything that goes in and out of the match. All methods are
+// called from match loop. Record tick is called at the start of each update, other
+// calls belong to the last recorded tick.
+type Recorder interface {
+	RecordInit(id, creator uuid.UUID, meta []byte)
+	RecordTick(tick uint64, now time.Time)
+	RecordJoin(user uuid.UUID, meta []byte)
+	RecordLeave(user uuid.UUID)
+	RecordRequest(user uuid.UUID, packet knet.ClientPacket)
+	// RecordSend receives nil targets if packet was sent to all users.
+	RecordSend(targets []uuid.UUID, opCode knet.OpCode, data []byte, udp bool)
+	RecordSignal(data []byte)
+}
+
 // Request glues packet and sender together
 type Request struct {
-	*knet.Connection
+	knet.Conn
 	knet.ClientPacket
 }
 
@@ -288,6 +582,9 @@ type Core interface {
 	OnError(state State, err error) bool
 	OnEnd(state State)
 	OnInfoRequest(state State) ([]byte, error)
+	// OnSignal handles data passed to Match.Signal. Returned data and first error
+	// are replied to the sender, the second error is fatal as in other hooks.
+	OnSignal(state State, data []byte) ([]byte, error, error)
 }
 
 type CoreBase struct{}
@@ -302,3 +599,6 @@ func (*CoreBase) OnTick(state State) error                         { return nil
 func (*CoreBase) OnError(state State, err error) bool              { return true }
 func (*CoreBase) OnEnd(state State)                                {}
 func (*CoreBase) OnInfoRequest(state State) ([]byte, error)        { return nil, nil }
+func (*CoreBase) OnSignal(state State, data []byte) ([]byte, error, error) {
+	return nil, ErrUnhandledSignal, nil
+}
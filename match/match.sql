@@ -0,0 +1,17 @@
+--+init+--
+CREATE TABLE IF NOT EXISTS match_snapshots (
+    id UUID PRIMARY KEY NOT NULL,
+    core VARCHAR(128) NOT NULL,
+    creator UUID NOT NULL,
+    tag BYTEA NOT NULL,
+    tick_rate INTEGER NOT NULL,
+    data BYTEA NOT NULL,
+    created BIGINT NOT NULL
+)
+--+save+--
+INSERT INTO match_snapshots (id, core, creator, tag, tick_rate, data, created) VALUES ($1, $2, $3, $4, $5, $6, $7)
+ON CONFLICT (id) DO UPDATE SET tag = $4, tick_rate = $5, data = $6
+--+delete+--
+DELETE FROM match_snapshots WHERE id = $1
+--+load+--
+SELECT id, core, creator, tag, tick_rate, data, created FROM match_snapshots
@@ -0,0 +1,101 @@
+package matchtest
+
+import (
+	"sync"
+
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/state"
+)
+
+// Packet is a packet that was written to the Conn by server.
+type Packet struct {
+	OpCode knet.OpCode
+	Data   []byte
+	Udp    bool
+}
+
+// Conn is in-memory knet.Conn. Packets injected to it are harvested by match
+// as if they came from network and packets written by match are stored so
+// test can inspect them. All allowed operations on Conn are thread safe.
+type Conn struct {
+	mutex        sync.Mutex
+	queued       []knet.ClientPacket
+	outbound     []Packet
+	disconnected bool
+	closed       bool
+}
+
+// Inject queues a packet that will be harvested on next match update.
+func (c *Conn) Inject(packet knet.ClientPacket) {
+	c.mutex.Lock()
+	c.queued = append(c.queued, packet)
+	c.mutex.Unlock()
+}
+
+// Sent returns all packets written to connection so far.
+func (c *Conn) Sent() []Packet {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]Packet(nil), c.outbound...)
+}
+
+// Take returns all packets written to connection and clears them.
+func (c *Conn) Take() []Packet {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	res := c.outbound
+	c.outbound = nil
+	return res
+}
+
+// Disconnect simulates the client disconnecting.
+func (c *Conn) Disconnect() {
+	c.mutex.Lock()
+	c.disconnected = true
+	c.mutex.Unlock()
+}
+
+// Closed returns true if server closed the connection.
+func (c *Conn) Closed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+func (c *Conn) HarvestPackets(state *state.State, buffer *[]knet.ClientPacket, helper *[][]byte) {
+	c.mutex.Lock()
+	*buffer = append(*buffer, c.queued...)
+	c.queued = c.queued[:0]
+	c.mutex.Unlock()
+}
+
+func (c *Conn) WritePacket(packetCode knet.OpCode, packetData []byte, udp bool) error {
+	c.mutex.Lock()
+	c.outbound = append(c.outbound, Packet{
+		OpCode: packetCode,
+		Data:   append([]byte(nil), packetData...),
+		Udp:    udp,
+	})
+	c.mutex.Unlock()
+	return nil
+}
+
+func (c *Conn) WritePacketTCP(packetCode knet.OpCode, packetData []byte) error {
+	return c.WritePacket(packetCode, packetData, false)
+}
+
+func (c *Conn) WritePacketUDP(packetCode knet.OpCode, packetData []byte) error {
+	return c.WritePacket(packetCode, packetData, true)
+}
+
+func (c *Conn) Disconnected() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.disconnected
+}
+
+func (c *Conn) Close() {
+	c.mutex.Lock()
+	c.closed = true
+	c.mutex.Unlock()
+}
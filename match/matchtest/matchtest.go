@@ -0,0 +1,144 @@
+// matchtest provides utilities for testing match cores without database, sockets
+// or http server. Harness drives the match loop manually so each Tick is one
+// deterministic iteration.
+package matchtest
+
+import (
+	"time"
+
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/match"
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/state/statetest"
+	"github.com/jakubDoka/keeper/util/clock"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+// SessionDuration is duration of sessions of users created by harness.
+const SessionDuration = time.Hour
+
+// Epoch is the time manual clock of harness starts at.
+var Epoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Harness holds the match under test and everything it needs to run.
+type Harness struct {
+	*match.Match
+
+	State   *state.State
+	Manager *match.Manager
+	Creator *state.User
+	Clock   *clock.Manual
+}
+
+// New creates harness with in-memory state and calls core.OnInit with meta. Logger
+// has no targets, add them to Harness.State.Logger if you want to see the output.
+func New(core match.Core, meta []byte) (*Harness, error) {
+	return NewWithID(core, uuid.New(), uuid.Nil, Epoch, meta)
+}
+
+// NewWithID is like New but match and its creator have given ids and clock starts at
+// start. Nil id means random one, zero start means Epoch.
+func NewWithID(core match.Core, creator, id uuid.UUID, start time.Time, meta []byte) (*Harness, error) {
+	if start.IsZero() {
+		start = Epoch
+	}
+
+	s, c := statetest.NewManual(start)
+
+	h := &Harness{
+		State:   s,
+		Manager: match.NewManager(s),
+		Clock:   c,
+	}
+
+	h.Creator = h.NewUserWithID(creator)
+
+	m, err := match.New(s, h.Manager, core, h.Creator, id, meta)
+	h.Match = m
+	return h, err
+}
+
+// NewUser creates a user with valid session and adds him to state.
+func (h *Harness) NewUser() *state.User {
+	return h.NewUserWithID(uuid.New())
+}
+
+// NewUserWithID is like NewUser but user has given id.
+func (h *Harness) NewUserWithID(id uuid.UUID) *state.User {
+	if id == uuid.Nil {
+		id = uuid.New()
+	}
+	user := state.NewUserWithClock(h.Clock, id, uuid.New(), SessionDuration, "127.0.0.1")
+	h.State.AddUser(user)
+	return user
+}
+
+// Join creates new user and queues his connection to match. Match will process
+// the connection on next Tick.
+func (h *Harness) Join(meta []byte) *Player {
+	return h.JoinAs(h.NewUser(), meta)
+}
+
+// JoinAs is like Join but uses existing user.
+func (h *Harness) JoinAs(user *state.User, meta []byte) *Player {
+	p := &Player{
+		User: user,
+		Conn: &Conn{},
+	}
+	h.ConnectUser(user, p.Conn, meta)
+	return p
+}
+
+// Spectate creates new user and queues his connection as spectator.
+func (h *Harness) Spectate(meta []byte) *Player {
+	p := &Player{
+		User: h.NewUser(),
+		Conn: &Conn{},
+	}
+	h.ConnectSpectator(p.User, p.Conn, meta)
+	return p
+}
+
+// Tick performs n iterations of match loop. Clock is advanced by one tick
+// interval after each iteration. It returns false if match ended.
+func (h *Harness) Tick(n int) bool {
+	for i := 0; i < n; i++ {
+		if !h.Update() {
+			return false
+		}
+		h.Clock.Advance(time.Second / time.Duration(h.TickRate()))
+	}
+	return true
+}
+
+// Player is a fake client connected trough Conn.
+type Player struct {
+	*state.User
+	*Conn
+}
+
+// Send injects packet as if player sent it. Packet is delivered to match on next Tick.
+func (p *Player) Send(opCode knet.OpCode, data []byte, udp bool, targets ...uuid.UUID) {
+	if targets == nil {
+		targets = []uuid.UUID{}
+	}
+	p.Inject(knet.ClientPacket{
+		OpCode:  opCode,
+		Session: p.Session(),
+		Targets: targets,
+		Data:    data,
+		Udp:     udp,
+		User:    p.User,
+	})
+}
+
+// Received returns packets with given op code that player received so far.
+func (p *Player) Received(opCode knet.OpCode) []Packet {
+	var res []Packet
+	for _, packet := range p.Sent() {
+		if packet.OpCode == opCode {
+			res = append(res, packet)
+		}
+	}
+	return res
+}
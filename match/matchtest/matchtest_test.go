@@ -0,0 +1,239 @@
+package matchtest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/match"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+const ocEcho = knet.OCLast
+
+type echoCore struct {
+	match.CoreBase
+	ticks int
+}
+
+func (e *echoCore) OnConnection(state match.State, user match.User, meta []byte) ([]byte, error, error) {
+	if string(meta) == "deny" {
+		return nil, errors.New("denied"), nil
+	}
+	return meta, nil, nil
+}
+
+func (e *echoCore) OnCustomRequest(state match.State, req []match.Request) error {
+	for _, r := range req {
+		state.ResendPacket(r.ClientPacket)
+	}
+	return nil
+}
+
+func (e *echoCore) OnTick(state match.State) error {
+	e.ticks++
+	if e.ticks == 10 {
+		state.Terminate()
+	}
+	return nil
+}
+
+func TestHarness(t *testing.T) {
+	core := &echoCore{}
+	h, err := New(core, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := h.Join([]byte("hello"))
+	b := h.Join(nil)
+	c := h.Join([]byte("deny"))
+
+	h.Tick(1)
+
+	if res := a.Received(knet.OCMatchJoinSuccess); len(res) != 1 || string(res[0].Data) != "hello" {
+		t.Errorf("unexpected join response %v", res)
+	}
+	if res := c.Received(knet.OCMatchJoinFail); len(res) != 1 || string(res[0].Data) != "denied" {
+		t.Errorf("unexpected join response %v", res)
+	}
+	if h.UserAmount() != 2 {
+		t.Errorf("expected 2 users, got %d", h.UserAmount())
+	}
+
+	a.Send(ocEcho, []byte("ping"), true, b.ID())
+	h.Tick(1)
+
+	if res := b.Received(ocEcho); len(res) != 1 || string(res[0].Data) != "ping" || !res[0].Udp {
+		t.Errorf("unexpected echo %v", res)
+	}
+	if res := a.Received(ocEcho); len(res) != 0 {
+		t.Errorf("sender should not receive echo %v", res)
+	}
+
+	b.Disconnect()
+	h.Tick(1)
+
+	if !b.Closed() {
+		t.Error("disconnected connection should be closed")
+	}
+	if h.UserAmount() != 1 {
+		t.Errorf("expected 1 user, got %d", h.UserAmount())
+	}
+
+	if h.Tick(10) {
+		t.Error("match should have terminated")
+	}
+}
+
+func TestHarnessClock(t *testing.T) {
+	h, err := New(&echoCore{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.SetTickRate(10)
+	h.Tick(5)
+
+	if now := h.Clock.Now(); !now.Equal(Epoch.Add(time.Second / 2)) {
+		t.Errorf("unexpected time after 5 ticks: %v", now)
+	}
+
+	user := h.NewUser()
+	h.Clock.Advance(SessionDuration + 1)
+
+	if h.State.GetUser(user.Session(), user.ID()) != nil {
+		t.Error("session should have expired")
+	}
+}
+
+type broadcastCore struct {
+	match.CoreBase
+	requests int
+}
+
+func (b *broadcastCore) OnCustomRequest(state match.State, req []match.Request) error {
+	b.requests += len(req)
+	return nil
+}
+
+func (b *broadcastCore) OnTick(state match.State) error {
+	state.SendPacket(nil, ocEcho, []byte("tick"), false)
+	return nil
+}
+
+func TestSpectators(t *testing.T) {
+	core := &broadcastCore{}
+	h, err := New(core, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rejected := h.Spectate(nil)
+	h.Tick(1)
+	if res := rejected.Received(knet.OCMatchJoinFail); len(res) != 1 {
+		t.Errorf("spectators should be disabled by default %v", res)
+	}
+
+	h.SetTickRate(10)
+	h.SetPolicy(match.Policy{MaxSpectators: 1, SpectatorDelay: time.Second / 2})
+
+	player := h.Join(nil)
+	spectator := h.Spectate(nil)
+	full := h.Spectate(nil)
+	h.Tick(1)
+
+	if res := spectator.Received(knet.OCMatchJoinSuccess); len(res) != 1 {
+		t.Errorf("spectator should be accepted %v", res)
+	}
+	if res := full.Received(knet.OCMatchJoinFail); len(res) != 1 {
+		t.Errorf("spectator over limit should be rejected %v", res)
+	}
+	if h.UserAmount() != 1 || h.SpectatorAmount() != 1 {
+		t.Errorf("expected 1 user and 1 spectator, got %d %d", h.UserAmount(), h.SpectatorAmount())
+	}
+
+	spectator.Send(ocEcho, nil, false)
+	player.Send(ocEcho, nil, false)
+	h.Tick(3)
+
+	if core.requests != 1 {
+		t.Errorf("only player requests should reach core, got %d", core.requests)
+	}
+	if len(spectator.Received(ocEcho)) != 0 {
+		t.Error("spectator should receive packets with delay")
+	}
+
+	h.Tick(5)
+
+	if res := spectator.Received(ocEcho); len(res) != 4 {
+		t.Errorf("expected 4 delayed packets, got %d", len(res))
+	}
+
+	spectator.Disconnect()
+	h.Tick(1)
+
+	if h.SpectatorAmount() != 0 || !spectator.Closed() {
+		t.Error("disconnected spectator should be removed")
+	}
+}
+
+type blocks map[uuid.UUID]uuid.UUID
+
+func (b blocks) Blocked(a, c uuid.UUID) bool {
+	return b[a] == c || b[c] == a
+}
+
+func TestBlocked(t *testing.T) {
+	h, err := New(&echoCore{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := blocks{}
+	h.Manager.SetBlockResolver(b)
+
+	a := h.Join(nil)
+	blocked := h.NewUser()
+	b[a.ID()] = blocked.ID()
+	c := h.JoinAs(blocked, nil)
+	d := h.Join(nil)
+
+	h.Tick(1)
+
+	if res := c.Received(knet.OCMatchJoinFail); len(res) != 1 || string(res[0].Data) != match.ErrBlocked.Error() {
+		t.Errorf("unexpected join response %v", res)
+	}
+	if res := d.Received(knet.OCMatchJoinSuccess); len(res) != 1 {
+		t.Errorf("unexpected join response %v", res)
+	}
+	if h.UserAmount() != 2 {
+		t.Errorf("expected 2 users, got %d", h.UserAmount())
+	}
+}
+
+type joins map[uuid.UUID]int
+
+func (j joins) JoinedMatch(user, match uuid.UUID) { j[user]++ }
+func (j joins) LeftMatch(user, match uuid.UUID)   { j[user]-- }
+
+func TestRejoin(t *testing.T) {
+	h, err := New(&echoCore{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := joins{}
+	h.Manager.SetListener(j)
+
+	first := h.Join(nil)
+	h.Tick(1)
+	second := h.JoinAs(first.User, nil)
+	h.Tick(1)
+
+	if !first.Closed() || second.Closed() {
+		t.Error("rejoin should replace the old connection")
+	}
+	if j[first.ID()] != 1 || h.UserAmount() != 1 {
+		t.Errorf("rejoin should not count as another join %v %d", j, h.UserAmount())
+	}
+}
@@ -0,0 +1,396 @@
+package match
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/util"
+	"github.com/jakubDoka/keeper/util/kcrypto"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+// MigrateRpc is id of the peer rpc that receives migrated matches.
+const MigrateRpc = "migrate-match"
+
+// AbortMigrationRpc is id of the peer rpc that removes match received by MigrateRpc
+// when the sender did not get the response, body is id of the match.
+const AbortMigrationRpc = "abort-migration"
+
+// AbortedTTL is how long node rejects migration of a match it aborted so migration
+// request delayed up to knet.PeerMaxSkew cannot restore it after the abort.
+const AbortedTTL = 2 * knet.PeerMaxSkew
+
+var (
+	ErrMatchExists        = errors.New("match with this id already exists")
+	ErrInvalidMigration   = errors.New("migration data is corrupted")
+	ErrMigrationRejected  = errors.New("peer response to migration is corrupted")
+	ErrMigrationAborted   = errors.New("migration of this match was aborted recently")
+	ErrMigrationConfirmed = errors.New("migrated match already has users")
+	ErrMigrationUnknown   = errors.New("result of migration is unknown, match stays paused")
+)
+
+// Encode writes snapshot as id, creator, core, tag, tick rate, data and creation
+// time in unix nanoseconds.
+func (s Snapshot) Encode(writer *util.Writer) {
+	writer.
+		UUID(s.ID).
+		UUID(s.Creator).
+		String(s.Core).
+		Bytes(s.Tag).
+		Uint32(uint32(s.TickRate)).
+		Bytes(s.Data).
+		Uint64(uint64(s.Created.UnixNano()))
+}
+
+// DecodeSnapshot reads snapshot written by Snapshot.Encode.
+func DecodeSnapshot(reader *util.Reader) (s Snapshot, ok bool) {
+	if s.ID, ok = reader.UUID(); !ok {
+		return
+	}
+	if s.Creator, ok = reader.UUID(); !ok {
+		return
+	}
+	if s.Core, ok = reader.String(); !ok {
+		return
+	}
+	if s.Tag, ok = reader.Bytes(); !ok {
+		return
+	}
+	tickRate, ok := reader.Uint32()
+	if !ok {
+		return
+	}
+	s.TickRate = int(tickRate)
+	if s.Data, ok = reader.Bytes(); !ok {
+		return
+	}
+	created, ok := reader.Uint64()
+	s.Created = time.Unix(0, int64(created))
+	return
+}
+
+// Migrate moves running match to other keeper node sharing the cluster secret. Address
+// is http address of the node. Match is snapshotted on its loop and paused while the
+// snapshot is sent to the node so the loop is not blocked by the transfer. After the
+// node confirms, connected players and spectators receive knet.OCMatchRedirect holding
+// tcp address of the node, match id and new key, the match stops here and its snapshot
+// is deleted from the store. Players have to reconnect with the new key, their sessions
+// stay the same. Node sharing the store saves the match again with its next periodic
+// snapshot.
+//
+// If the node rejects the match, match resumes and the error is returned. If transfer
+// fails otherwise, the node is asked to abort the migration since it may have
+// accepted the match even if the response was lost, match resumes after the node
+// confirms the abort and transfer error is returned. If the abort fails too, match
+// stays paused and ErrMigrationUnknown is returned, call Migrate again to retry.
+func (m *Manager) Migrate(id uuid.UUID, address string) error {
+	match := m.GetMatch(id)
+	if match == nil {
+		return ErrMatchNotFound
+	}
+
+	if _, ok := match.Core.(SnapshotCore); !ok {
+		return ErrNotSnapshotCore
+	}
+
+	var data []byte
+	reply := <-match.queueSignal(signal{
+		reply: make(chan Reply, 1),
+		task: func(state State) (bool, error) {
+			data = match.pause()
+			return false, nil
+		},
+	})
+	if reply.Err != nil {
+		return reply.Err
+	}
+
+	target, keys, err := m.transfer(address, data)
+	if err != nil {
+		var peerErr *knet.PeerError
+		rejected := errors.As(err, &peerErr) && peerErr.Rejected()
+		if !rejected {
+			if _, abortErr := knet.CallPeer(m.State, address, AbortMigrationRpc, id[:]); abortErr != nil {
+				m.Error("Failed to abort migration of match %s to %s after %s: %s", id, address, err, abortErr)
+				return ErrMigrationUnknown
+			}
+		}
+
+		match.queueSignal(signal{
+			reply: make(chan Reply, 1),
+			task: func(state State) (bool, error) {
+				match.migrating = false
+				// aborted copy on the node could delete snapshot from shared store
+				match.RequestSnapshot()
+				return false, nil
+			},
+		})
+		return err
+	}
+
+	reply = <-match.queueSignal(signal{
+		reply: make(chan Reply, 1),
+		task: func(state State) (bool, error) {
+			match.redirect(target, keys)
+			return true, nil
+		},
+	})
+
+	// match runs on the node now even if it stopped here in the meantime
+	match.saver.close()
+	if m.store != nil {
+		if err := m.store.Delete(id); err != nil {
+			m.Error("Failed to delete snapshot of migrated match %s: %s", id, err)
+		}
+	}
+
+	m.Info("Match %s migrated to %s.", id, address)
+
+	return reply.Err
+}
+
+// MigrateAll migrates all matches with SnapshotCore to the node, it is meant for
+// rolling deploys. Matches that failed to migrate are logged and keep running.
+func (m *Manager) MigrateAll(address string) {
+	m.matchesMutex.RLock()
+	var ids []uuid.UUID
+	for id, match := range m.matches {
+		if _, ok := match.Core.(SnapshotCore); ok {
+			ids = append(ids, id)
+		}
+	}
+	m.matchesMutex.RUnlock()
+
+	for _, id := range ids {
+		if err := m.Migrate(id, address); err != nil {
+			m.Error("Failed to migrate match %s: %s", id, err)
+		}
+	}
+}
+
+// pause encodes the match for migration and stops updating it until migration
+// finishes.
+func (m *Match) pause() []byte {
+	snapshot, _ := m.Snapshot()
+
+	var users []User
+	for _, user := range m.users {
+		users = append(users, user)
+	}
+	for _, user := range m.spectators {
+		users = append(users, user)
+	}
+
+	writer := util.Writer{}
+	snapshot.Encode(&writer)
+	writer.Uint32(uint32(len(users)))
+	for _, user := range users {
+		writer.
+			UUID(user.User.ID()).
+			UUID(user.Session()).
+			Uint64(uint64(user.Expiration().UnixNano())).
+			String(user.IP())
+	}
+
+	m.migrating = true
+
+	return writer.Buffer()
+}
+
+// transfer sends migration data to the node and returns tcp address of the node
+// and new keys of users.
+func (m *Manager) transfer(address string, data []byte) (string, map[uuid.UUID]kcrypto.Key, error) {
+	response, err := knet.CallPeer(m.State, address, MigrateRpc, data)
+	if err != nil {
+		return "", nil, err
+	}
+
+	reader := util.NewReader(response)
+	target, ok := reader.String()
+	if !ok {
+		return "", nil, ErrMigrationRejected
+	}
+	count, ok := reader.Uint32()
+	if !ok {
+		return "", nil, ErrMigrationRejected
+	}
+
+	keys := make(map[uuid.UUID]kcrypto.Key, util.Clamp(count, 0, 1024))
+	for i := uint32(0); i < count; i++ {
+		id, ok := reader.UUID()
+		if !ok {
+			return "", nil, ErrMigrationRejected
+		}
+		key, ok := reader.Key()
+		if !ok {
+			return "", nil, ErrMigrationRejected
+		}
+		keys[id] = key
+	}
+
+	return target, keys, nil
+}
+
+// redirect sends users to the node match migrated to.
+func (m *Match) redirect(target string, keys map[uuid.UUID]kcrypto.Key) {
+	var calc util.Calculator
+	calc.String(target).UUID().Key()
+
+	for id, key := range keys {
+		user, ok := m.users[id]
+		if !ok {
+			user, ok = m.spectators[id]
+		}
+		if !ok {
+			continue
+		}
+
+		redirect := calc.ToWriter()
+		redirect.
+			String(target).
+			UUID(m.id).
+			Key(key)
+		user.WritePacketTCP(knet.OCMatchRedirect, redirect.Buffer())
+		user.Close()
+	}
+
+	m.migrated = true
+}
+
+// AcceptMigration restores match sent by Manager.Migrate of other node and returns
+// response for it. Users of the match are added to state if missing and receive new
+// keys.
+func (m *Manager) AcceptMigration(data []byte) ([]byte, error) {
+	reader := util.NewReader(data)
+
+	snapshot, ok := DecodeSnapshot(&reader)
+	if !ok {
+		return nil, ErrInvalidMigration
+	}
+
+	m.migrationMutex.Lock()
+	defer m.migrationMutex.Unlock()
+
+	if aborted, ok := m.aborted[snapshot.ID]; ok && m.Clock.Now().Sub(aborted) <= AbortedTTL {
+		return nil, ErrMigrationAborted
+	}
+
+	count, ok := reader.Uint32()
+	if !ok {
+		return nil, ErrInvalidMigration
+	}
+
+	users := make([]*state.User, 0, util.Clamp(count, 0, 1024))
+	for i := uint32(0); i < count; i++ {
+		id, ok := reader.UUID()
+		if !ok {
+			return nil, ErrInvalidMigration
+		}
+		session, ok := reader.UUID()
+		if !ok {
+			return nil, ErrInvalidMigration
+		}
+		expiration, ok := reader.Uint64()
+		if !ok {
+			return nil, ErrInvalidMigration
+		}
+		ip, ok := reader.String()
+		if !ok {
+			return nil, ErrInvalidMigration
+		}
+
+		duration := time.Unix(0, int64(expiration)).Sub(m.Clock.Now())
+		users = append(users, state.NewUserWithClock(m.Clock, id, session, duration, ip))
+	}
+
+	if m.GetMatch(snapshot.ID) != nil {
+		return nil, ErrMatchExists
+	}
+
+	factory := m.GetCore(snapshot.Core)
+	if factory == nil {
+		return nil, ErrUnknownCore
+	}
+
+	match, err := Restore(m.State, m, factory(), snapshot)
+	if err != nil {
+		return nil, err
+	}
+	match.policy = m.policies[snapshot.Core]
+	match.migratedIn = true
+
+	target := m.Net.GetConnectionString()
+
+	var calc util.Calculator
+	writer := calc.String(target).Uint32().ToWriter()
+	writer.
+		String(target).
+		Uint32(uint32(len(users)))
+
+	for _, user := range users {
+		if m.GetUser(user.Session(), uuid.Nil) == nil {
+			m.AddUser(user)
+		}
+
+		key, ok := m.GetKey(user.ID())
+		if !ok {
+			key = m.CreateKey(user.ID())
+		}
+
+		writer.
+			UUID(user.ID()).
+			Key(key)
+	}
+
+	if m.store != nil {
+		m.saveSnapshot(snapshot)
+	}
+	m.AddMatch(match)
+
+	m.Info("Accepted migrated match %s.", snapshot.ID)
+
+	return writer.Buffer(), nil
+}
+
+// AbortMigration stops match this node accepted with AcceptMigration unless users
+// already joined it, then ErrMigrationConfirmed is returned. Migration of the match
+// is rejected for AbortedTTL. Aborting unknown match succeeds so abort can be
+// repeated.
+func (m *Manager) AbortMigration(id uuid.UUID) error {
+	m.migrationMutex.Lock()
+	defer m.migrationMutex.Unlock()
+
+	now := m.Clock.Now()
+	for match, aborted := range m.aborted {
+		if now.Sub(aborted) > AbortedTTL {
+			delete(m.aborted, match)
+		}
+	}
+	m.aborted[id] = now
+
+	match := m.GetMatch(id)
+	if match == nil || !match.migratedIn {
+		return nil
+	}
+
+	reply := <-match.queueSignal(signal{
+		reply: make(chan Reply, 1),
+		task: func(state State) (bool, error) {
+			if len(match.users) != 0 || len(match.spectators) != 0 {
+				return false, ErrMigrationConfirmed
+			}
+			return true, nil
+		},
+	})
+	if reply.Err == ErrMatchEnded {
+		return nil
+	}
+
+	if reply.Err == nil {
+		m.Info("Aborted migration of match %s.", id)
+	}
+
+	return reply.Err
+}
@@ -0,0 +1,178 @@
+package match
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/util"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+// migrationTarget creates node accepting migrations, if lose is true it accepts
+// migrations but responds with error.
+func migrationTarget(secret string, lose bool) (*Manager, *httptest.Server) {
+	target := testManager()
+	target.Cluster.Secret = secret
+	target.RegisterCore("counter", func() Core { return &tickCounter{} })
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, re *http.Request) {
+		if err := knet.RpcAssertPeer(target.State, nil, w, re); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(re.Body)
+		if re.Header.Get("id") == AbortMigrationRpc {
+			var id uuid.UUID
+			copy(id[:], body)
+			if err := target.AbortMigration(id); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+		response, err := target.AcceptMigration(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if lose {
+			http.Error(w, "response lost", http.StatusGatewayTimeout)
+			return
+		}
+		w.Write(response)
+	}))
+
+	return target, server
+}
+
+func TestMigrate(t *testing.T) {
+	source := testManager()
+	source.Cluster.Secret = "secret"
+	source.RegisterCore("counter", func() Core { return &tickCounter{} })
+	store := &memoryStore{snapshots: map[uuid.UUID]Snapshot{}}
+	source.EnableSnapshots(store)
+
+	target, server := migrationTarget("secret", false)
+	defer server.Close()
+
+	_, impostor := migrationTarget("other", false)
+	defer impostor.Close()
+
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	user := state.NewUser(uuid.New(), uuid.New(), time.Hour, "")
+	match, err := source.CreateMatch("counter", user, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := &fakeConn{}
+	match.ConnectUser(user, conn, nil)
+	for match.UserAmount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	store.Save(Snapshot{ID: match.ID()})
+	if err := source.Migrate(match.ID(), strings.TrimPrefix(impostor.URL, "http://")); err == nil {
+		t.Fatal("migration to node with other secret should fail")
+	}
+	if source.GetMatch(match.ID()) == nil {
+		t.Fatal("match should keep running after failed migration")
+	}
+	if _, ok := store.snapshots[match.ID()]; !ok {
+		t.Error("snapshot should be kept after failed migration")
+	}
+	<-match.Signal(nil)
+	if match.migrating {
+		t.Error("match should resume after failed migration")
+	}
+
+	if err := source.Migrate(match.ID(), address); err != nil {
+		t.Fatal(err)
+	}
+	source.running.Wait()
+
+	if source.GetMatch(match.ID()) != nil {
+		t.Error("migrated match should be removed from source")
+	}
+	if _, ok := store.snapshots[match.ID()]; ok {
+		t.Error("snapshot should be deleted after node confirmed migration")
+	}
+	migrated := target.GetMatch(match.ID())
+	if migrated == nil {
+		t.Fatal("match should run on target")
+	}
+	target.Shutdown()
+	if migrated.Core.(*tickCounter).ticks == 0 {
+		t.Error("core state should be transferred")
+	}
+	if target.GetUser(user.Session(), uuid.Nil) == nil {
+		t.Error("user session should be transferred")
+	}
+
+	last := conn.written[len(conn.written)-1]
+	if last.OpCode != knet.OCMatchRedirect {
+		t.Fatalf("expected redirect, got %v", last.OpCode)
+	}
+	reader := util.NewReader(last.Data)
+	addr, _ := reader.String()
+	id, _ := reader.UUID()
+	key, _ := reader.Key()
+	expected, _ := target.GetKey(user.ID())
+	if addr != target.Net.GetConnectionString() || id != match.ID() || key != expected {
+		t.Errorf("unexpected redirect %s %s", addr, id)
+	}
+}
+
+func TestMigrateLostResponse(t *testing.T) {
+	source := testManager()
+	source.Cluster.Secret = "secret"
+	source.RegisterCore("counter", func() Core { return &tickCounter{} })
+
+	target, server := migrationTarget("secret", true)
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	user := state.NewUser(uuid.New(), uuid.New(), time.Hour, "")
+	match, err := source.CreateMatch("counter", user, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := source.Migrate(match.ID(), address); err == nil {
+		t.Fatal("migration with lost response should fail")
+	}
+	target.running.Wait()
+	if target.GetMatch(match.ID()) != nil {
+		t.Error("node should abort match it accepted")
+	}
+	<-match.Signal(nil)
+	if match.migrating {
+		t.Error("match should resume after abort")
+	}
+
+	// delayed migration request cannot restore aborted match
+	snapshot, _ := match.Snapshot()
+	writer := util.Writer{}
+	snapshot.Encode(&writer)
+	writer.Uint32(0)
+	if _, err := target.AcceptMigration(writer.Buffer()); err != ErrMigrationAborted {
+		t.Errorf("expected %v, got %v", ErrMigrationAborted, err)
+	}
+
+	server.Close()
+	if err := source.Migrate(match.ID(), address); err != ErrMigrationUnknown {
+		t.Errorf("expected %v, got %v", ErrMigrationUnknown, err)
+	}
+	<-match.Signal(nil)
+	if !match.migrating {
+		t.Error("match should stay paused if abort fails")
+	}
+
+	source.Shutdown()
+}
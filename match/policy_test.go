@@ -0,0 +1,122 @@
+package match
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/util/clock"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+type fakeConn struct {
+	packets      []knet.ClientPacket
+	written      []knet.ClientPacket
+	disconnected bool
+}
+
+func (f *fakeConn) HarvestPackets(_ *state.State, buffer *[]knet.ClientPacket, _ *[][]byte) {
+	*buffer = append(*buffer, f.packets...)
+	f.packets = f.packets[:0]
+}
+func (f *fakeConn) WritePacket(knet.OpCode, []byte, bool) error { return nil }
+func (f *fakeConn) WritePacketTCP(opCode knet.OpCode, data []byte) error {
+	f.written = append(f.written, knet.ClientPacket{OpCode: opCode, Data: data})
+	return nil
+}
+func (f *fakeConn) WritePacketUDP(knet.OpCode, []byte) error { return nil }
+func (f *fakeConn) Disconnected() bool                       { return f.disconnected }
+func (f *fakeConn) Close()                                   {}
+
+func TestPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		// act is called each update with the elapsed time
+		act      func(elapsed time.Duration, m *Match, conn *fakeConn)
+		expected time.Duration
+	}{
+		{
+			name:     "empty",
+			policy:   Policy{EmptyTimeout: 10 * time.Second},
+			act:      func(time.Duration, *Match, *fakeConn) {},
+			expected: 10 * time.Second,
+		},
+		{
+			name:   "empty after leave",
+			policy: Policy{EmptyTimeout: 10 * time.Second},
+			act: func(elapsed time.Duration, m *Match, conn *fakeConn) {
+				switch elapsed {
+				case 5 * time.Second:
+					m.ConnectUser(state.NewUser(uuid.New(), uuid.New(), time.Hour, ""), conn, nil)
+				case 20 * time.Second:
+					conn.disconnected = true
+				}
+			},
+			expected: 31 * time.Second,
+		},
+		{
+			name:     "lifetime",
+			policy:   Policy{MaxLifetime: 7 * time.Second},
+			act:      func(time.Duration, *Match, *fakeConn) {},
+			expected: 7 * time.Second,
+		},
+		{
+			name:   "idle",
+			policy: Policy{IdleTimeout: 5 * time.Second},
+			act: func(elapsed time.Duration, m *Match, conn *fakeConn) {
+				if elapsed == 0 {
+					m.ConnectUser(state.NewUser(uuid.New(), uuid.New(), time.Hour, ""), conn, nil)
+				}
+				if elapsed <= 8*time.Second {
+					conn.packets = append(conn.packets, knet.ClientPacket{})
+				}
+			},
+			expected: 14 * time.Second,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			manager := testManager()
+			c := clock.NewManual(time.Unix(0, 0))
+			manager.Clock = c
+
+			m := newMatch(manager.State, manager, &CoreBase{}, uuid.Nil, uuid.Nil)
+			m.SetPolicy(test.policy)
+			conn := &fakeConn{}
+
+			var elapsed time.Duration
+			for m.Update() {
+				if elapsed > time.Minute {
+					t.Fatal("match was not terminated")
+				}
+				test.act(elapsed, m, conn)
+				c.Advance(time.Second)
+				elapsed += time.Second
+			}
+
+			// one more update is needed to end terminated match
+			if elapsed-time.Second != test.expected {
+				t.Errorf("expected termination after %v, got %v", test.expected, elapsed-time.Second)
+			}
+		})
+	}
+}
+
+func TestMatchRemovedAfterEnd(t *testing.T) {
+	manager := testManager()
+	manager.RegisterCoreWithPolicy("base", func() Core { return &CoreBase{} }, Policy{MaxLifetime: time.Millisecond})
+
+	match, err := manager.CreateMatch("base", state.NewUser(uuid.New(), uuid.New(), 0, ""), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manager.running.Wait()
+
+	if manager.GetMatch(match.ID()) != nil {
+		t.Error("ended match should be removed from manager")
+	}
+}
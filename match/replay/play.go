@@ -0,0 +1,161 @@
+package replay
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/match"
+	"github.com/jakubDoka/keeper/match/matchtest"
+	"github.com/jakubDoka/keeper/util"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+// Report is result of Play.
+type Report struct {
+	// Ticks is amount of ticks that were replayed.
+	Ticks       int
+	Divergences []Divergence
+}
+
+// Diverged returns true if core produced different output.
+func (r *Report) Diverged() bool {
+	return len(r.Divergences) != 0
+}
+
+// Divergence describes tick where replayed core did not send same packets as the
+// recorded one.
+type Divergence struct {
+	Tick          uint64
+	Expected, Got []Send
+}
+
+func (d Divergence) String() string {
+	return fmt.Sprintf("tick %d: expected %d packets, got %d", d.Tick, len(d.Expected), len(d.Got))
+}
+
+// Play re-drives fresh core with inputs from replay and reports ticks where outputs
+// differ. Clock of the match starts at time of the first tick and is set to recorded
+// time before each tick. Packets sent during a tick are compared regardless of order
+// as the order users are processed in is not deterministic.
+func Play(replay *Replay, core match.Core) (Report, error) {
+	var start time.Time
+	if len(replay.Ticks) > 0 {
+		start = replay.Ticks[0].Time
+	}
+
+	h, err := matchtest.NewWithID(core, replay.Creator, replay.ID, start, replay.Meta)
+	if err != nil {
+		return Report{}, util.WrapErr("failed to init core", err)
+	}
+
+	var capture capture
+	h.SetRecorder(&capture)
+
+	players := map[uuid.UUID]*matchtest.Player{}
+	report := Report{}
+
+	for _, tick := range replay.Ticks {
+		if d := tick.Time.Sub(h.Clock.Now()); d > 0 {
+			h.Clock.Advance(d)
+		}
+
+		for _, leave := range tick.Leaves {
+			if player, ok := players[leave]; ok {
+				player.Disconnect()
+				delete(players, leave)
+			}
+		}
+
+		for _, request := range tick.Requests {
+			player, ok := players[request.User]
+			if !ok {
+				return report, fmt.Errorf("tick %d: request from unknown user %s", tick.Number, request.User)
+			}
+			player.Send(request.OpCode, request.Data, request.Udp, request.Targets...)
+		}
+
+		for _, join := range tick.Joins {
+			user := h.State.GetUser(uuid.Nil, join.User)
+			if user == nil {
+				user = h.NewUserWithID(join.User)
+			}
+			players[join.User] = h.JoinAs(user, join.Meta)
+		}
+
+		for _, signal := range tick.Signals {
+			h.Signal(signal)
+		}
+
+		capture.sends = capture.sends[:0]
+		running := h.Update()
+		report.Ticks++
+
+		if !equal(tick.Sends, capture.sends) {
+			report.Divergences = append(report.Divergences, Divergence{
+				Tick:     tick.Number,
+				Expected: tick.Sends,
+				Got:      append([]Send(nil), capture.sends...),
+			})
+		}
+
+		if !running {
+			break
+		}
+	}
+
+	return report, nil
+}
+
+func equal(a, b []Send) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	encA, encB := encode(a), encode(b)
+	for i := range encA {
+		if !bytes.Equal(encA[i], encB[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func encode(sends []Send) [][]byte {
+	res := make([][]byte, len(sends))
+	for i, send := range sends {
+		var r Recorder
+		r.RecordSend(send.Targets, send.OpCode, send.Data, send.Udp)
+		res[i] = r.buffer.Buffer()
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return bytes.Compare(res[i], res[j]) < 0
+	})
+	return res
+}
+
+// capture collects packets replayed match sends.
+type capture struct {
+	sends []Send
+}
+
+func (c *capture) RecordInit(id, creator uuid.UUID, meta []byte)          {}
+func (c *capture) RecordTick(tick uint64, now time.Time)                  {}
+func (c *capture) RecordJoin(user uuid.UUID, meta []byte)                 {}
+func (c *capture) RecordLeave(user uuid.UUID)                             {}
+func (c *capture) RecordRequest(user uuid.UUID, packet knet.ClientPacket) {}
+func (c *capture) RecordSignal(data []byte)                               {}
+func (c *capture) RecordSend(targets []uuid.UUID, opCode knet.OpCode, data []byte, udp bool) {
+	if targets != nil {
+		targets = append([]uuid.UUID(nil), targets...)
+	}
+	c.sends = append(c.sends, Send{
+		Targets: targets,
+		OpCode:  opCode,
+		Data:    append([]byte(nil), data...),
+		Udp:     udp,
+	})
+}
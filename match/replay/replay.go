@@ -0,0 +1,361 @@
+// replay records match inputs and outputs and re-drives cores with them so
+// desyncs and reported cheating can be investigated after the fact.
+package replay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/util"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+// Magic starts every replay file, Version follows it.
+const (
+	Magic   = "KRPL"
+	Version = 1
+)
+
+// kinds of records
+const (
+	rTick uint8 = iota
+	rJoin
+	rLeave
+	rRequest
+	rSend
+	rSignal
+)
+
+// all means that packet was sent to all players
+const all = ^uint32(0)
+
+var (
+	ErrInvalidMagic   = errors.New("data is not a replay")
+	ErrInvalidVersion = fmt.Errorf("unsupported replay version, expected %d", Version)
+	ErrUnexpectedEOF  = errors.New("replay is truncated")
+	ErrUnknownRecord  = errors.New("unknown record kind")
+	ErrMissingTick    = errors.New("record is not preceded by tick")
+)
+
+// Replay is decoded recording of a match.
+type Replay struct {
+	ID, Creator uuid.UUID
+	Meta        []byte
+	Ticks       []Tick
+}
+
+// Tick holds everything that happened during one match update.
+type Tick struct {
+	Number   uint64
+	Time     time.Time
+	Joins    []Join
+	Leaves   []uuid.UUID
+	Requests []Request
+	Sends    []Send
+	Signals  [][]byte
+}
+
+// Join is a connection attempt.
+type Join struct {
+	User uuid.UUID
+	Meta []byte
+}
+
+// Request is a packet user sent to match.
+type Request struct {
+	User    uuid.UUID
+	OpCode  knet.OpCode
+	Targets []uuid.UUID
+	Data    []byte
+	Udp     bool
+}
+
+// Send is a packet match sent trough SendPacket. Nil targets mean all users.
+type Send struct {
+	Targets []uuid.UUID
+	OpCode  knet.OpCode
+	Data    []byte
+	Udp     bool
+}
+
+// Recorder implements match.Recorder and writes records to io.Writer. Data is
+// flushed at the start of each tick so writer does not have to be buffered.
+type Recorder struct {
+	w      io.Writer
+	buffer util.Writer
+	err    error
+}
+
+// NewRecorder creates recorder writing to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: w}
+}
+
+// Err returns the first error writer returned. Recorder stops recording after that.
+func (r *Recorder) Err() error {
+	return r.err
+}
+
+// Flush writes buffered records.
+func (r *Recorder) Flush() error {
+	if r.err != nil {
+		return r.err
+	}
+	_, r.err = r.w.Write(r.buffer.Buffer())
+	r.buffer = util.Writer{}
+	return r.err
+}
+
+func (r *Recorder) RecordInit(id, creator uuid.UUID, meta []byte) {
+	if r.err != nil {
+		return
+	}
+	r.buffer.
+		Rest([]byte(Magic)).
+		Uint32(Version).
+		UUID(id).
+		UUID(creator).
+		Bytes(meta)
+}
+
+func (r *Recorder) RecordTick(tick uint64, now time.Time) {
+	if r.Flush() != nil {
+		return
+	}
+	r.buffer.
+		Uint8(rTick).
+		Uint64(tick).
+		Uint64(uint64(now.UnixNano()))
+}
+
+func (r *Recorder) RecordJoin(user uuid.UUID, meta []byte) {
+	if r.err != nil {
+		return
+	}
+	r.buffer.
+		Uint8(rJoin).
+		UUID(user).
+		Bytes(meta)
+}
+
+func (r *Recorder) RecordLeave(user uuid.UUID) {
+	if r.err != nil {
+		return
+	}
+	r.buffer.
+		Uint8(rLeave).
+		UUID(user)
+}
+
+func (r *Recorder) RecordRequest(user uuid.UUID, packet knet.ClientPacket) {
+	if r.err != nil {
+		return
+	}
+	r.buffer.
+		Uint8(rRequest).
+		UUID(user)
+	r.packet(packet.Targets, packet.OpCode, packet.Data, packet.Udp)
+}
+
+func (r *Recorder) RecordSend(targets []uuid.UUID, opCode knet.OpCode, data []byte, udp bool) {
+	if r.err != nil {
+		return
+	}
+	r.buffer.Uint8(rSend)
+	r.packet(targets, opCode, data, udp)
+}
+
+func (r *Recorder) RecordSignal(data []byte) {
+	if r.err != nil {
+		return
+	}
+	r.buffer.
+		Uint8(rSignal).
+		Bytes(data)
+}
+
+func (r *Recorder) packet(targets []uuid.UUID, opCode knet.OpCode, data []byte, udp bool) {
+	var flag uint8
+	if udp {
+		flag = 1
+	}
+	r.buffer.
+		Uint32(uint32(opCode)).
+		Uint8(flag)
+
+	if targets == nil {
+		r.buffer.Uint32(all)
+	} else {
+		r.buffer.Uint32(uint32(len(targets)))
+		for _, target := range targets {
+			r.buffer.UUID(target)
+		}
+	}
+
+	r.buffer.Bytes(data)
+}
+
+// Read decodes whole replay from r.
+func Read(r io.Reader) (*Replay, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, util.WrapErr("failed to read replay", err)
+	}
+	return Decode(data)
+}
+
+// Decode decodes replay from data.
+func Decode(data []byte) (*Replay, error) {
+	if len(data) < len(Magic) || string(data[:len(Magic)]) != Magic {
+		return nil, ErrInvalidMagic
+	}
+
+	reader := util.NewReader(data[len(Magic):])
+	version, ok := reader.Uint32()
+	if !ok {
+		return nil, ErrUnexpectedEOF
+	}
+	if version != Version {
+		return nil, ErrInvalidVersion
+	}
+
+	replay := &Replay{}
+
+	replay.ID, ok = reader.UUID()
+	if !ok {
+		return nil, ErrUnexpectedEOF
+	}
+	replay.Creator, ok = reader.UUID()
+	if !ok {
+		return nil, ErrUnexpectedEOF
+	}
+	replay.Meta, ok = reader.Bytes()
+	if !ok {
+		return nil, ErrUnexpectedEOF
+	}
+
+	var tick *Tick
+	for {
+		kind, ok := reader.Uint8()
+		if !ok {
+			break
+		}
+
+		if kind != rTick && tick == nil {
+			return nil, ErrMissingTick
+		}
+
+		switch kind {
+		case rTick:
+			number, ok := reader.Uint64()
+			if !ok {
+				return nil, ErrUnexpectedEOF
+			}
+			nano, ok := reader.Uint64()
+			if !ok {
+				return nil, ErrUnexpectedEOF
+			}
+			replay.Ticks = append(replay.Ticks, Tick{
+				Number: number,
+				Time:   time.Unix(0, int64(nano)),
+			})
+			tick = &replay.Ticks[len(replay.Ticks)-1]
+		case rJoin:
+			user, ok := reader.UUID()
+			if !ok {
+				return nil, ErrUnexpectedEOF
+			}
+			meta, ok := reader.Bytes()
+			if !ok {
+				return nil, ErrUnexpectedEOF
+			}
+			tick.Joins = append(tick.Joins, Join{user, meta})
+		case rLeave:
+			user, ok := reader.UUID()
+			if !ok {
+				return nil, ErrUnexpectedEOF
+			}
+			tick.Leaves = append(tick.Leaves, user)
+		case rRequest:
+			user, ok := reader.UUID()
+			if !ok {
+				return nil, ErrUnexpectedEOF
+			}
+			send, ok := readPacket(&reader)
+			if !ok {
+				return nil, ErrUnexpectedEOF
+			}
+			if send.Targets == nil {
+				send.Targets = []uuid.UUID{}
+			}
+			tick.Requests = append(tick.Requests, Request{
+				User:    user,
+				OpCode:  send.OpCode,
+				Targets: send.Targets,
+				Data:    send.Data,
+				Udp:     send.Udp,
+			})
+		case rSend:
+			send, ok := readPacket(&reader)
+			if !ok {
+				return nil, ErrUnexpectedEOF
+			}
+			tick.Sends = append(tick.Sends, send)
+		case rSignal:
+			data, ok := reader.Bytes()
+			if !ok {
+				return nil, ErrUnexpectedEOF
+			}
+			tick.Signals = append(tick.Signals, data)
+		default:
+			return nil, ErrUnknownRecord
+		}
+	}
+
+	return replay, nil
+}
+
+func readPacket(reader *util.Reader) (Send, bool) {
+	opCode, ok := reader.Uint32()
+	if !ok {
+		return Send{}, false
+	}
+	flag, ok := reader.Uint8()
+	if !ok {
+		return Send{}, false
+	}
+	count, ok := reader.Uint32()
+	if !ok {
+		return Send{}, false
+	}
+
+	var targets []uuid.UUID
+	if count != all {
+		if int(count) > len(reader.Rest())/uuid.Length {
+			return Send{}, false
+		}
+		targets = make([]uuid.UUID, count)
+		for i := range targets {
+			targets[i], ok = reader.UUID()
+			if !ok {
+				return Send{}, false
+			}
+		}
+	}
+
+	data, ok := reader.Bytes()
+	if !ok {
+		return Send{}, false
+	}
+
+	return Send{
+		Targets: targets,
+		OpCode:  knet.OpCode(opCode),
+		Data:    data,
+		Udp:     flag == 1,
+	}, true
+}
@@ -0,0 +1,159 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/match"
+	"github.com/jakubDoka/keeper/match/matchtest"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+const ocCount = knet.OCLast
+
+// counter broadcasts how many requests it received so far, offset allows
+// simulating a desync.
+type counter struct {
+	match.CoreBase
+	count, offset uint32
+}
+
+func (c *counter) OnCustomRequest(state match.State, req []match.Request) error {
+	for range req {
+		c.count++
+		var buf [4]byte
+		binary.BigEndian.PutUint32(buf[:], c.count+c.offset)
+		state.SendPacket(state.All(), ocCount, buf[:], false)
+	}
+	return nil
+}
+
+func TestRecordAndPlay(t *testing.T) {
+	h, err := matchtest.New(&counter{}, []byte("meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var file bytes.Buffer
+	recorder := NewRecorder(&file)
+	h.SetRecorder(recorder)
+
+	a := h.Join(nil)
+	b := h.Join([]byte("b"))
+	h.Tick(1)
+
+	a.Send(ocCount, nil, false)
+	b.Send(ocCount, []byte("x"), true, a.ID())
+	h.Tick(2)
+
+	b.Disconnect()
+	a.Send(ocCount, nil, false)
+	h.Tick(1)
+
+	if err := recorder.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	replay, err := Read(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if replay.ID != h.ID() || replay.Creator != h.Creator.ID() || string(replay.Meta) != "meta" {
+		t.Errorf("unexpected header %v %v %q", replay.ID, replay.Creator, replay.Meta)
+	}
+	if len(replay.Ticks) != 4 {
+		t.Fatalf("expected 4 ticks, got %d", len(replay.Ticks))
+	}
+	if len(replay.Ticks[0].Joins) != 2 || len(replay.Ticks[1].Requests) != 2 || len(replay.Ticks[3].Leaves) != 1 {
+		t.Errorf("unexpected ticks %+v", replay.Ticks)
+	}
+
+	report, err := Play(replay, &counter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Diverged() || report.Ticks != 4 {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	report, err = Play(replay, &counter{offset: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Divergences) != 2 || report.Divergences[0].Tick != 1 {
+		t.Errorf("unexpected report %+v", report)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	if _, err := Decode([]byte("nope")); err != ErrInvalidMagic {
+		t.Errorf("expected %v, got %v", ErrInvalidMagic, err)
+	}
+
+	var r Recorder
+	r.RecordInit(uuid.Nil, uuid.Nil, nil)
+	r.RecordJoin(uuid.Nil, nil)
+	if _, err := Decode(r.buffer.Buffer()); err != ErrMissingTick {
+		t.Errorf("expected %v, got %v", ErrMissingTick, err)
+	}
+}
+
+func TestPlayRealTime(t *testing.T) {
+	h, err := matchtest.NewWithID(&counter{}, uuid.New(), uuid.Nil, time.Now(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var file bytes.Buffer
+	recorder := NewRecorder(&file)
+	h.SetRecorder(recorder)
+
+	a := h.Join(nil)
+	h.Tick(1)
+	a.Send(ocCount, nil, false)
+	h.Tick(1)
+
+	if err := recorder.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	replay, err := Read(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Play(replay, &counter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Diverged() || report.Ticks != 2 {
+		t.Errorf("unexpected report %+v", report)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(data []byte) (int, error) {
+	return 0, errors.New("disk is full")
+}
+
+func TestRecorderError(t *testing.T) {
+	r := NewRecorder(failingWriter{})
+	r.RecordInit(uuid.Nil, uuid.Nil, nil)
+	r.RecordTick(0, time.Time{})
+	if r.Err() == nil {
+		t.Fatal("expected error")
+	}
+
+	r.RecordJoin(uuid.Nil, []byte("meta"))
+	r.RecordTick(1, time.Time{})
+	r.RecordSend(nil, ocCount, []byte("data"), false)
+	if len(r.buffer.Buffer()) != 0 {
+		t.Errorf("recorder should stop buffering after error, got %d bytes", len(r.buffer.Buffer()))
+	}
+}
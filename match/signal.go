@@ -0,0 +1,93 @@
+package match
+
+import (
+	"errors"
+)
+
+var (
+	ErrMatchEnded      = errors.New("match ended before handling the signal")
+	ErrUnhandledSignal = errors.New("match does not handle signals")
+)
+
+// Reply is the result of Core.OnSignal.
+type Reply struct {
+	Data []byte
+	Err  error
+}
+
+type signal struct {
+	data  []byte
+	reply chan Reply
+	// task is called instead of OnSignal if not nil, loop ends if it returns true.
+	task func(state State) (bool, error)
+}
+
+// Signal queues data for Core.OnSignal that is called on next update. Returned
+// channel receives exactly one reply, ErrMatchEnded if match ends before handling
+// the signal. Channel is buffered so it can be ignored. This is thread safe and
+// it is the only way other goroutines should talk to running match.
+func (m *Match) Signal(data []byte) <-chan Reply {
+	return m.queueSignal(signal{data: data, reply: make(chan Reply, 1)})
+}
+
+func (m *Match) queueSignal(s signal) <-chan Reply {
+	m.signalsMutex.Lock()
+	if m.ended {
+		s.reply <- Reply{Err: ErrMatchEnded}
+	} else {
+		m.signals = append(m.signals, s)
+	}
+	m.signalsMutex.Unlock()
+
+	return s.reply
+}
+
+func (m *Match) handleSignals(state State) bool {
+	m.signalsMutex.Lock()
+	m.signals, m.tempSignals = m.tempSignals[:0], m.signals
+	m.signalsMutex.Unlock()
+
+	for i, s := range m.tempSignals {
+		if s.task != nil {
+			stop, err := s.task(state)
+			s.reply <- Reply{Err: err}
+			if stop {
+				m.rejectSignals(m.tempSignals[i+1:])
+				return false
+			}
+			continue
+		}
+
+		if m.recorder != nil {
+			m.recorder.RecordSignal(s.data)
+		}
+
+		reply, err, fatalErr := m.OnSignal(state, s.data)
+		if fatalErr != nil {
+			err = fatalErr
+		}
+		s.reply <- Reply{reply, err}
+
+		if m.handleErr(fatalErr) {
+			m.rejectSignals(m.tempSignals[i+1:])
+			return false
+		}
+	}
+
+	return true
+}
+
+// endSignals rejects pending signals and all future ones.
+func (m *Match) endSignals() {
+	m.signalsMutex.Lock()
+	m.ended = true
+	m.rejectSignals(m.signals)
+	m.signals = nil
+	m.signalsMutex.Unlock()
+}
+
+func (m *Match) rejectSignals(signals []signal) {
+	for _, s := range signals {
+		s.reply <- Reply{Err: ErrMatchEnded}
+	}
+}
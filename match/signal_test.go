@@ -0,0 +1,83 @@
+package match
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+type pausable struct {
+	CoreBase
+	paused bool
+}
+
+func (p *pausable) OnSignal(state State, data []byte) ([]byte, error, error) {
+	switch string(data) {
+	case "pause":
+		p.paused = !p.paused
+		if p.paused {
+			return []byte("paused"), nil, nil
+		}
+		return []byte("resumed"), nil, nil
+	case "stop":
+		state.Terminate()
+		return nil, nil, nil
+	case "crash":
+		return nil, nil, errors.New("crash")
+	}
+	return nil, ErrUnhandledSignal, nil
+}
+
+func TestSignalMatch(t *testing.T) {
+	manager := testManager()
+	manager.RegisterCore("pausable", func() Core { return &pausable{} })
+
+	match, err := manager.CreateMatch("pausable", state.NewUser(uuid.New(), uuid.New(), 0, ""), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reply, err := manager.SignalMatch(match.ID(), []byte("pause")); err != nil || string(reply) != "paused" {
+		t.Errorf("unexpected reply %q %v", reply, err)
+	}
+	if reply, err := manager.SignalMatch(match.ID(), []byte("pause")); err != nil || string(reply) != "resumed" {
+		t.Errorf("unexpected reply %q %v", reply, err)
+	}
+	if _, err := manager.SignalMatch(match.ID(), []byte("?")); err != ErrUnhandledSignal {
+		t.Errorf("expected %v, got %v", ErrUnhandledSignal, err)
+	}
+
+	if _, err := manager.SignalMatch(match.ID(), []byte("stop")); err != nil {
+		t.Fatal(err)
+	}
+
+	manager.running.Wait()
+
+	if reply := <-match.Signal(nil); reply.Err != ErrMatchEnded {
+		t.Errorf("expected %v, got %v", ErrMatchEnded, reply.Err)
+	}
+	if _, err := manager.SignalMatch(match.ID(), nil); err != ErrMatchNotFound {
+		t.Errorf("expected %v, got %v", ErrMatchNotFound, err)
+	}
+}
+
+func TestSignalFatal(t *testing.T) {
+	manager := testManager()
+	m := newMatch(manager.State, manager, &pausable{}, uuid.Nil, uuid.Nil)
+
+	crash := m.Signal([]byte("crash"))
+	pending := m.Signal([]byte("pause"))
+
+	if m.Update() {
+		t.Fatal("fatal signal error should end the match")
+	}
+
+	if reply := <-crash; reply.Err == nil {
+		t.Error("sender should receive the fatal error")
+	}
+	if reply := <-pending; reply.Err != ErrMatchEnded {
+		t.Errorf("expected %v, got %v", ErrMatchEnded, reply.Err)
+	}
+}
@@ -0,0 +1,226 @@
+package match
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/util"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+var ErrNotSnapshotCore = errors.New("core does not implement SnapshotCore")
+
+// SnapshotCore is optional extension of Core. Matches with such core survive server
+// restarts if snapshots are enabled on Manager. Restore is called instead of OnInit
+// when match is recreated.
+type SnapshotCore interface {
+	Core
+	Snapshot() []byte
+	Restore(data []byte) error
+}
+
+// Snapshot is everything needed to recreate a match.
+type Snapshot struct {
+	ID, Creator uuid.UUID
+	Core        string
+	Tag         []byte
+	TickRate    int
+	Data        []byte
+	// Created is kept so Policy.MaxLifetime counts from the original creation.
+	Created time.Time
+}
+
+// SnapshotStore persists snapshots. Methods are called from multiple goroutines.
+type SnapshotStore interface {
+	Save(snapshot Snapshot) error
+	Delete(id uuid.UUID) error
+	Load() ([]Snapshot, error)
+}
+
+//go:embed match.sql
+var sqlString string
+
+// SQLSnapshotStore stores snapshots in database trough state.Prepared.
+type SQLSnapshotStore struct {
+	*state.State
+}
+
+// NewSQLSnapshotStore prepares the statements, this has to be called before state.Prepared
+// is finished.
+func NewSQLSnapshotStore(s *state.State) (*SQLSnapshotStore, error) {
+	err := s.Prepare("matches", sqlString)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLSnapshotStore{s}, nil
+}
+
+func (s *SQLSnapshotStore) Save(snapshot Snapshot) error {
+	_, err := s.Get("matches:save").Exec(
+		snapshot.ID.StringWithHyphens(),
+		snapshot.Core,
+		snapshot.Creator.StringWithHyphens(),
+		snapshot.Tag,
+		snapshot.TickRate,
+		snapshot.Data,
+		snapshot.Created.UnixNano(),
+	)
+	return err
+}
+
+func (s *SQLSnapshotStore) Delete(id uuid.UUID) error {
+	_, err := s.Get("matches:delete").Exec(id.StringWithHyphens())
+	return err
+}
+
+func (s *SQLSnapshotStore) Load() ([]Snapshot, error) {
+	rows, err := s.Get("matches:load").Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Snapshot
+	for rows.Next() {
+		var id, creator string
+		var created int64
+		var snapshot Snapshot
+		err := rows.Scan(&id, &snapshot.Core, &creator, &snapshot.Tag, &snapshot.TickRate, &snapshot.Data, &created)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Created = time.Unix(0, created)
+		snapshot.ID, err = uuid.ParseWithHyphens(id)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Creator, err = uuid.ParseWithHyphens(creator)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, snapshot)
+	}
+
+	return result, rows.Err()
+}
+
+// Restore recreates match from snapshot. Match is not added to manager.
+func Restore(state *state.State, manager *Manager, core Core, snapshot Snapshot) (*Match, error) {
+	sc, ok := core.(SnapshotCore)
+	if !ok {
+		return nil, ErrNotSnapshotCore
+	}
+
+	m := newMatch(state, manager, core, snapshot.Creator, snapshot.ID)
+	m.coreID = snapshot.Core
+	if !snapshot.Created.IsZero() {
+		m.created = snapshot.Created
+	}
+
+	err := sc.Restore(snapshot.Data)
+	if err != nil {
+		return nil, util.WrapErr("failed to restore core", err)
+	}
+
+	if snapshot.TickRate != 0 {
+		m.SetTickRate(snapshot.TickRate)
+	}
+
+	if len(snapshot.Tag) != 0 {
+		i, err := m.SetTag(snapshot.Tag)
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore tag:%d: %s", i, err)
+		}
+	}
+
+	m.refreshInfo()
+
+	return m, nil
+}
+
+// Snapshot captures the match state. Returns false if core is not SnapshotCore. This
+// is not thread safe, Manager takes snapshots from match loop. Snapshot owns its data
+// so it can be saved on other goroutine.
+func (m *Match) Snapshot() (Snapshot, bool) {
+	sc, ok := m.Core.(SnapshotCore)
+	if !ok {
+		return Snapshot{}, false
+	}
+
+	return Snapshot{
+		ID:       m.id,
+		Creator:  m.creator,
+		Core:     m.coreID,
+		Tag:      append([]byte(nil), m.tagSource...),
+		TickRate: m.tickRate,
+		Data:     append([]byte(nil), sc.Snapshot()...),
+		Created:  m.created,
+	}, true
+}
+
+// snapshotSaver saves snapshots of one match off the match loop. Saves run one at a
+// time in order they were requested and only the latest pending snapshot is kept.
+type snapshotSaver struct {
+	mutex   sync.Mutex
+	pending *Snapshot
+	saving  bool
+	closed  bool
+	running sync.WaitGroup
+}
+
+func (s *snapshotSaver) save(manager *Manager, snapshot Snapshot) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	s.pending = &snapshot
+	if s.saving {
+		return
+	}
+
+	s.saving = true
+	s.running.Add(1)
+	go s.run(manager)
+}
+
+func (s *snapshotSaver) run(manager *Manager) {
+	defer s.running.Done()
+
+	for {
+		s.mutex.Lock()
+		snapshot := s.pending
+		s.pending = nil
+		if snapshot == nil {
+			s.saving = false
+			s.mutex.Unlock()
+			return
+		}
+		s.mutex.Unlock()
+
+		manager.saveSnapshot(*snapshot)
+	}
+}
+
+// close drops pending snapshot and waits for the running save so nothing is saved
+// after the match ends.
+func (s *snapshotSaver) close() {
+	s.mutex.Lock()
+	s.closed = true
+	s.pending = nil
+	s.mutex.Unlock()
+
+	s.running.Wait()
+}
+
+// CoreID returns id under which the core of the match is registered, empty
+// if match was not created by Manager.
+func (m *Match) CoreID() string {
+	return m.coreID
+}
@@ -0,0 +1,192 @@
+package match
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+
+	"github.com/jakubDoka/keeper/index"
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/state/statetest"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+type memoryStore struct {
+	mutex     sync.Mutex
+	snapshots map[uuid.UUID]Snapshot
+}
+
+func (m *memoryStore) Save(snapshot Snapshot) error {
+	m.mutex.Lock()
+	m.snapshots[snapshot.ID] = snapshot
+	m.mutex.Unlock()
+	return nil
+}
+
+func (m *memoryStore) Delete(id uuid.UUID) error {
+	m.mutex.Lock()
+	delete(m.snapshots, id)
+	m.mutex.Unlock()
+	return nil
+}
+
+func (m *memoryStore) Load() ([]Snapshot, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var res []Snapshot
+	for _, s := range m.snapshots {
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+type tickCounter struct {
+	CoreBase
+	ticks uint32
+}
+
+func (t *tickCounter) OnTick(state State) error {
+	t.ticks++
+	return nil
+}
+
+func (t *tickCounter) OnInfoRequest(state State) ([]byte, error) {
+	return t.Snapshot(), nil
+}
+
+func (t *tickCounter) Snapshot() []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], t.ticks)
+	return buf[:]
+}
+
+func (t *tickCounter) Restore(data []byte) error {
+	t.ticks = binary.BigEndian.Uint32(data)
+	return nil
+}
+
+func testManager() *Manager {
+	return NewManager(statetest.New())
+}
+
+func TestSnapshotShutdownAndRestore(t *testing.T) {
+	store := &memoryStore{snapshots: map[uuid.UUID]Snapshot{}}
+
+	manager := testManager()
+	manager.EnableSnapshots(store)
+	manager.RegisterCore("counter", func() Core { return &tickCounter{} })
+	manager.DeclareField("mode", index.KindString)
+
+	creator := state.NewUser(uuid.New(), uuid.New(), 0, "")
+	match, err := manager.CreateMatch("counter", creator, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	match.SetTickRate(1000)
+	if _, err := match.SetTag([]byte("mode: ranked")); err != nil {
+		t.Fatal(err)
+	}
+
+	manager.Shutdown()
+
+	snapshot, ok := store.snapshots[match.ID()]
+	if !ok {
+		t.Fatal("snapshot was not saved on shutdown")
+	}
+	if snapshot.Core != "counter" || snapshot.Creator != creator.ID() || string(snapshot.Tag) != "mode: ranked" {
+		t.Errorf("unexpected snapshot %+v", snapshot)
+	}
+
+	restarted := testManager()
+	restarted.EnableSnapshots(store)
+	restarted.RegisterCore("counter", func() Core { return &tickCounter{} })
+	restarted.DeclareField("mode", index.KindString)
+	if err := restarted.RestoreSnapshots(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := restarted.GetMatch(match.ID())
+	if restored == nil {
+		t.Fatal("match was not restored")
+	}
+	if restored.TickRate() != 1000 || restored.CoreID() != "counter" {
+		t.Errorf("unexpected restored match %d %s", restored.TickRate(), restored.CoreID())
+	}
+	if !restored.created.Equal(match.created) {
+		t.Errorf("restored match should keep creation time %v %v", restored.created, match.created)
+	}
+
+	restored.RequestStop()
+	restarted.running.Wait()
+
+	if store.snapshots[match.ID()].Data == nil {
+		t.Error("restored match should save snapshot again")
+	}
+}
+
+func TestSnapshotDeletedOnEnd(t *testing.T) {
+	store := &memoryStore{snapshots: map[uuid.UUID]Snapshot{}}
+
+	manager := testManager()
+	manager.EnableSnapshots(store)
+
+	match := newMatch(manager.State, manager, &tickCounter{}, uuid.Nil, uuid.Nil)
+	store.Save(Snapshot{ID: match.ID()})
+
+	match.Terminate()
+	manager.AddMatch(match)
+	manager.running.Wait()
+
+	if _, ok := store.snapshots[match.ID()]; ok {
+		t.Error("snapshot of ended match should be deleted")
+	}
+}
+
+func TestSnapshotNotSavedAfterEnd(t *testing.T) {
+	store := &memoryStore{snapshots: map[uuid.UUID]Snapshot{}}
+
+	manager := testManager()
+	manager.EnableSnapshots(store)
+	manager.DeclareField("mode", index.KindString)
+
+	match := newMatch(manager.State, manager, &tickCounter{}, uuid.Nil, uuid.Nil)
+	if _, err := match.SetTag([]byte("mode: ranked")); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, _ := match.Snapshot()
+	if _, err := match.SetTag([]byte("mode: casual")); err != nil {
+		t.Fatal(err)
+	}
+	if string(snapshot.Tag) != "mode: ranked" {
+		t.Errorf("snapshot should own its tag, got %q", snapshot.Tag)
+	}
+
+	match.saver.save(manager, snapshot)
+	match.saver.running.Wait()
+	if _, ok := store.snapshots[match.ID()]; !ok {
+		t.Fatal("snapshot was not saved")
+	}
+
+	store.Delete(match.ID())
+	match.saver.close()
+	match.saver.save(manager, snapshot)
+	match.saver.running.Wait()
+	if _, ok := store.snapshots[match.ID()]; ok {
+		t.Error("snapshot should not be saved after match ended")
+	}
+}
+
+func TestInfoRefreshedOnTick(t *testing.T) {
+	manager := testManager()
+	counter := &tickCounter{}
+	match := newMatch(manager.State, manager, counter, uuid.Nil, uuid.Nil)
+
+	match.Update()
+	match.Update()
+
+	counter.ticks = 10
+	if info := match.Info(); binary.BigEndian.Uint32(info) != 2 {
+		t.Errorf("info should be taken on match loop, got %d", binary.BigEndian.Uint32(info))
+	}
+}
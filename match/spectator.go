@@ -0,0 +1,167 @@
+package match
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+var (
+	ErrSpectatorsDisabled = errors.New("match does not allow spectators")
+	ErrSpectatorLimit     = errors.New("match has maximum amount of spectators")
+)
+
+// SpectatorCore is optional extension of Core that controls spectators. Without it
+// spectators are accepted up to Policy.MaxSpectators and receive all packets sent
+// to all players.
+type SpectatorCore interface {
+	Core
+	// OnSpectatorConnection has same semantics as OnConnection.
+	OnSpectatorConnection(state State, user User, meta []byte) ([]byte, error, error)
+	// OnSpectatorDisconnection is called when spectator disconnects.
+	OnSpectatorDisconnection(state State, user User) error
+	// OnSpectatorPacket is called for each packet broadcasted to all players. Returned
+	// data is sent to spectators instead if ok is true.
+	OnSpectatorPacket(state State, opCode knet.OpCode, data []byte, udp bool) (result []byte, ok bool)
+}
+
+type delayedPacket struct {
+	due    time.Time
+	opCode knet.OpCode
+	data   []byte
+	udp    bool
+}
+
+// ConnectSpectator is like ConnectUser but user joins as spectator. Packets from
+// spectators are discarded.
+func (m *Match) ConnectSpectator(user *state.User, conn knet.Conn, meta []byte) {
+	m.queuedUsersMutex.Lock()
+	m.queuedUsers = append(m.queuedUsers, User{
+		User:      user,
+		Conn:      conn,
+		Party:     m.manager.PartyOf(user.ID()),
+		Spectator: true,
+		meta:      meta,
+	})
+	m.queuedUsersMutex.Unlock()
+}
+
+// SpectatorAmount returns amount of spectators. This is thread safe.
+func (m *Match) SpectatorAmount() uint32 {
+	return atomic.LoadUint32(&m.spectatorAmount)
+}
+
+// GetSpectator returns spectator with given id.
+func (m *Match) GetSpectator(id uuid.UUID) (User, bool) {
+	user, ok := m.spectators[id]
+	return user, ok
+}
+
+// SendSpectators sends packet to all spectators immediately, ignoring the delay and
+// OnSpectatorPacket.
+func (m *Match) SendSpectators(opCode knet.OpCode, data []byte, udp bool) {
+	for _, spectator := range m.spectators {
+		spectator.WritePacket(opCode, data, udp)
+	}
+}
+
+func (m *Match) connectSpectator(state State, user User) error {
+	var meta []byte
+	var err error
+
+	switch {
+	case m.policy.MaxSpectators == 0:
+		err = ErrSpectatorsDisabled
+	case len(m.spectators) >= m.policy.MaxSpectators:
+		err = ErrSpectatorLimit
+	default:
+		if sc, ok := m.Core.(SpectatorCore); ok {
+			var fatalErr error
+			meta, err, fatalErr = sc.OnSpectatorConnection(state, user, user.meta)
+			if fatalErr != nil {
+				return fatalErr
+			}
+		}
+	}
+
+	user.meta = nil
+
+	if err != nil {
+		user.WritePacketTCP(knet.OCMatchJoinFail, []byte(err.Error()))
+		return nil
+	}
+
+	user.WritePacketTCP(knet.OCMatchJoinSuccess, meta)
+	m.spectators[user.User.ID()] = user
+	atomic.StoreUint32(&m.spectatorAmount, uint32(len(m.spectators)))
+
+	return nil
+}
+
+func (m *Match) updateSpectators(state State) error {
+	sc, _ := m.Core.(SpectatorCore)
+
+	for id, spectator := range m.spectators {
+		if spectator.Disconnected() {
+			if sc != nil {
+				if err := sc.OnSpectatorDisconnection(state, spectator); err != nil {
+					return err
+				}
+			}
+			spectator.Close()
+			delete(m.spectators, id)
+			atomic.StoreUint32(&m.spectatorAmount, uint32(len(m.spectators)))
+			continue
+		}
+
+		m.buffer = m.buffer[:0]
+		spectator.HarvestPackets(m.state, &m.buffer, &m.helper)
+	}
+
+	return nil
+}
+
+func (m *Match) broadcastSpectators(opCode knet.OpCode, data []byte, udp bool) {
+	if len(m.spectators) == 0 {
+		return
+	}
+
+	if sc, ok := m.Core.(SpectatorCore); ok {
+		data, ok = sc.OnSpectatorPacket(m.State(), opCode, data, udp)
+		if !ok {
+			return
+		}
+	}
+
+	if m.policy.SpectatorDelay == 0 {
+		m.SendSpectators(opCode, data, udp)
+		return
+	}
+
+	m.delayed = append(m.delayed, delayedPacket{
+		due:    m.state.Clock.Now().Add(m.policy.SpectatorDelay),
+		opCode: opCode,
+		data:   append([]byte(nil), data...),
+		udp:    udp,
+	})
+}
+
+func (m *Match) flushDelayed() {
+	if len(m.delayed) == 0 {
+		return
+	}
+
+	now := m.state.Clock.Now()
+
+	i := 0
+	for ; i < len(m.delayed) && !m.delayed[i].due.After(now); i++ {
+		packet := m.delayed[i]
+		m.SendSpectators(packet.opCode, packet.data, packet.udp)
+	}
+
+	m.delayed = append(m.delayed[:0], m.delayed[i:]...)
+}
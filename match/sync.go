@@ -0,0 +1,387 @@
+package match
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/util"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+// DefaultSyncHistory is amount of snapshots StateSync keeps as baselines by default.
+const DefaultSyncHistory = 32
+
+var (
+	ErrInvalidDelta    = errors.New("delta is corrupted")
+	ErrBaselineMissing = errors.New("delta baseline is not known")
+)
+
+// Differ computes delta between two snapshots and applies it.
+type Differ interface {
+	// Diff appends delta transforming base into target to dst.
+	Diff(dst, base, target []byte) []byte
+	// Patch appends target reconstructed from base and delta to dst.
+	Patch(dst, base, delta []byte) ([]byte, error)
+}
+
+// StateSync sends world snapshots to players as deltas against the last snapshot
+// each player acknowledged. Full snapshot is sent as knet.OCStateFull holding
+// snapshot id and data, delta as knet.OCStateDelta holding snapshot id, baseline id
+// and delta. Players acknowledge with knet.OCStateAck holding snapshot id.
+//
+// Player that did not acknowledge anything yet or whose baseline is older then
+// History snapshots gets full snapshot. Use StateReceiver on the client side.
+type StateSync struct {
+	// History is amount of kept baselines, DefaultSyncHistory if 0.
+	History int
+	// Differ computes deltas, ByteDiff if nil.
+	Differ Differ
+	// Reliable makes snapshots go trough tcp.
+	Reliable bool
+
+	id        uint32
+	snapshots []syncSnapshot
+	acks      map[uuid.UUID]uint32
+	deltas    map[uint32][]byte
+	rest      []Request
+}
+
+type syncSnapshot struct {
+	id   uint32
+	data []byte
+}
+
+// LastID returns id of last pushed snapshot, ids start from 1.
+func (s *StateSync) LastID() uint32 {
+	return s.id
+}
+
+// Acked returns id of the last snapshot user acknowledged, 0 if none.
+func (s *StateSync) Acked(user uuid.UUID) uint32 {
+	return s.acks[user]
+}
+
+// Push stores snapshot and sends it to all players of the match. Data is copied.
+func (s *StateSync) Push(state State, data []byte) {
+	s.init()
+
+	s.id++
+	history := s.History
+	if history == 0 {
+		history = DefaultSyncHistory
+	}
+	if len(s.snapshots) >= history {
+		s.snapshots = append(s.snapshots[:0], s.snapshots[len(s.snapshots)-history+1:]...)
+	}
+	s.snapshots = append(s.snapshots, syncSnapshot{s.id, append([]byte(nil), data...)})
+
+	for k := range s.deltas {
+		delete(s.deltas, k)
+	}
+
+	var full []byte
+	for id := range state.users {
+		base, ok := s.baseline(s.acks[id])
+		if !ok {
+			if full == nil {
+				full = make([]byte, 4, 4+len(data))
+				binary.BigEndian.PutUint32(full, s.id)
+				full = append(full, data...)
+			}
+			state.SendPacket(state.Only(id), knet.OCStateFull, full, !s.Reliable)
+			continue
+		}
+
+		delta, ok := s.deltas[base.id]
+		if !ok {
+			delta = make([]byte, 8, 8+len(data)/4)
+			binary.BigEndian.PutUint32(delta, s.id)
+			binary.BigEndian.PutUint32(delta[4:], base.id)
+			delta = s.differ().Diff(delta, base.data, data)
+			s.deltas[base.id] = delta
+		}
+		state.SendPacket(state.Only(id), knet.OCStateDelta, delta, !s.Reliable)
+	}
+}
+
+// Ack records acknowledgement if packet is one and reports whether it was.
+func (s *StateSync) Ack(packet knet.ClientPacket) bool {
+	if packet.OpCode != knet.OCStateAck {
+		return false
+	}
+	s.init()
+
+	if packet.User == nil {
+		return true
+	}
+
+	reader := util.NewReader(packet.Data)
+	id, ok := reader.Uint32()
+	if !ok || id > s.id {
+		return true
+	}
+
+	user := packet.User.ID()
+	if id > s.acks[user] {
+		s.acks[user] = id
+	}
+
+	return true
+}
+
+// Filter processes acknowledgements and returns the other requests. Returned slice
+// is reused by next call.
+func (s *StateSync) Filter(req []Request) []Request {
+	s.rest = s.rest[:0]
+	for _, r := range req {
+		if !s.Ack(r.ClientPacket) {
+			s.rest = append(s.rest, r)
+		}
+	}
+	return s.rest
+}
+
+// Forget drops acknowledgements of user, call it when user disconnects.
+func (s *StateSync) Forget(user uuid.UUID) {
+	delete(s.acks, user)
+}
+
+func (s *StateSync) baseline(id uint32) (syncSnapshot, bool) {
+	if id == 0 || len(s.snapshots) == 0 {
+		return syncSnapshot{}, false
+	}
+	first := s.snapshots[0].id
+	if id < first {
+		return syncSnapshot{}, false
+	}
+	return s.snapshots[id-first], true
+}
+
+func (s *StateSync) differ() Differ {
+	if s.Differ == nil {
+		return ByteDiff{}
+	}
+	return s.Differ
+}
+
+func (s *StateSync) init() {
+	if s.acks == nil {
+		s.acks = make(map[uuid.UUID]uint32)
+		s.deltas = make(map[uint32][]byte)
+	}
+}
+
+// StateReceiver reconstructs snapshots sent by StateSync. It is meant for clients
+// written in go and for tests.
+type StateReceiver struct {
+	// History has to be at least as big as History of StateSync.
+	History int
+	Differ  Differ
+
+	snapshots []syncSnapshot
+}
+
+// Receive decodes knet.OCStateFull or knet.OCStateDelta packet and returns snapshot
+// id and data. Ack with the id should be sent back to server.
+func (r *StateReceiver) Receive(opCode knet.OpCode, packet []byte) (uint32, []byte, error) {
+	reader := util.NewReader(packet)
+	id, ok := reader.Uint32()
+	if !ok {
+		return 0, nil, ErrInvalidDelta
+	}
+
+	var data []byte
+	switch opCode {
+	case knet.OCStateFull:
+		data = append(data, reader.Rest()...)
+	case knet.OCStateDelta:
+		baseID, ok := reader.Uint32()
+		if !ok {
+			return 0, nil, ErrInvalidDelta
+		}
+
+		var base []byte
+		found := false
+		for _, s := range r.snapshots {
+			if s.id == baseID {
+				base, found = s.data, true
+				break
+			}
+		}
+		if !found {
+			return 0, nil, ErrBaselineMissing
+		}
+
+		differ := r.Differ
+		if differ == nil {
+			differ = ByteDiff{}
+		}
+
+		var err error
+		data, err = differ.Patch(nil, base, reader.Rest())
+		if err != nil {
+			return 0, nil, err
+		}
+	default:
+		return 0, nil, ErrInvalidDelta
+	}
+
+	history := r.History
+	if history == 0 {
+		history = DefaultSyncHistory
+	}
+	if len(r.snapshots) >= history {
+		r.snapshots = append(r.snapshots[:0], r.snapshots[1:]...)
+	}
+	r.snapshots = append(r.snapshots, syncSnapshot{id, data})
+
+	return id, data, nil
+}
+
+// ByteDiff is byte level Differ. Delta holds target length followed by runs of
+// unchanged byte count, changed byte count and changed bytes.
+type ByteDiff struct{}
+
+func (ByteDiff) Diff(dst, base, target []byte) []byte {
+	dst = appendUint32(dst, uint32(len(target)))
+
+	i := 0
+	for i < len(target) {
+		start := i
+		for i < len(target) && i < len(base) && base[i] == target[i] {
+			i++
+		}
+		if i == len(target) {
+			break
+		}
+		skip := i - start
+
+		start = i
+		for i < len(target) && (i >= len(base) || base[i] != target[i]) {
+			i++
+		}
+
+		dst = appendUint32(dst, uint32(skip))
+		dst = appendUint32(dst, uint32(i-start))
+		dst = append(dst, target[start:i]...)
+	}
+
+	return dst
+}
+
+func (ByteDiff) Patch(dst, base, delta []byte) ([]byte, error) {
+	reader := util.NewReader(delta)
+	length, ok := reader.Uint32()
+	if !ok || int(length) > len(base)+len(delta) {
+		return dst, ErrInvalidDelta
+	}
+
+	start := len(dst)
+	dst = append(dst, make([]byte, length)...)
+	target := dst[start:]
+	copy(target, base)
+
+	i := 0
+	for len(reader.Rest()) != 0 {
+		skip, ok := reader.Uint32()
+		if !ok {
+			return dst, ErrInvalidDelta
+		}
+		changed, ok := reader.Uint32()
+		if !ok {
+			return dst, ErrInvalidDelta
+		}
+		rest := reader.Rest()
+		i += int(skip)
+		if int(changed) > len(rest) || i+int(changed) > len(target) {
+			return dst, ErrInvalidDelta
+		}
+		copy(target[i:], rest[:changed])
+		i += int(changed)
+		reader = util.NewReader(rest[changed:])
+	}
+
+	return dst, nil
+}
+
+// FieldDiff is field level Differ for snapshots made of fields of Size bytes. Delta
+// holds target length, bitmask of changed fields and the changed fields. Size below 1
+// is treated as 1.
+type FieldDiff struct {
+	Size int
+}
+
+func (f FieldDiff) size() int {
+	if f.Size < 1 {
+		return 1
+	}
+	return f.Size
+}
+
+func (f FieldDiff) Diff(dst, base, target []byte) []byte {
+	f.Size = f.size()
+	dst = appendUint32(dst, uint32(len(target)))
+
+	fields := (len(target) + f.Size - 1) / f.Size
+	mask := len(dst)
+	dst = append(dst, make([]byte, (fields+7)/8)...)
+
+	for i := 0; i < fields; i++ {
+		start, end := i*f.Size, (i+1)*f.Size
+		if end > len(target) {
+			end = len(target)
+		}
+		if end <= len(base) && string(base[start:end]) == string(target[start:end]) {
+			continue
+		}
+		dst[mask+i/8] |= 1 << (i % 8)
+		dst = append(dst, target[start:end]...)
+	}
+
+	return dst
+}
+
+func (f FieldDiff) Patch(dst, base, delta []byte) ([]byte, error) {
+	f.Size = f.size()
+	reader := util.NewReader(delta)
+	length, ok := reader.Uint32()
+	if !ok || int(length) > len(base)+len(delta) {
+		return dst, ErrInvalidDelta
+	}
+
+	fields := (int(length) + f.Size - 1) / f.Size
+	rest := reader.Rest()
+	if len(rest) < (fields+7)/8 {
+		return dst, ErrInvalidDelta
+	}
+	mask, rest := rest[:(fields+7)/8], rest[(fields+7)/8:]
+
+	start := len(dst)
+	dst = append(dst, make([]byte, length)...)
+	target := dst[start:]
+	copy(target, base)
+
+	for i := 0; i < fields; i++ {
+		if mask[i/8]&(1<<(i%8)) == 0 {
+			continue
+		}
+		start, end := i*f.Size, (i+1)*f.Size
+		if end > len(target) {
+			end = len(target)
+		}
+		if len(rest) < end-start {
+			return dst, ErrInvalidDelta
+		}
+		copy(target[start:end], rest)
+		rest = rest[end-start:]
+	}
+
+	return dst, nil
+}
+
+func appendUint32(dst []byte, value uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], value)
+	return append(dst, buf[:]...)
+}
@@ -0,0 +1,107 @@
+package match_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/match"
+	"github.com/jakubDoka/keeper/match/matchtest"
+)
+
+func TestDiffers(t *testing.T) {
+	tests := []struct {
+		name         string
+		base, target string
+	}{
+		{"same", "abcdefgh", "abcdefgh"},
+		{"middle", "abcdefgh", "abXdeYgh"},
+		{"grow", "abcd", "abcdefgh"},
+		{"shrink", "abcdefgh", "abXd"},
+		{"empty base", "", "abcdefgh"},
+	}
+
+	differs := []match.Differ{match.ByteDiff{}, match.FieldDiff{Size: 3}, match.FieldDiff{}}
+
+	for _, test := range tests {
+		for _, differ := range differs {
+			t.Run(test.name, func(t *testing.T) {
+				delta := differ.Diff(nil, []byte(test.base), []byte(test.target))
+				result, err := differ.Patch(nil, []byte(test.base), delta)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(result) != test.target {
+					t.Errorf("%T: expected %q, got %q", differ, test.target, result)
+				}
+			})
+		}
+	}
+
+	if _, err := (match.ByteDiff{}).Patch(nil, nil, []byte{0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0, 9}); err != match.ErrInvalidDelta {
+		t.Errorf("expected %v, got %v", match.ErrInvalidDelta, err)
+	}
+}
+
+func TestStateSync(t *testing.T) {
+	h, err := matchtest.New(&match.CoreBase{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := h.Join(nil)
+	h.Tick(1)
+	p.Take()
+
+	sync := &match.StateSync{History: 3}
+	receiver := &match.StateReceiver{History: 3}
+	world := bytes.Repeat([]byte("world state "), 10)
+
+	receive := func(ack bool) (knet.OpCode, []byte) {
+		packets := p.Take()
+		if len(packets) != 1 {
+			t.Fatalf("expected one packet, got %v", packets)
+		}
+		id, data, err := receiver.Receive(packets[0].OpCode, packets[0].Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ack {
+			var buf [4]byte
+			binary.BigEndian.PutUint32(buf[:], id)
+			sync.Ack(knet.ClientPacket{OpCode: knet.OCStateAck, Data: buf[:], User: p.User})
+		}
+		return packets[0].OpCode, data
+	}
+
+	sync.Push(h.Match.State(), world)
+	if op, data := receive(true); op != knet.OCStateFull || !bytes.Equal(data, world) {
+		t.Fatalf("expected full snapshot, got %v", op)
+	}
+
+	world[5] = 'X'
+	sync.Push(h.Match.State(), world)
+	op, data := receive(false)
+	if op != knet.OCStateDelta || !bytes.Equal(data, world) {
+		t.Fatalf("expected delta, got %v %q", op, data)
+	}
+
+	world[6] = 'Y'
+	sync.Push(h.Match.State(), world)
+	if op, data := receive(false); op != knet.OCStateDelta || !bytes.Equal(data, world) {
+		t.Fatalf("expected delta against acked baseline, got %v", op)
+	}
+
+	sync.Push(h.Match.State(), world)
+	if op, _ := receive(true); op != knet.OCStateFull {
+		t.Errorf("expected full snapshot once baseline is too old, got %v", op)
+	}
+	if sync.Acked(p.ID()) != sync.LastID() {
+		t.Error("ack should be recorded")
+	}
+
+	req := []match.Request{{ClientPacket: knet.ClientPacket{OpCode: knet.OCStateAck, User: p.User}}, {ClientPacket: knet.ClientPacket{OpCode: knet.OCLast}}}
+	if rest := sync.Filter(req); len(rest) != 1 || rest[0].OpCode != knet.OCLast {
+		t.Errorf("unexpected filtered requests %v", rest)
+	}
+}
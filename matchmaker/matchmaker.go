@@ -0,0 +1,566 @@
+// matchmaker groups players waiting in queues and creates matches for them.
+package matchmaker
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jakubDoka/keeper/index"
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/match"
+	"github.com/jakubDoka/keeper/notify"
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/util"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+// ResultTTL is how long results of matched tickets are kept for polling.
+const ResultTTL = time.Minute
+
+// DefaultExpiration is used when Queue.Expiration is 0.
+const DefaultExpiration = 10 * time.Minute
+
+var (
+	ErrUnknownQueue   = errors.New("unknown matchmaking queue")
+	ErrAlreadyQueued  = errors.New("user already has a ticket")
+	ErrTicketNotFound = errors.New("ticket not found")
+	ErrNoUsers        = errors.New("ticket has no users")
+	ErrTicketTooLarge = errors.New("ticket has more users then queue allows")
+	ErrNoSession      = errors.New("no user of group has session")
+)
+
+// Queue configures how tickets are grouped.
+type Queue struct {
+	// Core is id of match core that is created for each group.
+	Core string
+	// MinSize and MaxSize bound the amount of users in group.
+	MinSize, MaxSize int
+
+	// Skill is name of numeric property tickets are compared by, empty disables
+	// skill matching. Properties can differ by tolerance that starts at Tolerance and
+	// grows by Widening each second ticket waits up to MaxTolerance (0 means unbounded).
+	Skill                             string
+	Tolerance, Widening, MaxTolerance float64
+
+	// Meta is appended to meta passed to match core.
+	Meta []byte
+
+	// Expiration is how long ticket can wait for match, DefaultExpiration is used
+	// if 0. Expired tickets and tickets of users without session are removed and
+	// their users are notified with knet.OCTicketExpired, data is id of the ticket.
+	Expiration time.Duration
+}
+
+// Ticket is a request of one or more users to be matched together.
+type Ticket struct {
+	ID    uuid.UUID
+	Queue string
+	Users []uuid.UUID
+	// Query holds requirements on other tickets. Numeric fields constrain the
+	// properties of other tickets, ranges include lower bound and exclude upper bound
+	// as in index. String fields have to agree with string fields of other tickets if
+	// they specify the same name.
+	Query      []index.Field
+	Properties map[string]float64
+	Created    time.Time
+}
+
+// Status of ticket.
+type Status uint32
+
+const (
+	Pending Status = iota
+	Matched
+	Unknown
+)
+
+// Result describes match that was created for ticket.
+type Result struct {
+	Match   uuid.UUID
+	Address string
+	Users   []uuid.UUID
+	created time.Time
+}
+
+// Matchmaker holds tickets and periodically forms groups. All allowed operations
+// are thread safe.
+type Matchmaker struct {
+	*state.State
+
+	manager  *match.Manager
+	notifier notify.Notifier
+
+	queues  map[string]*queue
+	tickets map[uuid.UUID]*Ticket
+	users   map[uuid.UUID]uuid.UUID
+	results map[uuid.UUID]Result
+	pending notify.Batch
+	mutex   sync.Mutex
+
+	finished bool
+}
+
+type queue struct {
+	Queue
+	tickets []*Ticket
+}
+
+func (q *queue) expiration() time.Duration {
+	if q.Expiration == 0 {
+		return DefaultExpiration
+	}
+	return q.Expiration
+}
+
+// group is set of tickets match is being created for. Its tickets are not in
+// queue but they are still pending.
+type group struct {
+	queue   *queue
+	tickets []*Ticket
+}
+
+// New creates matchmaker, notifier can be nil.
+func New(state *state.State, manager *match.Manager, notifier notify.Notifier) *Matchmaker {
+	return &Matchmaker{
+		State:    state,
+		manager:  manager,
+		notifier: notifier,
+		queues:   make(map[string]*queue),
+		tickets:  make(map[uuid.UUID]*Ticket),
+		users:    make(map[uuid.UUID]uuid.UUID),
+		results:  make(map[uuid.UUID]Result),
+	}
+}
+
+// AddQueue registers queue under id.
+func (m *Matchmaker) AddQueue(id string, q Queue) {
+	m.check()
+	if q.MaxSize < q.MinSize {
+		q.MaxSize = q.MinSize
+	}
+	m.Info("Registered matchmaking queue %s.", id)
+	m.queues[id] = &queue{Queue: q}
+}
+
+func (m *Matchmaker) check() {
+	if m.finished {
+		panic("matchmaker already finished, do this during initialization")
+	}
+}
+
+func (m *Matchmaker) Finish() {
+	m.finished = true
+}
+
+// Add submits ticket and returns its id. Fields ID and Created are filled in.
+func (m *Matchmaker) Add(ticket Ticket) (uuid.UUID, error) {
+	if len(ticket.Users) == 0 {
+		return uuid.Nil, ErrNoUsers
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	q, ok := m.queues[ticket.Queue]
+	if !ok {
+		return uuid.Nil, ErrUnknownQueue
+	}
+
+	if len(ticket.Users) > q.MaxSize {
+		return uuid.Nil, ErrTicketTooLarge
+	}
+
+	for _, user := range ticket.Users {
+		if _, ok := m.users[user]; ok {
+			return uuid.Nil, ErrAlreadyQueued
+		}
+	}
+
+	ticket.ID = uuid.New()
+	ticket.Created = m.Clock.Now()
+
+	t := &ticket
+	q.tickets = append(q.tickets, t)
+	m.tickets[t.ID] = t
+	for _, user := range t.Users {
+		m.users[user] = t.ID
+	}
+
+	return t.ID, nil
+}
+
+// Remove cancels the ticket.
+func (m *Matchmaker) Remove(id uuid.UUID) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.tickets[id]; !ok {
+		return ErrTicketNotFound
+	}
+
+	m.remove(id)
+
+	return nil
+}
+
+// Ticket returns copy of pending ticket.
+func (m *Matchmaker) Ticket(id uuid.UUID) (Ticket, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ticket, ok := m.tickets[id]
+	if !ok {
+		return Ticket{}, false
+	}
+	return *ticket, true
+}
+
+// TicketOf returns id of pending ticket the user belongs to.
+func (m *Matchmaker) TicketOf(user uuid.UUID) (uuid.UUID, bool) {
+	m.mutex.Lock()
+	id, ok := m.users[user]
+	m.mutex.Unlock()
+	return id, ok
+}
+
+// Status returns state of the ticket. Result is valid only if status is Matched.
+func (m *Matchmaker) Status(id uuid.UUID) (Status, Result) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.tickets[id]; ok {
+		return Pending, Result{}
+	}
+
+	if result, ok := m.results[id]; ok {
+		return Matched, result
+	}
+
+	return Unknown, Result{}
+}
+
+// Run processes queues each interval. Run this on goroutine.
+func (m *Matchmaker) Run(interval time.Duration) {
+	ticker := m.Clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C() {
+		m.Process()
+	}
+}
+
+// Process forms as many groups as possible in all queues. Matches are created and
+// users are notified after matchmaker is unlocked so slow cores and connections do
+// not block other operations. Groups whose match cannot be created are queued again.
+func (m *Matchmaker) Process() {
+	m.mutex.Lock()
+
+	now := m.Clock.Now()
+
+	for id, result := range m.results {
+		if now.Sub(result.created) > ResultTTL {
+			delete(m.results, id)
+		}
+	}
+
+	var groups []group
+	for _, q := range m.queues {
+		m.expire(q, now)
+		groups = m.process(q, now, groups)
+	}
+
+	m.unlock()
+
+	for _, g := range groups {
+		m.createMatch(g, now)
+	}
+}
+
+// expire removes tickets that waited too long or whose users have no session.
+func (m *Matchmaker) expire(q *queue, now time.Time) {
+	kept := q.tickets[:0]
+	for _, ticket := range q.tickets {
+		if now.Sub(ticket.Created) <= q.expiration() && m.online(ticket) {
+			kept = append(kept, ticket)
+			continue
+		}
+
+		m.forget(ticket)
+
+		writer := util.NewWriter(uuid.Length)
+		writer.UUID(ticket.ID)
+		for _, user := range ticket.Users {
+			m.pending.Add(user, knet.OCTicketExpired, writer.Buffer())
+		}
+	}
+	q.tickets = kept
+}
+
+// online returns whether any user of ticket has session.
+func (m *Matchmaker) online(ticket *Ticket) bool {
+	for _, user := range ticket.Users {
+		if m.GetUser(uuid.Nil, user) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// process appends groups formed in q to groups and takes their tickets out of q.
+func (m *Matchmaker) process(q *queue, now time.Time, groups []group) []group {
+	used := make(map[*Ticket]bool)
+	var members, candidates []*Ticket
+
+	for _, anchor := range q.tickets {
+		if used[anchor] {
+			continue
+		}
+
+		candidates = candidates[:0]
+		for _, other := range q.tickets {
+			if other != anchor && !used[other] && m.compatible(q, anchor, other, now) {
+				candidates = append(candidates, other)
+			}
+		}
+
+		if q.Skill != "" {
+			skill := anchor.Properties[q.Skill]
+			sort.SliceStable(candidates, func(i, j int) bool {
+				return math.Abs(candidates[i].Properties[q.Skill]-skill) <
+					math.Abs(candidates[j].Properties[q.Skill]-skill)
+			})
+		}
+
+		members = append(members[:0], anchor)
+		size := len(anchor.Users)
+		for _, candidate := range candidates {
+			if size == q.MaxSize {
+				break
+			}
+			if size+len(candidate.Users) > q.MaxSize {
+				continue
+			}
+			fits := true
+			for _, member := range members[1:] {
+				if !m.compatible(q, member, candidate, now) {
+					fits = false
+					break
+				}
+			}
+			if fits {
+				members = append(members, candidate)
+				size += len(candidate.Users)
+			}
+		}
+
+		if size < q.MinSize {
+			continue
+		}
+
+		for _, ticket := range members {
+			used[ticket] = true
+		}
+		groups = append(groups, group{q, append([]*Ticket(nil), members...)})
+	}
+
+	kept := q.tickets[:0]
+	for _, ticket := range q.tickets {
+		if !used[ticket] {
+			kept = append(kept, ticket)
+		}
+	}
+	q.tickets = kept
+
+	return groups
+}
+
+// createMatch creates match for the group and notifies its users, it has to be
+// called without holding the lock. If match cannot be created, tickets that were
+// not removed meanwhile are queued again.
+func (m *Matchmaker) createMatch(g group, now time.Time) {
+	q := g.queue
+
+	var users []uuid.UUID
+	for _, ticket := range g.tickets {
+		users = append(users, ticket.Users...)
+	}
+
+	var creator *state.User
+	for _, user := range users {
+		if creator = m.GetUser(uuid.Nil, user); creator != nil {
+			break
+		}
+	}
+
+	var created *match.Match
+	err := ErrNoSession
+	if creator != nil {
+		writer := util.NewWriter(4 + len(users)*uuid.Length + len(q.Meta))
+		writer.Uint32(uint32(len(users)))
+		for _, user := range users {
+			writer.UUID(user)
+		}
+		writer.Rest(q.Meta)
+
+		created, err = m.manager.CreateMatch(q.Core, creator, writer.Buffer())
+	}
+
+	m.mutex.Lock()
+	defer m.unlock()
+
+	if err != nil {
+		m.Error("Matchmaker failed to create match of type %s: %s", q.Core, err)
+		for _, ticket := range g.tickets {
+			if m.tickets[ticket.ID] == ticket {
+				q.tickets = append(q.tickets, ticket)
+			}
+		}
+		// older tickets are grouped first
+		sort.SliceStable(q.tickets, func(i, j int) bool {
+			return q.tickets[i].Created.Before(q.tickets[j].Created)
+		})
+		return
+	}
+
+	result := Result{
+		Match:   created.ID(),
+		Address: m.Net.GetConnectionString(),
+		Users:   users,
+		created: now,
+	}
+
+	for _, ticket := range g.tickets {
+		m.remove(ticket.ID)
+		m.results[ticket.ID] = result
+
+		var calc util.Calculator
+		writer := calc.UUID().UUID().String(result.Address).ToWriter()
+		writer.
+			UUID(ticket.ID).
+			UUID(result.Match).
+			String(result.Address)
+		for _, user := range ticket.Users {
+			m.pending.Add(user, knet.OCMatchFound, writer.Buffer())
+		}
+	}
+}
+
+// unlock unlocks matchmaker and sends notifications queued while it was locked.
+func (m *Matchmaker) unlock() {
+	pending := m.pending.Take()
+	m.mutex.Unlock()
+	pending.Send(m.notifier)
+}
+
+func (m *Matchmaker) remove(id uuid.UUID) {
+	ticket, ok := m.tickets[id]
+	if !ok {
+		return
+	}
+
+	m.forget(ticket)
+
+	q := m.queues[ticket.Queue]
+	for i, t := range q.tickets {
+		if t == ticket {
+			q.tickets = append(q.tickets[:i], q.tickets[i+1:]...)
+			break
+		}
+	}
+}
+
+// forget removes ticket from lookups but not from its queue.
+func (m *Matchmaker) forget(ticket *Ticket) {
+	delete(m.tickets, ticket.ID)
+	for _, user := range ticket.Users {
+		delete(m.users, user)
+	}
+}
+
+// compatible is like queue.compatible but also keeps apart users blocked by each other.
+func (m *Matchmaker) compatible(q *queue, a, b *Ticket, now time.Time) bool {
+	if !q.compatible(a, b, now) {
+		return false
+	}
+	for _, userA := range a.Users {
+		for _, userB := range b.Users {
+			if m.manager.Blocked(userA, userB) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (q *queue) tolerance(t *Ticket, now time.Time) float64 {
+	tolerance := q.Tolerance + q.Widening*now.Sub(t.Created).Seconds()
+	if q.MaxTolerance != 0 && tolerance > q.MaxTolerance {
+		tolerance = q.MaxTolerance
+	}
+	return tolerance
+}
+
+func (q *queue) compatible(a, b *Ticket, now time.Time) bool {
+	if q.Skill != "" {
+		sa, okA := a.Properties[q.Skill]
+		sb, okB := b.Properties[q.Skill]
+		if !okA || !okB {
+			return false
+		}
+		tolerance := math.Max(q.tolerance(a, now), q.tolerance(b, now))
+		if math.Abs(sa-sb) > tolerance {
+			return false
+		}
+	}
+
+	return satisfies(a.Query, b) && satisfies(b.Query, a)
+}
+
+func satisfies(query []index.Field, t *Ticket) bool {
+	for _, field := range query {
+		switch field.Type {
+		case index.FTInt:
+			value, ok := t.Properties[field.Name]
+			if !ok || value != float64(field.Int1) {
+				return false
+			}
+		case index.FTRange:
+			value, ok := t.Properties[field.Name]
+			if !ok || value < float64(field.Int1) || value >= float64(field.Int2) {
+				return false
+			}
+		case index.FTFloat:
+			value, ok := t.Properties[field.Name]
+			if !ok || value != field.Float1 {
+				return false
+			}
+		case index.FTFloatRange:
+			value, ok := t.Properties[field.Name]
+			if !ok || value < field.Float1 || value >= field.Float2 {
+				return false
+			}
+		case index.FTString, index.FTExactString:
+			for _, other := range t.Query {
+				if other.Name != field.Name || (other.Type != index.FTString && other.Type != index.FTExactString) {
+					continue
+				}
+				if !agree(field, other) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// agree returns whether two string requirements can be both satisfied.
+func agree(a, b index.Field) bool {
+	if a.Type == index.FTExactString && b.Type == index.FTExactString {
+		return a.String == b.String
+	}
+	return strings.HasPrefix(a.String, b.String) || strings.HasPrefix(b.String, a.String)
+}
@@ -0,0 +1,272 @@
+package matchmaker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jakubDoka/keeper/index"
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/match"
+	"github.com/jakubDoka/keeper/notify/notifytest"
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/state/statetest"
+	"github.com/jakubDoka/keeper/util/clock"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+func setup(t *testing.T, q Queue) (*Matchmaker, *clock.Manual, *notifytest.Recorder) {
+	s, c := statetest.NewManual(time.Unix(0, 0))
+
+	manager := match.NewManager(s)
+	manager.RegisterCore("game", func() match.Core { return &match.CoreBase{} })
+
+	n := &notifytest.Recorder{}
+	m := New(s, manager, n)
+	q.Core = "game"
+	m.AddQueue("queue", q)
+
+	return m, c, n
+}
+
+func (m *Matchmaker) testTicket(t *testing.T, query string, properties map[string]float64) (uuid.UUID, uuid.UUID) {
+	var parser index.Parser
+	fields, _, err := parser.Parse([]byte(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := state.NewUserWithClock(m.Clock, uuid.New(), uuid.New(), time.Hour, "")
+	m.AddUser(user)
+
+	id, err := m.Add(Ticket{
+		Queue:      "queue",
+		Users:      []uuid.UUID{user.ID()},
+		Query:      append([]index.Field(nil), fields...),
+		Properties: properties,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id, user.ID()
+}
+
+func TestQuery(t *testing.T) {
+	m, _, n := setup(t, Queue{MinSize: 2, MaxSize: 2})
+
+	a, userA := m.testTicket(t, "mode: ranked region: 1", map[string]float64{"region": 1})
+	b, userB := m.testTicket(t, "mode: casual", map[string]float64{"region": 1})
+	c, userC := m.testTicket(t, "mode: ranked", map[string]float64{"region": 2})
+	d, userD := m.testTicket(t, "region: 1-2", map[string]float64{"region": 1})
+
+	m.Process()
+
+	for _, id := range []uuid.UUID{b, c} {
+		if status, _ := m.Status(id); status != Pending {
+			t.Errorf("ticket %s should still be pending", id)
+		}
+	}
+
+	statusA, resultA := m.Status(a)
+	statusD, resultD := m.Status(d)
+	if statusA != Matched || statusD != Matched || resultA.Match != resultD.Match {
+		t.Fatalf("a and d should be matched together %v %v", resultA, resultD)
+	}
+
+	if m.manager.GetMatch(resultA.Match) == nil {
+		t.Error("match was not created")
+	}
+
+	if len(n.Of(userA)) != 1 || len(n.Of(userD)) != 1 || len(n.Of(userB)) != 0 || len(n.Of(userC)) != 0 {
+		t.Error("only matched users should be notified")
+	}
+	if last, _ := n.Last(userA); last.OpCode != knet.OCMatchFound {
+		t.Errorf("unexpected notification %v", last.OpCode)
+	}
+
+	if _, ok := m.TicketOf(userA); ok {
+		t.Error("matched user should not have ticket")
+	}
+}
+
+func TestRangeUpperBound(t *testing.T) {
+	m, _, _ := setup(t, Queue{MinSize: 2, MaxSize: 2})
+
+	a, _ := m.testTicket(t, "mmr: 1000.0-1500.0", map[string]float64{"mmr": 1200})
+	b, _ := m.testTicket(t, "", map[string]float64{"mmr": 1500})
+
+	m.Process()
+
+	for _, id := range []uuid.UUID{a, b} {
+		if status, _ := m.Status(id); status != Pending {
+			t.Errorf("upper bound of range should be excluded, ticket %s matched", id)
+		}
+	}
+}
+
+func TestWidening(t *testing.T) {
+	m, c, _ := setup(t, Queue{
+		MinSize:      2,
+		MaxSize:      3,
+		Skill:        "mmr",
+		Tolerance:    50,
+		Widening:     10,
+		MaxTolerance: 200,
+		Expiration:   time.Hour,
+	})
+
+	a, _ := m.testTicket(t, "", map[string]float64{"mmr": 1000})
+	b, _ := m.testTicket(t, "", map[string]float64{"mmr": 1100})
+	far, _ := m.testTicket(t, "", map[string]float64{"mmr": 2000})
+
+	m.Process()
+	if status, _ := m.Status(a); status != Pending {
+		t.Fatal("tickets should not match before tolerance widens")
+	}
+
+	c.Advance(5 * time.Second)
+	m.Process()
+
+	statusA, resultA := m.Status(a)
+	statusB, resultB := m.Status(b)
+	if statusA != Matched || statusB != Matched || resultA.Match != resultB.Match {
+		t.Fatal("a and b should be matched after widening")
+	}
+	if len(resultA.Users) != 2 {
+		t.Errorf("expected group of 2, got %d", len(resultA.Users))
+	}
+
+	c.Advance(30 * time.Minute)
+	m.Process()
+	if status, _ := m.Status(far); status != Pending {
+		t.Error("tolerance should be capped")
+	}
+	if status, _ := m.Status(a); status != Unknown {
+		t.Error("result should expire")
+	}
+}
+
+func TestCreateFailure(t *testing.T) {
+	m, _, n := setup(t, Queue{MinSize: 2, MaxSize: 2})
+	m.queues["queue"].Core = "missing"
+
+	a, userA := m.testTicket(t, "", nil)
+	b, userB := m.testTicket(t, "", nil)
+
+	m.Process()
+	for _, id := range []uuid.UUID{a, b} {
+		if status, _ := m.Status(id); status != Pending {
+			t.Errorf("ticket %s should stay queued after failure", id)
+		}
+	}
+	if len(n.Of(userA)) != 0 || len(n.Of(userB)) != 0 {
+		t.Error("users should not be notified about failure")
+	}
+
+	m.queues["queue"].Core = "game"
+	m.Process()
+	if status, _ := m.Status(a); status != Matched {
+		t.Error("ticket should be matched on next pass")
+	}
+}
+
+func TestAddErrors(t *testing.T) {
+	m, _, _ := setup(t, Queue{MinSize: 2, MaxSize: 2})
+
+	_, user := m.testTicket(t, "", nil)
+
+	if _, err := m.Add(Ticket{Queue: "queue", Users: []uuid.UUID{user}}); err != ErrAlreadyQueued {
+		t.Errorf("expected %v, got %v", ErrAlreadyQueued, err)
+	}
+	if _, err := m.Add(Ticket{Queue: "nope", Users: []uuid.UUID{uuid.New()}}); err != ErrUnknownQueue {
+		t.Errorf("expected %v, got %v", ErrUnknownQueue, err)
+	}
+	if _, err := m.Add(Ticket{Queue: "queue", Users: []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}}); err != ErrTicketTooLarge {
+		t.Errorf("expected %v, got %v", ErrTicketTooLarge, err)
+	}
+}
+
+type blocks map[uuid.UUID]uuid.UUID
+
+func (b blocks) Blocked(a, c uuid.UUID) bool {
+	return b[a] == c || b[c] == a
+}
+
+func TestBlocked(t *testing.T) {
+	m, _, _ := setup(t, Queue{MinSize: 2, MaxSize: 2})
+	b := blocks{}
+	m.manager.SetBlockResolver(b)
+
+	a, userA := m.testTicket(t, "", nil)
+	blocked, userB := m.testTicket(t, "", nil)
+	b[userA] = userB
+
+	m.Process()
+	if status, _ := m.Status(a); status != Pending {
+		t.Fatal("blocked users should not be matched")
+	}
+
+	c, _ := m.testTicket(t, "", nil)
+	m.Process()
+
+	statusA, resultA := m.Status(a)
+	statusB, resultB := m.Status(blocked)
+	statusC, resultC := m.Status(c)
+	if statusA != Matched || statusB != Pending || statusC != Matched || resultA.Match != resultC.Match {
+		t.Errorf("a and c should be matched %v %v %v", resultA, resultB, resultC)
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	m, c, n := setup(t, Queue{MinSize: 2, MaxSize: 2, Expiration: time.Minute})
+
+	waiting, userW := m.testTicket(t, "", nil)
+	c.Advance(time.Second)
+	m.Process()
+	if status, _ := m.Status(waiting); status != Pending {
+		t.Fatal("ticket should wait until it expires")
+	}
+
+	c.Advance(time.Minute)
+	offline, err := m.Add(Ticket{Queue: "queue", Users: []uuid.UUID{uuid.New()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Process()
+
+	for _, id := range []uuid.UUID{waiting, offline} {
+		if status, _ := m.Status(id); status != Unknown {
+			t.Errorf("ticket %s should be removed", id)
+		}
+	}
+	if last, ok := n.Last(userW); !ok || last.OpCode != knet.OCTicketExpired {
+		t.Error("user should be notified about expiration")
+	}
+	if _, ok := m.TicketOf(userW); ok {
+		t.Error("user should be able to queue again")
+	}
+}
+
+type reentrant struct {
+	notifytest.Recorder
+	matchmaker *Matchmaker
+}
+
+func (r *reentrant) Notify(user uuid.UUID, opCode knet.OpCode, data []byte) bool {
+	r.matchmaker.TicketOf(user)
+	return r.Recorder.Notify(user, opCode, data)
+}
+
+func TestNotifyOutsideLock(t *testing.T) {
+	m, _, _ := setup(t, Queue{MinSize: 2, MaxSize: 2})
+	n := &reentrant{matchmaker: m}
+	m.notifier = n
+
+	_, userA := m.testTicket(t, "", nil)
+	m.testTicket(t, "", nil)
+	m.Process()
+
+	if len(n.Of(userA)) != 1 {
+		t.Error("user should be notified")
+	}
+}
@@ -0,0 +1,40 @@
+package notify
+
+import (
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+// Batch collects notifications so they can be sent after locks are released. Writes
+// to slow connections then do not stall everything waiting for the lock.
+type Batch struct {
+	items []batched
+}
+
+type batched struct {
+	user   uuid.UUID
+	opCode knet.OpCode
+	data   []byte
+}
+
+// Add queues notification, data must not be modified until Send.
+func (b *Batch) Add(user uuid.UUID, opCode knet.OpCode, data []byte) {
+	b.items = append(b.items, batched{user, opCode, data})
+}
+
+// Take moves queued notifications to new batch and leaves b empty.
+func (b *Batch) Take() Batch {
+	taken := *b
+	*b = Batch{}
+	return taken
+}
+
+// Send delivers queued notifications trough notifier, nil notifier discards them.
+func (b Batch) Send(notifier Notifier) {
+	if notifier == nil {
+		return
+	}
+	for _, item := range b.items {
+		notifier.Notify(item.user, item.opCode, item.data)
+	}
+}
@@ -0,0 +1,134 @@
+// notify keeps connections that server uses to push events to users outside of matches.
+package notify
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+// Notifier can deliver packet to user.
+type Notifier interface {
+	// Notify returns false if user is not connected.
+	Notify(user uuid.UUID, opCode knet.OpCode, data []byte) bool
+}
+
+// Listener is told when users connect to and disconnect from Hub.
+type Listener interface {
+	Connected(user uuid.UUID)
+	Disconnected(user uuid.UUID)
+}
+
+// Hub is knet.Acceptor that holds one connection per user. Packets sent by clients
+// trough the connection are discarded. All allowed operations are thread safe.
+type Hub struct {
+	*state.State
+
+	connections      map[uuid.UUID]knet.Conn
+	connectionsMutex sync.Mutex
+	buffer           []knet.ClientPacket
+	helper           [][]byte
+	disconnected     []uuid.UUID
+
+	listeners []Listener
+}
+
+// NewHub creates hub, call Run on goroutine so disconnected connections are released.
+func NewHub(state *state.State) *Hub {
+	return &Hub{
+		State:       state,
+		connections: make(map[uuid.UUID]knet.Conn),
+	}
+}
+
+func (h *Hub) Accept(conn *knet.Connection, packet knet.ClientPacket) {
+	go conn.CollectPackets(h.State)
+	h.Add(packet.User.ID(), conn)
+}
+
+// AddListener adds listener of connection changes, call this before hub accepts
+// connections.
+func (h *Hub) AddListener(listener Listener) {
+	h.listeners = append(h.listeners, listener)
+}
+
+// Add registers connection for user, previous connection is closed.
+func (h *Hub) Add(user uuid.UUID, conn knet.Conn) {
+	h.connectionsMutex.Lock()
+	previous, ok := h.connections[user]
+	h.connections[user] = conn
+	h.connectionsMutex.Unlock()
+
+	if ok {
+		previous.Close()
+	}
+
+	for _, listener := range h.listeners {
+		listener.Connected(user)
+	}
+}
+
+// Connected returns whether user has notification connection.
+func (h *Hub) Connected(user uuid.UUID) bool {
+	h.connectionsMutex.Lock()
+	conn, ok := h.connections[user]
+	h.connectionsMutex.Unlock()
+	return ok && !conn.Disconnected()
+}
+
+func (h *Hub) Notify(user uuid.UUID, opCode knet.OpCode, data []byte) bool {
+	h.connectionsMutex.Lock()
+	conn, ok := h.connections[user]
+	h.connectionsMutex.Unlock()
+
+	if !ok || conn.Disconnected() {
+		return false
+	}
+
+	err := conn.WritePacketTCP(opCode, data)
+	if err != nil {
+		h.Debug("Failed to notify %s: %s", user, err)
+		return false
+	}
+
+	return true
+}
+
+// Run periodically drops disconnected connections and discards incoming packets.
+func (h *Hub) Run(interval time.Duration) {
+	ticker := h.Clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C() {
+		h.Clean()
+	}
+}
+
+// Clean performs one iteration of Run. Listeners are told about dropped connections
+// after hub is unlocked so they can notify users.
+func (h *Hub) Clean() {
+	h.disconnected = h.disconnected[:0]
+
+	h.connectionsMutex.Lock()
+	for id, conn := range h.connections {
+		if conn.Disconnected() {
+			conn.Close()
+			delete(h.connections, id)
+			h.disconnected = append(h.disconnected, id)
+			continue
+		}
+		h.buffer = h.buffer[:0]
+		h.helper = h.helper[:0]
+		conn.HarvestPackets(h.State, &h.buffer, &h.helper)
+	}
+	h.connectionsMutex.Unlock()
+
+	for _, listener := range h.listeners {
+		for _, id := range h.disconnected {
+			listener.Disconnected(id)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+// notifytest provides notify.Notifier that records notifications for tests.
+package notifytest
+
+import (
+	"sync"
+
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+// Notification is recorded notification.
+type Notification struct {
+	OpCode knet.OpCode
+	Data   []byte
+}
+
+// Recorder records notifications of every user, it is safe for concurrent use.
+type Recorder struct {
+	mutex sync.Mutex
+	sent  map[uuid.UUID][]Notification
+}
+
+// Notify records the notification and reports it as delivered.
+func (r *Recorder) Notify(user uuid.UUID, opCode knet.OpCode, data []byte) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.sent == nil {
+		r.sent = make(map[uuid.UUID][]Notification)
+	}
+	r.sent[user] = append(r.sent[user], Notification{opCode, append([]byte(nil), data...)})
+
+	return true
+}
+
+// Of returns notifications user received in order.
+func (r *Recorder) Of(user uuid.UUID) []Notification {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]Notification(nil), r.sent[user]...)
+}
+
+// Last returns the last notification of user, ok is false if there is none.
+func (r *Recorder) Last(user uuid.UUID) (n Notification, ok bool) {
+	sent := r.Of(user)
+	if len(sent) == 0 {
+		return
+	}
+	return sent[len(sent)-1], true
+}
@@ -0,0 +1,431 @@
+// party groups players so they can matchmake and join matches together.
+package party
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jakubDoka/keeper/cluster"
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/matchmaker"
+	"github.com/jakubDoka/keeper/notify"
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/util"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+var (
+	ErrAlreadyInParty = errors.New("you are already in party")
+	ErrTargetInParty  = errors.New("user is already in party")
+	ErrNotInParty     = errors.New("you are not in party")
+	ErrNotLeader      = errors.New("only party leader can do this")
+	ErrNotMember      = errors.New("user is not member of your party")
+	ErrNotInvited     = errors.New("you are not invited to this party")
+	ErrPartyNotFound  = errors.New("party not found")
+	ErrPartyFull      = errors.New("party is full")
+	ErrSelf           = errors.New("you cannot do this to yourself")
+)
+
+// Party is snapshot of party state.
+type Party struct {
+	ID      uuid.UUID
+	Leader  uuid.UUID
+	Members []uuid.UUID
+}
+
+// Encode writes party as id, leader and length prefixed members.
+func (p Party) Encode(writer *util.Writer) {
+	writer.
+		UUID(p.ID).
+		UUID(p.Leader).
+		Uint32(uint32(len(p.Members)))
+	for _, member := range p.Members {
+		writer.UUID(member)
+	}
+}
+
+type party struct {
+	Party
+	invites map[uuid.UUID]bool
+	ticket  uuid.UUID
+}
+
+// Parties manages all parties. Members are notified about every change trough
+// notifier. Parties is notify.Listener, members leave when their notification
+// connection drops or their session expires (see Run). All allowed operations are
+// thread safe.
+type Parties struct {
+	*state.State
+
+	// MaxSize limits amount of members, 0 means no limit.
+	MaxSize int
+
+	notifier   notify.Notifier
+	matchmaker *matchmaker.Matchmaker
+	cluster    *cluster.Cluster
+
+	parties map[uuid.UUID]*party
+	members map[uuid.UUID]*party
+	pending notify.Batch
+	mutex   sync.Mutex
+}
+
+// New creates party manager, notifier can be nil. Call Run on goroutine so members
+// with expired sessions are removed.
+func New(state *state.State, nodes *cluster.Cluster, mm *matchmaker.Matchmaker, notifier notify.Notifier) *Parties {
+	return &Parties{
+		State:      state,
+		notifier:   notifier,
+		matchmaker: mm,
+		cluster:    nodes,
+		parties:    make(map[uuid.UUID]*party),
+		members:    make(map[uuid.UUID]*party),
+	}
+}
+
+// PartyOf returns id of party user is member of or uuid.Nil.
+func (p *Parties) PartyOf(user uuid.UUID) uuid.UUID {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if party, ok := p.members[user]; ok {
+		return party.ID
+	}
+	return uuid.Nil
+}
+
+// Get returns party of the user.
+func (p *Parties) Get(user uuid.UUID) (Party, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	party, ok := p.members[user]
+	if !ok {
+		return Party{}, false
+	}
+	return party.copy(), true
+}
+
+// Create creates party with leader as the only member.
+func (p *Parties) Create(leader uuid.UUID) (uuid.UUID, error) {
+	p.mutex.Lock()
+	defer p.unlock()
+
+	if _, ok := p.members[leader]; ok {
+		return uuid.Nil, ErrAlreadyInParty
+	}
+
+	party := &party{
+		Party: Party{
+			ID:      uuid.New(),
+			Leader:  leader,
+			Members: []uuid.UUID{leader},
+		},
+		invites: make(map[uuid.UUID]bool),
+	}
+
+	p.parties[party.ID] = party
+	p.members[leader] = party
+
+	p.update(party)
+
+	return party.ID, nil
+}
+
+// Invite allows target to join the party of actor. Any member can invite.
+func (p *Parties) Invite(actor, target uuid.UUID) error {
+	if actor == target {
+		return ErrSelf
+	}
+
+	p.mutex.Lock()
+	defer p.unlock()
+
+	party, ok := p.members[actor]
+	if !ok {
+		return ErrNotInParty
+	}
+
+	if _, ok := p.members[target]; ok {
+		return ErrTargetInParty
+	}
+
+	party.invites[target] = true
+
+	var calc util.Calculator
+	writer := calc.UUID().UUID().ToWriter()
+	writer.
+		UUID(party.ID).
+		UUID(actor)
+	p.notify(target, knet.OCPartyInvite, writer.Buffer())
+
+	return nil
+}
+
+// Join adds user to party they were invited to.
+func (p *Parties) Join(user, id uuid.UUID) error {
+	p.mutex.Lock()
+	defer p.unlock()
+
+	if _, ok := p.members[user]; ok {
+		return ErrAlreadyInParty
+	}
+
+	party, ok := p.parties[id]
+	if !ok {
+		return ErrPartyNotFound
+	}
+
+	if !party.invites[user] {
+		return ErrNotInvited
+	}
+
+	if p.MaxSize != 0 && len(party.Members) >= p.MaxSize {
+		return ErrPartyFull
+	}
+
+	delete(party.invites, user)
+	party.Members = append(party.Members, user)
+	p.members[user] = party
+
+	p.changed(party)
+
+	return nil
+}
+
+// Leave removes user from their party. If leader leaves, the oldest member becomes
+// the leader. Empty party is disbanded.
+func (p *Parties) Leave(user uuid.UUID) error {
+	p.mutex.Lock()
+	defer p.unlock()
+
+	party, ok := p.members[user]
+	if !ok {
+		return ErrNotInParty
+	}
+
+	p.remove(party, user)
+
+	return nil
+}
+
+// Promote makes target the leader.
+func (p *Parties) Promote(actor, target uuid.UUID) error {
+	p.mutex.Lock()
+	defer p.unlock()
+
+	party, err := p.leaderOf(actor, target)
+	if err != nil {
+		return err
+	}
+
+	party.Leader = target
+	p.update(party)
+
+	return nil
+}
+
+// Kick removes target from party.
+func (p *Parties) Kick(actor, target uuid.UUID) error {
+	p.mutex.Lock()
+	defer p.unlock()
+
+	party, err := p.leaderOf(actor, target)
+	if err != nil {
+		return err
+	}
+
+	p.remove(party, target)
+
+	return nil
+}
+
+// Matchmake submits ticket for all members. Ticket is canceled when members change.
+func (p *Parties) Matchmake(actor uuid.UUID, ticket matchmaker.Ticket) (uuid.UUID, error) {
+	p.mutex.Lock()
+	defer p.unlock()
+
+	party, ok := p.members[actor]
+	if !ok {
+		return uuid.Nil, ErrNotInParty
+	}
+	if party.Leader != actor {
+		return uuid.Nil, ErrNotLeader
+	}
+
+	ticket.Users = append([]uuid.UUID(nil), party.Members...)
+	id, err := p.matchmaker.Add(ticket)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	party.ticket = id
+
+	return id, nil
+}
+
+// JoinMatch tells all members to connect to the match, the match can run on any node
+// of the cluster. Each member with session receives knet.OCPartyJoinMatch holding
+// party id followed by their cluster.Access. Members are notified after the party is
+// unlocked since reaching other nodes can take a while.
+func (p *Parties) JoinMatch(actor, matchID uuid.UUID) error {
+	p.mutex.Lock()
+	party, ok := p.members[actor]
+	if !ok {
+		p.mutex.Unlock()
+		return ErrNotInParty
+	}
+	if party.Leader != actor {
+		p.mutex.Unlock()
+		return ErrNotLeader
+	}
+	snapshot := party.copy()
+	p.mutex.Unlock()
+
+	var batch notify.Batch
+	for _, member := range snapshot.Members {
+		user := p.GetUser(uuid.Nil, member)
+		if user == nil {
+			continue
+		}
+
+		access, err := p.cluster.JoinMatch(matchID, user)
+		if err != nil {
+			return err
+		}
+
+		var calc util.Calculator
+		writer := calc.UUID().UUID().String(access.Address).Key().ToWriter()
+		writer.UUID(snapshot.ID)
+		access.Encode(&writer)
+		batch.Add(member, knet.OCPartyJoinMatch, writer.Buffer())
+	}
+
+	batch.Send(p.notifier)
+
+	return nil
+}
+
+// Connected is part of notify.Listener, parties do not react to it.
+func (p *Parties) Connected(user uuid.UUID) {}
+
+// Disconnected removes user from their party.
+func (p *Parties) Disconnected(user uuid.UUID) {
+	p.mutex.Lock()
+	defer p.unlock()
+
+	if party, ok := p.members[user]; ok {
+		p.remove(party, user)
+	}
+}
+
+// Run periodically calls Sweep.
+func (p *Parties) Run(interval time.Duration) {
+	ticker := p.Clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C() {
+		p.Sweep()
+	}
+}
+
+// Sweep removes members whose session expired.
+func (p *Parties) Sweep() {
+	p.mutex.Lock()
+	defer p.unlock()
+
+	for user, party := range p.members {
+		if p.GetUser(uuid.Nil, user) == nil {
+			p.remove(party, user)
+		}
+	}
+}
+
+func (p *Parties) leaderOf(actor, target uuid.UUID) (*party, error) {
+	if actor == target {
+		return nil, ErrSelf
+	}
+
+	party, ok := p.members[actor]
+	if !ok {
+		return nil, ErrNotInParty
+	}
+
+	if party.Leader != actor {
+		return nil, ErrNotLeader
+	}
+
+	if p.members[target] != party {
+		return nil, ErrNotMember
+	}
+
+	return party, nil
+}
+
+func (p *Parties) remove(party *party, user uuid.UUID) {
+	for i, member := range party.Members {
+		if member == user {
+			party.Members = append(party.Members[:i], party.Members[i+1:]...)
+			break
+		}
+	}
+	delete(p.members, user)
+
+	var calc util.Calculator
+	writer := calc.UUID().ToWriter()
+	writer.UUID(party.ID)
+	p.notify(user, knet.OCPartyLeave, writer.Buffer())
+
+	if len(party.Members) == 0 {
+		delete(p.parties, party.ID)
+		p.cancelTicket(party)
+		return
+	}
+
+	if party.Leader == user {
+		party.Leader = party.Members[0]
+	}
+
+	p.changed(party)
+}
+
+// changed is called when members change.
+func (p *Parties) changed(party *party) {
+	p.cancelTicket(party)
+	p.update(party)
+}
+
+func (p *Parties) cancelTicket(party *party) {
+	if party.ticket == uuid.Nil {
+		return
+	}
+	p.matchmaker.Remove(party.ticket)
+	party.ticket = uuid.Nil
+}
+
+func (p *Parties) update(party *party) {
+	writer := util.NewWriter(uuid.Length*(2+len(party.Members)) + 4)
+	party.Encode(&writer)
+	for _, member := range party.Members {
+		p.notify(member, knet.OCPartyUpdate, writer.Buffer())
+	}
+}
+
+// notify queues notification, it is sent by unlock.
+func (p *Parties) notify(user uuid.UUID, opCode knet.OpCode, data []byte) {
+	p.pending.Add(user, opCode, data)
+}
+
+// unlock unlocks parties and then sends queued notifications.
+func (p *Parties) unlock() {
+	pending := p.pending.Take()
+	p.mutex.Unlock()
+	pending.Send(p.notifier)
+}
+
+func (p *party) copy() Party {
+	c := p.Party
+	c.Members = append([]uuid.UUID(nil), p.Members...)
+	return c
+}
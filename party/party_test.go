@@ -0,0 +1,198 @@
+package party
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jakubDoka/keeper/cluster"
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/match"
+	"github.com/jakubDoka/keeper/match/matchtest"
+	"github.com/jakubDoka/keeper/matchmaker"
+	"github.com/jakubDoka/keeper/notify/notifytest"
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/state/statetest"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+func last(n *notifytest.Recorder, user uuid.UUID) knet.OpCode {
+	notification, ok := n.Last(user)
+	if !ok {
+		return knet.OCError
+	}
+	return notification.OpCode
+}
+
+func setup() (*Parties, *notifytest.Recorder) {
+	s := statetest.New()
+	manager := match.NewManager(s)
+	manager.RegisterCore("game", func() match.Core { return &match.CoreBase{} })
+	mm := matchmaker.New(s, manager, nil)
+	mm.AddQueue("squad", matchmaker.Queue{Core: "game", MinSize: 4, MaxSize: 4})
+	n := &notifytest.Recorder{}
+	return New(s, cluster.New(s, manager), mm, n), n
+}
+
+func TestLifecycle(t *testing.T) {
+	p, n := setup()
+	leader, friend, stranger := uuid.New(), uuid.New(), uuid.New()
+
+	id, err := p.Create(leader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Join(friend, id); err != ErrNotInvited {
+		t.Errorf("expected %v, got %v", ErrNotInvited, err)
+	}
+
+	if err := p.Invite(leader, friend); err != nil {
+		t.Fatal(err)
+	}
+	if last(n, friend) != knet.OCPartyInvite {
+		t.Error("friend should be notified about invite")
+	}
+
+	if err := p.Join(friend, id); err != nil {
+		t.Fatal(err)
+	}
+	if last(n, leader) != knet.OCPartyUpdate || last(n, friend) != knet.OCPartyUpdate {
+		t.Error("members should be notified about update")
+	}
+	if p.PartyOf(friend) != id {
+		t.Error("friend should be in party")
+	}
+
+	if err := p.Kick(friend, leader); err != ErrNotLeader {
+		t.Errorf("expected %v, got %v", ErrNotLeader, err)
+	}
+	if err := p.Kick(leader, stranger); err != ErrNotMember {
+		t.Errorf("expected %v, got %v", ErrNotMember, err)
+	}
+
+	ticket, err := p.Matchmake(leader, matchmaker.Ticket{Queue: "squad"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := p.matchmaker.TicketOf(friend); got != ticket {
+		t.Error("ticket should include all members")
+	}
+
+	if err := p.Promote(leader, friend); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Leave(friend); err != nil {
+		t.Fatal(err)
+	}
+	if last(n, friend) != knet.OCPartyLeave {
+		t.Error("friend should be notified about leaving")
+	}
+	if party, _ := p.Get(leader); party.Leader != leader || len(party.Members) != 1 {
+		t.Errorf("leadership should pass back to leader %+v", party)
+	}
+	if _, ok := p.matchmaker.TicketOf(leader); ok {
+		t.Error("ticket should be canceled when members change")
+	}
+
+	if err := p.Leave(leader); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.parties) != 0 {
+		t.Error("empty party should be disbanded")
+	}
+}
+
+func TestPartyInMatch(t *testing.T) {
+	p, _ := setup()
+	leader := uuid.New()
+	id, _ := p.Create(leader)
+
+	h, err := matchtest.New(&match.CoreBase{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Manager.SetPartyResolver(p)
+
+	user := state.NewUser(leader, uuid.New(), time.Hour, "")
+	h.JoinAs(user, nil)
+	h.Tick(1)
+
+	if u, ok := h.GetUser(leader); !ok || u.Party != id {
+		t.Errorf("user should have party id %v", u.Party)
+	}
+
+	p.AddUser(user)
+	if err := p.JoinMatch(leader, uuid.New()); err != match.ErrMatchNotFound {
+		t.Errorf("expected %v, got %v", match.ErrMatchNotFound, err)
+	}
+}
+
+func TestJoinMatch(t *testing.T) {
+	p, n := setup()
+	leader := state.NewUser(uuid.New(), uuid.New(), time.Hour, "")
+	friend := state.NewUser(uuid.New(), uuid.New(), time.Hour, "")
+	offline := uuid.New()
+	p.AddUser(leader)
+	p.AddUser(friend)
+
+	id, _ := p.Create(leader.ID())
+	for _, member := range []uuid.UUID{friend.ID(), offline} {
+		if err := p.Invite(leader.ID(), member); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Join(member, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	access, err := p.cluster.CreateMatch("game", leader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.JoinMatch(friend.ID(), access.Match); err != ErrNotLeader {
+		t.Errorf("expected %v, got %v", ErrNotLeader, err)
+	}
+	if err := p.JoinMatch(leader.ID(), access.Match); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, member := range []uuid.UUID{leader.ID(), friend.ID()} {
+		if _, ok := p.GetKey(member); !ok || last(n, member) != knet.OCPartyJoinMatch {
+			t.Errorf("member %s should receive access to the match", member)
+		}
+	}
+	if last(n, offline) == knet.OCPartyJoinMatch {
+		t.Error("member without session should be skipped")
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	p, n := setup()
+	leader, friend, expired := uuid.New(), uuid.New(), uuid.New()
+	p.AddUser(state.NewUser(leader, uuid.New(), time.Hour, ""))
+	p.AddUser(state.NewUser(friend, uuid.New(), time.Hour, ""))
+
+	id, _ := p.Create(leader)
+	for _, member := range []uuid.UUID{friend, expired} {
+		if err := p.Invite(leader, member); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Join(member, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p.Sweep()
+	if p.PartyOf(expired) != uuid.Nil {
+		t.Error("member without session should be removed")
+	}
+
+	p.Disconnected(friend)
+	if p.PartyOf(friend) != uuid.Nil || last(n, friend) != knet.OCPartyLeave {
+		t.Error("disconnected member should leave")
+	}
+	if party, _ := p.Get(leader); len(party.Members) != 1 {
+		t.Errorf("only leader should stay %+v", party)
+	}
+}
@@ -0,0 +1,370 @@
+// presence tracks whether users are online, in which match they play and their
+// custom status, and notifies subscribed users about changes.
+package presence
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/notify"
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/util"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+// DefaultMaxCustomLength is default limit of custom status in bytes.
+const DefaultMaxCustomLength = 128
+
+var (
+	ErrCustomTooLong = errors.New("custom status is too long")
+	ErrForbidden     = errors.New("you cannot see presence of this user")
+)
+
+// Status tells what user is doing.
+type Status uint8
+
+const (
+	Offline Status = iota
+	Online
+	InMatch
+)
+
+var statusStrings = [...]string{"offline", "online", "in match"}
+
+func (s Status) String() string {
+	if int(s) < len(statusStrings) {
+		return statusStrings[s]
+	}
+	return "unknown"
+}
+
+// Presence is snapshot of user presence.
+type Presence struct {
+	User   uuid.UUID
+	Status Status
+	// Match is set if Status is InMatch.
+	Match uuid.UUID
+	// Custom is status set by user, it is cleared when user goes offline.
+	Custom string
+	// Since is time of the last Status change, zero if user was not seen.
+	Since time.Time
+}
+
+// Encode writes presence as user, status, match, custom status and since as unix
+// seconds, 0 if user was not seen.
+func (p Presence) Encode(writer *util.Writer) {
+	var since uint64
+	if !p.Since.IsZero() {
+		since = uint64(p.Since.Unix())
+	}
+	writer.
+		UUID(p.User).
+		Uint8(uint8(p.Status)).
+		UUID(p.Match).
+		String(p.Custom).
+		Uint64(since)
+}
+
+type user struct {
+	Presence
+	connected     bool
+	matches       []uuid.UUID
+	subscriptions map[uuid.UUID]struct{}
+}
+
+// Tracker tracks presence of users. User is online while they have live session (see
+// Login) or notification connection (see notify.Hub) and in match while they are
+// connected to one. Tracker is notify.Listener and match.Listener. Subscribers are
+// notified with knet.OCPresenceUpdate about every change of subscribed users, after
+// tracker is unlocked. All allowed operations are thread safe.
+type Tracker struct {
+	*state.State
+
+	// MaxCustomLength limits custom status, DefaultMaxCustomLength is used if 0.
+	MaxCustomLength int
+	// Authorize decides whether subscriber can see presence of target, nil allows
+	// everyone. It is not asked when user looks at themselves.
+	Authorize func(subscriber, target uuid.UUID) bool
+
+	notifier notify.Notifier
+
+	users       map[uuid.UUID]*user
+	subscribers map[uuid.UUID]map[uuid.UUID]struct{}
+	pending     notify.Batch
+	mutex       sync.Mutex
+}
+
+// New creates tracker, notifier can be nil. Call Run on goroutine so expired sessions
+// are noticed.
+func New(state *state.State, notifier notify.Notifier) *Tracker {
+	return &Tracker{
+		State:       state,
+		notifier:    notifier,
+		users:       make(map[uuid.UUID]*user),
+		subscribers: make(map[uuid.UUID]map[uuid.UUID]struct{}),
+	}
+}
+
+// Login marks user with live session online.
+func (t *Tracker) Login(id uuid.UUID) {
+	t.mutex.Lock()
+	defer t.unlock()
+
+	t.refresh(id, t.user(id))
+}
+
+func (t *Tracker) Connected(id uuid.UUID) {
+	t.mutex.Lock()
+	defer t.unlock()
+
+	u := t.user(id)
+	u.connected = true
+	t.refresh(id, u)
+}
+
+func (t *Tracker) Disconnected(id uuid.UUID) {
+	t.mutex.Lock()
+	defer t.unlock()
+
+	if u, ok := t.users[id]; ok {
+		u.connected = false
+		t.refresh(id, u)
+	}
+}
+
+func (t *Tracker) JoinedMatch(id, match uuid.UUID) {
+	t.mutex.Lock()
+	defer t.unlock()
+
+	u := t.user(id)
+	for _, m := range u.matches {
+		if m == match {
+			return
+		}
+	}
+	u.matches = append(u.matches, match)
+	t.refresh(id, u)
+}
+
+func (t *Tracker) LeftMatch(id, match uuid.UUID) {
+	t.mutex.Lock()
+	defer t.unlock()
+
+	u, ok := t.users[id]
+	if !ok {
+		return
+	}
+
+	for i, m := range u.matches {
+		if m == match {
+			u.matches = append(u.matches[:i], u.matches[i+1:]...)
+			break
+		}
+	}
+	t.refresh(id, u)
+}
+
+// SetCustom sets custom status of the user, empty string clears it.
+func (t *Tracker) SetCustom(id uuid.UUID, custom string) error {
+	if len(custom) > t.maxCustomLength() {
+		return ErrCustomTooLong
+	}
+
+	t.mutex.Lock()
+	defer t.unlock()
+
+	u := t.user(id)
+	t.refresh(id, u)
+	if u.Status == Offline || u.Custom == custom {
+		return nil
+	}
+
+	u.Custom = custom
+	t.publish(u.Presence)
+
+	return nil
+}
+
+// Get returns presence of targets as seen by viewer.
+func (t *Tracker) Get(viewer uuid.UUID, targets ...uuid.UUID) ([]Presence, error) {
+	if err := t.authorize(viewer, targets); err != nil {
+		return nil, err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.presences(targets), nil
+}
+
+// Subscribe makes subscriber receive updates of targets and returns their current
+// presence. Subscriptions are dropped when subscriber goes offline.
+func (t *Tracker) Subscribe(subscriber uuid.UUID, targets ...uuid.UUID) ([]Presence, error) {
+	if err := t.authorize(subscriber, targets); err != nil {
+		return nil, err
+	}
+
+	t.mutex.Lock()
+	defer t.unlock()
+
+	u := t.user(subscriber)
+	t.refresh(subscriber, u)
+	if u.Status == Offline {
+		return t.presences(targets), nil
+	}
+
+	if u.subscriptions == nil {
+		u.subscriptions = make(map[uuid.UUID]struct{})
+	}
+	for _, target := range targets {
+		if target == subscriber {
+			continue
+		}
+		u.subscriptions[target] = struct{}{}
+		subscribers, ok := t.subscribers[target]
+		if !ok {
+			subscribers = make(map[uuid.UUID]struct{})
+			t.subscribers[target] = subscribers
+		}
+		subscribers[subscriber] = struct{}{}
+	}
+
+	return t.presences(targets), nil
+}
+
+// Unsubscribe stops updates of targets.
+func (t *Tracker) Unsubscribe(subscriber uuid.UUID, targets ...uuid.UUID) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	u, ok := t.users[subscriber]
+	if !ok {
+		return
+	}
+
+	for _, target := range targets {
+		delete(u.subscriptions, target)
+		t.unsubscribe(subscriber, target)
+	}
+}
+
+// Run periodically calls Sweep.
+func (t *Tracker) Run(interval time.Duration) {
+	ticker := t.Clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C() {
+		t.Sweep()
+	}
+}
+
+// Sweep marks users whose session expired offline.
+func (t *Tracker) Sweep() {
+	t.mutex.Lock()
+	defer t.unlock()
+
+	for id, u := range t.users {
+		t.refresh(id, u)
+	}
+}
+
+func (t *Tracker) user(id uuid.UUID) *user {
+	u, ok := t.users[id]
+	if !ok {
+		u = &user{Presence: Presence{User: id}}
+		t.users[id] = u
+	}
+	return u
+}
+
+// refresh recomputes status of user and publishes it if it changed. Offline users
+// lose their subscriptions and are forgotten.
+func (t *Tracker) refresh(id uuid.UUID, u *user) {
+	status, match := Offline, uuid.Nil
+	switch {
+	case len(u.matches) != 0:
+		status, match = InMatch, u.matches[len(u.matches)-1]
+	case u.connected || t.GetUser(uuid.Nil, id) != nil:
+		status = Online
+	}
+
+	if status == Offline {
+		delete(t.users, id)
+		for target := range u.subscriptions {
+			t.unsubscribe(id, target)
+		}
+		u.subscriptions = nil
+		u.Custom = ""
+	}
+
+	if status == u.Status && match == u.Match {
+		return
+	}
+
+	u.Status, u.Match = status, match
+	u.Since = t.Clock.Now()
+	t.publish(u.Presence)
+}
+
+func (t *Tracker) unsubscribe(subscriber, target uuid.UUID) {
+	subscribers := t.subscribers[target]
+	delete(subscribers, subscriber)
+	if len(subscribers) == 0 {
+		delete(t.subscribers, target)
+	}
+}
+
+func (t *Tracker) publish(p Presence) {
+	subscribers := t.subscribers[p.User]
+	if t.notifier == nil || len(subscribers) == 0 {
+		return
+	}
+
+	var calc util.Calculator
+	writer := calc.UUID().Uint8().UUID().String(p.Custom).Uint64().ToWriter()
+	p.Encode(&writer)
+
+	for subscriber := range subscribers {
+		t.pending.Add(subscriber, knet.OCPresenceUpdate, writer.Buffer())
+	}
+}
+
+// unlock unlocks tracker and then sends queued notifications.
+func (t *Tracker) unlock() {
+	pending := t.pending.Take()
+	t.mutex.Unlock()
+	pending.Send(t.notifier)
+}
+
+func (t *Tracker) presences(targets []uuid.UUID) []Presence {
+	result := make([]Presence, len(targets))
+	for i, target := range targets {
+		if u, ok := t.users[target]; ok {
+			result[i] = u.Presence
+		} else {
+			result[i] = Presence{User: target}
+		}
+	}
+	return result
+}
+
+func (t *Tracker) authorize(viewer uuid.UUID, targets []uuid.UUID) error {
+	if t.Authorize == nil {
+		return nil
+	}
+	for _, target := range targets {
+		if target != viewer && !t.Authorize(viewer, target) {
+			return ErrForbidden
+		}
+	}
+	return nil
+}
+
+func (t *Tracker) maxCustomLength() int {
+	if t.MaxCustomLength == 0 {
+		return DefaultMaxCustomLength
+	}
+	return t.MaxCustomLength
+}
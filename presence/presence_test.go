@@ -0,0 +1,201 @@
+package presence
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jakubDoka/keeper/knet"
+	"github.com/jakubDoka/keeper/notify/notifytest"
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/state/statetest"
+	"github.com/jakubDoka/keeper/util"
+	"github.com/jakubDoka/keeper/util/clock"
+	"github.com/jakubDoka/keeper/util/uuid"
+)
+
+// last decodes the last presence update user received.
+func last(n *notifytest.Recorder, user uuid.UUID) Presence {
+	notification, ok := n.Last(user)
+	if !ok || notification.OpCode != knet.OCPresenceUpdate {
+		return Presence{}
+	}
+
+	r := util.NewReader(notification.Data)
+	var p Presence
+	p.User, _ = r.UUID()
+	status, _ := r.Uint8()
+	p.Status = Status(status)
+	p.Match, _ = r.UUID()
+	p.Custom, _ = r.String()
+	since, _ := r.Uint64()
+	p.Since = time.Unix(int64(since), 0)
+
+	return p
+}
+
+func setup() (*Tracker, *clock.Manual, *notifytest.Recorder) {
+	s, c := statetest.NewManual(time.Unix(100, 0))
+	n := &notifytest.Recorder{}
+	return New(s, n), c, n
+}
+
+func (t *Tracker) status(viewer, target uuid.UUID) Status {
+	presences, err := t.Get(viewer, target)
+	if err != nil {
+		panic(err)
+	}
+	return presences[0].Status
+}
+
+func TestLifecycle(t *testing.T) {
+	tr, c, n := setup()
+	friend, player, match := uuid.New(), uuid.New(), uuid.New()
+
+	tr.Connected(friend)
+	presences, err := tr.Subscribe(friend, player)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if presences[0].Status != Offline || !presences[0].Since.IsZero() {
+		t.Error(presences)
+	}
+
+	tr.AddUser(state.NewUserWithClock(c, player, uuid.New(), time.Minute, ""))
+	tr.Login(player)
+	if p := last(n, friend); p.Status != Online || p.User != player || p.Since != c.Now() {
+		t.Error(p)
+	}
+
+	if err := tr.SetCustom(player, "afk"); err != nil {
+		t.Fatal(err)
+	}
+	if last(n, friend).Custom != "afk" {
+		t.Error(last(n, friend))
+	}
+	if err := tr.SetCustom(player, strings.Repeat("a", DefaultMaxCustomLength+1)); err != ErrCustomTooLong {
+		t.Error(err)
+	}
+
+	tr.JoinedMatch(player, match)
+	if p := last(n, friend); p.Status != InMatch || p.Match != match || p.Custom != "afk" {
+		t.Error(p)
+	}
+	tr.LeftMatch(player, match)
+	if p := last(n, friend); p.Status != Online || p.Match != uuid.Nil {
+		t.Error(p)
+	}
+
+	count := len(n.Of(friend))
+	tr.Connected(player)
+	c.Advance(time.Hour)
+	tr.Sweep()
+	if len(n.Of(friend)) != count {
+		t.Error("connected player should stay online")
+	}
+
+	tr.Disconnected(player)
+	if p := last(n, friend); p.Status != Offline || p.Custom != "" {
+		t.Error(p)
+	}
+	if tr.status(friend, player) != Offline {
+		t.Error("player should be offline")
+	}
+
+	tr.Unsubscribe(friend, player)
+	tr.Connected(player)
+	if len(n.Of(friend)) != count+1 {
+		t.Error("unsubscribed friend should not be notified")
+	}
+}
+
+func TestSubscriberOffline(t *testing.T) {
+	tr, _, n := setup()
+	friend, player := uuid.New(), uuid.New()
+
+	tr.Connected(friend)
+	if _, err := tr.Subscribe(friend, player); err != nil {
+		t.Fatal(err)
+	}
+	tr.Disconnected(friend)
+
+	tr.Connected(player)
+	if len(n.Of(friend)) != 0 {
+		t.Error("offline subscriber should lose subscriptions")
+	}
+	if len(tr.subscribers) != 0 {
+		t.Error(tr.subscribers)
+	}
+
+	if _, err := tr.Subscribe(friend, player); err != nil {
+		t.Fatal(err)
+	}
+	tr.Disconnected(player)
+	if len(n.Of(friend)) != 0 {
+		t.Error("offline user cannot subscribe")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	tr, _, _ := setup()
+	friend, stranger := uuid.New(), uuid.New()
+	tr.Authorize = func(subscriber, target uuid.UUID) bool {
+		return subscriber == friend
+	}
+
+	tr.Connected(stranger)
+	if _, err := tr.Get(stranger, friend); err != ErrForbidden {
+		t.Error(err)
+	}
+	if _, err := tr.Subscribe(stranger, friend); err != ErrForbidden {
+		t.Error(err)
+	}
+	if tr.status(stranger, stranger) != Online {
+		t.Error("user should see themselves")
+	}
+	if tr.status(friend, stranger) != Online {
+		t.Error("friend should see stranger")
+	}
+}
+
+// reentrant asks tracker from Notify, it deadlocks if tracker notifies under lock.
+type reentrant struct {
+	notifytest.Recorder
+	tracker *Tracker
+}
+
+func (r *reentrant) Notify(user uuid.UUID, opCode knet.OpCode, data []byte) bool {
+	r.tracker.Get(user, user)
+	return r.Recorder.Notify(user, opCode, data)
+}
+
+func TestNotifyOutsideLock(t *testing.T) {
+	tr, _, _ := setup()
+	n := &reentrant{tracker: tr}
+	tr.notifier = n
+	friend, player := uuid.New(), uuid.New()
+
+	tr.Connected(friend)
+	if _, err := tr.Subscribe(friend, player); err != nil {
+		t.Fatal(err)
+	}
+	tr.Connected(player)
+
+	if len(n.Of(friend)) != 1 {
+		t.Error("friend should be notified")
+	}
+}
+
+func TestRejoin(t *testing.T) {
+	tr, _, _ := setup()
+	player, match := uuid.New(), uuid.New()
+
+	tr.Connected(player)
+	tr.JoinedMatch(player, match)
+	tr.JoinedMatch(player, match)
+	tr.LeftMatch(player, match)
+
+	if tr.status(player, player) != Online {
+		t.Error("player should not stay in match after leaving it once")
+	}
+}
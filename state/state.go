@@ -8,6 +8,7 @@ import (
 	"github.com/jakubDoka/keeper/kcfg"
 	"github.com/jakubDoka/keeper/klog"
 	"github.com/jakubDoka/keeper/util"
+	"github.com/jakubDoka/keeper/util/clock"
 	"github.com/jakubDoka/keeper/util/kcrypto"
 	"github.com/jakubDoka/keeper/util/uuid"
 )
@@ -19,6 +20,14 @@ type State struct {
 	*klog.Logger
 	*util.Prepared
 
+	// Clock is time source for everything that uses state. Replace it before
+	// state is used if you need to control time.
+	Clock clock.Clock
+	// Resolver is asked for sessions this state does not know, it can be nil.
+	Resolver SessionResolver
+
+	listeners []UserListener
+
 	sessions     map[uuid.UUID]*User
 	users        map[uuid.UUID]*User
 	sessionMutex sync.RWMutex
@@ -34,6 +43,7 @@ func New(db *sql.DB, cfg *kcfg.Config, log *klog.Logger) *State {
 		DB:       db,
 		Logger:   log,
 		Prepared: util.NewPrepared(),
+		Clock:    clock.Real{},
 		sessions: make(map[uuid.UUID]*User),
 		users:    make(map[uuid.UUID]*User),
 		keys:     make(map[uuid.UUID]kcrypto.Key),
@@ -78,6 +88,22 @@ func (s *State) AddUser(user *User) {
 	}
 	s.users[user.id] = user
 	s.sessionMutex.Unlock()
+
+	for _, listener := range s.listeners {
+		listener.UserAdded(user)
+	}
+}
+
+// UserListener is told about users added to state.
+type UserListener interface {
+	// UserAdded is called after user logged in or their session was resolved. It is
+	// called outside state locks so it can load data user will need.
+	UserAdded(user *User)
+}
+
+// AddUserListener adds listener of added users, call this before state is used.
+func (s *State) AddUserListener(listener UserListener) {
+	s.listeners = append(s.listeners, listener)
 }
 
 // GetUser returns user under the session if present. If user expired or does not exist,
@@ -112,22 +138,53 @@ func (s *State) GetUser(session, id uuid.UUID) *User {
 	return user
 }
 
+// SessionResolver finds sessions created elsewhere, for example on other node.
+type SessionResolver interface {
+	// ResolveSession returns nil if session is unknown.
+	ResolveSession(session uuid.UUID) *User
+}
+
+// ResolveSession is like GetUser with session but it asks Resolver if session is not
+// known. Resolved user is added to state.
+func (s *State) ResolveSession(session uuid.UUID) *User {
+	user := s.GetUser(session, uuid.Nil)
+	if user != nil || s.Resolver == nil || session == uuid.Nil {
+		return user
+	}
+
+	user = s.Resolver.ResolveSession(session)
+	if user == nil || user.Expired() {
+		return nil
+	}
+
+	s.AddUser(user)
+
+	return user
+}
+
 // User holds minimal data about user that is required by system.
 // All allowed operations on user are thread safe.
 type User struct {
 	id, session uuid.UUID
 	expiration  time.Time
 	ip          string
+	clock       clock.Clock
 }
 
 // NewUser constructs a user with given livetime. User is also give a cipher
 // to encrypt and decrypt his messages.
 func NewUser(id, session uuid.UUID, duration time.Duration, IP string) *User {
+	return NewUserWithClock(clock.Real{}, id, session, duration, IP)
+}
+
+// NewUserWithClock is like NewUser but expiration is measured by c.
+func NewUserWithClock(c clock.Clock, id, session uuid.UUID, duration time.Duration, IP string) *User {
 	return &User{
 		id:         id,
 		session:    session,
-		expiration: time.Now().Add(duration),
+		expiration: c.Now().Add(duration),
 		ip:         IP,
+		clock:      c,
 	}
 }
 
@@ -147,7 +204,7 @@ func (u *User) Session() uuid.UUID {
 }
 
 func (u *User) Expired() bool {
-	return u.expiration.Before(time.Now())
+	return u.expiration.Before(u.clock.Now())
 }
 
 func (u *User) Expiration() time.Time {
@@ -0,0 +1,26 @@
+// statetest provides in-memory state for tests of packages built on top of it.
+package statetest
+
+import (
+	"time"
+
+	"github.com/jakubDoka/keeper/kcfg"
+	"github.com/jakubDoka/keeper/klog"
+	"github.com/jakubDoka/keeper/state"
+	"github.com/jakubDoka/keeper/util/clock"
+)
+
+// New creates state with default config and without database. Logger has no
+// targets so nothing is printed.
+func New() *state.State {
+	config := kcfg.DefaultConfig
+	return state.New(nil, &config, &klog.Logger{})
+}
+
+// NewManual is like New but clock of the state is manual and starts at start.
+func NewManual(start time.Time) (*state.State, *clock.Manual) {
+	s := New()
+	c := clock.NewManual(start)
+	s.Clock = c
+	return s, c
+}
@@ -69,6 +69,16 @@ func (r *Reader) UUID() (uuid.UUID, bool) {
 	return result, true
 }
 
+// Uint8 reads single byte from buffer. returns false if failed.
+func (r *Reader) Uint8() (uint8, bool) {
+	if r.offset >= len(r.buf) {
+		return 0, false
+	}
+	result := r.buf[r.offset]
+	r.offset++
+	return result, true
+}
+
 // Uint32 reads Uint32 from buffer with Big endian encoding. returns false if failed.
 func (r *Reader) Uint32() (uint32, bool) {
 	nextoffset := r.offset + 4
@@ -106,6 +116,12 @@ func NewWriter(cap int) Writer {
 	return Writer{buf: make([]byte, 0, cap)}
 }
 
+// Uint8 writes single byte to buffer.
+func (w *Writer) Uint8(value uint8) *Writer {
+	w.buf = append(w.buf, value)
+	return w
+}
+
 // Uint32 writes uint32 to buffer in Big endian encoding.
 func (w *Writer) Uint32(value uint32) *Writer {
 	var data [4]byte
@@ -171,6 +187,12 @@ func (c *Calculator) Pad(chunk int) *Calculator {
 	return c
 }
 
+// Uint8 increments counter by size of uint8 in bytes.
+func (c *Calculator) Uint8() *Calculator {
+	c.offset++
+	return c
+}
+
 // Uint32 increments counter by size of uint32 in bytes.
 func (c *Calculator) Uint32() *Calculator {
 	c.offset += 4
@@ -0,0 +1,160 @@
+// clock abstracts the time source so time dependant code can be driven manually
+// in tests and simulations.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is source of time and tickers.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker mirrors the time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Reset(d time.Duration)
+	Stop()
+}
+
+// Real is Clock that uses time package.
+type Real struct{}
+
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+func (Real) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (r realTicker) C() <-chan time.Time {
+	return r.Ticker.C
+}
+
+// Manual is Clock that moves only when told to. Tickers created by it fire during
+// Advance, same as time.Ticker they drop ticks if nobody reads them. All allowed
+// operations on Manual are thread safe.
+type Manual struct {
+	mutex   sync.Mutex
+	now     time.Time
+	tickers []*manualTicker
+}
+
+// NewManual creates manual clock starting at start.
+func NewManual(start time.Time) *Manual {
+	return &Manual{now: start}
+}
+
+func (m *Manual) Now() time.Time {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.now
+}
+
+func (m *Manual) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+
+	m.mutex.Lock()
+	t := &manualTicker{
+		clock:    m,
+		c:        make(chan time.Time, 1),
+		interval: d,
+		next:     m.now.Add(d),
+	}
+	m.tickers = append(m.tickers, t)
+	m.mutex.Unlock()
+
+	return t
+}
+
+// Advance moves the clock by d and fires all tickers that are due.
+func (m *Manual) Advance(d time.Duration) {
+	m.mutex.Lock()
+	m.advance(d)
+	m.mutex.Unlock()
+}
+
+// Step advances the clock to the closest ticker deadline and returns the
+// duration it advanced by. If there are no tickers, clock does not move.
+func (m *Manual) Step() time.Duration {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var closest time.Time
+	for _, t := range m.tickers {
+		if closest.IsZero() || t.next.Before(closest) {
+			closest = t.next
+		}
+	}
+
+	if closest.IsZero() {
+		return 0
+	}
+
+	d := closest.Sub(m.now)
+	m.advance(d)
+	return d
+}
+
+func (m *Manual) advance(d time.Duration) {
+	m.now = m.now.Add(d)
+	for _, t := range m.tickers {
+		if t.next.After(m.now) {
+			continue
+		}
+		select {
+		case t.c <- t.next:
+		default:
+		}
+		// all missed ticks are dropped at once so long advances are cheap
+		missed := m.now.Sub(t.next) / t.interval
+		t.next = t.next.Add((missed + 1) * t.interval)
+	}
+}
+
+func (m *Manual) remove(t *manualTicker) {
+	m.mutex.Lock()
+	for i, o := range m.tickers {
+		if o == t {
+			m.tickers = append(m.tickers[:i], m.tickers[i+1:]...)
+			break
+		}
+	}
+	m.mutex.Unlock()
+}
+
+type manualTicker struct {
+	clock    *Manual
+	c        chan time.Time
+	interval time.Duration
+	next     time.Time
+}
+
+func (t *manualTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *manualTicker) Reset(d time.Duration) {
+	if d <= 0 {
+		panic("non-positive interval for Ticker.Reset")
+	}
+
+	t.clock.mutex.Lock()
+	t.interval = d
+	t.next = t.clock.now.Add(d)
+	t.clock.mutex.Unlock()
+}
+
+func (t *manualTicker) Stop() {
+	t.clock.remove(t)
+}
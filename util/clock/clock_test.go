@@ -0,0 +1,72 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestManual(t *testing.T) {
+	start := time.Unix(0, 0)
+	c := NewManual(start)
+
+	ticker := c.NewTicker(time.Second)
+
+	select {
+	case <-ticker.C():
+		t.Fatal("ticker fired before advance")
+	default:
+	}
+
+	c.Advance(time.Second / 2)
+	select {
+	case <-ticker.C():
+		t.Fatal("ticker fired too early")
+	default:
+	}
+
+	c.Advance(time.Second / 2)
+	select {
+	case tm := <-ticker.C():
+		if !tm.Equal(start.Add(time.Second)) {
+			t.Errorf("unexpected tick time %v", tm)
+		}
+	default:
+		t.Fatal("ticker did not fire")
+	}
+
+	ticker.Reset(time.Second * 3)
+	if d := c.Step(); d != time.Second*3 {
+		t.Errorf("expected step of 3s, got %v", d)
+	}
+	<-ticker.C()
+
+	ticker.Stop()
+	if d := c.Step(); d != 0 {
+		t.Errorf("stopped ticker should not be stepped to, got %v", d)
+	}
+
+	if !c.Now().Equal(start.Add(time.Second * 4)) {
+		t.Errorf("unexpected time %v", c.Now())
+	}
+}
+
+func TestManualLongAdvance(t *testing.T) {
+	start := time.Unix(0, 0)
+	c := NewManual(start)
+
+	ticker := c.NewTicker(time.Millisecond)
+	c.Advance(time.Hour*24*365*10 + time.Millisecond/2)
+
+	select {
+	case tm := <-ticker.C():
+		if !tm.Equal(start.Add(time.Millisecond)) {
+			t.Errorf("unexpected tick time %v", tm)
+		}
+	default:
+		t.Fatal("ticker did not fire")
+	}
+
+	if d := c.Step(); d != time.Millisecond/2 {
+		t.Errorf("expected step of 0.5ms, got %v", d)
+	}
+}